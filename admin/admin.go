@@ -0,0 +1,295 @@
+// Package admin serve a HTTP/JSON control API of the links in a running
+// process, usually on a Unix socket: inspect the links, tunnels and channels,
+// open/close the tunnels, kick a link and change the log level.
+package admin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/logger"
+	"github.com/ooclab/es/tunnel"
+	"github.com/ooclab/es/tunnel/channel"
+)
+
+// admin error define
+var (
+	ErrLinkNotFound = errors.New("no such link")
+	ErrSocketInUse  = errors.New("admin socket is in use")
+)
+
+// LinkState is the state of a link
+type LinkState struct {
+	ID        uint64    `json:"id"`
+	Name      string    `json:"name"`
+	Remote    string    `json:"remote"`
+	Connected time.Time `json:"connected"`
+
+	// PeerName and PeerLabels are registered by the remote endpoint
+	PeerName   string            `json:"peer_name,omitempty"`
+	PeerLabels map[string]string `json:"peer_labels,omitempty"`
+
+	RTT      string        `json:"rtt,omitempty"`
+	Sessions int           `json:"sessions"`
+	Stats    channel.Stats `json:"stats"`
+	Tunnels  []TunnelState `json:"tunnels"`
+}
+
+// TunnelState is the state of a tunnel, the Local* is the address in this
+// endpoint
+type TunnelState struct {
+	ID         uint32            `json:"id"`
+	Proto      string            `json:"proto"`
+	LocalHost  string            `json:"local_host"`
+	LocalPort  int               `json:"local_port"`
+	RemoteHost string            `json:"remote_host"`
+	RemotePort int               `json:"remote_port"`
+	Reverse    bool              `json:"reverse"`
+	Peer       string            `json:"peer,omitempty"`
+	Relay      bool              `json:"relay,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Stats      channel.Stats     `json:"stats"`
+	Channels   []ChannelState    `json:"channels,omitempty"`
+}
+
+// ChannelState is the state of a channel
+type ChannelState struct {
+	ID     uint32        `json:"id"`
+	Local  string        `json:"local"`
+	Remote string        `json:"remote"`
+	Stats  channel.Stats `json:"stats"`
+}
+
+type entry struct {
+	id        uint64
+	l         *link.Link
+	name      string
+	remote    string
+	connected time.Time
+}
+
+// Server keep the links to administrate and the status of the instance
+type Server struct {
+	lock   sync.Mutex
+	nextID uint64
+	links  map[uint64]*entry
+
+	role      string
+	transport string
+	address   string
+	started   time.Time
+	tunnels   map[tunnelKey]*TunnelStatus
+
+	log   logger.Logger
+	level logger.Level
+}
+
+// NewServer create a Server
+func NewServer() *Server {
+	return &Server{
+		nextID:  1,
+		links:   make(map[uint64]*entry),
+		started: time.Now(),
+		tunnels: make(map[tunnelKey]*TunnelStatus),
+		log:     logger.Default(),
+		level:   logger.DefaultLevel(),
+	}
+}
+
+// SetLogger set the logger of the server and the level changed by
+// /log-level, they are the default logger of logrus and its level if not set
+func (s *Server) SetLogger(log logger.Logger, level logger.Level) {
+	s.lock.Lock()
+	s.log, s.level = log, level
+	s.lock.Unlock()
+}
+
+func (s *Server) logger() (logger.Logger, logger.Level) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.log, s.level
+}
+
+// AddLink add the link, name is the server/client it belongs to, and return
+// its ID in admin API
+func (s *Server) AddLink(l *link.Link, name string, remote net.Addr) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := s.nextID
+	s.nextID++
+	s.links[id] = &entry{
+		id:        id,
+		l:         l,
+		name:      name,
+		remote:    remote.String(),
+		connected: time.Now(),
+	}
+	return id
+}
+
+// RemoveLink remove the link by ID
+func (s *Server) RemoveLink(id uint64) {
+	s.lock.Lock()
+	delete(s.links, id)
+	s.lock.Unlock()
+}
+
+func (s *Server) get(id uint64) (*entry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e := s.links[id]
+	if e == nil {
+		return nil, ErrLinkNotFound
+	}
+	return e, nil
+}
+
+// Links get the state of all links ordered by ID, the channels are included
+// if withChannels
+func (s *Server) Links(withChannels bool) []LinkState {
+	entries := s.entries()
+	states := make([]LinkState, len(entries))
+	for i, e := range entries {
+		states[i] = e.state(withChannels)
+	}
+	return states
+}
+
+func (s *Server) entries() []*entry {
+	s.lock.Lock()
+	entries := make([]*entry, 0, len(s.links))
+	for _, e := range s.links {
+		entries = append(entries, e)
+	}
+	s.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+	return entries
+}
+
+// Link get the state of a link
+func (s *Server) Link(id uint64) (LinkState, error) {
+	e, err := s.get(id)
+	if err != nil {
+		return LinkState{}, err
+	}
+	return e.state(true), nil
+}
+
+// OpenTunnel open a tunnel over the link, ctx bounds the wait of the remote
+// endpoint
+func (s *Server) OpenTunnel(ctx context.Context, id uint64, opts link.TunnelOptions) (TunnelState, error) {
+	e, err := s.get(id)
+	if err != nil {
+		return TunnelState{}, err
+	}
+	h, err := e.l.OpenTunnel(ctx, opts)
+	if err != nil {
+		return TunnelState{}, err
+	}
+	return configState(h.ID(), h.Config(), h.Stats()), nil
+}
+
+// CloseTunnel close a tunnel of the link
+func (s *Server) CloseTunnel(id uint64, tid uint32) error {
+	e, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	return e.l.CloseTunnel(tid)
+}
+
+// Kick close the link
+func (s *Server) Kick(id uint64) error {
+	e, err := s.get(id)
+	if err != nil {
+		return err
+	}
+	return e.l.Close()
+}
+
+func (e *entry) state(withChannels bool) LinkState {
+	ls := LinkState{
+		ID:        e.id,
+		Name:      e.name,
+		Remote:    e.remote,
+		Connected: e.connected,
+		PeerName:  e.l.Name(),
+		Sessions:  e.l.Sessions(),
+		Tunnels:   []TunnelState{},
+	}
+	if labels := e.l.Labels(); len(labels) > 0 {
+		ls.PeerLabels = labels
+	}
+	if rtt := e.l.RTT(); rtt > 0 {
+		ls.RTT = rtt.String()
+	}
+	for _, t := range e.l.Tunnels() {
+		ts := tunnelState(t, withChannels)
+		ls.Stats.Add(ts.Stats)
+		ls.Tunnels = append(ls.Tunnels, ts)
+	}
+	sort.Slice(ls.Tunnels, func(i, j int) bool { return ls.Tunnels[i].ID < ls.Tunnels[j].ID })
+	return ls
+}
+
+func configState(id uint32, cfg *tunnel.TunnelConfig, stats channel.Stats) TunnelState {
+	return TunnelState{
+		ID:         id,
+		Proto:      cfg.Proto,
+		LocalHost:  cfg.LocalHost,
+		LocalPort:  cfg.LocalPort,
+		RemoteHost: cfg.RemoteHost,
+		RemotePort: cfg.RemotePort,
+		Reverse:    cfg.Reverse,
+		Peer:       cfg.Peer,
+		Labels:     cfg.Labels,
+		Stats:      stats,
+	}
+}
+
+func tunnelState(t *tunnel.Tunnel, withChannels bool) TunnelState {
+	ts := configState(t.ID, t.Config, t.Stats())
+	ts.Relay = t.IsRelay()
+	if !withChannels {
+		return ts
+	}
+	for _, c := range t.Channels() {
+		ts.Channels = append(ts.Channels, ChannelState{
+			ID:     c.ID(),
+			Local:  c.LocalAddr().String(),
+			Remote: c.RemoteAddr().String(),
+			Stats:  c.Stats(),
+		})
+	}
+	sort.Slice(ts.Channels, func(i, j int) bool { return ts.Channels[i].ID < ts.Channels[j].ID })
+	return ts
+}
+
+// ListenUnix listen on the Unix socket which is only accessible by the
+// current user, the stale socket file is removed
+func ListenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, ErrSocketInUse
+		}
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,212 @@
+package admin
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/logger"
+)
+
+func linkPair(t *testing.T) (server *link.Link, client *link.Link) {
+	c1, c2 := net.Pipe()
+	server, client = link.NewLink(nil), link.NewLink(nil)
+	for _, v := range []struct {
+		l    *link.Link
+		conn net.Conn
+	}{{server, c1}, {client, c2}} {
+		v := v
+		go func() {
+			v.l.Bind(es.NewBaseConn(v.conn))
+			v.l.Wait()
+			v.l.Close()
+		}()
+	}
+	// wait both sides are bound
+	for _, l := range []*link.Link{server, client} {
+		if _, err := l.Ping(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server, client
+}
+
+func runEcho(t *testing.T) (port int, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, func() { ln.Close() }
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func Test_Admin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "admin.sock")
+
+	server, client := linkPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	s := NewServer()
+	ln, err := ListenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.Serve(ln)
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("wrong socket mode: %v, %v", fi.Mode(), err)
+	}
+	if _, err := ListenUnix(path); err != ErrSocketInUse {
+		t.Errorf("listen twice: got %v, want ErrSocketInUse", err)
+	}
+
+	s.AddLink(server, "server", &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234})
+	id := s.AddLink(client, "client", &net.TCPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 3000})
+	c := NewClient(path, 5*time.Second)
+
+	links, err := c.Links()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || links[1].ID != id || links[1].Name != "client" || links[1].Remote != "5.6.7.8:3000" {
+		t.Fatalf("wrong links: %+v", links)
+	}
+
+	// status
+	s.SetInstance("client", "tcp", "5.6.7.8:3000")
+	s.SetTunnel("client", "tcp/127.0.0.1:1:127.0.0.1:2", nil)
+	s.SetTunnel("client", "tcp/127.0.0.1:3:127.0.0.1:4", errors.New("refused"))
+	st, err := c.Status(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Role != "client" || len(st.Links) != 2 || st.Links[0].RTT == "" || len(st.Tunnels) != 2 ||
+		!st.Tunnels[0].Open || st.Tunnels[1].Error != "refused" {
+		t.Fatalf("wrong status: %+v", st)
+	}
+	s.RetainTunnels("client", func(spec string) bool { return spec == "tcp/127.0.0.1:1:127.0.0.1:2" })
+	if st = s.Status(false); len(st.Tunnels) != 1 {
+		t.Errorf("got tunnels %+v after retain", st.Tunnels)
+	}
+
+	// open a tunnel and send data through it
+	echoPort, stop := runEcho(t)
+	defer stop()
+	port := freePort(t)
+	ts, err := c.OpenTunnel(id, &TunnelRequest{LocalHost: "127.0.0.1", LocalPort: port, RemoteHost: "127.0.0.1", RemotePort: echoPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Proto != "tcp" || ts.LocalPort != port {
+		t.Errorf("wrong tunnel: %+v", ts)
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("hello admin")
+	conn.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// the send counter is updated after the data is written
+	var ls LinkState
+	for i := 0; i < 100; i++ {
+		if ls, err = c.Link(id); err != nil {
+			t.Fatal(err)
+		}
+		if len(ls.Tunnels) != 1 || len(ls.Tunnels[0].Channels) != 1 {
+			t.Fatalf("wrong link: %+v", ls)
+		}
+		if ls.Tunnels[0].Channels[0].Stats.Send == uint64(len(msg)) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cs := ls.Tunnels[0].Channels[0]; cs.Stats.Recv != uint64(len(msg)) || cs.Stats.Send != uint64(len(msg)) {
+		t.Errorf("wrong channel stats: %+v", cs)
+	}
+	if ls.Stats.Recv != uint64(len(msg)) {
+		t.Errorf("wrong link stats: %+v", ls.Stats)
+	}
+
+	if err := c.CloseTunnel(id, ts.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseTunnel(id, ts.ID); err == nil {
+		t.Error("close the closed tunnel: no error")
+	}
+	if _, err := c.Link(42); err == nil {
+		t.Error("get unknown link: no error")
+	}
+
+	// log level
+	defer logrus.SetLevel(logrus.GetLevel())
+	if err := c.SetLogLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	if level, err := c.LogLevel(); err != nil || level != "debug" {
+		t.Errorf("got log level %q, %v", level, err)
+	}
+	if err := c.SetLogLevel("loud"); err == nil {
+		t.Error("set invalid log level: no error")
+	}
+
+	// the level of the injected logger
+	v := &slog.LevelVar{}
+	s.SetLogger(logger.NewSlog(slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: v}))), logger.NewSlogLevel(v))
+	if err := c.SetLogLevel("warn"); err != nil {
+		t.Fatal(err)
+	}
+	if level, err := c.LogLevel(); err != nil || level != "warn" || v.Level() != slog.LevelWarn || logrus.GetLevel() != logrus.DebugLevel {
+		t.Errorf("got log level %q, %v, slog level %s", level, err, v.Level())
+	}
+
+	// kick
+	if err := c.Kick(id); err != nil {
+		t.Fatal(err)
+	}
+	if !client.IsClosed() {
+		t.Error("the kicked link is not closed")
+	}
+}
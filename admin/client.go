@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Client call the admin API on the Unix socket
+type Client struct {
+	http *http.Client
+}
+
+// NewClient create a Client of the socket
+func NewClient(path string, timeout time.Duration) *Client {
+	return &Client{
+		http: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Status get the status of the instance, ping the links if withRTT
+func (c *Client) Status(withRTT bool) (Status, error) {
+	path := "/status"
+	if withRTT {
+		path += "?rtt=1"
+	}
+	var st Status
+	err := c.do(http.MethodGet, path, nil, &st)
+	return st, err
+}
+
+// Links get all links without channels
+func (c *Client) Links() ([]LinkState, error) {
+	var links []LinkState
+	err := c.do(http.MethodGet, "/links", nil, &links)
+	return links, err
+}
+
+// Link get the link with channels
+func (c *Client) Link(id uint64) (LinkState, error) {
+	var ls LinkState
+	err := c.do(http.MethodGet, fmt.Sprintf("/links/%d", id), nil, &ls)
+	return ls, err
+}
+
+// Kick close the link
+func (c *Client) Kick(id uint64) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("/links/%d", id), nil, nil)
+}
+
+// OpenTunnel open a tunnel over the link
+func (c *Client) OpenTunnel(id uint64, req *TunnelRequest) (TunnelState, error) {
+	var ts TunnelState
+	err := c.do(http.MethodPost, fmt.Sprintf("/links/%d/tunnels", id), req, &ts)
+	return ts, err
+}
+
+// CloseTunnel close the tunnel of the link
+func (c *Client) CloseTunnel(id uint64, tid uint32) error {
+	return c.do(http.MethodDelete, fmt.Sprintf("/links/%d/tunnels/%d", id, tid), nil, nil)
+}
+
+// LogLevel get the log level
+func (c *Client) LogLevel() (string, error) {
+	var v LogLevel
+	err := c.do(http.MethodGet, "/log-level", nil, &v)
+	return v.Level, err
+}
+
+// SetLogLevel set the log level
+func (c *Client) SetLogLevel(level string) error {
+	return c.do(http.MethodPut, "/log-level", &LogLevel{Level: level}, nil)
+}
+
+func (c *Client) do(method string, path string, body interface{}, result interface{}) error {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://admin"+path, &buf)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var e ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return errors.New(resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,216 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/policy"
+	"github.com/ooclab/es/tunnel"
+)
+
+// TunnelRequest is the body of POST /links/{id}/tunnels, the Local* is the
+// address in this endpoint
+type TunnelRequest struct {
+	Proto      string `json:"proto"`
+	LocalHost  string `json:"local_host"`
+	LocalPort  int    `json:"local_port"`
+	RemoteHost string `json:"remote_host"`
+	RemotePort int    `json:"remote_port"`
+	Reverse    bool   `json:"reverse"`
+	Peer       string `json:"peer"`
+}
+
+// LogLevel is the body of GET/PUT /log-level
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// ErrorResponse is the body of the failed requests
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func (r *TunnelRequest) check() error {
+	if r.Proto == "" {
+		r.Proto = "tcp"
+	}
+	if r.Proto != "tcp" && r.Proto != "udp" {
+		return fmt.Errorf("invalid proto %q, want tcp or udp", r.Proto)
+	}
+	// the listening side may bind port 0, the ephemeral port
+	if r.LocalPort < 0 || r.LocalPort > 65535 || r.LocalPort == 0 && r.Reverse {
+		return fmt.Errorf("local_port %d is out of range", r.LocalPort)
+	}
+	if r.RemotePort < 0 || r.RemotePort > 65535 || r.RemotePort == 0 && !r.Reverse {
+		return fmt.Errorf("remote_port %d is out of range", r.RemotePort)
+	}
+	return nil
+}
+
+// options get the options of link.OpenTunnel, the listening side binds the
+// local address if forward, or the remote address if reverse
+func (r *TunnelRequest) options() link.TunnelOptions {
+	opts := link.TunnelOptions{
+		Proto:    r.Proto,
+		BindHost: r.LocalHost,
+		BindPort: r.LocalPort,
+		DialHost: r.RemoteHost,
+		DialPort: r.RemotePort,
+		Reverse:  r.Reverse,
+		Peer:     r.Peer,
+	}
+	if r.Reverse {
+		opts.BindHost, opts.BindPort, opts.DialHost, opts.DialPort = r.RemoteHost, r.RemotePort, r.LocalHost, r.LocalPort
+	}
+	return opts
+}
+
+// Serve serve the admin API on ln until it is closed
+func (s *Server) Serve(ln net.Listener) error {
+	return http.Serve(ln, s)
+}
+
+// ServeHTTP route the admin API:
+//
+//	GET    /status[?rtt=1]            the status of the instance, ping the links if rtt
+//	GET    /links                     the links without channels
+//	GET    /links/{id}                the link with channels
+//	DELETE /links/{id}                kick the link
+//	POST   /links/{id}/tunnels        open a tunnel by TunnelRequest
+//	DELETE /links/{id}/tunnels/{tid}  close the tunnel
+//	GET    /log-level                 get the level of the logger set by SetLogger
+//	PUT    /log-level                 set the level by LogLevel
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case parts[0] == "status" && len(parts) == 1:
+		if r.Method != http.MethodGet {
+			s.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		s.writeJSON(w, http.StatusOK, s.Status(r.URL.Query().Get("rtt") != ""))
+	case parts[0] == "log-level" && len(parts) == 1:
+		s.serveLogLevel(w, r)
+	case parts[0] == "links" && len(parts) == 1:
+		if r.Method != http.MethodGet {
+			s.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		s.writeJSON(w, http.StatusOK, s.Links(false))
+	case parts[0] == "links" && len(parts) <= 4:
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			s.writeError(w, http.StatusNotFound, ErrLinkNotFound)
+			return
+		}
+		s.serveLink(w, r, id, parts[2:])
+	default:
+		s.writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *Server) serveLink(w http.ResponseWriter, r *http.Request, id uint64, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == http.MethodGet:
+		ls, err := s.Link(id)
+		if err != nil {
+			s.writeError(w, http.StatusNotFound, err)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, ls)
+
+	case len(parts) == 0 && r.Method == http.MethodDelete:
+		if err := s.Kick(id); err != nil {
+			s.writeError(w, statusOf(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 1 && parts[0] == "tunnels" && r.Method == http.MethodPost:
+		var req TunnelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := req.check(); err != nil {
+			s.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		ts, err := s.OpenTunnel(r.Context(), id, req.options())
+		if err != nil {
+			s.writeError(w, statusOf(err), err)
+			return
+		}
+		s.writeJSON(w, http.StatusCreated, ts)
+
+	case len(parts) == 2 && parts[0] == "tunnels" && r.Method == http.MethodDelete:
+		tid, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			s.writeError(w, http.StatusNotFound, tunnel.ErrTunnelNotFound)
+			return
+		}
+		if err := s.CloseTunnel(id, uint32(tid)); err != nil {
+			s.writeError(w, statusOf(err), err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		s.writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *Server) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	log, level := s.logger()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req LogLevel
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := level.Set(req.Level); err != nil {
+			s.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Infof("admin: log level is changed to %s", level.Get())
+	default:
+		s.writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	s.writeJSON(w, http.StatusOK, LogLevel{Level: level.Get()})
+}
+
+func statusOf(err error) int {
+	switch {
+	case errors.Is(err, ErrLinkNotFound), errors.Is(err, tunnel.ErrTunnelNotFound), errors.Is(err, link.ErrPeerNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, policy.ErrDenied):
+		return http.StatusForbidden
+	case errors.Is(err, tunnel.ErrPortInUse):
+		return http.StatusConflict
+	}
+	return http.StatusBadGateway
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log, _ := s.logger()
+		log.Debugf("admin: write response failed: %s", err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, code int, err error) {
+	s.writeJSON(w, code, ErrorResponse{Error: err.Error()})
+}
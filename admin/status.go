@@ -0,0 +1,96 @@
+package admin
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status is the state of the running instance
+type Status struct {
+	Role      string         `json:"role"`
+	Transport string         `json:"transport,omitempty"`
+	Address   string         `json:"address"`
+	Started   time.Time      `json:"started"`
+	Links     []LinkState    `json:"links"`
+	Tunnels   []TunnelStatus `json:"tunnels,omitempty"`
+}
+
+// TunnelStatus is the state of a tunnel configured in a client, Spec is the
+// tunnel as configured
+type TunnelStatus struct {
+	Client string `json:"client"`
+	Spec   string `json:"spec"`
+	Open   bool   `json:"open"`
+	Error  string `json:"error,omitempty"`
+}
+
+type tunnelKey struct {
+	client string
+	spec   string
+}
+
+// SetInstance set the role, transport and address of the running instance
+func (s *Server) SetInstance(role string, transport string, address string) {
+	s.lock.Lock()
+	s.role, s.transport, s.address = role, transport, address
+	s.lock.Unlock()
+}
+
+// SetTunnel record the result of opening the configured tunnel spec of client
+func (s *Server) SetTunnel(client string, spec string, err error) {
+	ts := &TunnelStatus{Client: client, Spec: spec, Open: err == nil}
+	if err != nil {
+		ts.Error = err.Error()
+	}
+	s.lock.Lock()
+	s.tunnels[tunnelKey{client, spec}] = ts
+	s.lock.Unlock()
+}
+
+// RetainTunnels remove the configured tunnels of client which are not kept
+func (s *Server) RetainTunnels(client string, keep func(spec string) bool) {
+	s.lock.Lock()
+	for k := range s.tunnels {
+		if k.client == client && !keep(k.spec) {
+			delete(s.tunnels, k)
+		}
+	}
+	s.lock.Unlock()
+}
+
+// Status get a snapshot of the instance, ping every link if withRTT
+func (s *Server) Status(withRTT bool) Status {
+	s.lock.Lock()
+	st := Status{
+		Role:      s.role,
+		Transport: s.transport,
+		Address:   s.address,
+		Started:   s.started,
+	}
+	for _, ts := range s.tunnels {
+		st.Tunnels = append(st.Tunnels, *ts)
+	}
+	s.lock.Unlock()
+
+	if withRTT {
+		var wg sync.WaitGroup
+		for _, e := range s.entries() {
+			wg.Add(1)
+			go func(e *entry) {
+				defer wg.Done()
+				e.l.Ping()
+			}(e)
+		}
+		wg.Wait()
+	}
+	st.Links = s.Links(false)
+
+	sort.Slice(st.Tunnels, func(a, b int) bool {
+		if st.Tunnels[a].Client != st.Tunnels[b].Client {
+			return st.Tunnels[a].Client < st.Tunnels[b].Client
+		}
+		return st.Tunnels[a].Spec < st.Tunnels[b].Spec
+	})
+	return st
+}
@@ -0,0 +1,52 @@
+package es
+
+import "sync"
+
+// the size classes of pooled buffer, the largest one can hold a full frame
+const (
+	bufferSize512 = 512
+	bufferSize4K  = 1024 * 4
+	bufferSize16K = 1024 * 16
+	bufferSize64K = 1024 * 64
+)
+
+// the pools keep array pointers, so Put does not allocate
+var (
+	bufferPool512 = sync.Pool{New: func() interface{} { return new([bufferSize512]byte) }}
+	bufferPool4K  = sync.Pool{New: func() interface{} { return new([bufferSize4K]byte) }}
+	bufferPool16K = sync.Pool{New: func() interface{} { return new([bufferSize16K]byte) }}
+	bufferPool64K = sync.Pool{New: func() interface{} { return new([bufferSize64K]byte) }}
+)
+
+// GetBuffer get a buffer of length size from the buffer pool, the buffer is
+// not zeroed. It allocates a new one if size is larger than the largest
+// size class.
+func GetBuffer(size int) []byte {
+	switch {
+	case size <= bufferSize512:
+		return bufferPool512.Get().(*[bufferSize512]byte)[:size]
+	case size <= bufferSize4K:
+		return bufferPool4K.Get().(*[bufferSize4K]byte)[:size]
+	case size <= bufferSize16K:
+		return bufferPool16K.Get().(*[bufferSize16K]byte)[:size]
+	case size <= bufferSize64K:
+		return bufferPool64K.Get().(*[bufferSize64K]byte)[:size]
+	}
+	return make([]byte, size)
+}
+
+// PutBuffer return a buffer got by GetBuffer to the buffer pool. The buffer
+// must not be used after PutBuffer. It's safe to put any buffer owned by the
+// caller, only the one matches a size class is kept.
+func PutBuffer(b []byte) {
+	switch cap(b) {
+	case bufferSize512:
+		bufferPool512.Put((*[bufferSize512]byte)(b[:bufferSize512]))
+	case bufferSize4K:
+		bufferPool4K.Put((*[bufferSize4K]byte)(b[:bufferSize4K]))
+	case bufferSize16K:
+		bufferPool16K.Put((*[bufferSize16K]byte)(b[:bufferSize16K]))
+	case bufferSize64K:
+		bufferPool64K.Put((*[bufferSize64K]byte)(b[:bufferSize64K]))
+	}
+}
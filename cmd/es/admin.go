@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ooclab/es/admin"
+)
+
+var errAdminUsage = errors.New(`want one of the admin commands:
+  status [-rtt]               show the status of the instance
+  links                       list the links
+  link ID                     show the tunnels and channels of a link
+  open ID -L|-R SPEC          open a tunnel over the link
+  close ID TUNNEL_ID          close a tunnel of the link
+  kick ID                     close the link
+  log-level [LEVEL]           get or set the log level`)
+
+func runAdmin(args []string) error {
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	socket := fs.String("socket", "", "the -admin socket of the running instance")
+	raw := fs.Bool("json", false, "print the raw JSON")
+	timeout := fs.Duration("timeout", 15*time.Second, "request timeout")
+	fs.Parse(args)
+	if *socket == "" {
+		return errors.New("the -socket is required")
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		return errAdminUsage
+	}
+
+	c := admin.NewClient(*socket, *timeout)
+	output := func(v interface{}, text func(io.Writer)) {
+		if *raw {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(v)
+			return
+		}
+		text(os.Stdout)
+	}
+
+	cmd, args := args[0], args[1:]
+	if cmd == "status" && (len(args) == 0 || len(args) == 1 && args[0] == "-rtt") {
+		s, err := c.Status(len(args) == 1)
+		if err != nil {
+			return err
+		}
+		output(s, func(w io.Writer) { printStatus(w, &s) })
+		return nil
+	}
+	if cmd == "links" && len(args) == 0 {
+		links, err := c.Links()
+		if err != nil {
+			return err
+		}
+		output(links, func(w io.Writer) { printLinks(w, links) })
+		return nil
+	}
+	if cmd == "log-level" && len(args) <= 1 {
+		if len(args) == 1 {
+			if err := c.SetLogLevel(args[0]); err != nil {
+				return err
+			}
+		}
+		level, err := c.LogLevel()
+		if err != nil {
+			return err
+		}
+		fmt.Println(level)
+		return nil
+	}
+	if len(args) == 0 {
+		return errAdminUsage
+	}
+
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid link ID %q", args[0])
+	}
+	switch {
+	case cmd == "link" && len(args) == 1:
+		ls, err := c.Link(id)
+		if err != nil {
+			return err
+		}
+		output(ls, func(w io.Writer) { printLink(w, &ls) })
+	case cmd == "open" && len(args) == 3 && (args[1] == "-L" || args[1] == "-R"):
+		t, err := parseTunnelSpec(args[2], args[1] == "-R")
+		if err != nil {
+			return err
+		}
+		ts, err := c.OpenTunnel(id, &admin.TunnelRequest{
+			Proto:      t.Proto,
+			LocalHost:  t.LocalHost,
+			LocalPort:  t.LocalPort,
+			RemoteHost: t.RemoteHost,
+			RemotePort: t.RemotePort,
+			Reverse:    t.Reverse,
+			Peer:       t.Peer,
+		})
+		if err != nil {
+			return err
+		}
+		output(ts, func(w io.Writer) { fmt.Fprintf(w, "tunnel %d is opened\n", ts.ID) })
+	case cmd == "close" && len(args) == 2:
+		tid, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid tunnel ID %q", args[1])
+		}
+		return c.CloseTunnel(id, uint32(tid))
+	case cmd == "kick" && len(args) == 1:
+		return c.Kick(id)
+	default:
+		return errAdminUsage
+	}
+	return nil
+}
+
+func printLinks(w io.Writer, links []admin.LinkState) {
+	fmt.Fprintf(w, "%-6s %-24s %-24s %-12s %-8s %-12s %-12s\n", "ID", "NAME", "REMOTE", "RTT", "TUNNELS", "RECV", "SEND")
+	for _, l := range links {
+		rtt := l.RTT
+		if rtt == "" {
+			rtt = "-"
+		}
+		fmt.Fprintf(w, "%-6d %-24s %-24s %-12s %-8d %-12d %-12d\n", l.ID, l.Name, l.Remote, rtt, len(l.Tunnels), l.Stats.Recv, l.Stats.Send)
+	}
+}
+
+func printLink(w io.Writer, l *admin.LinkState) {
+	printLinks(w, []admin.LinkState{*l})
+	fmt.Fprintf(w, "connected %s, %d sessions\n", l.Connected.Format(time.RFC3339), l.Sessions)
+	if l.PeerName != "" || len(l.PeerLabels) > 0 {
+		fmt.Fprintf(w, "peer %q, labels %s\n", l.PeerName, labelFlag(l.PeerLabels))
+	}
+	for _, t := range l.Tunnels {
+		direction := "forward"
+		if t.Reverse {
+			direction = "reverse"
+		}
+		if t.Relay {
+			direction += " relay"
+		}
+		peer := ""
+		if t.Peer != "" {
+			peer = "@" + t.Peer
+		}
+		fmt.Fprintf(w, "tunnel %d %s %s/%s:%d:%s:%d%s recv %d send %d\n", t.ID, direction,
+			t.Proto, t.LocalHost, t.LocalPort, t.RemoteHost, t.RemotePort, peer, t.Stats.Recv, t.Stats.Send)
+		for _, c := range t.Channels {
+			fmt.Fprintf(w, "  channel %d %s <-> %s recv %d send %d\n", c.ID, c.Local, c.Remote, c.Stats.Recv, c.Stats.Send)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es/config"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/proto/udp"
+)
+
+var (
+	errNoServer   = errors.New("the -server address is required")
+	errLinkBroken = errors.New("link is broken")
+)
+
+func runClient(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	o := &options{}
+	o.register(fs)
+	server := fs.String("server", "", "server address, such as 1.2.3.4:3000")
+	retry := fs.Duration("retry", 5*time.Second, "reconnect delay after the link is broken, 0 means exit")
+	hubName := fs.String("hub-name", "", "register this name in the server, the other clients reach this client by it if the server is a hub")
+	labels := labelFlag{}
+	fs.Var(labels, "label", "register the label `key=value` in the server (repeatable)")
+	var tunnels []*config.Tunnel
+	fs.Var(tunnelFlag{specs: &tunnels}, "L", "forward tunnel `[proto/]local_host:local_port:remote_host:remote_port`, listen at local (repeatable)")
+	fs.Var(tunnelFlag{specs: &tunnels, reverse: true}, "R", "reverse tunnel `[proto/]local_host:local_port:remote_host:remote_port`, listen at remote (repeatable)")
+	fs.Parse(args)
+	if err := o.setup(); err != nil {
+		return err
+	}
+	if *server == "" {
+		return errNoServer
+	}
+
+	inst := newInstance(roleClient, o.Transport.Transport, *server)
+	if err := inst.serveStatus(o.status); err != nil {
+		return err
+	}
+	if err := inst.serveAdmin(o.admin); err != nil {
+		return err
+	}
+
+	cfg := &config.Client{
+		Name:      *server,
+		Server:    *server,
+		Retry:     config.Duration(*retry),
+		HubName:   *hubName,
+		Labels:    labels,
+		Transport: o.Transport,
+		Tunnels:   tunnels,
+	}
+	c := startClient(inst, cfg)
+	<-c.done
+	return nil
+}
+
+// client keep a link to the server, and the tunnels open over it
+type client struct {
+	inst *instance
+	cfg  *config.Client
+
+	lock    sync.Mutex
+	tunnels []config.Tunnel
+	opened  map[config.Tunnel]*link.TunnelHandle
+	opening map[config.Tunnel]*link.Link // the link each tunnel is opening on
+	l       *link.Link
+	timeout time.Duration
+
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+// startClient connect to the server in background, and reconnect after the
+// link is broken
+func startClient(inst *instance, cfg *config.Client) *client {
+	c := &client{
+		inst:    inst,
+		cfg:     cfg,
+		opened:  make(map[config.Tunnel]*link.TunnelHandle),
+		opening: make(map[config.Tunnel]*link.Link),
+		stopCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, t := range cfg.Tunnels {
+		c.tunnels = append(c.tunnels, *t)
+	}
+	go c.run()
+	return c
+}
+
+func (c *client) run() {
+	defer close(c.done)
+	for {
+		if err := c.runLink(); err != nil {
+			logrus.WithField("error", err).Errorf("connect to server %s failed", c.cfg.Server)
+		}
+		retry := time.Duration(c.cfg.Retry)
+		if retry <= 0 || isClosedChan(c.stopCh) {
+			return
+		}
+		logrus.Infof("reconnect to server %s in %s", c.cfg.Server, retry)
+		select {
+		case <-c.stopCh:
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// dial connect to server by the transport, closeFunc release the underlying
+// resources after the link is broken
+func dial(t *config.Transport, server string) (conn io.ReadWriteCloser, remote net.Addr, closeFunc func(), err error) {
+	if t.Transport == "tcp" {
+		c, err := net.Dial("tcp", server)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return c, c.RemoteAddr(), func() { c.Close() }, nil
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sock, uc, err := udp.NewClientSocket(pc, raddr)
+	if err != nil {
+		pc.Close()
+		return nil, nil, nil, err
+	}
+	return uc, raddr, func() {
+		sock.Close()
+		pc.Close()
+	}, nil
+}
+
+// runLink open the tunnels over a new link, and return after the link is
+// broken
+func (c *client) runLink() error {
+	conn, remote, closeFunc, err := dial(&c.cfg.Transport, c.cfg.Server)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+	logrus.Infof("connected to server %s", remote)
+
+	lc := linkConfig(&c.cfg.Transport, false)
+	lc.Name = c.cfg.HubName
+	lc.Labels = c.cfg.Labels
+	l := link.NewLink(lc)
+	l.Bind(wrap(&c.cfg.Transport, conn))
+	c.inst.addLink(c.cfg.Name, l, remote)
+	defer c.inst.deleteLink(l)
+
+	c.lock.Lock()
+	if isClosedChan(c.stopCh) {
+		c.lock.Unlock()
+		l.Close()
+		return nil
+	}
+	c.l = l
+	// NewLink fills the default of the timeout
+	c.timeout = lc.ConnectionWriteTimeout
+	c.lock.Unlock()
+	c.openTunnels()
+
+	l.Wait()
+	l.Close()
+
+	c.lock.Lock()
+	c.l = nil
+	for t := range c.opened {
+		delete(c.opened, t)
+		c.inst.setTunnel(c.cfg.Name, t.String(), errLinkBroken)
+	}
+	c.lock.Unlock()
+	logrus.Infof("link to server %s is broken", remote)
+	return nil
+}
+
+// openTunnels open the tunnels which are not opened on the current link, the
+// wait of each one is bounded by ConnectionWriteTimeout, c.lock is not held
+// meanwhile
+func (c *client) openTunnels() {
+	c.lock.Lock()
+	l, timeout := c.l, c.timeout
+	var pending []config.Tunnel
+	if l != nil {
+		for _, t := range c.tunnels {
+			if _, ok := c.opened[t]; ok || c.opening[t] == l {
+				continue
+			}
+			c.opening[t] = l
+			pending = append(pending, t)
+		}
+	}
+	c.lock.Unlock()
+
+	for _, t := range pending {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		h, err := l.OpenTunnel(ctx, t.TunnelOptions())
+		cancel()
+
+		c.lock.Lock()
+		if c.opening[t] == l {
+			delete(c.opening, t)
+		}
+		// the link is broken or the tunnel is removed meanwhile
+		stale := c.l != l || !c.wanted(t)
+		if !stale {
+			if err != nil {
+				logrus.WithField("error", err).Errorf("open tunnel %s failed", t.String())
+			} else {
+				c.opened[t] = h
+				logrus.Infof("open tunnel %s", h.Config())
+			}
+			c.inst.setTunnel(c.cfg.Name, t.String(), err)
+		}
+		c.lock.Unlock()
+		if stale && err == nil {
+			h.Close()
+		}
+	}
+}
+
+// wanted report whether t is in the tunnels, c.lock must be held
+func (c *client) wanted(t config.Tunnel) bool {
+	for _, v := range c.tunnels {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// SetTunnels close the opened tunnels not in tunnels, and open the new ones
+func (c *client) SetTunnels(tunnels []*config.Tunnel) {
+	c.lock.Lock()
+	want := make(map[config.Tunnel]bool)
+	c.tunnels = nil
+	for _, t := range tunnels {
+		want[*t] = true
+		c.tunnels = append(c.tunnels, *t)
+	}
+	closing := make(map[config.Tunnel]*link.TunnelHandle)
+	for t, h := range c.opened {
+		if !want[t] {
+			closing[t] = h
+			delete(c.opened, t)
+		}
+	}
+	c.inst.retainTunnels(c.cfg.Name, func(spec string) bool {
+		for t := range want {
+			if t.String() == spec {
+				return true
+			}
+		}
+		return false
+	})
+	c.lock.Unlock()
+
+	for t, h := range closing {
+		if err := h.Close(); err != nil {
+			logrus.WithField("error", err).Warnf("close tunnel %s failed", t.String())
+		} else {
+			logrus.Infof("close tunnel %s", t.String())
+		}
+	}
+	c.openTunnels()
+}
+
+// Close close the link and stop reconnecting
+func (c *client) Close() error {
+	c.lock.Lock()
+	close(c.stopCh)
+	if c.l != nil {
+		c.l.Close()
+	}
+	c.lock.Unlock()
+	<-c.done
+	c.inst.retainTunnels(c.cfg.Name, func(string) bool { return false })
+	return nil
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
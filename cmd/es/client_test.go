@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/config"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/session"
+)
+
+// silentHandler never answers the requests, it reports them to got
+type silentHandler struct {
+	got chan struct{}
+}
+
+func (h silentHandler) Handle(*session.EMSG) *session.EMSG {
+	select {
+	case h.got <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func Test_client_CloseOpening(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	h := silentHandler{got: make(chan struct{}, 1)}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		l := link.NewLinkCustom(&link.LinkConfig{IsServerSide: true}, h)
+		l.Bind(es.NewBaseConn(conn))
+		l.Wait()
+		l.Close()
+	}()
+
+	server := ln.Addr().String()
+	c := startClient(newInstance(roleClient, "tcp", server), &config.Client{
+		Name:      server,
+		Server:    server,
+		Transport: config.Transport{Transport: "tcp"},
+		Tunnels:   []*config.Tunnel{{LocalHost: "127.0.0.1", LocalPort: freePort(t), RemoteHost: "127.0.0.1", RemotePort: 1}},
+	})
+	select {
+	case <-h.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the tunnel request is not sent")
+	}
+
+	// the server never answers, close doesn't wait the tunnel request
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("close is blocked by the opening tunnel")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/config"
+	"github.com/ooclab/es/ecrypt"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/logger"
+)
+
+var (
+	errTransport   = errors.New("unknown transport")
+	errCipher      = errors.New("unsupported cipher")
+	errCompression = errors.New("unsupported compression")
+)
+
+// options is shared by the server and client subcommands
+type options struct {
+	config.Transport
+	logLevel string
+	status   string
+	admin    string
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.Transport.Transport, "transport", "tcp", "underlying transport: tcp or udp")
+	fs.StringVar(&o.Cipher, "cipher", "aes256cfb", "cipher used when -secret is set: rc4 or aes256cfb")
+	fs.StringVar(&o.Secret, "secret", "", "shared secret, empty means no encryption")
+	fs.StringVar(&o.Compression, "compression", "", "compress the frames: deflate, empty means no compression")
+	fs.StringVar(&o.logLevel, "log-level", "info", "log level: debug, info, warn or error")
+	fs.StringVar(&o.status, "status", "", "serve the status on this address, such as 127.0.0.1:7070")
+	fs.StringVar(&o.admin, "admin", "", "serve the admin API on this Unix socket, such as /run/es.sock")
+}
+
+// setup check the options and apply the log level
+func (o *options) setup() error {
+	if err := logger.DefaultLevel().Set(o.logLevel); err != nil {
+		return fmt.Errorf("%w %q", err, o.logLevel)
+	}
+
+	if o.Transport.Transport != "tcp" && o.Transport.Transport != "udp" {
+		return fmt.Errorf("%w %q", errTransport, o.Transport.Transport)
+	}
+	if o.Compression != "" && o.Compression != link.CompressionDeflate {
+		return fmt.Errorf("%w %q", errCompression, o.Compression)
+	}
+	if o.Secret != "" && !ecrypt.IsSupported(o.Cipher) {
+		return fmt.Errorf("%w %q", errCipher, o.Cipher)
+	}
+	return nil
+}
+
+// wrap create the es.Conn for link, every conn has its own cipher state
+func wrap(t *config.Transport, rw io.ReadWriteCloser) es.Conn {
+	if t.Secret != "" {
+		return es.NewSafeConn(rw, ecrypt.NewCipher(t.Cipher, []byte(t.Secret)))
+	}
+	if c, ok := rw.(es.Conn); ok {
+		// udp.Conn is message oriented already
+		return c
+	}
+	return es.NewBaseConn(rw)
+}
+
+func linkConfig(t *config.Transport, isServerSide bool) *link.LinkConfig {
+	return &link.LinkConfig{
+		IsServerSide: isServerSide,
+		Compression:  t.Compression,
+	}
+}
@@ -0,0 +1,66 @@
+// es is the command line tool to run es servers and clients.
+//
+//	es server -listen :3000 -secret SECRET -status 127.0.0.1:7070
+//	es client -server SERVER_IP:3000 -secret SECRET \
+//		-L 127.0.0.1:8000:127.0.0.1:1080 -R udp/127.0.0.1:53::5353
+//	es run -config es.json
+//	es status -addr 127.0.0.1:7070
+//	es admin -socket /run/es.sock links
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	roleServer = "server"
+	roleClient = "client"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s <command> [flags]
+
+Commands:
+  server    accept the clients and serve their tunnels
+  client    connect to a server and open the tunnels given by -L/-R
+  run       run the servers and clients of a config file, and reload it
+            after it's changed
+  status    query the status of a running instance
+  admin     inspect and drive a running instance by its -admin socket
+
+Run "%s <command> -h" for the flags of a command.
+`, os.Args[0], os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case roleServer:
+		err = runServer(os.Args[2:])
+	case roleClient:
+		err = runClient(os.Args[2:])
+	case "run":
+		err = runConfig(os.Args[2:])
+	case "status":
+		err = runStatus(os.Args[2:])
+	case "admin":
+		err = runAdmin(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es/config"
+	"github.com/ooclab/es/logger"
+)
+
+const roleConfig = "config"
+
+var errNoConfig = errors.New("the -config file is required")
+
+func runConfig(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	path := fs.String("config", "", "the JSON config file")
+	reload := fs.Duration("reload", 2*time.Second, "check the config file for changes in this interval, 0 means no reload")
+	fs.Parse(args)
+	if *path == "" {
+		return errNoConfig
+	}
+
+	w, cfg, err := config.NewWatcher(*path)
+	if err != nil {
+		return err
+	}
+
+	inst := newInstance(roleConfig, "", *path)
+	if err := inst.serveStatus(cfg.Status); err != nil {
+		return err
+	}
+	if err := inst.serveAdmin(cfg.Admin); err != nil {
+		return err
+	}
+	r := &runner{
+		inst:    inst,
+		servers: make(map[string]*server),
+		clients: make(map[string]*client),
+	}
+	if err := r.apply(cfg); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		close(stop)
+	}()
+
+	if *reload > 0 {
+		w.Run(*reload, stop, func(cfg *config.Config) {
+			logrus.Infof("config file %s is changed, reload it", *path)
+			if err := r.apply(cfg); err != nil {
+				logrus.WithField("error", err).Error("reload config failed")
+			}
+		}, func(err error) {
+			logrus.WithField("error", err).Errorf("load config file %s failed, keep the running config", *path)
+		})
+	} else {
+		<-stop
+	}
+	r.Close()
+	return nil
+}
+
+// runner run the servers and clients of the config file
+type runner struct {
+	inst    *instance
+	cfg     *config.Config
+	servers map[string]*server
+	clients map[string]*client
+}
+
+// apply start/stop the servers and clients by the new config, the tunnels of
+// a running client are opened/closed on its current link
+func (r *runner) apply(cfg *config.Config) error {
+	logger.DefaultLevel().Set(cfg.LogLevel)
+	if r.cfg != nil && r.cfg.Status != cfg.Status {
+		logrus.Warn("the status address is changed, restart to apply it")
+	}
+	if r.cfg != nil && r.cfg.Admin != cfg.Admin {
+		logrus.Warn("the admin socket is changed, restart to apply it")
+	}
+
+	// servers are identified by the transport and listen address, and
+	// restarted if the other options are changed
+	wantServers := make(map[string]*config.Server)
+	for _, sc := range cfg.Servers {
+		wantServers[serverKey(sc)] = sc
+	}
+	for key, s := range r.servers {
+		if sc := wantServers[key]; sc == nil || !reflect.DeepEqual(sc, s.cfg) {
+			logrus.Infof("stop server %s", s.cfg.Listen)
+			s.Close()
+			delete(r.servers, key)
+		}
+	}
+	var firstErr error
+	for _, sc := range cfg.Servers {
+		key := serverKey(sc)
+		if _, ok := r.servers[key]; ok {
+			continue
+		}
+		s, err := startServer(r.inst, sc)
+		if err != nil {
+			logrus.WithField("error", err).Errorf("start server %s failed", sc.Listen)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		r.servers[key] = s
+	}
+
+	// clients are identified by name
+	wantClients := make(map[string]*config.Client)
+	for _, cc := range cfg.Clients {
+		wantClients[cc.Name] = cc
+	}
+	for name, c := range r.clients {
+		if cc := wantClients[name]; cc == nil || !cc.SameLink(c.cfg) {
+			logrus.Infof("stop client %s", name)
+			c.Close()
+			delete(r.clients, name)
+		}
+	}
+	for _, cc := range cfg.Clients {
+		if c, ok := r.clients[cc.Name]; ok {
+			c.SetTunnels(cc.Tunnels)
+			continue
+		}
+		r.clients[cc.Name] = startClient(r.inst, cc)
+	}
+
+	r.cfg = cfg
+	return firstErr
+}
+
+// Close stop all servers and clients
+func (r *runner) Close() {
+	for key, s := range r.servers {
+		s.Close()
+		delete(r.servers, key)
+	}
+	for name, c := range r.clients {
+		c.Close()
+		delete(r.clients, name)
+	}
+}
+
+func serverKey(sc *config.Server) string {
+	return sc.Transport.Transport + "/" + sc.Listen
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/config"
+)
+
+// freePort pick a free local tcp port
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// runEcho run a tcp echo server and return its port
+func runEcho(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// echoThrough check the echo server can be reached by port, and wait a while
+// for the tunnel to be opened
+func echoThrough(port int) error {
+	var err error
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, 4)
+			if _, err = conn.Write([]byte("ping")); err == nil {
+				_, err = io.ReadFull(conn, buf)
+			}
+			conn.Close()
+			if err == nil && string(buf) == "ping" {
+				return nil
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("echo through port %d failed: %v", port, err)
+}
+
+func Test_runnerApply(t *testing.T) {
+	echoPort := runEcho(t)
+	serverPort, forwardPort, reversePort := freePort(t), freePort(t), freePort(t)
+	data := func(tunnels string) []byte {
+		return []byte(fmt.Sprintf(`{
+			"log_level": "error",
+			"servers": [{"listen": "127.0.0.1:%d", "secret": "s3cret"}],
+			"clients": [{"name": "c", "server": "127.0.0.1:%d", "secret": "s3cret", "tunnels": [%s]}]
+		}`, serverPort, serverPort, tunnels))
+	}
+	forward := fmt.Sprintf(`{"local_host": "127.0.0.1", "local_port": %d, "remote_host": "127.0.0.1", "remote_port": %d}`, forwardPort, echoPort)
+	reverse := fmt.Sprintf(`{"reverse": true, "local_host": "127.0.0.1", "local_port": %d, "remote_host": "127.0.0.1", "remote_port": %d}`, echoPort, reversePort)
+
+	cfg, err := config.Parse(data(forward))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &runner{
+		inst:    newInstance(roleConfig, "", "test"),
+		servers: make(map[string]*server),
+		clients: make(map[string]*client),
+	}
+	defer r.Close()
+	if err := r.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := echoThrough(forwardPort); err != nil {
+		t.Fatal(err)
+	}
+
+	// replace the forward tunnel by a reverse one on the same link
+	c := r.clients["c"]
+	cfg, _ = config.Parse(data(reverse))
+	if err := r.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if r.clients["c"] != c {
+		t.Fatal("the client is restarted")
+	}
+	if err := echoThrough(reversePort); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", forwardPort)); err == nil {
+		conn.Close()
+		t.Error("the removed tunnel is still listening")
+	}
+	if s := r.inst.Status(false); len(s.Links) != 2 || len(s.Tunnels) != 1 || !s.Tunnels[0].Open {
+		t.Errorf("wrong status: %+v", s)
+	}
+
+	// the changed secret restart the server and client
+	cfg, _ = config.Parse([]byte(fmt.Sprintf(`{
+		"log_level": "error",
+		"servers": [{"listen": "127.0.0.1:%d", "secret": "changed"}],
+		"clients": [{"name": "c", "server": "127.0.0.1:%d", "secret": "changed", "tunnels": [%s]}]
+	}`, serverPort, serverPort, forward)))
+	if err := r.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if r.clients["c"] == c {
+		t.Fatal("the client is not restarted")
+	}
+	if err := echoThrough(forwardPort); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_runnerApply_Policy(t *testing.T) {
+	echoPort := runEcho(t)
+	serverPort, allowedPort, deniedPort := freePort(t), freePort(t), freePort(t)
+	cfg, err := config.Parse([]byte(fmt.Sprintf(`{
+		"log_level": "error",
+		"servers": [{"listen": "127.0.0.1:%d", "policy": {"binds": [{"host": "127.0.0.1", "ports": %d}]}}],
+		"clients": [{"name": "c", "server": "127.0.0.1:%d", "tunnels": [
+			{"reverse": true, "local_host": "127.0.0.1", "local_port": %d, "remote_host": "127.0.0.1", "remote_port": %d},
+			{"reverse": true, "local_host": "127.0.0.1", "local_port": %d, "remote_host": "127.0.0.1", "remote_port": %d}
+		]}]
+	}`, serverPort, allowedPort, serverPort, echoPort, allowedPort, echoPort, deniedPort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &runner{
+		inst:    newInstance(roleConfig, "", "test"),
+		servers: make(map[string]*server),
+		clients: make(map[string]*client),
+	}
+	defer r.Close()
+	if err := r.apply(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := echoThrough(allowedPort); err != nil {
+		t.Fatal(err)
+	}
+
+	s := r.inst.Status(false)
+	if len(s.Tunnels) != 2 {
+		t.Fatalf("got tunnels %+v", s.Tunnels)
+	}
+	for _, ts := range s.Tunnels {
+		denied := strings.Contains(ts.Spec, fmt.Sprintf(":%d)", deniedPort))
+		if denied && (ts.Open || !strings.Contains(ts.Error, "policy-denied: bind")) {
+			t.Errorf("the tunnel should be denied: %+v", ts)
+		}
+		if !denied && !ts.Open {
+			t.Errorf("the tunnel should be open: %+v", ts)
+		}
+	}
+}
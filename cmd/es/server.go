@@ -0,0 +1,208 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es/config"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/policy"
+	"github.com/ooclab/es/proto/udp"
+)
+
+func runServer(args []string) error {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	o := &options{}
+	o.register(fs)
+	listen := fs.String("listen", ":3000", "listen address")
+	hub := fs.Bool("hub", false, "relay the tunnels between the clients registered by -hub-name")
+	fs.Parse(args)
+	if err := o.setup(); err != nil {
+		return err
+	}
+
+	inst := newInstance(roleServer, o.Transport.Transport, *listen)
+	if err := inst.serveStatus(o.status); err != nil {
+		return err
+	}
+	if err := inst.serveAdmin(o.admin); err != nil {
+		return err
+	}
+
+	s, err := startServer(inst, &config.Server{Listen: *listen, Transport: o.Transport, Hub: *hub})
+	if err != nil {
+		return err
+	}
+	<-s.done
+	return s.err
+}
+
+// server accept the clients and serve their links
+type server struct {
+	inst     *instance
+	cfg      *config.Server
+	policy   *policy.Engine
+	registry *link.Registry
+	hub      *link.Hub
+
+	accept func() (io.ReadWriteCloser, net.Addr, error)
+	ln     io.Closer
+
+	lock   sync.Mutex
+	links  map[*link.Link]bool
+	closed bool
+
+	done chan struct{}
+	err  error
+}
+
+// startServer listen on cfg.Listen and serve in background
+func startServer(inst *instance, cfg *config.Server) (*server, error) {
+	s := &server{
+		inst:     inst,
+		cfg:      cfg,
+		links:    make(map[*link.Link]bool),
+		registry: link.NewRegistry(),
+		done:     make(chan struct{}),
+	}
+	if cfg.Policy != nil {
+		s.policy = policy.NewEngine(cfg.Policy)
+	}
+	if cfg.Hub {
+		s.hub = link.NewHub(s.registry)
+	}
+	var err error
+	if cfg.Transport.Transport == "udp" {
+		err = s.listenUDP()
+	} else {
+		err = s.listenTCP()
+	}
+	if err != nil {
+		return nil, err
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *server) listenTCP() error {
+	ln, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("server listen on tcp %s", ln.Addr())
+	s.ln = ln
+	s.accept = func() (io.ReadWriteCloser, net.Addr, error) {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn.RemoteAddr(), nil
+	}
+	return nil
+}
+
+func (s *server) listenUDP() error {
+	pc, err := net.ListenPacket("udp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	sock, err := udp.NewServerSocket(pc)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	logrus.Infof("server listen on udp %s", pc.LocalAddr())
+	s.ln = closerFunc(func() error {
+		sock.Close()
+		return pc.Close()
+	})
+	s.accept = func() (io.ReadWriteCloser, net.Addr, error) {
+		conn, err := sock.Accept()
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn.RemoteAddr(), nil
+	}
+	return nil
+}
+
+func (s *server) serve() {
+	defer close(s.done)
+	for {
+		conn, remote, err := s.accept()
+		if err != nil {
+			s.lock.Lock()
+			if !s.closed {
+				s.err = err
+			}
+			s.lock.Unlock()
+			return
+		}
+		go s.serveLink(conn, remote)
+	}
+}
+
+// serveLink run a link over conn until it's broken
+func (s *server) serveLink(conn io.ReadWriteCloser, remote net.Addr) {
+	logrus.Infof("accept client %s", remote)
+	lc := linkConfig(&s.cfg.Transport, true)
+	if s.policy != nil {
+		// the clients behind one IP share the limits
+		host, _, _ := net.SplitHostPort(remote.String())
+		lc.Policy = s.policy.Guard(host)
+	}
+	lc.Registry = s.registry
+	lc.Hub = s.hub
+	l := link.NewLink(lc)
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		conn.Close()
+		return
+	}
+	s.links[l] = true
+	s.lock.Unlock()
+	s.inst.addLink(s.cfg.Listen, l, remote)
+
+	l.Bind(wrap(&s.cfg.Transport, conn))
+	l.Wait()
+	l.Close()
+
+	s.inst.deleteLink(l)
+	s.lock.Lock()
+	delete(s.links, l)
+	s.lock.Unlock()
+	logrus.Infof("client %s (link %d) is gone", remote, l.ID)
+}
+
+// Close stop listening and close the links of the server
+func (s *server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	var links []*link.Link
+	for l := range s.links {
+		links = append(links, l)
+	}
+	s.lock.Unlock()
+
+	err := s.ln.Close()
+	for _, l := range links {
+		l.Close()
+	}
+	<-s.done
+	return err
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es/admin"
+	"github.com/ooclab/es/link"
+)
+
+const statusPath = "/status"
+
+// instance keep the links of the running servers and clients in the admin
+// server, which serve the status on -status and the admin API on -admin
+type instance struct {
+	lock  sync.Mutex
+	links map[*link.Link]uint64
+	admin *admin.Server
+}
+
+func newInstance(role string, transport string, address string) *instance {
+	i := &instance{
+		links: make(map[*link.Link]uint64),
+		admin: admin.NewServer(),
+	}
+	i.admin.SetInstance(role, transport, address)
+	return i
+}
+
+func (i *instance) addLink(name string, l *link.Link, remote net.Addr) {
+	id := i.admin.AddLink(l, name, remote)
+	i.lock.Lock()
+	i.links[l] = id
+	i.lock.Unlock()
+}
+
+func (i *instance) deleteLink(l *link.Link) {
+	i.lock.Lock()
+	if id, ok := i.links[l]; ok {
+		i.admin.RemoveLink(id)
+		delete(i.links, l)
+	}
+	i.lock.Unlock()
+}
+
+func (i *instance) setTunnel(client string, spec string, err error) {
+	i.admin.SetTunnel(client, spec, err)
+}
+
+// retainTunnels remove the tunnels of client which are not kept
+func (i *instance) retainTunnels(client string, keep func(spec string) bool) {
+	i.admin.RetainTunnels(client, keep)
+}
+
+// Status get a snapshot of the instance, ping every link if withRTT
+func (i *instance) Status(withRTT bool) admin.Status {
+	return i.admin.Status(withRTT)
+}
+
+// serveStatus serve the status in background if addr is not empty
+func (i *instance) serveStatus(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	// only the read-only status of the admin API is served on TCP
+	mux := http.NewServeMux()
+	mux.Handle(statusPath, i.admin)
+	logrus.Infof("serve status on %s", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logrus.WithField("error", err).Error("serve status quit")
+		}
+	}()
+	return nil
+}
+
+// serveAdmin serve the admin API on the Unix socket in background if path
+// is not empty
+func (i *instance) serveAdmin(path string) error {
+	if path == "" {
+		return nil
+	}
+	ln, err := admin.ListenUnix(path)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("serve admin API on %s", path)
+	go func() {
+		if err := i.admin.Serve(ln); err != nil {
+			logrus.WithField("error", err).Error("serve admin API quit")
+		}
+	}()
+	return nil
+}
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:7070", "the -status address of the running instance")
+	rtt := fs.Bool("rtt", false, "ping the links to measure the RTT")
+	raw := fs.Bool("json", false, "print the raw JSON")
+	timeout := fs.Duration("timeout", 15*time.Second, "request timeout")
+	fs.Parse(args)
+
+	url := "http://" + *addr + statusPath
+	if *rtt {
+		url += "?rtt=1"
+	}
+	client := &http.Client{Timeout: *timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("query status failed: %s", resp.Status)
+	}
+
+	if *raw {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	var s admin.Status
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return err
+	}
+	printStatus(os.Stdout, &s)
+	return nil
+}
+
+func printStatus(w io.Writer, s *admin.Status) {
+	if s.Transport != "" {
+		fmt.Fprintf(w, "%s over %s, %s, up %s\n", s.Role, s.Transport, s.Address,
+			time.Since(s.Started).Truncate(time.Second))
+	} else {
+		fmt.Fprintf(w, "%s %s, up %s\n", s.Role, s.Address, time.Since(s.Started).Truncate(time.Second))
+	}
+	fmt.Fprintf(w, "links: %d\n", len(s.Links))
+	for _, l := range s.Links {
+		rtt := l.RTT
+		if rtt == "" {
+			rtt = "-"
+		}
+		fmt.Fprintf(w, "  %-24s %-24s rtt %-12s connected %s\n", l.Name, l.Remote, rtt, l.Connected.Format(time.RFC3339))
+	}
+	if s.Role == roleServer {
+		return
+	}
+	fmt.Fprintf(w, "tunnels: %d\n", len(s.Tunnels))
+	for _, t := range s.Tunnels {
+		state := "open"
+		if !t.Open {
+			state = "failed: " + t.Error
+		}
+		fmt.Fprintf(w, "  %-24s %-48s %s\n", t.Client, t.Spec, state)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ooclab/es/config"
+)
+
+var errTunnelSpec = errors.New("wrong tunnel spec")
+
+// formatTunnelSpec is the reverse of parseTunnelSpec
+func formatTunnelSpec(t *config.Tunnel) string {
+	s := fmt.Sprintf("%s/%s:%d:%s:%d", t.Proto, t.LocalHost, t.LocalPort, t.RemoteHost, t.RemotePort)
+	if t.Peer != "" {
+		s += "@" + t.Peer
+	}
+	return s
+}
+
+// parseTunnelSpec parse "[proto/]local_host:local_port:remote_host:remote_port[@peer]",
+// the hosts may be empty, the proto is tcp by default, the remote address
+// is in the peer client of hub if peer is given
+func parseTunnelSpec(value string, reverse bool) (*config.Tunnel, error) {
+	t := &config.Tunnel{Proto: "tcp", Reverse: reverse}
+
+	if i := strings.LastIndex(value, "@"); i >= 0 {
+		if t.Peer = value[i+1:]; t.Peer == "" {
+			return nil, fmt.Errorf("%w %q: empty peer", errTunnelSpec, value)
+		}
+		value = value[:i]
+	}
+
+	if i := strings.Index(value, "/"); i >= 0 {
+		t.Proto = strings.ToLower(strings.TrimSpace(value[:i]))
+		value = value[i+1:]
+	}
+	if t.Proto != "tcp" && t.Proto != "udp" {
+		return nil, fmt.Errorf("%w %q: unknown protocol %q", errTunnelSpec, value, t.Proto)
+	}
+
+	L := strings.Split(value, ":")
+	if len(L) != 4 {
+		return nil, fmt.Errorf("%w %q: need local_host:local_port:remote_host:remote_port", errTunnelSpec, value)
+	}
+	t.LocalHost = L[0]
+	t.RemoteHost = L[2]
+
+	var err error
+	// the listening side may bind port 0, the ephemeral port
+	if t.LocalPort, err = parsePort(L[1], !reverse); err != nil {
+		return nil, fmt.Errorf("%w %q: local port: %s", errTunnelSpec, value, err)
+	}
+	if t.RemotePort, err = parsePort(L[3], reverse); err != nil {
+		return nil, fmt.Errorf("%w %q: remote port: %s", errTunnelSpec, value, err)
+	}
+	return t, nil
+}
+
+func parsePort(s string, allowZero bool) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if port < 0 || port > 65535 || port == 0 && !allowZero {
+		return 0, errors.New("out of range")
+	}
+	return port, nil
+}
+
+// tunnelFlag collect the repeated -L/-R flags
+type tunnelFlag struct {
+	reverse bool
+	specs   *[]*config.Tunnel
+}
+
+func (f tunnelFlag) String() string {
+	if f.specs == nil {
+		return ""
+	}
+	var L []string
+	for _, t := range *f.specs {
+		if t.Reverse == f.reverse {
+			L = append(L, formatTunnelSpec(t))
+		}
+	}
+	return strings.Join(L, ",")
+}
+
+func (f tunnelFlag) Set(value string) error {
+	t, err := parseTunnelSpec(value, f.reverse)
+	if err != nil {
+		return err
+	}
+	*f.specs = append(*f.specs, t)
+	return nil
+}
+
+// labelFlag collect the repeated key=value flags
+type labelFlag map[string]string
+
+func (f labelFlag) String() string {
+	var L []string
+	for k, v := range f {
+		L = append(L, k+"="+v)
+	}
+	sort.Strings(L)
+	return strings.Join(L, ",")
+}
+
+func (f labelFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("wrong label %q, want key=value", value)
+	}
+	f[value[:i]] = value[i+1:]
+	return nil
+}
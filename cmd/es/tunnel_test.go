@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"testing"
+
+	"github.com/ooclab/es/config"
+)
+
+func Test_parseTunnelSpec(t *testing.T) {
+	cases := []struct {
+		value   string
+		reverse bool
+		want    config.Tunnel
+	}{
+		{"127.0.0.1:8000:127.0.0.1:1080", false, config.Tunnel{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 8000, RemoteHost: "127.0.0.1", RemotePort: 1080, Reverse: false}},
+		{"127.0.0.1:8080::18080", true, config.Tunnel{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 8080, RemoteHost: "", RemotePort: 18080, Reverse: true}},
+		{"udp/:5353:8.8.8.8:53", false, config.Tunnel{Proto: "udp", LocalHost: "", LocalPort: 5353, RemoteHost: "8.8.8.8", RemotePort: 53, Reverse: false}},
+		{"127.0.0.1:2222:127.0.0.1:22@home", false, config.Tunnel{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 2222, RemoteHost: "127.0.0.1", RemotePort: 22, Peer: "home"}},
+		{"TCP/127.0.0.1:1:127.0.0.1:65535", true, config.Tunnel{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 1, RemoteHost: "127.0.0.1", RemotePort: 65535, Reverse: true}},
+		{"127.0.0.1:0:127.0.0.1:22", false, config.Tunnel{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 0, RemoteHost: "127.0.0.1", RemotePort: 22}},
+		{"127.0.0.1:8080::0", true, config.Tunnel{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 8080, RemoteHost: "", RemotePort: 0, Reverse: true}},
+	}
+	for _, c := range cases {
+		got, err := parseTunnelSpec(c.value, c.reverse)
+		if err != nil {
+			t.Errorf("parse %q failed: %s", c.value, err)
+			continue
+		}
+		if *got != c.want {
+			t.Errorf("parse %q: got %+v, want %+v", c.value, *got, c.want)
+		}
+	}
+}
+
+func Test_parseTunnelSpec_Invalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"127.0.0.1:8000:127.0.0.1",
+		"f:127.0.0.1:8000:127.0.0.1:1080",
+		"sctp/127.0.0.1:8000:127.0.0.1:1080",
+		"127.0.0.1:http:127.0.0.1:1080",
+		"127.0.0.1:8000:127.0.0.1:0",
+		"127.0.0.1:70000:127.0.0.1:1080",
+		"127.0.0.1:2222:127.0.0.1:22@",
+	} {
+		if _, err := parseTunnelSpec(value, false); !errors.Is(err, errTunnelSpec) {
+			t.Errorf("parse %q: got error %v, want errTunnelSpec", value, err)
+		}
+	}
+
+	// the dial side can't be port 0
+	if _, err := parseTunnelSpec("127.0.0.1:0:127.0.0.1:22", true); !errors.Is(err, errTunnelSpec) {
+		t.Errorf("parse reverse local port 0: got error %v, want errTunnelSpec", err)
+	}
+}
+
+func Test_tunnelFlag(t *testing.T) {
+	var specs []*config.Tunnel
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(tunnelFlag{specs: &specs}, "L", "")
+	fs.Var(tunnelFlag{specs: &specs, reverse: true}, "R", "")
+	err := fs.Parse([]string{
+		"-L", "127.0.0.1:8000:127.0.0.1:1080",
+		"-R", "127.0.0.1:8080::18080",
+		"-L", "udp/:5353:8.8.8.8:53",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 3 {
+		t.Fatalf("got %d tunnels, want 3", len(specs))
+	}
+	if specs[0].Reverse || !specs[1].Reverse || specs[2].Reverse || specs[2].Proto != "udp" {
+		t.Errorf("tunnels are mixed up: %v", specs)
+	}
+	if got := fs.Lookup("L").Value.String(); got != "tcp/127.0.0.1:8000:127.0.0.1:1080,udp/:5353:8.8.8.8:53" {
+		t.Errorf("got -L %q", got)
+	}
+}
@@ -0,0 +1,375 @@
+// Package config load the servers and clients of the es command from a JSON
+// file, and watch the file for hot reload.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ooclab/es/ecrypt"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/logger"
+	"github.com/ooclab/es/policy"
+	"github.com/ooclab/es/tunnel"
+)
+
+// config error define
+var (
+	ErrUnknownKey = errors.New("unknown key")
+	ErrRequired   = errors.New("is required")
+	ErrInvalid    = errors.New("invalid value")
+	ErrDuplicated = errors.New("is duplicated")
+)
+
+// Error is a config error of the key, such as "clients[0].tunnels[1].local_port"
+type Error struct {
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return e.Err.Error()
+	}
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func invalid(key string, format string, a ...interface{}) *Error {
+	return &Error{Key: key, Err: fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalid}, a...)...)}
+}
+
+// Config describe the servers and clients run in one process
+type Config struct {
+	// LogLevel is debug, info, warn or error
+	LogLevel string `json:"log_level"`
+
+	// Status is the address to serve the status, empty means disabled
+	Status string `json:"status"`
+
+	// Admin is the Unix socket to serve the admin API, empty means disabled
+	Admin string `json:"admin"`
+
+	Servers []*Server `json:"servers"`
+	Clients []*Client `json:"clients"`
+}
+
+// Transport is the underlying connection of a link, the peers authenticate
+// each other by the shared secret
+type Transport struct {
+	// Transport is tcp (by default) or udp
+	Transport string `json:"transport"`
+
+	// Cipher is used when Secret is set, aes256cfb by default
+	Cipher string `json:"cipher"`
+	Secret string `json:"secret"`
+
+	// Compression is the link compression, such as "deflate"
+	Compression string `json:"compression"`
+}
+
+// Server accept the clients on Listen
+type Server struct {
+	Listen string `json:"listen"`
+	Transport
+
+	// Policy restrict the tunnels requested by the clients, the identity of
+	// a client is its IP
+	Policy *policy.Policy `json:"policy"`
+
+	// Hub relay the tunnels between the clients registered by hub_name
+	Hub bool `json:"hub"`
+}
+
+// Client connect to Server and open the Tunnels over the link
+type Client struct {
+	// Name identify the client in reload and status, it's the server
+	// address by default
+	Name string `json:"name"`
+
+	Server string `json:"server"`
+
+	// Retry is the reconnect delay after the link is broken
+	Retry Duration `json:"retry"`
+
+	// HubName and Labels are registered in the server, the other clients
+	// open the tunnels to this client by HubName if the server is a hub
+	HubName string            `json:"hub_name"`
+	Labels  map[string]string `json:"labels"`
+
+	Transport
+
+	Tunnels []*Tunnel `json:"tunnels"`
+}
+
+// Tunnel is a tunnel opened by the client
+type Tunnel struct {
+	// Proto is tcp (by default) or udp
+	Proto      string `json:"proto"`
+	LocalHost  string `json:"local_host"`
+	LocalPort  int    `json:"local_port"`
+	RemoteHost string `json:"remote_host"`
+	RemotePort int    `json:"remote_port"`
+	Reverse    bool   `json:"reverse"`
+	Weight     int    `json:"weight"`
+	NoCompress bool   `json:"no_compress"`
+
+	// Peer is the hub_name of the client at the far end, empty means the
+	// server
+	Peer string `json:"peer"`
+}
+
+// Duration is a time.Duration in the string form, such as "5s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("want a duration string, such as \"5s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+const defaultRetry = Duration(5 * time.Second)
+
+// Load read and check the config file
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse load the config from JSON, fill the defaults and check it
+func Parse(data []byte) (*Config, error) {
+	if err := checkSyntax(data); err != nil {
+		return nil, err
+	}
+	c := &Config{}
+	if err := decode("", data, c); err != nil {
+		return nil, err
+	}
+	c.setDefaults()
+	if err := c.check(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) setDefaults() {
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	for _, s := range c.Servers {
+		s.Transport.setDefaults()
+	}
+	for _, cl := range c.Clients {
+		cl.Transport.setDefaults()
+		if cl.Name == "" {
+			cl.Name = cl.Server
+		}
+		if cl.Retry == 0 {
+			cl.Retry = defaultRetry
+		}
+		for _, t := range cl.Tunnels {
+			if t.Proto == "" {
+				t.Proto = "tcp"
+			}
+		}
+	}
+}
+
+func (c *Config) check() error {
+	if _, err := logger.ParseLevel(c.LogLevel); err != nil {
+		return invalid("log_level", "%q", c.LogLevel)
+	}
+
+	listens := map[string]bool{}
+	for i, s := range c.Servers {
+		key := fmt.Sprintf("servers[%d]", i)
+		if s.Listen == "" {
+			return &Error{Key: key + ".listen", Err: ErrRequired}
+		}
+		if listens[s.Transport.Transport+s.Listen] {
+			return &Error{Key: key + ".listen", Err: ErrDuplicated}
+		}
+		listens[s.Transport.Transport+s.Listen] = true
+		if err := s.Transport.check(key); err != nil {
+			return err
+		}
+		if s.Policy != nil {
+			if err := checkPolicy(key+".policy", s.Policy); err != nil {
+				return err
+			}
+		}
+	}
+
+	names := map[string]bool{}
+	for i, cl := range c.Clients {
+		key := fmt.Sprintf("clients[%d]", i)
+		if cl.Server == "" {
+			return &Error{Key: key + ".server", Err: ErrRequired}
+		}
+		if names[cl.Name] {
+			return &Error{Key: key + ".name", Err: ErrDuplicated}
+		}
+		names[cl.Name] = true
+		if cl.Retry < 0 {
+			return invalid(key+".retry", "negative duration")
+		}
+		if err := cl.Transport.check(key); err != nil {
+			return err
+		}
+
+		tunnels := map[Tunnel]bool{}
+		for j, t := range cl.Tunnels {
+			tkey := fmt.Sprintf("%s.tunnels[%d]", key, j)
+			if err := t.check(tkey); err != nil {
+				return err
+			}
+			if tunnels[*t] {
+				return &Error{Key: tkey, Err: ErrDuplicated}
+			}
+			tunnels[*t] = true
+		}
+	}
+	return nil
+}
+
+func (t *Transport) setDefaults() {
+	if t.Transport == "" {
+		t.Transport = "tcp"
+	}
+	if t.Cipher == "" {
+		t.Cipher = "aes256cfb"
+	}
+}
+
+func (t *Transport) check(key string) error {
+	if t.Transport != "tcp" && t.Transport != "udp" {
+		return invalid(key+".transport", "%q, want tcp or udp", t.Transport)
+	}
+	if !ecrypt.IsSupported(t.Cipher) {
+		return invalid(key+".cipher", "unsupported cipher %q", t.Cipher)
+	}
+	if t.Compression != "" && t.Compression != link.CompressionDeflate {
+		return invalid(key+".compression", "unsupported compression %q", t.Compression)
+	}
+	return nil
+}
+
+func checkPolicy(key string, p *policy.Policy) error {
+	for i, proto := range p.Protos {
+		if proto != "tcp" && proto != "udp" {
+			return invalid(fmt.Sprintf("%s.protos[%d]", key, i), "%q, want tcp or udp", proto)
+		}
+	}
+	checkRules := func(name string, rules []policy.Rule) error {
+		for i, rule := range rules {
+			rkey := fmt.Sprintf("%s.%s[%d].host", key, name, i)
+			if rule.Host == "" {
+				return &Error{Key: rkey, Err: ErrRequired}
+			}
+			if strings.Contains(rule.Host, "/") {
+				if _, _, err := net.ParseCIDR(rule.Host); err != nil {
+					return invalid(rkey, "%q is not a CIDR", rule.Host)
+				}
+			}
+		}
+		return nil
+	}
+	if err := checkRules("binds", p.Binds); err != nil {
+		return err
+	}
+	if err := checkRules("destinations", p.Destinations); err != nil {
+		return err
+	}
+	if p.MaxTunnelsPerLink < 0 {
+		return invalid(key+".max_tunnels_per_link", "negative limit")
+	}
+	if p.MaxTunnelsPerIdentity < 0 {
+		return invalid(key+".max_tunnels_per_identity", "negative limit")
+	}
+	return nil
+}
+
+func (t *Tunnel) check(key string) error {
+	if t.Proto != "tcp" && t.Proto != "udp" {
+		return invalid(key+".proto", "%q, want tcp or udp", t.Proto)
+	}
+	// the listening side may bind port 0, the ephemeral port
+	if t.LocalPort < 0 || t.LocalPort > 65535 || t.LocalPort == 0 && t.Reverse {
+		return invalid(key+".local_port", "%d is out of range", t.LocalPort)
+	}
+	if t.RemotePort < 0 || t.RemotePort > 65535 || t.RemotePort == 0 && !t.Reverse {
+		return invalid(key+".remote_port", "%d is out of range", t.RemotePort)
+	}
+	if t.Weight < 0 {
+		return invalid(key+".weight", "negative weight")
+	}
+	return nil
+}
+
+// TunnelOptions create the options for link.OpenTunnel
+func (t *Tunnel) TunnelOptions() link.TunnelOptions {
+	opts := link.TunnelOptions{
+		Proto:      t.Proto,
+		BindHost:   t.LocalHost,
+		BindPort:   t.LocalPort,
+		DialHost:   t.RemoteHost,
+		DialPort:   t.RemotePort,
+		Reverse:    t.Reverse,
+		Peer:       t.Peer,
+		Weight:     t.Weight,
+		NoCompress: t.NoCompress,
+	}
+	if t.Reverse {
+		opts.BindHost, opts.BindPort, opts.DialHost, opts.DialPort = t.RemoteHost, t.RemotePort, t.LocalHost, t.LocalPort
+	}
+	return opts
+}
+
+// TunnelConfig create the tunnel config in the view of this endpoint
+func (t *Tunnel) TunnelConfig() *tunnel.TunnelConfig {
+	return &tunnel.TunnelConfig{
+		Proto:      t.Proto,
+		LocalHost:  t.LocalHost,
+		LocalPort:  t.LocalPort,
+		RemoteHost: t.RemoteHost,
+		RemotePort: t.RemotePort,
+		Reverse:    t.Reverse,
+		Weight:     t.Weight,
+		NoCompress: t.NoCompress,
+		Peer:       t.Peer,
+	}
+}
+
+func (t *Tunnel) String() string {
+	return t.TunnelConfig().String()
+}
+
+// SameLink check whether the clients can share one link, the tunnels may be
+// different
+func (cl *Client) SameLink(o *Client) bool {
+	return cl.Name == o.Name && cl.Server == o.Server && cl.Retry == o.Retry && cl.Transport == o.Transport &&
+		cl.HubName == o.HubName && reflect.DeepEqual(cl.Labels, o.Labels)
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/policy"
+)
+
+const testConfig = `{
+	"log_level": "debug",
+	"status": "127.0.0.1:7070",
+	"admin": "/run/es.sock",
+	"servers": [
+		{"listen": ":3000", "secret": "s3cret", "policy": {
+			"protos": ["tcp"],
+			"binds": [{"host": "0.0.0.0", "ports": "10000-20000"}],
+			"destinations": [{"host": "10.0.0.0/8"}, {"host": "*.example.com", "ports": 443}],
+			"max_tunnels_per_link": 8
+		}},
+		{"listen": ":3000", "transport": "udp", "compression": "deflate", "hub": true}
+	],
+	"clients": [
+		{
+			"server": "1.2.3.4:3000",
+			"secret": "s3cret",
+			"cipher": "rc4",
+			"tunnels": [
+				{"local_host": "127.0.0.1", "local_port": 8000, "remote_host": "127.0.0.1", "remote_port": 1080},
+				{"proto": "udp", "local_host": "127.0.0.1", "local_port": 53, "remote_port": 5353, "reverse": true, "weight": 4}
+			]
+		},
+		{"name": "backup", "server": "5.6.7.8:3000", "retry": "1m", "hub_name": "office", "labels": {"site": "sh"}, "tunnels": [
+			{"local_port": 2222, "remote_host": "127.0.0.1", "remote_port": 22, "peer": "home"}
+		]}
+	]
+}`
+
+func Test_Parse(t *testing.T) {
+	c, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != "debug" || c.Status != "127.0.0.1:7070" || c.Admin != "/run/es.sock" || len(c.Servers) != 2 || len(c.Clients) != 2 {
+		t.Fatalf("wrong config: %+v", c)
+	}
+	if s := c.Servers[0]; s.Transport.Transport != "tcp" || s.Cipher != "aes256cfb" || s.Secret != "s3cret" {
+		t.Errorf("wrong defaults of server: %+v", s)
+	}
+	if p := c.Servers[0].Policy; p == nil || len(p.Binds) != 1 || p.Binds[0].Ports != (policy.PortRange{Min: 10000, Max: 20000}) ||
+		len(p.Destinations) != 2 || p.Destinations[1].Ports != (policy.PortRange{Min: 443, Max: 443}) || p.MaxTunnelsPerLink != 8 {
+		t.Errorf("wrong policy: %+v", c.Servers[0].Policy)
+	}
+	if s := c.Servers[1]; s.Transport.Transport != "udp" || s.Compression != "deflate" || !s.Hub {
+		t.Errorf("wrong server: %+v", s)
+	}
+
+	cl := c.Clients[0]
+	if cl.Name != "1.2.3.4:3000" || cl.Retry != defaultRetry || cl.Cipher != "rc4" || len(cl.Tunnels) != 2 {
+		t.Fatalf("wrong client: %+v", cl)
+	}
+	want := Tunnel{Proto: "udp", LocalHost: "127.0.0.1", LocalPort: 53, RemotePort: 5353, Reverse: true, Weight: 4}
+	if *cl.Tunnels[1] != want {
+		t.Errorf("got tunnel %+v, want %+v", *cl.Tunnels[1], want)
+	}
+	if cl.Tunnels[0].Proto != "tcp" {
+		t.Errorf("the default proto is %q", cl.Tunnels[0].Proto)
+	}
+	// the remote endpoint binds the reverse tunnel
+	wantOpts := link.TunnelOptions{Proto: "udp", BindPort: 5353, DialHost: "127.0.0.1", DialPort: 53, Reverse: true, Weight: 4}
+	if opts := cl.Tunnels[1].TunnelOptions(); !reflect.DeepEqual(opts, wantOpts) {
+		t.Errorf("got options %+v, want %+v", opts, wantOpts)
+	}
+	if cl := c.Clients[1]; cl.Name != "backup" || cl.Retry != Duration(time.Minute) || cl.HubName != "office" || cl.Labels["site"] != "sh" ||
+		len(cl.Tunnels) != 1 || cl.Tunnels[0].Peer != "home" {
+		t.Errorf("wrong client: %+v", c.Clients[1])
+	}
+}
+
+func Test_Parse_Invalid(t *testing.T) {
+	cases := []struct {
+		data string
+		key  string
+		err  error
+	}{
+		{`{"log_level": "loud"}`, "log_level", ErrInvalid},
+		{`{"servers": [{"listen": ":3000", "port": 1}]}`, "servers[0].port", ErrUnknownKey},
+		{`{"servers": [{}]}`, "servers[0].listen", ErrRequired},
+		{`{"servers": [{"listen": ":1"}, {"listen": ":1"}]}`, "servers[1].listen", ErrDuplicated},
+		{`{"servers": [{"listen": ":1", "transport": "sctp"}]}`, "servers[0].transport", ErrInvalid},
+		{`{"servers": [{"listen": ":1", "cipher": "des"}]}`, "servers[0].cipher", ErrInvalid},
+		{`{"servers": {"listen": ":1"}}`, "servers", ErrInvalid},
+		{`{"servers": [{"listen": ":1", "policy": {"protos": ["icmp"]}}]}`, "servers[0].policy.protos[0]", ErrInvalid},
+		{`{"servers": [{"listen": ":1", "policy": {"binds": [{"host": "*", "ports": "2-1"}]}}]}`, "servers[0].policy.binds[0].ports", ErrInvalid},
+		{`{"servers": [{"listen": ":1", "policy": {"destinations": [{"host": "10.0.0.0/33"}]}}]}`, "servers[0].policy.destinations[0].host", ErrInvalid},
+		{`{"servers": [{"listen": ":1", "policy": {"binds": [{"ports": 80}]}}]}`, "servers[0].policy.binds[0].host", ErrRequired},
+		{`{"clients": [{"server": "a:1", "compression": "zip"}]}`, "clients[0].compression", ErrInvalid},
+		{`{"clients": [{"server": "a:1", "retry": 5}]}`, "clients[0].retry", ErrInvalid},
+		{`{"clients": [{"server": "a:1"}, {"server": "a:1"}]}`, "clients[1].name", ErrDuplicated},
+		{`{"clients": [{"server": "a:1", "tunnels": [{"local_port": "80", "remote_port": 80}]}]}`, "clients[0].tunnels[0].local_port", ErrInvalid},
+		{`{"clients": [{"server": "a:1", "tunnels": [{"local_port": 80}]}]}`, "clients[0].tunnels[0].remote_port", ErrInvalid},
+		{`{"clients": [{"server": "a:1", "tunnels": [{"remote_port": 80, "reverse": true}]}]}`, "clients[0].tunnels[0].local_port", ErrInvalid},
+		{`{"clients": [{"server": "a:1", "tunnels": [{"local_port": 1, "remote_port": 1}, {"local_port": 2, "remote_port": 2, "proto": "icmp"}]}]}`, "clients[0].tunnels[1].proto", ErrInvalid},
+		{`{"clients": [{"server": "a:1", "tunnels": [{"local_port": 1, "remote_port": 1}, {"local_port": 1, "remote_port": 1}]}]}`, "clients[0].tunnels[1]", ErrDuplicated},
+	}
+	for _, c := range cases {
+		_, err := Parse([]byte(c.data))
+		var ce *Error
+		if !errors.As(err, &ce) {
+			t.Errorf("parse %s: got error %v, want a config error", c.data, err)
+			continue
+		}
+		if ce.Key != c.key || !errors.Is(err, c.err) {
+			t.Errorf("parse %s: got %q, want key %q and %v", c.data, err, c.key, c.err)
+		}
+	}
+}
+
+func Test_Parse_Syntax(t *testing.T) {
+	_, err := Parse([]byte("{\n\t\"log_level\": \"info\",\n\t\"status\" \"x\"\n}"))
+	if err == nil || err.Error() != `line 3, column 11: invalid character '"' after object key` {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func Test_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "es-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "es.json")
+	if err := ioutil.WriteFile(path, []byte(`{"log_level": "info"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, c, err := NewWatcher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LogLevel != "info" {
+		t.Fatalf("got log level %q", c.LogLevel)
+	}
+
+	changes := make(chan *Config, 1)
+	errs := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.Run(10*time.Millisecond, stop,
+		func(c *Config) { changes <- c },
+		func(err error) { errs <- err })
+
+	ioutil.WriteFile(path, []byte(`{"log_level": "loud"}`), 0644)
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("got error %v", err)
+		}
+	case <-changes:
+		t.Fatal("the invalid config is loaded")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the invalid config is not reported")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"log_level": "warn"}`), 0644)
+	select {
+	case c := <-changes:
+		if c.LogLevel != "warn" {
+			t.Errorf("got log level %q", c.LogLevel)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change is not reported")
+	}
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkSyntax report the JSON syntax error with the line and column
+func checkSyntax(data []byte) error {
+	var v interface{}
+	err := json.Unmarshal(data, &v)
+	var se *json.SyntaxError
+	if errors.As(err, &se) {
+		line := 1 + bytes.Count(data[:se.Offset], []byte("\n"))
+		col := int(se.Offset) - bytes.LastIndexByte(data[:se.Offset], '\n') - 1
+		return &Error{Err: fmt.Errorf("line %d, column %d: %s", line, col, se)}
+	}
+	return err
+}
+
+// decode unmarshal the JSON data into v like json.Unmarshal, but the unknown
+// keys are rejected and the errors point at the offending key
+func decode(key string, data []byte, v interface{}) error {
+	return decodeValue(key, data, reflect.ValueOf(v).Elem())
+}
+
+func decodeValue(key string, data []byte, v reflect.Value) error {
+	if string(data) == "null" {
+		return nil
+	}
+	if reflect.PtrTo(v.Type()).Implements(unmarshalerType) {
+		return decodeLeaf(key, data, v)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeValue(key, data, v.Elem())
+
+	case reflect.Struct:
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return invalid(key, "want an object")
+		}
+		fields := map[string]reflect.Value{}
+		structFields(v, fields)
+		names := make([]string, 0, len(m))
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fkey := name
+			if key != "" {
+				fkey = key + "." + name
+			}
+			f, ok := fields[name]
+			if !ok {
+				return &Error{Key: fkey, Err: ErrUnknownKey}
+			}
+			if err := decodeValue(fkey, m[name], f); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Slice:
+		var L []json.RawMessage
+		if err := json.Unmarshal(data, &L); err != nil {
+			return invalid(key, "want an array")
+		}
+		s := reflect.MakeSlice(v.Type(), len(L), len(L))
+		for i, item := range L {
+			if err := decodeValue(fmt.Sprintf("%s[%d]", key, i), item, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	return decodeLeaf(key, data, v)
+}
+
+// structFields collect the fields by the json name, the fields of the
+// embedded structs are promoted
+func structFields(v reflect.Value, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			structFields(v.Field(i), fields)
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = v.Field(i)
+	}
+}
+
+func decodeLeaf(key string, data []byte, v reflect.Value) error {
+	err := json.Unmarshal(data, v.Addr().Interface())
+	if err == nil {
+		return nil
+	}
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return invalid(key, "want %s, got %s", te.Type, te.Value)
+	}
+	return invalid(key, "%s", err)
+}
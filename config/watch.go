@@ -0,0 +1,58 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"time"
+)
+
+// Watcher poll the config file for hot reload
+type Watcher struct {
+	path string
+	last []byte
+}
+
+// NewWatcher load the config file, and the Watcher report the changes after it
+func NewWatcher(path string) (*Watcher, *Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := Parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Watcher{path: path, last: data}, c, nil
+}
+
+// Run poll the file every interval until stop is closed. onChange is called
+// with the new config after the file is modified, and onError with the error
+// if the new content is invalid (the running config should be kept).
+func (w *Watcher) Run(interval time.Duration, stop <-chan struct{}, onChange func(*Config), onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		data, err := ioutil.ReadFile(w.path)
+		if err != nil {
+			// the editor may replace the file by rename, try it later
+			continue
+		}
+		if bytes.Equal(data, w.last) {
+			continue
+		}
+		w.last = data
+
+		c, err := Parse(data)
+		if err != nil {
+			onError(err)
+			continue
+		}
+		onChange(c)
+	}
+}
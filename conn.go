@@ -1,16 +1,20 @@
 package es
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
+	"sync"
 
 	"github.com/ooclab/es/ecrypt"
 )
 
 const (
 	maxMessageLength = 1024*64 - 1
+
+	sizeOfFrameHeader      = 2
+	defaultWriteBufferSize = 1024 * 64
+	maxPooledWriteBuffer   = 1024 * 1024
 )
 
 // common error define
@@ -26,9 +30,48 @@ type Conn interface {
 	Close() error
 }
 
+// BatchSender is implemented by the Conn which can send several messages
+// in one underlying write
+type BatchSender interface {
+	SendBatch(messages [][]byte) error
+}
+
+var writeBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, defaultWriteBufferSize)
+		return &b
+	},
+}
+
+// encodeFrames append the length-prefixed messages to a pooled buffer, the
+// caller must call putWriteBuffer after use
+func encodeFrames(messages [][]byte) (*[]byte, error) {
+	bp := writeBufferPool.Get().(*[]byte)
+	buf := (*bp)[:0]
+	for _, m := range messages {
+		if len(m) > maxMessageLength {
+			putWriteBuffer(bp)
+			return nil, ErrMaxLengthLimit
+		}
+		buf = append(buf, byte(len(m)>>8), byte(len(m)))
+		buf = append(buf, m...)
+	}
+	*bp = buf
+	return bp, nil
+}
+
+func putWriteBuffer(bp *[]byte) {
+	// do not keep the huge buffer of a big batch
+	if cap(*bp) > maxPooledWriteBuffer {
+		return
+	}
+	writeBufferPool.Put(bp)
+}
+
 // BaseConn is the basic connection type
 type BaseConn struct {
 	conn io.ReadWriteCloser
+	head [sizeOfFrameHeader]byte
 }
 
 // NewBaseConn create a base Conn object
@@ -38,34 +81,35 @@ func NewBaseConn(conn io.ReadWriteCloser) Conn {
 	}
 }
 
-// Recv read a message from this Conn
+// Recv read a message from this Conn. The message is got from the buffer
+// pool, the caller can return it by PutBuffer when it's not used anymore.
 func (c *BaseConn) Recv() (message []byte, err error) {
-	head, err := c.mustRecv(2)
-	if err != nil {
+	head := c.head[:]
+	if err = c.mustRecv(head); err != nil {
 		return
 	}
-	return c.mustRecv(binary.BigEndian.Uint16(head))
+	message = GetBuffer(int(binary.BigEndian.Uint16(head)))
+	if err = c.mustRecv(message); err != nil {
+		PutBuffer(message)
+		return nil, err
+	}
+	return
 }
 
 // Send send a message to this Conn
 func (c *BaseConn) Send(message []byte) error {
-	dlen := uint16(len(message))
-	if dlen > maxMessageLength {
-		return ErrMaxLengthLimit
-	}
+	return c.SendBatch([][]byte{message})
+}
 
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, dlen)
+// SendBatch send several messages to this Conn in one write
+func (c *BaseConn) SendBatch(messages [][]byte) error {
+	bp, err := encodeFrames(messages)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(buf, binary.BigEndian, message)
-	if err != nil {
-		return err
-	}
-
 	// TODO: make sure write exactly data
-	_, err = c.conn.Write(buf.Bytes())
+	_, err = c.conn.Write(*bp)
+	putWriteBuffer(bp)
 	return err
 }
 
@@ -74,16 +118,16 @@ func (c *BaseConn) Close() error {
 	return c.conn.Close()
 }
 
-func (c *BaseConn) mustRecv(dlen uint16) ([]byte, error) {
-	data := make([]byte, dlen)
-	for i := 0; i < int(dlen); {
+// mustRecv fill data from the underlying conn
+func (c *BaseConn) mustRecv(data []byte) error {
+	for i := 0; i < len(data); {
 		n, err := c.conn.Read(data[i:])
 		if err != nil {
-			return nil, err
+			return err
 		}
 		i += n
 	}
-	return data, nil
+	return nil
 }
 
 // SafeConn ecrypt Conn
@@ -101,41 +145,40 @@ func NewSafeConn(conn io.ReadWriteCloser, cipher *ecrypt.Cipher) Conn {
 	return c
 }
 
-// Recv read a message from this Conn
+// Recv read a message from this Conn. The message is got from the buffer
+// pool, the caller can return it by PutBuffer when it's not used anymore.
 func (c *SafeConn) Recv() (message []byte, err error) {
-	head, err := c.mustRecv(2)
-	if err != nil {
+	head := c.head[:]
+	if err = c.mustRecv(head); err != nil {
 		return
 	}
-	c.cipher.Decrypt(head[0:2], head[0:2])
-	message, err = c.mustRecv(binary.BigEndian.Uint16(head))
-	if err == nil {
-		c.cipher.Decrypt(message, message)
+	c.cipher.Decrypt(head, head)
+	message = GetBuffer(int(binary.BigEndian.Uint16(head)))
+	if err = c.mustRecv(message); err != nil {
+		PutBuffer(message)
+		return nil, err
 	}
+	c.cipher.Decrypt(message, message)
 	return
 }
 
 // Send send a message to this Conn
 func (c *SafeConn) Send(message []byte) error {
-	dlen := uint16(len(message))
-	if dlen > maxMessageLength {
-		return ErrMaxLengthLimit
-	}
+	return c.SendBatch([][]byte{message})
+}
 
-	buf := new(bytes.Buffer)
-	err := binary.Write(buf, binary.BigEndian, dlen)
+// SendBatch send several messages to this Conn in one write
+func (c *SafeConn) SendBatch(messages [][]byte) error {
+	bp, err := encodeFrames(messages)
 	if err != nil {
 		return err
 	}
-	err = binary.Write(buf, binary.BigEndian, message)
-	if err != nil {
-		return err
-	}
-
+	// the cipher is a stream, encrypt the whole batch is the same as
+	// encrypt the frames one by one
+	c.cipher.Encrypt(*bp, *bp)
 	// TODO: make sure write exactly data
-	b := buf.Bytes()
-	c.cipher.Encrypt(b, b)
-	_, err = c.conn.Write(b)
+	_, err = c.conn.Write(*bp)
+	putWriteBuffer(bp)
 	return err
 }
 
@@ -110,3 +110,111 @@ func Test_SafeConn(t *testing.T) {
 
 	testEcho(sc)
 }
+
+// countConn count the underlying writes
+type countConn struct {
+	writes int
+}
+
+func (c *countConn) Read(p []byte) (int, error)  { return 0, errors.New("not readable") }
+func (c *countConn) Write(p []byte) (int, error) { c.writes++; return len(p), nil }
+func (c *countConn) Close() error                { return nil }
+
+func Test_BaseConnSendBatch(t *testing.T) {
+	// run server
+	l, _ := net.Listen("tcp", "127.0.0.1:")
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			panic(err)
+		}
+		bc := NewBaseConn(conn)
+		bc.(BatchSender).SendBatch([][]byte{[]byte("a"), []byte("bb"), {}, []byte("ccc")})
+	}()
+
+	conn, _ := net.Dial("tcp", l.Addr().String())
+	bc := NewBaseConn(conn)
+	defer bc.Close()
+	for _, want := range []string{"a", "bb", "", "ccc"} {
+		msg, err := bc.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %s", err)
+		}
+		if string(msg) != want {
+			t.Errorf("Recv got %q, want %q", msg, want)
+		}
+	}
+
+	cc := &countConn{}
+	bc = NewBaseConn(cc)
+	if err := bc.(BatchSender).SendBatch([][]byte{make([]byte, 10), make([]byte, maxMessageLength+1)}); err != ErrMaxLengthLimit {
+		t.Errorf("SendBatch large message got %v, want %v", err, ErrMaxLengthLimit)
+	}
+	if cc.writes != 0 {
+		t.Errorf("SendBatch failed but wrote %d times", cc.writes)
+	}
+}
+
+func benchmarkSend(b *testing.B, bc Conn, batch int) {
+	msg := make([]byte, 64)
+	msgs := make([][]byte, batch)
+	for i := range msgs {
+		msgs[i] = msg
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg) * batch))
+	for i := 0; i < b.N; i++ {
+		if batch == 1 {
+			bc.Send(msg)
+		} else {
+			bc.(BatchSender).SendBatch(msgs)
+		}
+	}
+}
+
+func Benchmark_BaseConnSend(b *testing.B) {
+	benchmarkSend(b, NewBaseConn(&countConn{}), 1)
+}
+
+func Benchmark_BaseConnSendBatch(b *testing.B) {
+	benchmarkSend(b, NewBaseConn(&countConn{}), 16)
+}
+
+func Benchmark_SafeConnSend(b *testing.B) {
+	benchmarkSend(b, NewSafeConn(&countConn{}, ecrypt.NewCipher("aes256cfb", []byte("secret"))), 1)
+}
+
+func Benchmark_SafeConnSendBatch(b *testing.B) {
+	benchmarkSend(b, NewSafeConn(&countConn{}, ecrypt.NewCipher("aes256cfb", []byte("secret"))), 16)
+}
+
+// loopReader repeat the frames forever
+type loopReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *loopReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.pos:])
+	r.pos = (r.pos + n) % len(r.data)
+	return n, nil
+}
+func (r *loopReader) Write(p []byte) (int, error) { return len(p), nil }
+func (r *loopReader) Close() error                { return nil }
+
+func Benchmark_BaseConnRecv(b *testing.B) {
+	msg := make([]byte, 1024*16)
+	bp, _ := encodeFrames([][]byte{msg})
+	bc := NewBaseConn(&loopReader{data: append([]byte{}, *bp...)})
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(msg)))
+	for i := 0; i < b.N; i++ {
+		m, err := bc.Recv()
+		if err != nil {
+			b.Fatal(err)
+		}
+		PutBuffer(m)
+	}
+}
@@ -7,3 +7,11 @@ const (
 	LinkMsgTypeSession      = 10
 	LinkMsgTypeTunnel       = 20
 )
+
+// LinkMsgFlagCompressed is set in the message type if the rest of the link
+// message is compressed
+const LinkMsgFlagCompressed = 0x80
+
+// BondJoinMsgType is the type of the first message on every path of a bonded
+// link, it carries the bond ID. It's consumed before the link is bound.
+const BondJoinMsgType = 30
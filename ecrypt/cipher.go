@@ -7,7 +7,6 @@ import (
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rc4"
-	"fmt"
 )
 
 type Cipher struct {
@@ -57,15 +56,20 @@ func newAES256CFBCipher(secret []byte) (*Cipher, error) {
 	return &Cipher{ec, dc}, nil
 }
 
+// IsSupported check whether the crypto method is supported by NewCipher
+func IsSupported(cryptoMethod string) bool {
+	return cipherMap[cryptoMethod] != nil
+}
+
+// NewCipher create a Cipher, it returns nil if the crypto method is not
+// supported, check it by IsSupported first
 func NewCipher(cryptoMethod string, secret []byte) *Cipher {
 	cc := cipherMap[cryptoMethod]
 	if cc == nil {
-		fmt.Printf("unsupported crypto method %s", cryptoMethod)
 		return nil
 	}
 	c, err := cc(secret)
 	if err != nil {
-		fmt.Print(err)
 		return nil
 	}
 	return c
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Printf("Usage: %s Address Tunnel\n", os.Args[0])
+		fmt.Printf("Example: %s 127.0.0.1:3000 f:127.0.0.1:10080:127.0.0.1:8080\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	logrus.SetLevel(logrus.DebugLevel)
+
+	proto, localHost, localPort, remoteHost, remotePort, reverse, err := parseTunnel(os.Args[2])
+	if err != nil {
+		logrus.Fatalf("parse tunnel failed: %s", err)
+	}
+	opts := link.TunnelOptions{Proto: proto, BindHost: localHost, BindPort: localPort, DialHost: remoteHost, DialPort: remotePort}
+	if reverse {
+		opts = link.TunnelOptions{Proto: proto, BindHost: remoteHost, BindPort: remotePort, DialHost: localHost, DialPort: localPort, Reverse: true}
+	}
+
+	conn, err := net.Dial("tcp", os.Args[1])
+	if err != nil {
+		logrus.Fatalf("connect %s failed: %s", os.Args[1], err)
+	}
+
+	l := link.NewLink(nil)
+	if err := l.Bind(es.NewBaseConn(conn)); err != nil {
+		logrus.Fatalf("bind link failed: %s", err)
+	}
+	// the link works after Bind returns
+	if h, err := l.OpenTunnel(context.Background(), opts); err != nil {
+		logrus.Errorf("open tunnel failed: %s", err)
+	} else {
+		logrus.Infof("open tunnel %s", h.Config())
+	}
+	l.Wait()
+	l.Close()
+}
+
+func parseTunnel(value string) (proto string, localHost string, localPort int, remoteHost string, remotePort int, reverse bool, err error) {
+	L := strings.Split(value, ":")
+	if len(L) != 5 {
+		err = errors.New("tunnel map is wrong, want r|f[/tcp|udp]:local_host:local_port:remote_host:remote_port: " + value)
+		return
+	}
+
+	// the protocol is given with the direction, such as "f/udp"
+	direction := L[0]
+	if i := strings.Index(direction, "/"); i >= 0 {
+		proto = strings.TrimSpace(strings.ToLower(direction[i+1:]))
+		direction = direction[:i]
+	}
+
+	localHost = L[1]
+	remoteHost = L[3]
+	switch direction {
+	case "r", "R":
+		reverse = true
+	case "f", "F":
+		reverse = false
+	default:
+		err = errors.New("wrong tunnel map")
+		return
+	}
+
+	if proto == "" {
+		proto = "tcp"
+	}
+	if !(proto == "tcp" || proto == "udp") {
+		err = errors.New("unknown protocol")
+		return
+	}
+	localPort, err = strconv.Atoi(L[2])
+	if err != nil {
+		return
+	}
+	remotePort, err = strconv.Atoi(L[4])
+	if err != nil {
+		return
+	}
+
+	return
+}
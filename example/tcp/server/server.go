@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Printf("Usage: %s Address\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	logrus.SetLevel(logrus.DebugLevel)
+
+	l, err := net.Listen("tcp", os.Args[1])
+	if err != nil {
+		logrus.Fatalf("listen %s failed: %s", os.Args[1], err)
+	}
+
+	// the links are numbered, and named by the clients
+	registry := link.NewRegistry()
+	registry.Subscribe(func(e link.Event) {
+		logrus.Infof("link %d %s: name %q, labels %v", e.Link.ID, e.Type, e.Link.Name(), e.Link.Labels())
+	})
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			logrus.Fatalf("accept failed: %s", err)
+		}
+		logrus.Infof("accept client %s", conn.RemoteAddr())
+
+		go handleClient(registry, conn)
+	}
+}
+
+func handleClient(registry *link.Registry, _conn net.Conn) {
+	l := link.NewLink(&link.LinkConfig{IsServerSide: true, Registry: registry})
+	conn := es.NewBaseConn(_conn)
+	if err := l.Bind(conn); err != nil {
+		logrus.Errorf("bind link failed: %s", err)
+	}
+	l.Wait()
+	l.Close()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es/proto/udp"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Printf("Usage: %s RemoteAddress\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	logrus.SetLevel(logrus.DebugLevel)
+
+	raddr, err := net.ResolveUDPAddr("udp", os.Args[1])
+	if err != nil {
+		logrus.Fatalf("resolve remote udp addr %s failed: %s", os.Args[1], err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		logrus.Fatalf("listen udp failed: %s", err)
+	}
+
+	sock, clientConn, err := udp.NewClientSocket(conn, raddr)
+	if err != nil {
+		logrus.Fatalf("create client socket failed: %s", err)
+	}
+	defer sock.Close()
+	defer clientConn.Close()
+
+	// send the messages of growing size, and check the echo
+	maxSize := 1024 * 1024 * 16
+	for i := 2; i <= maxSize; i = i * 2 {
+		b := make([]byte, i+1)
+		rand.Read(b)
+		sc := md5.Sum(b)
+
+		start := time.Now()
+		if err := clientConn.SendMsg(b); err != nil {
+			logrus.Errorf("SendMsg failed: %s", err)
+			return
+		}
+		t := time.Since(start)
+		speed := (float64(len(b)) / t.Seconds()) / (1024 * 1024)
+		logrus.Infof("%9d --> send %s %16s %16f M/s", len(b), hex.EncodeToString(sc[:]), t, speed)
+
+		msg, err := clientConn.RecvMsg()
+		if err != nil {
+			logrus.Errorf("RecvMsg failed: %s", err)
+			return
+		}
+		if md5.Sum(msg) != sc {
+			logrus.Errorf("the echo of %d bytes is mismatch", len(b))
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es/proto/udp"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Printf("Usage: %s Address\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	logrus.SetLevel(logrus.DebugLevel)
+
+	addr, err := net.ResolveUDPAddr("udp", os.Args[1])
+	if err != nil {
+		logrus.Fatalf("resolve udp addr %s failed: %s", os.Args[1], err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		logrus.Fatalf("listen %s failed: %s", addr, err)
+	}
+	defer conn.Close()
+	sock, err := udp.NewServerSocket(conn)
+	if err != nil {
+		logrus.Fatalf("create server socket failed: %s", err)
+	}
+
+	for {
+		conn, err := sock.Accept()
+		if err != nil {
+			logrus.Errorf("accept failed: %s", err)
+			break
+		}
+		logrus.Infof("accept client %s", conn)
+		go echo(conn)
+	}
+}
+
+// echo send the received messages back
+func echo(conn *udp.Conn) {
+	defer logrus.Infof("quit client %s", conn)
+	for {
+		msg, err := conn.RecvMsg()
+		if err != nil {
+			logrus.Errorf("recv msg failed: %s", err)
+			return
+		}
+		rc := md5.Sum(msg)
+		logrus.Debugf("%9d <-- recv %s", len(msg), hex.EncodeToString(rc[:]))
+		if err := conn.SendMsg(msg); err != nil {
+			logrus.Errorf("send msg failed: %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,497 @@
+package link
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/logger"
+	tcommon "github.com/ooclab/es/tunnel/common"
+)
+
+const (
+	bondPathQueueSize = 64
+	bondJoinSize      = 1 + 8 // type + bond ID
+)
+
+// bond error define
+var (
+	ErrBondClosed      = errors.New("bond is closed")
+	ErrBondNoPath      = errors.New("bond has no alive path")
+	ErrBondJoinInvalid = errors.New("invalid bond join message")
+
+	// errBondFrameDropped is returned by pick for the frames of a reset
+	// channel
+	errBondFrameDropped = errors.New("frame of reset channel is dropped")
+)
+
+// bondPath is a underlying Conn of Bond
+type bondPath struct {
+	id     int
+	conn   es.Conn
+	queue  chan []byte
+	queued int64 // the bytes in queue
+
+	dead     chan struct{}
+	deadOnce sync.Once
+	isDead   bool
+	lock     sync.RWMutex // protect isDead, enqueue under read lock
+}
+
+// Bond is a es.Conn which spreads the link frames over several underlying
+// Conns (paths), such as several TCP connections.
+//
+// The frames of a tunnel channel always use the same path to keep them in
+// order, other frames use the path with the least queued bytes. If a path is
+// dead, it's removed and its queued frames are sent by other paths. The
+// frames in flight on it are lost, so the channels using it are reset: they
+// are closed in both endpoints and their later frames are dropped. The Bond
+// is closed when its last path is dead.
+type Bond struct {
+	ID uint64
+
+	lock       sync.Mutex
+	paths      []*bondPath
+	nextPathID int
+	affinity   map[uint64]*bondPath // channel -> path
+	reset      map[uint64]bool      // the channels reset by dead paths
+	lastErr    error
+
+	inbound   chan []byte
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	onClose   func()
+
+	log logger.Logger
+}
+
+// NewBond create a Bond with a random ID, the ID is sent by JoinBond on
+// every path
+func NewBond() *Bond {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return newBond(binary.BigEndian.Uint64(b), nil)
+}
+
+func newBond(id uint64, log logger.Logger) *Bond {
+	return &Bond{
+		ID:       id,
+		affinity: make(map[uint64]*bondPath),
+		reset:    make(map[uint64]bool),
+		inbound:  make(chan []byte, 1),
+		closeCh:  make(chan struct{}),
+		log:      logger.OrDefault(log).WithField("bond_id", id),
+	}
+}
+
+// SetLogger set the logger of the bond, call it before Add
+func (b *Bond) SetLogger(log logger.Logger) {
+	b.log = log.WithField("bond_id", b.ID)
+}
+
+// JoinBond send the bond join message by conn, it must be the first message
+// of a path
+func JoinBond(conn es.Conn, id uint64) error {
+	m := make([]byte, bondJoinSize)
+	m[0] = es.BondJoinMsgType
+	binary.BigEndian.PutUint64(m[1:], id)
+	return conn.Send(m)
+}
+
+func (b *Bond) isClosed() bool {
+	select {
+	case <-b.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Add add a path to this Bond
+func (b *Bond) Add(conn es.Conn) error {
+	b.lock.Lock()
+	if b.isClosed() {
+		b.lock.Unlock()
+		return ErrBondClosed
+	}
+	p := &bondPath{
+		id:    b.nextPathID,
+		conn:  conn,
+		queue: make(chan []byte, bondPathQueueSize),
+		dead:  make(chan struct{}),
+	}
+	b.nextPathID++
+	b.paths = append(b.paths, p)
+	b.lock.Unlock()
+
+	b.log.WithField("path_id", p.id).Debugf("add bond path")
+
+	go b.sendLoop(p)
+	go b.recvLoop(p)
+	return nil
+}
+
+// Paths get the number of alive paths
+func (b *Bond) Paths() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.paths)
+}
+
+// channelKey get the channel of a tunnel frame
+func channelKey(m []byte) (key uint64, isChannel, isClose bool) {
+	if len(m) < tcommon.FrameHeaderSize || m[0]&^es.LinkMsgFlagCompressed != es.LinkMsgTypeTunnel {
+		return 0, false, false
+	}
+	tm, _ := tcommon.LoadTMSG(m[1:tcommon.FrameHeaderSize])
+	return uint64(tm.TunnelID)<<32 | uint64(tm.ChannelID), true, tm.Type == tcommon.MsgTypeChannelClose
+}
+
+// pick get the path to send m
+func (b *Bond) pick(m []byte) (*bondPath, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.isClosed() {
+		return nil, ErrBondClosed
+	}
+	if len(b.paths) == 0 {
+		return nil, ErrBondNoPath
+	}
+
+	key, isChannel, isClose := channelKey(m)
+	if isChannel {
+		if b.reset[key] {
+			return nil, errBondFrameDropped
+		}
+		if p := b.affinity[key]; p != nil {
+			if isClose {
+				delete(b.affinity, key)
+			}
+			return p, nil
+		}
+	}
+	return b.leastQueued(key, isChannel && !isClose), nil
+}
+
+// pickAny get the path to send m, ignoring the reset channels
+func (b *Bond) pickAny(m []byte) (*bondPath, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.isClosed() {
+		return nil, ErrBondClosed
+	}
+	if len(b.paths) == 0 {
+		return nil, ErrBondNoPath
+	}
+	return b.leastQueued(0, false), nil
+}
+
+// leastQueued get the path with the least queued bytes, and pin the channel
+// key to it if pin, b.lock must be held
+func (b *Bond) leastQueued(key uint64, pin bool) *bondPath {
+	p := b.paths[0]
+	for _, v := range b.paths[1:] {
+		if atomic.LoadInt64(&v.queued) < atomic.LoadInt64(&p.queued) {
+			p = v
+		}
+	}
+	if pin {
+		b.affinity[key] = p
+	}
+	return p
+}
+
+// enqueue queue the frame owned by Bond to a alive path chosen by pick
+func (b *Bond) enqueue(frame []byte, pick func([]byte) (*bondPath, error)) error {
+	for {
+		p, err := pick(frame)
+		if err == errBondFrameDropped {
+			es.PutBuffer(frame)
+			return nil
+		}
+		if err != nil {
+			es.PutBuffer(frame)
+			return err
+		}
+
+		p.lock.RLock()
+		if p.isDead {
+			p.lock.RUnlock()
+			continue
+		}
+		atomic.AddInt64(&p.queued, int64(len(frame)))
+		select {
+		case p.queue <- frame:
+			p.lock.RUnlock()
+			return nil
+		case <-p.dead:
+		case <-b.closeCh:
+		}
+		atomic.AddInt64(&p.queued, -int64(len(frame)))
+		p.lock.RUnlock()
+	}
+}
+
+// Send queue a message to one of the paths. The message is copied, so the
+// caller can reuse it after Send.
+func (b *Bond) Send(m []byte) error {
+	frame := es.GetBuffer(len(m))
+	copy(frame, m)
+	return b.enqueue(frame, b.pick)
+}
+
+// Recv recv a message from any path
+func (b *Bond) Recv() ([]byte, error) {
+	select {
+	case m := <-b.inbound:
+		return m, nil
+	case <-b.closeCh:
+		b.lock.Lock()
+		err := b.lastErr
+		b.lock.Unlock()
+		if err == nil {
+			err = ErrBondClosed
+		}
+		return nil, err
+	}
+}
+
+// Close close all paths
+func (b *Bond) Close() error {
+	b.closeOnce.Do(func() {
+		b.lock.Lock()
+		close(b.closeCh)
+		paths := b.paths
+		b.paths = nil
+		b.affinity = make(map[uint64]*bondPath)
+		b.reset = make(map[uint64]bool)
+		b.lock.Unlock()
+
+		for _, p := range paths {
+			p.conn.Close()
+		}
+		if b.onClose != nil {
+			b.onClose()
+		}
+	})
+	return nil
+}
+
+// removePath remove a dead path, and send its queued frames by other paths.
+// The channels pinned to it are reset, their frames in flight are lost.
+func (b *Bond) removePath(p *bondPath, err error) {
+	p.deadOnce.Do(func() {
+		close(p.dead)
+		p.lock.Lock()
+		p.isDead = true
+		p.lock.Unlock()
+		p.conn.Close()
+
+		b.lock.Lock()
+		for i, v := range b.paths {
+			if v == p {
+				b.paths = append(b.paths[:i], b.paths[i+1:]...)
+				break
+			}
+		}
+		// drop the later frames of the channels, the channel IDs are not
+		// reused, so they're kept until the bond is closed
+		var lost []uint64
+		for k, v := range b.affinity {
+			if v == p {
+				delete(b.affinity, k)
+				b.reset[k] = true
+				lost = append(lost, k)
+			}
+		}
+		remain := len(b.paths)
+		if remain == 0 {
+			b.lastErr = err
+		}
+		b.lock.Unlock()
+
+		b.log.WithFields(logger.Fields{
+			"path_id": p.id,
+			"remain":  remain,
+			"error":   err,
+		}).Warnf("bond path is dead")
+
+		if remain == 0 {
+			b.Close()
+		}
+
+		// no more frames can be queued to p
+	DRAIN:
+		for {
+			select {
+			case frame := <-p.queue:
+				atomic.AddInt64(&p.queued, -int64(len(frame)))
+				b.enqueue(frame, b.pick)
+			default:
+				break DRAIN
+			}
+		}
+
+		for _, key := range lost {
+			b.resetChannel(key)
+		}
+	})
+}
+
+// resetChannel close the channel in both endpoints
+func (b *Bond) resetChannel(key uint64) {
+	m := &tcommon.TMSG{
+		Type:      tcommon.MsgTypeChannelClose,
+		TunnelID:  uint32(key >> 32),
+		ChannelID: uint32(key),
+	}
+	b.log.WithFields(logger.Fields{
+		"tunnel_id":  m.TunnelID,
+		"channel_id": m.ChannelID,
+	}).Warnf("reset channel of dead bond path")
+
+	if err := b.enqueue(m.Frame(), b.pickAny); err != nil {
+		return
+	}
+	select {
+	case b.inbound <- m.Frame():
+	case <-b.closeCh:
+	}
+}
+
+func (b *Bond) sendLoop(p *bondPath) {
+	bs, _ := p.conn.(es.BatchSender)
+	batch := make([][]byte, 0, maxBatchMessages)
+	for {
+		var frame []byte
+		select {
+		case frame = <-p.queue:
+		case <-p.dead:
+			return
+		case <-b.closeCh:
+			return
+		}
+
+		var err error
+		batch = append(batch[:0], frame)
+		if bs == nil {
+			err = p.conn.Send(frame)
+		} else {
+			size := len(frame)
+		MORE:
+			for len(batch) < maxBatchMessages && size < maxBatchSize {
+				select {
+				case frame = <-p.queue:
+					batch = append(batch, frame)
+					size += len(frame)
+				default:
+					break MORE
+				}
+			}
+			err = bs.SendBatch(batch)
+		}
+		for i := range batch {
+			atomic.AddInt64(&p.queued, -int64(len(batch[i])))
+			es.PutBuffer(batch[i])
+			batch[i] = nil
+		}
+
+		if err != nil {
+			b.removePath(p, err)
+			return
+		}
+	}
+}
+
+func (b *Bond) recvLoop(p *bondPath) {
+	for {
+		m, err := p.conn.Recv()
+		if err != nil {
+			b.removePath(p, err)
+			return
+		}
+		if b.isReset(m) {
+			// the channel is closed in this endpoint already
+			es.PutBuffer(m)
+			continue
+		}
+		select {
+		case b.inbound <- m:
+		case <-b.closeCh:
+			return
+		}
+	}
+}
+
+// isReset check whether m is a frame of a reset channel
+func (b *Bond) isReset(m []byte) bool {
+	key, isChannel, _ := channelKey(m)
+	if !isChannel {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.reset[key]
+}
+
+// BondAcceptor group the accepted Conns into Bonds by the bond join message
+type BondAcceptor struct {
+	bonds map[uint64]*Bond
+	lock  sync.Mutex
+	log   logger.Logger
+}
+
+// NewBondAcceptor create a BondAcceptor
+func NewBondAcceptor() *BondAcceptor {
+	return &BondAcceptor{
+		bonds: make(map[uint64]*Bond),
+	}
+}
+
+// SetLogger set the logger of the accepted bonds
+func (a *BondAcceptor) SetLogger(log logger.Logger) {
+	a.lock.Lock()
+	a.log = log
+	a.lock.Unlock()
+}
+
+// Accept read the bond join message from conn and add it to the Bond. isNew
+// is true if it's the first path of the Bond, then the caller should bind a
+// link with it.
+func (a *BondAcceptor) Accept(conn es.Conn) (b *Bond, isNew bool, err error) {
+	m, err := conn.Recv()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(m) != bondJoinSize || m[0] != es.BondJoinMsgType {
+		return nil, false, ErrBondJoinInvalid
+	}
+	id := binary.BigEndian.Uint64(m[1:])
+	es.PutBuffer(m)
+
+	a.lock.Lock()
+	b = a.bonds[id]
+	if b == nil {
+		isNew = true
+		b = newBond(id, a.log)
+		b.onClose = func() {
+			a.lock.Lock()
+			if a.bonds[id] == b {
+				delete(a.bonds, id)
+			}
+			a.lock.Unlock()
+		}
+		a.bonds[id] = b
+	}
+	a.lock.Unlock()
+
+	if err = b.Add(conn); err != nil {
+		return nil, false, err
+	}
+	return b, isNew, nil
+}
@@ -0,0 +1,125 @@
+package link
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/logger"
+	tcommon "github.com/ooclab/es/tunnel/common"
+)
+
+// chanConn is a es.Conn, the sent messages are in sent, and Recv get the
+// messages from recv
+type chanConn struct {
+	sent   chan []byte
+	recv   chan []byte
+	closed chan struct{}
+}
+
+func newChanConn() *chanConn {
+	return &chanConn{
+		sent:   make(chan []byte, 16),
+		recv:   make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *chanConn) Send(m []byte) error {
+	select {
+	case <-c.closed:
+		return ErrBondClosed
+	default:
+	}
+	c.sent <- append([]byte{}, m...)
+	return nil
+}
+
+func (c *chanConn) Recv() ([]byte, error) {
+	select {
+	case m := <-c.recv:
+		return m, nil
+	case <-c.closed:
+		return nil, ErrBondClosed
+	}
+}
+
+func (c *chanConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func waitFrame(t *testing.T, ch chan []byte) []byte {
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("wait frame timeout")
+		return nil
+	}
+}
+
+func Test_Bond_ResetChannel(t *testing.T) {
+	b := newBond(1, logger.Discard)
+	defer b.Close()
+	c0, c1 := newChanConn(), newChanConn()
+	b.Add(c0)
+	b.Add(c1)
+
+	forward := (&tcommon.TMSG{Type: tcommon.MsgTypeChannelForward, TunnelID: 1, ChannelID: 7, Payload: []byte("data")}).Frame()
+	closeFrame := (&tcommon.TMSG{Type: tcommon.MsgTypeChannelClose, TunnelID: 1, ChannelID: 7}).Frame()
+	session := []byte{es.LinkMsgTypeSession, 1, 2, 3}
+
+	// find the path of channel 7
+	if err := b.Send(forward); err != nil {
+		t.Fatal(err)
+	}
+	dead, alive := c0, c1
+	select {
+	case <-c0.sent:
+	case <-c1.sent:
+		dead, alive = c1, c0
+	case <-time.After(2 * time.Second):
+		t.Fatal("the frame is not sent")
+	}
+
+	dead.Close()
+	for i := 0; i < 100 && b.Paths() != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b.Paths() != 1 {
+		t.Fatalf("paths is %d, want 1", b.Paths())
+	}
+
+	// the channel is closed in both endpoints
+	if m := waitFrame(t, alive.sent); !bytes.Equal(m, closeFrame) {
+		t.Errorf("got frame %v on the alive path, want the channel close", m)
+	}
+	m, err := b.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m, closeFrame) {
+		t.Errorf("got frame %v, want the channel close", m)
+	}
+
+	// the later frames of the channel are dropped in both directions
+	b.Send(forward)
+	b.Send(session)
+	if m := waitFrame(t, alive.sent); !bytes.Equal(m, session) {
+		t.Errorf("got frame %v on the alive path, want the session frame", m)
+	}
+	alive.recv <- forward
+	alive.recv <- session
+	if m, err = b.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m, session) {
+		t.Errorf("got frame %v, want the session frame", m)
+	}
+}
@@ -0,0 +1,226 @@
+package link
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ooclab/es"
+	tcommon "github.com/ooclab/es/tunnel/common"
+)
+
+// CompressionDeflate is the per-frame deflate compression (from the
+// standard library, with flate.BestSpeed)
+const CompressionDeflate = "deflate"
+
+const defaultCompressionThreshold = 256
+
+// compression error define
+var (
+	ErrCompressionUnsupported = errors.New("unsupported compression method")
+	ErrCompressedFrameInvalid = errors.New("invalid compressed frame")
+	errFrameTooLarge          = errors.New("decompressed frame is too large")
+)
+
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var flateReaderPool = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(bytes.NewReader(nil))
+	},
+}
+
+func isCompressionSupported(method string) bool {
+	return method == CompressionDeflate
+}
+
+// fixedBuffer is a io.Writer which can not grow
+type fixedBuffer struct {
+	b []byte
+	n int
+}
+
+var errFixedBufferFull = errors.New("buffer is full")
+
+func (w *fixedBuffer) Write(p []byte) (int, error) {
+	if w.n+len(p) > len(w.b) {
+		return 0, errFixedBufferFull
+	}
+	w.n += copy(w.b[w.n:], p)
+	return len(p), nil
+}
+
+// compressConn compress the link frames between Link and es.Conn.
+//
+// Every frame is compressed independently and flagged by
+// es.LinkMsgFlagCompressed in the message type, so the compressed and plain
+// frames can be mixed. The TMSG header of tunnel frame is not compressed. The
+// received frames are always decompressed if flagged, the sending compression
+// is enabled after the remote endpoint accept it.
+type compressConn struct {
+	es.Conn
+	enabled   int32
+	threshold int
+	skip      func(m []byte) bool // skip the frame which is compressed already
+}
+
+func newCompressConn(conn es.Conn, threshold int, skip func(m []byte) bool) *compressConn {
+	if threshold <= 0 {
+		threshold = defaultCompressionThreshold
+	}
+	return &compressConn{
+		Conn:      conn,
+		threshold: threshold,
+		skip:      skip,
+	}
+}
+
+func (c *compressConn) Enable() {
+	atomic.StoreInt32(&c.enabled, 1)
+}
+
+func (c *compressConn) isEnabled() bool {
+	return atomic.LoadInt32(&c.enabled) == 1
+}
+
+// compress get the compressed frame from the buffer pool, it returns nil if
+// the frame should not or can not be compressed smaller
+func (c *compressConn) compress(m []byte) []byte {
+	if !c.isEnabled() || len(m) < c.threshold || len(m) < plainHeaderSize(m[0]) || m[0]&es.LinkMsgFlagCompressed != 0 {
+		return nil
+	}
+	if c.skip != nil && c.skip(m) {
+		return nil
+	}
+
+	hs := plainHeaderSize(m[0])
+	b := es.GetBuffer(len(m))
+	copy(b, m[:hs])
+	b[0] |= es.LinkMsgFlagCompressed
+	out := &fixedBuffer{b: b[hs:]}
+
+	w := flateWriterPool.Get().(*flate.Writer)
+	w.Reset(out)
+	_, err := w.Write(m[hs:])
+	if err == nil {
+		err = w.Close()
+	}
+	flateWriterPool.Put(w)
+	if err != nil {
+		// the compressed is not smaller
+		es.PutBuffer(b)
+		return nil
+	}
+	return b[:hs+out.n]
+}
+
+// Send send a message, compress it if needed
+func (c *compressConn) Send(m []byte) error {
+	if cm := c.compress(m); cm != nil {
+		err := c.Conn.Send(cm)
+		es.PutBuffer(cm)
+		return err
+	}
+	return c.Conn.Send(m)
+}
+
+// SendBatch send several messages in one write if the underlying Conn
+// supports it
+func (c *compressConn) SendBatch(messages [][]byte) error {
+	bs, ok := c.Conn.(es.BatchSender)
+	if !ok {
+		for _, m := range messages {
+			if err := c.Send(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// the compressed frames should be returned to the pool, but the origin
+	// frames are owned by the caller
+	var compressed []int
+	for i, m := range messages {
+		if cm := c.compress(m); cm != nil {
+			messages[i] = cm
+			compressed = append(compressed, i)
+		}
+	}
+	err := bs.SendBatch(messages)
+	for _, i := range compressed {
+		es.PutBuffer(messages[i])
+		messages[i] = nil
+	}
+	return err
+}
+
+// Recv recv a message, decompress it if needed
+func (c *compressConn) Recv() ([]byte, error) {
+	m, err := c.Conn.Recv()
+	if err != nil || len(m) == 0 || m[0]&es.LinkMsgFlagCompressed == 0 {
+		return m, err
+	}
+
+	hs := plainHeaderSize(m[0] &^ es.LinkMsgFlagCompressed)
+	if len(m) < hs {
+		es.PutBuffer(m)
+		return nil, ErrCompressedFrameInvalid
+	}
+
+	// the origin frame is not larger than the max frame size
+	b := es.GetBuffer(1024 * 64)
+	copy(b, m[:hs])
+	b[0] &^= es.LinkMsgFlagCompressed
+
+	r := flateReaderPool.Get().(io.ReadCloser)
+	r.(flate.Resetter).Reset(bytes.NewReader(m[hs:]), nil)
+	n := hs
+	for err == nil {
+		if n == len(b) {
+			err = errFrameTooLarge
+			break
+		}
+		var rn int
+		rn, err = r.Read(b[n:])
+		n += rn
+	}
+	flateReaderPool.Put(r)
+	es.PutBuffer(m)
+	if err != io.EOF {
+		es.PutBuffer(b)
+		return nil, err
+	}
+	return b[:n], nil
+}
+
+// plainHeaderSize get the size of frame header which is not compressed. The
+// TMSG header of tunnel frame is kept, so the frame can be routed (such as by
+// Bond) without decompressing.
+func plainHeaderSize(msgType byte) int {
+	if msgType == es.LinkMsgTypeTunnel {
+		return tcommon.FrameHeaderSize
+	}
+	return 1
+}
+
+// skipCompressFunc skip the frames of tunnels opt-out the compression
+func skipCompressFunc(noCompress func(tid uint32) bool) func(m []byte) bool {
+	return func(m []byte) bool {
+		if m[0] != es.LinkMsgTypeTunnel || len(m) < tcommon.FrameHeaderSize {
+			return false
+		}
+		tm, err := tcommon.LoadTMSG(m[1:tcommon.FrameHeaderSize])
+		if err != nil {
+			return false
+		}
+		return noCompress(tm.TunnelID)
+	}
+}
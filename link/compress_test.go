@@ -0,0 +1,113 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es"
+	tcommon "github.com/ooclab/es/tunnel/common"
+)
+
+// queueConn is a es.Conn, Recv get the messages sent
+type queueConn struct {
+	frames [][]byte
+}
+
+func (c *queueConn) Send(m []byte) error {
+	c.frames = append(c.frames, append([]byte{}, m...))
+	return nil
+}
+
+func (c *queueConn) Recv() ([]byte, error) {
+	if len(c.frames) == 0 {
+		return nil, errors.New("no frames")
+	}
+	m := c.frames[0]
+	c.frames = c.frames[1:]
+	return m, nil
+}
+
+func (c *queueConn) Close() error { return nil }
+
+func Test_compressConn(t *testing.T) {
+	qc := &queueConn{}
+	cc := newCompressConn(qc, 64, skipCompressFunc(func(tid uint32) bool { return tid == 3 }))
+
+	small := append([]byte{es.LinkMsgTypeSession}, bytes.Repeat([]byte("a"), 32)...)
+	large := append([]byte{es.LinkMsgTypeSession}, bytes.Repeat([]byte("a"), 4096)...)
+	forward := (&tcommon.TMSG{
+		Type:     tcommon.MsgTypeChannelForward,
+		TunnelID: 1,
+		Payload:  bytes.Repeat([]byte("a"), 4096),
+	}).Frame()
+	skipped := (&tcommon.TMSG{
+		Type:     tcommon.MsgTypeChannelForward,
+		TunnelID: 3,
+		Payload:  bytes.Repeat([]byte("a"), 4096),
+	}).Frame()
+
+	// not enabled
+	cc.Send(large)
+	cc.Enable()
+	cc.Send(large)
+	cc.Send(small)
+	cc.Send(forward)
+	cc.Send(skipped)
+
+	wantCompressed := []bool{false, true, false, true, false}
+	for i, m := range qc.frames {
+		if compressed := m[0]&es.LinkMsgFlagCompressed != 0; compressed != wantCompressed[i] {
+			t.Errorf("frame %d compressed is %v, want %v", i, compressed, wantCompressed[i])
+		}
+	}
+	if len(qc.frames[1]) >= len(large) {
+		t.Errorf("compressed frame size %d is not smaller than %d", len(qc.frames[1]), len(large))
+	}
+
+	if !bytes.Equal(qc.frames[3][1:tcommon.FrameHeaderSize], forward[1:tcommon.FrameHeaderSize]) {
+		t.Errorf("TMSG header of compressed tunnel frame is changed")
+	}
+
+	for i, want := range [][]byte{large, large, small, forward, skipped} {
+		m, err := cc.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %s", err)
+		}
+		if !bytes.Equal(m, want) {
+			t.Errorf("frame %d mismatch after Recv", i)
+		}
+	}
+}
+
+func Test_Bind_CompressionTimeout(t *testing.T) {
+	testBindTimeout(t, &LinkConfig{Compression: "deflate", ConnectionWriteTimeout: 100 * time.Millisecond})
+}
+
+func Test_Bind_HelloTimeout(t *testing.T) {
+	testBindTimeout(t, &LinkConfig{Name: "a", ConnectionWriteTimeout: 100 * time.Millisecond})
+}
+
+// testBindTimeout check Bind returns if the remote endpoint never answers
+func testBindTimeout(t *testing.T, cfg *LinkConfig) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	// the peer reads the frames but never answers
+	go io.Copy(io.Discard, peer)
+
+	l := NewLink(cfg)
+	errCh := make(chan error, 1)
+	go func() { errCh <- l.Bind(es.NewBaseConn(conn)) }()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bind is blocked by the request to the remote endpoint")
+	}
+	l.Close()
+}
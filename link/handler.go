@@ -2,52 +2,99 @@ package link
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 
+	"github.com/ooclab/es/logger"
+	"github.com/ooclab/es/policy"
 	"github.com/ooclab/es/session"
 	"github.com/ooclab/es/tunnel"
-	"github.com/sirupsen/logrus"
 )
 
+func init() {
+	session.RegisterError("bad-request", ErrBadRequest)
+	session.RegisterError("unsupported-compression", ErrCompressionUnsupported)
+	session.RegisterError("policy-denied", policy.ErrDenied)
+	session.RegisterError("hub-disabled", ErrHubDisabled)
+	session.RegisterError("peer-not-found", ErrPeerNotFound)
+	session.RegisterError("self-relay", ErrSelfRelay)
+}
+
+// badRequest wrap the decoding error of request by ErrBadRequest
+func badRequest(err error) error {
+	return fmt.Errorf("%w: %s", ErrBadRequest, err)
+}
+
 type requestHandler struct {
 	router *session.Router
+	log    logger.Logger
+
+	// the requests of the async actions are handled off the recv loop, and
+	// their responses are sent by push
+	async map[string]bool
+	push  func([]byte) error
 }
 
-func newRequestHandler(routes []session.Route) *requestHandler {
+func newRequestHandler(log logger.Logger, routes []session.Route) *requestHandler {
 	h := &requestHandler{
 		router: session.NewRouter(),
+		log:    log,
 	}
 	h.router.AddRoutes([]session.Route{
 		{"/echo", h.echo},
+		{"/link/compression", h.compression},
 	})
 	h.router.AddRoutes(routes)
 	return h
 }
 
-func (h *requestHandler) Handle(m *session.EMSG) *session.EMSG {
-	var resp *session.Response
-	var err error
+// handleAsync handle the requests of actions in background, they may wait
+// the other links, push send their responses
+func (h *requestHandler) handleAsync(push func([]byte) error, actions ...string) {
+	h.async = make(map[string]bool)
+	for _, action := range actions {
+		h.async[action] = true
+	}
+	h.push = push
+}
 
+func (h *requestHandler) Handle(m *session.EMSG) *session.EMSG {
 	req := &session.Request{}
-	if err = json.Unmarshal(m.Payload, &req); err != nil {
-		logrus.Errorf("json unmarshal session request failed: %s", err)
-		resp = &session.Response{Status: "json-unmarshal-request-error"}
-	} else {
-		resp, err = h.router.Dispatch(req)
-		if err != nil {
-			logrus.Errorf("dispatch request failed: %s", err)
-			resp = &session.Response{Status: "dispatch-request-error"}
+	if err := json.Unmarshal(m.Payload, &req); err != nil {
+		h.log.Errorf("json unmarshal session request failed: %s", err)
+		return h.response(m.ID, session.ErrorResponse("json-unmarshal-request-error", badRequest(err)))
+	}
+	if !h.async[req.Action] {
+		return h.dispatch(m.ID, req)
+	}
+	go func() {
+		if err := h.push(h.dispatch(m.ID, req).Frame()); err != nil {
+			h.log.WithField("session_id", m.ID).Debugf("send response of %s failed: %s", req.Action, err)
 		}
+	}()
+	return nil
+}
+
+func (h *requestHandler) dispatch(id uint32, req *session.Request) *session.EMSG {
+	resp, err := h.router.Dispatch(req)
+	if err != nil {
+		h.log.Errorf("dispatch request failed: %s", err)
+		resp = session.ErrorResponse("dispatch-request-error", err)
 	}
+	return h.response(id, resp)
+}
+
+func (h *requestHandler) response(id uint32, resp *session.Response) *session.EMSG {
 
 	payload, err := json.Marshal(resp)
 	if err != nil {
-		logrus.Errorf("json marshal response failed: %s", err)
+		h.log.Errorf("json marshal response failed: %s", err)
 		resp = &session.Response{Status: "json-marshal-response-error"}
 	}
 
 	return &session.EMSG{
 		Type:    session.MsgTypeResponse,
-		ID:      m.ID,
+		ID:      id,
 		Payload: payload,
 	}
 }
@@ -56,35 +103,111 @@ func (h *requestHandler) echo(req *session.Request) (*session.Response, error) {
 	return &session.Response{Status: "success", Body: req.Body}, nil
 }
 
-func defaultTunnelCreateHandler(manager *tunnel.Manager) session.RequestHandlerFunc {
+// compression tell the remote endpoint whether we can decompress the frames
+func (h *requestHandler) compression(req *session.Request) (*session.Response, error) {
+	body := compressionBody{}
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		return session.ErrorResponse("load-compression-error", badRequest(err)), nil
+	}
+	if !isCompressionSupported(body.Method) {
+		return session.ErrorResponse("unsupported-compression", ErrCompressionUnsupported), nil
+	}
+	return &session.Response{Status: "success"}, nil
+}
+
+func defaultTunnelCreateHandler(log logger.Logger, manager *tunnel.Manager, guard *policy.Guard, relay func(*tunnel.TunnelConfig) (*tunnel.Tunnel, error)) session.RequestHandlerFunc {
 	return func(r *session.Request) (resp *session.Response, err error) {
 		cfg := &tunnel.TunnelConfig{}
 		if err = json.Unmarshal(r.Body, &cfg); err != nil {
-			logrus.Errorf("tunnel create: unmarshal tunnel config failed: %s", err)
-			resp = &session.Response{
-				Status: "load-tunnel-map-error",
-				Body:   nil,
+			log.Errorf("tunnel create: unmarshal tunnel config failed: %s", err)
+			return session.ErrorResponse("load-tunnel-map-error", badRequest(err)), nil
+		}
+
+		log.Debugf("got config for tunnel create: %s", cfg)
+
+		if cfg.Peer != "" {
+			t, err := relay(cfg)
+			switch {
+			case errors.Is(err, ErrHubDisabled):
+				return session.ErrorResponse("hub-disabled", err), nil
+			case errors.Is(err, ErrPeerNotFound):
+				return session.ErrorResponse("peer-not-found", err), nil
+			case errors.Is(err, ErrSelfRelay):
+				return session.ErrorResponse("self-relay", err), nil
+			case errors.Is(err, policy.ErrDenied):
+				log.Warnf("relay tunnel %s: %s", cfg, err)
+				return policyDenied(err), nil
+			case err != nil:
+				log.Errorf("relay tunnel %s failed: %s", cfg, err)
+				return session.ErrorResponse("relay-tunnel-failed", err), nil
 			}
-			return
+			return &session.Response{Status: "success", Body: createdBody(t)}, nil
 		}
 
-		logrus.Debugf("got config for tunnel create: %s", cfg)
+		release, err := allow(guard, cfg)
+		if err != nil {
+			log.Warnf("tunnel create %s: %s", cfg, err)
+			return policyDenied(err), nil
+		}
 
 		t, err := manager.TunnelCreate(cfg)
 		if err != nil {
-			logrus.Errorf("create tunnel failed: %s", err)
-			resp = &session.Response{
-				Status: "create-tunnel-failed",
-				Body:   nil,
-			}
-			return
+			release()
+			log.Errorf("create tunnel failed: %s", err)
+			return session.ErrorResponse("create-tunnel-failed", err), nil
 		}
+		go func() {
+			<-t.Done()
+			release()
+		}()
 
-		body, _ := json.Marshal(tunnelCreateBody{ID: t.ID})
 		resp = &session.Response{
 			Status: "success",
-			Body:   body,
+			Body:   createdBody(t),
 		}
 		return
 	}
 }
+
+// policyDenied is the response of the tunnel denied by the policy, the
+// status is the reason
+func policyDenied(err error) *session.Response {
+	resp := session.ErrorResponse("policy-denied", err)
+	resp.Status = resp.Error.Error()
+	return resp
+}
+
+// createdBody report the tunnel ID, and the bound port if this endpoint
+// listens
+func createdBody(t *tunnel.Tunnel) []byte {
+	body := tunnelCreateBody{ID: t.ID}
+	if !t.Config.Reverse {
+		body.Port = t.Config.LocalPort
+	}
+	b, _ := json.Marshal(body)
+	return b
+}
+
+// relay create the tunnel to the peer by the hub, cfg is requested by the
+// remote endpoint
+func (l *Link) relay(cfg *tunnel.TunnelConfig) (*tunnel.Tunnel, error) {
+	if l.config.Hub == nil {
+		return nil, ErrHubDisabled
+	}
+	return l.config.Hub.relay(l, cfg)
+}
+
+func defaultTunnelCloseHandler(log logger.Logger, manager *tunnel.Manager) session.RequestHandlerFunc {
+	return func(r *session.Request) (*session.Response, error) {
+		body := tunnelCloseBody{}
+		if err := json.Unmarshal(r.Body, &body); err != nil {
+			log.Errorf("tunnel close: unmarshal body failed: %s", err)
+			return session.ErrorResponse("load-tunnel-close-error", badRequest(err)), nil
+		}
+		if err := manager.TunnelClose(body.ID); err != nil {
+			log.WithField("tunnel_id", body.ID).Errorf("close tunnel failed: %s", err)
+			return session.ErrorResponse("close-tunnel-failed", err), nil
+		}
+		return &session.Response{Status: "success"}, nil
+	}
+}
@@ -0,0 +1,114 @@
+package link
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ooclab/es/policy"
+	"github.com/ooclab/es/tunnel"
+)
+
+// hub error define
+var (
+	ErrHubDisabled  = errors.New("hub is disabled")
+	ErrPeerNotFound = errors.New("no such peer")
+	ErrSelfRelay    = errors.New("peer is the requesting link itself")
+)
+
+// Hub relay the tunnels between the clients of a server: a client registers
+// its name in the handshake (LinkConfig.Name), and the other clients open
+// the tunnels to it by TunnelConfig.Peer. The server splices the channels of
+// two links, so the clients behind NAT can reach each other.
+type Hub struct {
+	registry *Registry
+}
+
+// NewHub create a Hub which finds the peers in registry, set them both in
+// LinkConfig of the server links
+func NewHub(registry *Registry) *Hub {
+	return &Hub{registry: registry}
+}
+
+// relay create the tunnel requested by link a to its peer, cfg is in the
+// view of the server, and return the relay tunnel of link a. The tunnel is
+// allowed by the policy of both links, and the wait of the peer is bounded by
+// ConnectionWriteTimeout of link a.
+func (h *Hub) relay(a *Link, cfg *tunnel.TunnelConfig) (*tunnel.Tunnel, error) {
+	b := h.registry.Lookup(cfg.Peer)
+	if b == nil || b.IsClosed() {
+		return nil, ErrPeerNotFound
+	}
+	if b == a {
+		return nil, ErrSelfRelay
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.ConnectionWriteTimeout)
+	defer cancel()
+
+	// the peer takes the role of server in the tunnel
+	peerCfg := *cfg
+	peerCfg.ID = 0
+	peerCfg.Peer = ""
+	releaseA, err := allow(a.config.Policy, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.PinnedIPs) > 0 {
+		// the peer dials the checked address, not the name resolved again
+		peerCfg.LocalHost = cfg.PinnedIPs[0].String()
+	}
+	releaseB, err := allow(b.config.Policy, &peerCfg)
+	if err != nil {
+		releaseA()
+		return nil, err
+	}
+	release := func() {
+		releaseA()
+		releaseB()
+	}
+
+	created, err := requestTunnel(ctx, b.config.ConnectionWriteTimeout, b.log, b.sessionManager, &peerCfg)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	id := created.ID
+	if !peerCfg.Reverse && peerCfg.LocalPort == 0 {
+		// the peer bound an ephemeral port
+		peerCfg.LocalPort = created.Port
+	}
+
+	acfg := *cfg
+	acfg.ID = 0
+	acfg.LocalPort = peerCfg.LocalPort
+	bcfg := peerCfg.RemoteConfig()
+	bcfg.ID = id
+	ta, tb, err := tunnel.Splice(a.tunnelManager, &acfg, b.tunnelManager, bcfg)
+	if err != nil {
+		release()
+		if err := closeRemoteTunnel(b.sessionManager, id); err != nil {
+			b.log.WithField("tunnel_id", id).Warnf("hub: close tunnel of peer %s failed: %s", cfg.Peer, err)
+		}
+		return nil, err
+	}
+
+	// closing one side close the other side, in both endpoints
+	go func() {
+		select {
+		case <-ta.Done():
+			b.CloseTunnel(tb.ID)
+		case <-tb.Done():
+			a.CloseTunnel(ta.ID)
+		}
+		release()
+	}()
+	a.log.WithField("tunnel_id", ta.ID).Debugf("hub: relay tunnel to %s (link %d) tunnel %d", cfg.Peer, b.ID, tb.ID)
+	return ta, nil
+}
+
+// allow count the tunnel in the guard of a link, nil guard allows all
+func allow(g *policy.Guard, cfg *tunnel.TunnelConfig) (release func(), err error) {
+	if g == nil {
+		return func() {}, nil
+	}
+	return g.Allow(cfg)
+}
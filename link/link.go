@@ -2,16 +2,19 @@ package link
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"io"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ooclab/es"
+	"github.com/ooclab/es/logger"
+	"github.com/ooclab/es/policy"
 	"github.com/ooclab/es/session"
 	"github.com/ooclab/es/tunnel"
-	"github.com/sirupsen/logrus"
 )
 
 // Define error
@@ -20,6 +23,10 @@ var (
 	ErrTimeout          = errors.New("timeout")
 	ErrKeepaliveTimeout = errors.New("keepalive error")
 	ErrMsgPingInvalid   = errors.New("invalid ping message")
+
+	// ErrBadRequest is returned by the remote endpoint if the request can
+	// not be decoded
+	ErrBadRequest = errors.New("bad request")
 )
 
 const (
@@ -29,6 +36,10 @@ const (
 
 	defaultInterval = 6 * time.Second  // min
 	maxLinkIdle     = 60 * time.Second // TODO: needed ?
+
+	// the limit of frames coalesced into one underlying write
+	maxBatchMessages = 64
+	maxBatchSize     = 1024 * 256
 )
 
 // LinkConfig reserved for config
@@ -44,18 +55,51 @@ type LinkConfig struct {
 	// close it. This is only applied to writes, where's there's generally
 	// an expectation that things will move along quickly.
 	ConnectionWriteTimeout time.Duration
+
+	// Compression is the method used to compress the sending frames, such as
+	// CompressionDeflate. It's enabled after the remote endpoint accept it,
+	// empty means no compression.
+	Compression string
+
+	// CompressionThreshold is the min size of frame to be compressed
+	CompressionThreshold int
+
+	// Policy is consulted before creating the tunnel requested by the remote
+	// endpoint, nil means no restriction
+	Policy *policy.Guard
+
+	// Registry assign the link ID and keep the name/labels registered by the
+	// remote endpoint, it's used by the server side
+	Registry *Registry
+
+	// Hub relay the tunnels to the peers registered in its registry, nil
+	// means the tunnels to the peers are refused
+	Hub *Hub
+
+	// Name and Labels are registered in the registry of the remote endpoint
+	// (server) in the handshake
+	Name   string
+	Labels map[string]string
+
+	// Logger receive the logs of the link, its sessions, tunnels and
+	// channels, nil means logger.Default(). Use logger.Discard to silence.
+	Logger logger.Logger
 }
 
 // Link is the main connection between two endpoint
 type Link struct {
+	// rtt is the last RTT measured by Ping (in nanoseconds), keep it the
+	// first for atomic in 32-bit platform
+	rtt int64
+
 	ID     uint32
 	config *LinkConfig
-	log    *logrus.Entry
+	log    logger.Logger
 
 	sessionManager *session.Manager
 	tunnelManager  *tunnel.Manager
 
-	outbound chan []byte
+	outbound *es.Outbound
 
 	// for underlying loop control
 	stopCh   chan struct{}
@@ -73,7 +117,10 @@ type Link struct {
 	shutdownCh   chan struct{}
 	shutdownLock sync.Mutex
 
-	defaultOpenTunnel OpenTunnelFunc
+	// the name and labels registered by the remote endpoint
+	name     string
+	labels   map[string]string
+	infoLock sync.Mutex
 }
 
 // NewLink create a new link
@@ -87,48 +134,56 @@ func NewLinkCustom(config *LinkConfig, hdr session.RequestHandler) *Link {
 }
 
 func newLink(config *LinkConfig, hdr session.RequestHandler) *Link {
-	logrus.Debugf("prepare to create new link with config %#v", config)
 	if config == nil {
 		config = &LinkConfig{}
 	}
+	log := logger.OrDefault(config.Logger)
+	log.Debugf("prepare to create new link with config %#v", config)
 	if config.KeepaliveInterval == 0 {
 		config.KeepaliveInterval = 30 * time.Second
 	}
 	if config.ConnectionWriteTimeout == 0 {
 		config.ConnectionWriteTimeout = 10 * time.Second
 	}
+	if config.Compression != "" && !isCompressionSupported(config.Compression) {
+		log.Errorf("unsupported compression method %s, disable it", config.Compression)
+		config.Compression = ""
+	}
 	l := &Link{
 		config:            config,
-		outbound:          make(chan []byte, 1),
+		outbound:          es.NewOutbound(),
 		lastRecvTimeMutex: &sync.Mutex{},
 
 		pings:      make(map[uint32]chan struct{}),
 		shutdownCh: make(chan struct{}),
 	}
-	l.log = logrus.WithFields(logrus.Fields{
-		"from": "link",
-		"id":   l.ID,
-	})
-	l.sessionManager = session.NewManager(config.IsServerSide, l.outbound)
-	l.tunnelManager = tunnel.NewManager(config.IsServerSide, l.outbound, l.sessionManager)
+	if config.Registry != nil {
+		l.ID = config.Registry.newID()
+	}
+	l.log = log.WithField("link_id", l.ID)
+	l.sessionManager = session.NewManager(config.IsServerSide, l.outbound, l.log)
+	l.tunnelManager = tunnel.NewManager(config.IsServerSide, l.outbound, l.sessionManager, l.log)
 	if hdr == nil {
-		hdr = newRequestHandler([]session.Route{
-			{"/tunnel", defaultTunnelCreateHandler(l.tunnelManager)},
+		h := newRequestHandler(l.log, []session.Route{
+			{"/tunnel", defaultTunnelCreateHandler(l.log, l.tunnelManager, config.Policy, l.relay)},
+			{"/tunnel/close", defaultTunnelCloseHandler(l.log, l.tunnelManager)},
+			{"/link/hello", helloHandler(l)},
 		})
+		// the relay waits the peer link, don't block the recv loop
+		h.handleAsync(l.outbound.PushSession, "/tunnel")
+		hdr = h
 	}
 	l.sessionManager.SetRequestHandler(hdr)
-	// TODO: custom defaultOpenTunnel func
-	l.defaultOpenTunnel = defaultOpenTunnel(l.sessionManager, l.tunnelManager)
 
 	// run keepalive
 	go func() {
 		if err := l.keepalive(); err != nil {
-			l.log.Errorf("link %d: keepalive failed: %s", l.ID, err)
+			l.log.Errorf("keepalive failed: %s", err)
 		}
-		l.log.Debugf("link %d: stop keepalive", l.ID)
+		l.log.Debugf("stop keepalive")
 	}()
 
-	l.log.Debug("create link success")
+	l.log.Debugf("create link success")
 	return l
 }
 
@@ -145,7 +200,7 @@ func (l *Link) IsClosed() bool {
 // Close is used to close the link
 func (l *Link) Close() error {
 	if l.IsClosed() {
-		l.log.Warn("link is closed already")
+		l.log.Warnf("link is closed already")
 		return nil
 	}
 
@@ -153,10 +208,13 @@ func (l *Link) Close() error {
 	close(l.shutdownCh)
 	l.shutdownLock.Unlock()
 
-	close(l.outbound)
+	l.outbound.Close()
 	// TODO: close sessions & tunnles
 	l.tunnelManager.Close()
 	l.sessionManager.Close()
+	if l.config.Registry != nil {
+		l.config.Registry.remove(l)
+	}
 	return nil
 }
 
@@ -173,7 +231,7 @@ func (l *Link) IsStopped() bool {
 // Stop close the current transaction underlying conn
 func (l *Link) Stop() error {
 	if l.IsStopped() {
-		l.log.Warn("link is stopped already")
+		l.log.Warnf("link is stopped already")
 		return nil
 	}
 
@@ -199,14 +257,21 @@ func (l *Link) Ping() (time.Duration, error) {
 	// Send the ping request
 	payload := make([]byte, 4)
 	binary.LittleEndian.PutUint32(payload, id)
-	l.outbound <- append([]byte{es.LinkMsgTypePingRequest}, payload...)
+	if err := l.outbound.PushControl(append([]byte{es.LinkMsgTypePingRequest}, payload...)); err != nil {
+		l.pingLock.Lock()
+		delete(l.pings, id)
+		l.pingLock.Unlock()
+		return 0, ErrLinkShutdown
+	}
 
 	// Wait for a response
 	start := time.Now()
 	select {
 	case <-ch:
 		// Compute the RTT
-		return time.Now().Sub(start), nil
+		rtt := time.Now().Sub(start)
+		atomic.StoreInt64(&l.rtt, int64(rtt))
+		return rtt, nil
 	case <-time.After(l.config.ConnectionWriteTimeout):
 		l.pingLock.Lock()
 		delete(l.pings, id) // Ignore it if a response comes later.
@@ -220,10 +285,10 @@ func (l *Link) Ping() (time.Duration, error) {
 // keepalive is a long running goroutine that periodically does
 // a ping to keep the connection alive.
 func (l *Link) keepalive() error {
-	l.log.WithFields(logrus.Fields{
+	l.log.WithFields(logger.Fields{
 		"interval":    l.config.KeepaliveInterval,
 		"max_timeout": l.config.ConnectionWriteTimeout,
-	}).Debug("start keepalive")
+	}).Debugf("start keepalive")
 	interval := defaultInterval
 	for {
 		select {
@@ -233,19 +298,19 @@ func (l *Link) keepalive() error {
 				interval = defaultInterval
 				rtt, err := l.Ping()
 				if err != nil {
-					l.log.WithFields(logrus.Fields{
+					l.log.WithFields(logger.Fields{
 						"error": err,
 						"idle":  idle,
-					}).Warn("ping failed")
+					}).Warnf("ping failed")
 					if idle > maxLinkIdle {
-						l.log.WithFields(logrus.Fields{
+						l.log.WithFields(logger.Fields{
 							"idle": idle,
-						}).Error("max link idle reach, close the underlying net.Conn")
+						}).Errorf("max link idle reach, close the underlying net.Conn")
 						l.Stop() // notice the underlying loop
 					}
 					continue
 				}
-				l.log.WithField("rtt", rtt).Debug("ping success")
+				l.log.WithField("rtt", rtt).Debugf("ping success")
 			} else {
 				interval = l.config.KeepaliveInterval - idle
 			}
@@ -256,14 +321,14 @@ func (l *Link) keepalive() error {
 }
 
 func (l *Link) recv(conn es.Conn) error {
-	l.log.Debug("start underlying recv")
+	l.log.Debugf("start underlying recv")
 	for {
 		m, err := conn.Recv()
 		if err != nil {
 			if err != io.EOF && !strings.Contains(err.Error(), "closed") && !strings.Contains(err.Error(), "reset by peer") {
-				l.log.WithFields(logrus.Fields{
+				l.log.WithFields(logger.Fields{
 					"error": err,
-				}).Error("read failed")
+				}).Errorf("read failed")
 			}
 			// TODO: nil
 			return err
@@ -274,17 +339,24 @@ func (l *Link) recv(conn es.Conn) error {
 		mType, mData := m[0], m[1:]
 
 		// dispatch
+		// the tunnel and ping frames are not referenced after handled, return
+		// them to the buffer pool. the session payload may be kept by the
+		// waiting session, and the ping request is sent back as response.
 		switch mType {
 		case es.LinkMsgTypeSession:
 			err = l.sessionManager.HandleIn(mData)
 		case es.LinkMsgTypeTunnel:
 			err = l.tunnelManager.HandleIn(mData)
+			es.PutBuffer(m)
 		case es.LinkMsgTypePingRequest:
-			l.outbound <- append([]byte{es.LinkMsgTypePingResponse}, mData...)
+			// reply in place
+			m[0] = es.LinkMsgTypePingResponse
+			err = l.outbound.PushControl(m)
 		case es.LinkMsgTypePingResponse:
 			err = l.handlePing(mData)
+			es.PutBuffer(m)
 		default:
-			l.log.WithField("type", mType).Error("unknown message type")
+			l.log.WithField("type", mType).Errorf("unknown message type")
 			// TODO:
 			return errors.New("unknown message type")
 		}
@@ -296,25 +368,52 @@ func (l *Link) recv(conn es.Conn) error {
 }
 
 func (l *Link) send(conn es.Conn) error {
-	l.log.Debug("start underlying send")
+	l.log.Debugf("start underlying send")
+	bs, ok := conn.(es.BatchSender)
+	if !ok {
+		l.log.Debugf("conn does not support batch send")
+	}
+	batch := make([][]byte, 0, maxBatchMessages)
 	for {
-		select {
-		case m := <-l.outbound:
-			// FIXME!
-			if m == nil {
-				return errors.New("get nil from l.outbound")
-			}
-			err := conn.Send(m)
-			if err != nil {
-				l.log.WithField("error", err).Error("write data to conn failed")
-				return err
-			}
-		case <-l.stopCh:
-			l.log.Debug("got stop event, quit Link.send")
+		m, err := l.outbound.Pop(l.stopCh)
+		switch err {
+		case nil:
+		case es.ErrOutboundStopped:
+			l.log.Debugf("got stop event, quit Link.send")
 			return nil
-		case <-l.shutdownCh:
-			l.log.Debug("got shutdown event, quit Link.send")
+		case es.ErrOutboundClosed:
+			l.log.Debugf("got shutdown event, quit Link.send")
 			return nil
+		default:
+			return err
+		}
+
+		// the frames are owned by the link after queued, so they can be
+		// returned to the buffer pool after sent
+		if bs == nil {
+			err = conn.Send(m)
+			es.PutBuffer(m)
+		} else {
+			// coalesce the queued frames into one write
+			batch = append(batch[:0], m)
+			size := len(m)
+			for len(batch) < maxBatchMessages && size < maxBatchSize {
+				m = l.outbound.TryPop()
+				if m == nil {
+					break
+				}
+				batch = append(batch, m)
+				size += len(m)
+			}
+			err = bs.SendBatch(batch)
+			for i := range batch {
+				es.PutBuffer(batch[i])
+				batch[i] = nil
+			}
+		}
+		if err != nil {
+			l.log.WithField("error", err).Errorf("write data to conn failed")
+			return err
 		}
 	}
 }
@@ -324,19 +423,27 @@ func (l *Link) Bind(conn es.Conn) error {
 	l.wg = &sync.WaitGroup{}
 	l.stopCh = make(chan struct{}, 1)
 
+	// always decompress the received frames, the sending compression is
+	// enabled after negotiated
+	cc := newCompressConn(conn, l.config.CompressionThreshold, skipCompressFunc(l.tunnelManager.NoCompress))
+	conn = cc
+
+	if l.config.Registry != nil {
+		l.config.Registry.add(l)
+	}
+
+	l.wg.Add(2)
 	go func() {
-		l.wg.Add(1)
 		if err := l.recv(conn); err != nil {
-			l.log.WithField("error", err).Error("Link.recv quit")
+			l.log.WithField("error", err).Errorf("Link.recv quit")
 		}
 		// TODO: notice send
 		l.Stop()
 		l.wg.Done()
 	}()
 	go func() {
-		l.wg.Add(1)
 		if err := l.send(conn); err != nil {
-			l.log.WithField("error", err).Error("Link.send quit")
+			l.log.WithField("error", err).Errorf("Link.send quit")
 		}
 		// TODO: notice recv
 		conn.Close()
@@ -344,15 +451,49 @@ func (l *Link) Bind(conn es.Conn) error {
 	}()
 
 	l.Ping() // TODO: wait ping success
+
+	if l.config.Compression != "" {
+		if err := l.negotiateCompression(l.config.Compression); err != nil {
+			l.log.WithField("error", err).Warnf("negotiate compression failed, send frames without compression")
+		} else {
+			cc.Enable()
+			l.log.WithField("method", l.config.Compression).Debugf("enable compression")
+		}
+	}
+
+	if l.config.Name != "" || len(l.config.Labels) > 0 {
+		if err := l.hello(); err != nil {
+			l.log.WithField("error", err).Warnf("register in the remote endpoint failed")
+		}
+	}
 	return nil
 }
 
+// negotiateCompression ask the remote endpoint whether it can decompress the
+// frames compressed by method, it gives up after ConnectionWriteTimeout, such
+// as the remote endpoint doesn't answer
+func (l *Link) negotiateCompression(method string) error {
+	s, err := l.sessionManager.New()
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(compressionBody{Method: method})
+	resp, err := s.SendAndWaitTimeout(&session.Request{
+		Action: "/link/compression",
+		Body:   body,
+	}, l.config.ConnectionWriteTimeout)
+	if err != nil {
+		return err
+	}
+	return resp.Err()
+}
+
 func (l *Link) Wait() {
 	l.wg.Wait()
 	l.wg = nil
 	l.Stop()
 	l.stopCh = nil
-	l.log.Debug("wait completed")
+	l.log.Debugf("wait completed")
 }
 
 // handlePing is invokde for a LinkMsgTypePing frame
@@ -388,7 +529,25 @@ func (l *Link) recvIdlenessTime() time.Duration {
 	return d
 }
 
-// OpenTunnel open a tunnel
-func (l *Link) OpenTunnel(proto string, localHost string, localPort int, remoteHost string, remotePort int, reverse bool) error {
-	return l.defaultOpenTunnel(proto, localHost, localPort, remoteHost, remotePort, reverse)
+// RTT get the last RTT measured by Ping or keepalive, 0 means unknown
+func (l *Link) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&l.rtt))
+}
+
+// Tunnels get the tunnels of the link
+func (l *Link) Tunnels() []*tunnel.Tunnel {
+	return l.tunnelManager.Tunnels()
+}
+
+// Sessions get the count of the sessions of the link
+func (l *Link) Sessions() int {
+	return l.sessionManager.Len()
+}
+
+// CloseTunnel close the tunnel opened by OpenTunnel in both endpoints
+func (l *Link) CloseTunnel(id uint32) error {
+	if err := l.tunnelManager.TunnelClose(id); err != nil {
+		return err
+	}
+	return closeRemoteTunnel(l.sessionManager, id)
 }
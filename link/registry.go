@@ -0,0 +1,255 @@
+package link
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ooclab/es/session"
+)
+
+// EventType is the type of registry event
+type EventType int
+
+// registry event types
+const (
+	// EventConnect is sent after the link is bound
+	EventConnect EventType = iota + 1
+
+	// EventRegister is sent after the remote endpoint registered its name
+	// and labels
+	EventRegister
+
+	// EventDisconnect is sent after the link is closed
+	EventDisconnect
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnect:
+		return "connect"
+	case EventRegister:
+		return "register"
+	case EventDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// Event is a change of the links in registry
+type Event struct {
+	Type EventType
+	Link *Link
+}
+
+// Registry keep the links of a server: it assigns the unique link IDs, and
+// the clients register their names and labels in the handshake (see
+// LinkConfig.Name). Set it in LinkConfig.Registry of the server links.
+type Registry struct {
+	lock     sync.Mutex
+	nextID   uint32
+	links    map[uint32]*Link
+	names    map[string]*Link
+	watchers []func(Event)
+}
+
+// NewRegistry create a Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		nextID: 1,
+		links:  make(map[uint32]*Link),
+		names:  make(map[string]*Link),
+	}
+}
+
+// Subscribe add fn to receive the events, fn is called in the goroutine
+// changing the link, it should not block
+func (r *Registry) Subscribe(fn func(Event)) {
+	r.lock.Lock()
+	r.watchers = append(r.watchers, fn)
+	r.lock.Unlock()
+}
+
+func (r *Registry) notify(t EventType, l *Link) {
+	r.lock.Lock()
+	watchers := r.watchers
+	r.lock.Unlock()
+	for _, fn := range watchers {
+		fn(Event{Type: t, Link: l})
+	}
+}
+
+// newID allocate the ID of a new link
+func (r *Registry) newID() uint32 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for {
+		id := r.nextID
+		r.nextID++
+		if _, exist := r.links[id]; id != 0 && !exist {
+			return id
+		}
+	}
+}
+
+func (r *Registry) add(l *Link) {
+	r.lock.Lock()
+	r.links[l.ID] = l
+	r.lock.Unlock()
+	l.log.Debugf("registry: connect")
+	r.notify(EventConnect, l)
+}
+
+// register bind name to the link, the previous link of name is replaced,
+// such as the client reconnected before the broken link is detected
+func (r *Registry) register(l *Link, name string, labels map[string]string) {
+	l.infoLock.Lock()
+	oldName := l.name
+	l.name = name
+	l.labels = labels
+	l.infoLock.Unlock()
+
+	r.lock.Lock()
+	if r.links[l.ID] != l {
+		// closed already
+		r.lock.Unlock()
+		return
+	}
+	if oldName != "" && r.names[oldName] == l {
+		delete(r.names, oldName)
+	}
+	if name != "" {
+		if old := r.names[name]; old != nil && old != l {
+			l.log.Warnf("registry: name %s is registered by link %d already, replace it", name, old.ID)
+		}
+		r.names[name] = l
+	}
+	r.lock.Unlock()
+	l.log.WithField("name", name).Infof("registry: register")
+	r.notify(EventRegister, l)
+}
+
+func (r *Registry) remove(l *Link) {
+	r.lock.Lock()
+	if r.links[l.ID] != l {
+		r.lock.Unlock()
+		return
+	}
+	delete(r.links, l.ID)
+	if name := l.Name(); name != "" && r.names[name] == l {
+		delete(r.names, name)
+	}
+	r.lock.Unlock()
+	l.log.Debugf("registry: disconnect")
+	r.notify(EventDisconnect, l)
+}
+
+// Get get the link by ID
+func (r *Registry) Get(id uint32) *Link {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.links[id]
+}
+
+// Lookup get the link registered by name
+func (r *Registry) Lookup(name string) *Link {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.names[name]
+}
+
+// Select get the links which have all the labels, ordered by ID
+func (r *Registry) Select(labels map[string]string) []*Link {
+	var links []*Link
+	for _, l := range r.All() {
+		if l.HasLabels(labels) {
+			links = append(links, l)
+		}
+	}
+	return links
+}
+
+// All get all links ordered by ID
+func (r *Registry) All() []*Link {
+	r.lock.Lock()
+	links := make([]*Link, 0, len(r.links))
+	for _, l := range r.links {
+		links = append(links, l)
+	}
+	r.lock.Unlock()
+	sort.Slice(links, func(i, j int) bool { return links[i].ID < links[j].ID })
+	return links
+}
+
+// Len get the count of links
+func (r *Registry) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.links)
+}
+
+// Name get the name registered by the remote endpoint
+func (l *Link) Name() string {
+	l.infoLock.Lock()
+	defer l.infoLock.Unlock()
+	return l.name
+}
+
+// Labels get a copy of the labels registered by the remote endpoint
+func (l *Link) Labels() map[string]string {
+	l.infoLock.Lock()
+	defer l.infoLock.Unlock()
+	labels := make(map[string]string, len(l.labels))
+	for k, v := range l.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// HasLabels check whether the link has all the labels
+func (l *Link) HasLabels(labels map[string]string) bool {
+	l.infoLock.Lock()
+	defer l.infoLock.Unlock()
+	for k, v := range labels {
+		if lv, ok := l.labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// hello register the name and labels of this endpoint in the remote
+// endpoint, the remote endpoint without registry ignores it. It gives up
+// after ConnectionWriteTimeout.
+func (l *Link) hello() error {
+	s, err := l.sessionManager.New()
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(helloBody{Name: l.config.Name, Labels: l.config.Labels})
+	resp, err := s.SendAndWaitTimeout(&session.Request{
+		Action: "/link/hello",
+		Body:   body,
+	}, l.config.ConnectionWriteTimeout)
+	if err != nil {
+		return err
+	}
+	if err := resp.Err(); err != nil {
+		return fmt.Errorf("register in the remote endpoint failed: %w", err)
+	}
+	return nil
+}
+
+func helloHandler(l *Link) session.RequestHandlerFunc {
+	return func(r *session.Request) (*session.Response, error) {
+		body := helloBody{}
+		if err := json.Unmarshal(r.Body, &body); err != nil {
+			return session.ErrorResponse("load-hello-error", badRequest(err)), nil
+		}
+		if l.config.Registry != nil {
+			l.config.Registry.register(l, body.Name, body.Labels)
+		}
+		return &session.Response{Status: "success"}, nil
+	}
+}
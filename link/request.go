@@ -1,67 +1,146 @@
 package link
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 
+	"github.com/ooclab/es/logger"
 	"github.com/ooclab/es/session"
 	"github.com/ooclab/es/tunnel"
-	"github.com/sirupsen/logrus"
 )
 
-func defaultOpenTunnel(sessionManager *session.Manager, tunnelManager *tunnel.Manager) OpenTunnelFunc {
-	return func(proto string, localHost string, localPort int, remoteHost string, remotePort int, reverse bool) error {
-		// send open tunnel message to remote endpoint
-		cfg := &tunnel.TunnelConfig{
-			LocalHost:  localHost,
-			LocalPort:  localPort,
-			RemoteHost: remoteHost,
-			RemotePort: remotePort,
-			Reverse:    reverse,
-			Proto:      proto,
-		}
+// openTunnel create the tunnel in the remote endpoint, and then in the local
+// side, timeout bounds the cleanup after ctx is done, see requestTunnel
+func openTunnel(ctx context.Context, timeout time.Duration, log logger.Logger, sessionManager *session.Manager, tunnelManager *tunnel.Manager, cfg *tunnel.TunnelConfig) (*tunnel.Tunnel, error) {
+	created, err := requestTunnel(ctx, timeout, log, sessionManager, cfg.RemoteConfig())
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Reverse && cfg.RemotePort == 0 {
+		// the remote endpoint bound an ephemeral port
+		cfg.RemotePort = created.Port
+	}
+
+	// success: open tunnel at local endpoint
+	log.WithField("config", cfg).Debugf("open tunnel in the remote endpoint success")
 
-		body, _ := json.Marshal(cfg.RemoteConfig())
-		s, err := sessionManager.New()
-		if err != nil {
-			logrus.WithField("error", err).Error("open session failed")
-			return err
+	cfg.ID = created.ID
+	t, err := tunnelManager.TunnelCreate(cfg)
+	if err != nil {
+		log.Errorf("open tunnel in the local side failed: %s", err)
+		if err := closeRemoteTunnel(sessionManager, cfg.ID); err != nil {
+			log.WithField("tunnel_id", cfg.ID).Warnf("close tunnel in the remote endpoint failed: %s", err)
 		}
+		return nil, fmt.Errorf("open tunnel in the local side failed: %w", err)
+	}
+
+	log.WithField("tunnel_id", t.ID).Debugf("open tunnel %s in the local side success", t)
 
+	return t, nil
+}
+
+// requestTunnel create the tunnel in the remote endpoint, remoteCfg is in
+// the view of the remote endpoint, and return the tunnel ID and bound port.
+// If ctx is done first, the response is still waited in background for
+// timeout to close the tunnel created after all.
+func requestTunnel(ctx context.Context, timeout time.Duration, log logger.Logger, sessionManager *session.Manager, remoteCfg *tunnel.TunnelConfig) (*tunnelCreateBody, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// send open tunnel message to remote endpoint
+	body, _ := json.Marshal(remoteCfg)
+	s, err := sessionManager.New()
+	if err != nil {
+		log.WithField("error", err).Errorf("open session failed")
+		return nil, err
+	}
+
+	type result struct {
+		resp *session.Response
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
 		resp, err := s.SendAndWait(&session.Request{
 			Action: "/tunnel",
 			Body:   body,
 		})
-		if err != nil {
-			logrus.WithField("error", err).Error("send request to remote endpoint failed")
-			return err
-		}
-
-		// fmt.Println("resp: ", resp)
-		if resp.Status != "success" {
-			logrus.WithField("error", err).Error("open tunnel in the remote endpoint failed")
-			return errors.New("open tunnel in the remote endpoint failed")
-		}
+		ch <- result{resp, err}
+	}()
 
-		tcBody := tunnelCreateBody{}
-		if err = json.Unmarshal(resp.Body, &tcBody); err != nil {
-			logrus.WithField("error", err).Error("json unmarshal body failed")
-			return errors.New("json unmarshal body error")
-		}
+	var r result
+	select {
+	case r = <-ch:
+	case <-ctx.Done():
+		// the remote endpoint may create the tunnel after all, close it.
+		// the wait ends by the timeout or the link shutdown, which closes
+		// the session
+		go func() {
+			t := time.NewTimer(timeout)
+			defer t.Stop()
+			var r result
+			select {
+			case r = <-ch:
+			case <-t.C:
+				s.Close()
+				log.Warnf("no response of the cancelled tunnel in %s, give up closing it", timeout)
+				return
+			}
+			if r.err != nil {
+				return
+			}
+			if created, err := tunnelCreated(log, r.resp); err == nil {
+				if err := closeRemoteTunnel(sessionManager, created.ID); err != nil {
+					log.WithField("tunnel_id", created.ID).Warnf("close the cancelled tunnel in the remote endpoint failed: %s", err)
+				}
+			}
+		}()
+		return nil, ctx.Err()
+	}
 
-		// success: open tunnel at local endpoint
-		logrus.WithField("config", cfg).Debug("open tunnel in the remote endpoint success")
+	if r.err != nil {
+		log.WithField("error", r.err).Errorf("send request to remote endpoint failed")
+		return nil, r.err
+	}
+	return tunnelCreated(log, r.resp)
+}
 
-		cfg.ID = tcBody.ID
-		t, err := tunnelManager.TunnelCreate(cfg)
-		if err != nil {
-			logrus.Errorf("open tunnel in the local side failed: %s", err)
-			// TODO: close the tunnel in remote endpoint
-			return errors.New("open tunnel in the local side failed")
-		}
+// tunnelCreated get the tunnel ID and bound port from the response of
+// tunnel create
+func tunnelCreated(log logger.Logger, resp *session.Response) (*tunnelCreateBody, error) {
+	if err := resp.Err(); err != nil {
+		log.WithField("error", err).Errorf("open tunnel in the remote endpoint failed")
+		return nil, fmt.Errorf("open tunnel in the remote endpoint failed: %w", err)
+	}
 
-		logrus.WithField("tunnel", t).Debug("open tunnel in the local side success")
+	tcBody := tunnelCreateBody{}
+	if err := json.Unmarshal(resp.Body, &tcBody); err != nil {
+		log.WithField("error", err).Errorf("json unmarshal body failed")
+		return nil, errors.New("json unmarshal body error")
+	}
+	return &tcBody, nil
+}
 
-		return nil
+// closeRemoteTunnel ask the remote endpoint to close the tunnel
+func closeRemoteTunnel(sessionManager *session.Manager, id uint32) error {
+	s, err := sessionManager.New()
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(tunnelCloseBody{ID: id})
+	resp, err := s.SendAndWait(&session.Request{
+		Action: "/tunnel/close",
+		Body:   body,
+	})
+	if err != nil {
+		return err
+	}
+	if err := resp.Err(); err != nil {
+		return fmt.Errorf("close tunnel in the remote endpoint failed: %w", err)
 	}
+	return nil
 }
@@ -0,0 +1,41 @@
+package link
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es"
+)
+
+func Test_OpenTunnel_CancelCleanup(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	// the peer reads the frames but never answers
+	go io.Copy(io.Discard, peer)
+
+	l := NewLink(&LinkConfig{ConnectionWriteTimeout: 100 * time.Millisecond})
+	defer l.Close()
+	if err := l.Bind(es.NewBaseConn(conn)); err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := l.OpenTunnel(ctx, TunnelOptions{BindHost: "127.0.0.1", DialHost: "127.0.0.1", DialPort: 12345})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	// the wait of the response is given up after the timeout
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("got %d goroutines, want %d, the cancelled request is still waiting", n, before)
+	}
+}
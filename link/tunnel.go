@@ -0,0 +1,146 @@
+package link
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/ooclab/es/tunnel"
+	"github.com/ooclab/es/tunnel/channel"
+)
+
+// ErrTunnelOptionsInvalid is returned by OpenTunnel for the invalid options
+var ErrTunnelOptionsInvalid = errors.New("invalid tunnel options")
+
+// TunnelOptions is the options of OpenTunnel. The tunnel listens on the bind
+// address in this endpoint, and the remote endpoint dials the dial address
+// for every accepted conn. Reverse swaps the endpoints.
+type TunnelOptions struct {
+	// Proto is "tcp" (default) or "udp"
+	Proto string
+
+	// BindPort 0 binds an ephemeral port, get it by TunnelHandle.BindAddr
+	BindHost string
+	BindPort int
+	DialHost string
+	DialPort int
+	Reverse  bool
+
+	// Peer is the client at the far end if the server is a hub
+	Peer string
+
+	// Weight and NoCompress, see tunnel.TunnelConfig
+	Weight     int
+	NoCompress bool
+
+	// RateLimit is the bytes per second of each direction, 0 means no limit
+	RateLimit int64
+
+	// IdleTimeout close the channel if no data is transferred, 0 means never
+	IdleTimeout time.Duration
+
+	// Labels is the metadata of the tunnel, it's sent to the remote endpoint
+	Labels map[string]string
+}
+
+// config get the tunnel config in the view of this endpoint
+func (o *TunnelOptions) config() (*tunnel.TunnelConfig, error) {
+	cfg := &tunnel.TunnelConfig{
+		Proto:       o.Proto,
+		LocalHost:   o.BindHost,
+		LocalPort:   o.BindPort,
+		RemoteHost:  o.DialHost,
+		RemotePort:  o.DialPort,
+		Reverse:     o.Reverse,
+		Peer:        o.Peer,
+		Weight:      o.Weight,
+		NoCompress:  o.NoCompress,
+		RateLimit:   o.RateLimit,
+		IdleTimeout: o.IdleTimeout,
+		Labels:      o.Labels,
+	}
+	if cfg.Proto == "" {
+		cfg.Proto = "tcp"
+	}
+	if o.Reverse {
+		cfg.LocalHost, cfg.LocalPort, cfg.RemoteHost, cfg.RemotePort = o.DialHost, o.DialPort, o.BindHost, o.BindPort
+	}
+
+	switch {
+	case cfg.Proto != "tcp" && cfg.Proto != "udp":
+		return nil, fmt.Errorf("%w: proto %q", ErrTunnelOptionsInvalid, cfg.Proto)
+	case o.BindPort < 0 || o.BindPort > 65535:
+		return nil, fmt.Errorf("%w: bind port %d", ErrTunnelOptionsInvalid, o.BindPort)
+	case o.DialPort <= 0 || o.DialPort > 65535:
+		return nil, fmt.Errorf("%w: dial port %d", ErrTunnelOptionsInvalid, o.DialPort)
+	case o.RateLimit < 0 || o.IdleTimeout < 0 || o.Weight < 0:
+		return nil, ErrTunnelOptionsInvalid
+	}
+	return cfg, nil
+}
+
+// TunnelHandle is a tunnel opened by OpenTunnel
+type TunnelHandle struct {
+	link   *Link
+	tunnel *tunnel.Tunnel
+}
+
+// ID get the tunnel ID, it's same in both endpoints
+func (h *TunnelHandle) ID() uint32 {
+	return h.tunnel.ID
+}
+
+// Config get the tunnel config in the view of this endpoint
+func (h *TunnelHandle) Config() *tunnel.TunnelConfig {
+	return h.tunnel.Config
+}
+
+// BindAddr get the address the tunnel listens on, in this endpoint or the
+// remote endpoint if reverse, the port is the bound one for BindPort 0
+func (h *TunnelHandle) BindAddr() string {
+	cfg := h.tunnel.Config
+	if cfg.Reverse {
+		return net.JoinHostPort(cfg.RemoteHost, strconv.Itoa(cfg.RemotePort))
+	}
+	return net.JoinHostPort(cfg.LocalHost, strconv.Itoa(cfg.LocalPort))
+}
+
+// Stats get the byte counters of the tunnel in this endpoint
+func (h *TunnelHandle) Stats() channel.Stats {
+	return h.tunnel.Stats()
+}
+
+// Done is closed after the tunnel is closed, by Close, the remote endpoint
+// or the link
+func (h *TunnelHandle) Done() <-chan struct{} {
+	return h.tunnel.Done()
+}
+
+// Close close the tunnel in both endpoints, it's a no-op if the tunnel is
+// closed already
+func (h *TunnelHandle) Close() error {
+	select {
+	case <-h.tunnel.Done():
+		return nil
+	default:
+	}
+	return h.link.CloseTunnel(h.tunnel.ID)
+}
+
+// OpenTunnel open a tunnel in both endpoints, ctx bounds the wait of the
+// remote endpoint. The errors of the remote endpoint match the sentinels by
+// errors.Is, such as tunnel.ErrPortInUse and policy.ErrDenied.
+func (l *Link) OpenTunnel(ctx context.Context, opts TunnelOptions) (*TunnelHandle, error) {
+	cfg, err := opts.config()
+	if err != nil {
+		return nil, err
+	}
+	t, err := openTunnel(ctx, l.config.ConnectionWriteTimeout, l.log, l.sessionManager, l.tunnelManager, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &TunnelHandle{link: l, tunnel: t}, nil
+}
@@ -1,10 +1,21 @@
 package link
 
-// may be other default request func
-
-// OpenTunnelFunc define a func about open tunnel
-type OpenTunnelFunc func(proto string, localHost string, localPort int, remoteHost string, remotePort int, reverse bool) error
-
 type tunnelCreateBody struct {
 	ID uint32
+	// Port is the port bound by the remote endpoint when it listens, it
+	// reports the ephemeral port of the requested port 0
+	Port int `json:",omitempty"`
+}
+
+type tunnelCloseBody struct {
+	ID uint32
+}
+
+type helloBody struct {
+	Name   string
+	Labels map[string]string
+}
+
+type compressionBody struct {
+	Method string
 }
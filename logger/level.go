@@ -0,0 +1,99 @@
+package logger
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrLevelInvalid is returned for a level name other than debug, info, warn
+// and error
+var ErrLevelInvalid = errors.New("invalid log level")
+
+// Level is the level of a Logger changed at runtime, by the names debug,
+// info, warn and error
+type Level interface {
+	Get() string
+	Set(name string) error
+}
+
+// ParseLevel check name and return its canonical form, "warning" is "warn"
+func ParseLevel(name string) (string, error) {
+	switch name {
+	case "debug", "info", "warn", "error":
+		return name, nil
+	case "warning":
+		return "warn", nil
+	}
+	return "", ErrLevelInvalid
+}
+
+// DefaultLevel get the level of the default logger
+func DefaultLevel() Level {
+	return NewLogrusLevel(logrus.StandardLogger())
+}
+
+type logrusLevel struct {
+	l *logrus.Logger
+}
+
+// NewLogrusLevel create a Level of l
+func NewLogrusLevel(l *logrus.Logger) Level {
+	return logrusLevel{l: l}
+}
+
+func (v logrusLevel) Get() string {
+	switch level := v.l.GetLevel(); {
+	case level >= logrus.DebugLevel:
+		return "debug"
+	case level == logrus.InfoLevel:
+		return "info"
+	case level == logrus.WarnLevel:
+		return "warn"
+	}
+	return "error"
+}
+
+func (v logrusLevel) Set(name string) error {
+	name, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level, _ := logrus.ParseLevel(name)
+	v.l.SetLevel(level)
+	return nil
+}
+
+type slogLevel struct {
+	v *slog.LevelVar
+}
+
+// NewSlogLevel create a Level of v, the handler of the slog.Logger passed to
+// NewSlog must use v as its level
+func NewSlogLevel(v *slog.LevelVar) Level {
+	return slogLevel{v: v}
+}
+
+func (v slogLevel) Get() string {
+	switch level := v.v.Level(); {
+	case level < slog.LevelInfo:
+		return "debug"
+	case level < slog.LevelWarn:
+		return "info"
+	case level < slog.LevelError:
+		return "warn"
+	}
+	return "error"
+}
+
+func (v slogLevel) Set(name string) error {
+	name, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	var level slog.Level
+	level.UnmarshalText([]byte(name))
+	v.v.Set(level)
+	return nil
+}
@@ -0,0 +1,48 @@
+// Package logger define the structured logger used by es, so the embedding
+// applications can route or silence the logs (see link.LinkConfig.Logger).
+//
+// The fields of es logs are consistent: link_id, tunnel_id, channel_id and
+// session_id.
+package logger
+
+import "github.com/sirupsen/logrus"
+
+// Fields is the key-value pairs attached to the logs
+type Fields map[string]interface{}
+
+// Logger is the structured logger, WithField and WithFields return a new
+// Logger with the fields attached, the receiver is not changed
+type Logger interface {
+	WithField(key string, value interface{}) Logger
+	WithFields(fields Fields) Logger
+
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Default get the logger used if none is set: the standard logger of logrus
+func Default() Logger {
+	return NewLogrus(logrus.StandardLogger())
+}
+
+// OrDefault return l, or the default logger if l is nil
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return Default()
+	}
+	return l
+}
+
+// Discard is the Logger drops all logs
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (d discard) WithField(key string, value interface{}) Logger { return d }
+func (d discard) WithFields(fields Fields) Logger                { return d }
+func (discard) Debugf(format string, args ...interface{})        {}
+func (discard) Infof(format string, args ...interface{})         {}
+func (discard) Warnf(format string, args ...interface{})         {}
+func (discard) Errorf(format string, args ...interface{})        {}
@@ -0,0 +1,96 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lines decode the JSON logs in buf
+func lines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var result []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		m := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("decode %q failed: %s", line, err)
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+func check(t *testing.T, log Logger, buf *bytes.Buffer, msgKey, levelKey string) {
+	log.Debugf("hidden %d", 1)
+	l := log.WithField("link_id", 1).WithFields(Fields{"tunnel_id": 2, "channel_id": 3})
+	l.Infof("open channel %d", 3)
+	log.Errorf("no fields")
+
+	got := lines(t, buf)
+	if len(got) != 2 {
+		t.Fatalf("got %d logs, want 2: %s", len(got), buf)
+	}
+	if got[0][msgKey] != "open channel 3" {
+		t.Errorf("got message %v", got[0][msgKey])
+	}
+	if !strings.EqualFold(got[0][levelKey].(string), "info") {
+		t.Errorf("got level %v", got[0][levelKey])
+	}
+	for k, v := range map[string]float64{"link_id": 1, "tunnel_id": 2, "channel_id": 3} {
+		if got[0][k] != v {
+			t.Errorf("got %s = %v, want %v", k, got[0][k], v)
+		}
+	}
+	if _, ok := got[1]["link_id"]; ok {
+		t.Error("WithField changed the parent logger")
+	}
+}
+
+func Test_Logrus(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logrus.New()
+	l.Out = buf
+	l.Formatter = &logrus.JSONFormatter{}
+	l.Level = logrus.InfoLevel
+	check(t, NewLogrus(l), buf, "msg", "level")
+}
+
+func Test_Slog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	check(t, NewSlog(l), buf, "msg", "level")
+}
+
+func Test_Discard(t *testing.T) {
+	l := Discard.WithField("link_id", 1).WithFields(Fields{"tunnel_id": 2})
+	l.Errorf("dropped")
+	if OrDefault(nil) == nil || OrDefault(Discard) != Discard {
+		t.Error("OrDefault is wrong")
+	}
+}
+
+func Test_Level(t *testing.T) {
+	v := &slog.LevelVar{}
+	for _, level := range []Level{NewLogrusLevel(logrus.New()), NewSlogLevel(v)} {
+		for name, want := range map[string]string{"debug": "debug", "warning": "warn", "error": "error", "info": "info"} {
+			if err := level.Set(name); err != nil {
+				t.Fatal(err)
+			}
+			if got := level.Get(); got != want {
+				t.Errorf("%T: got %q after set %q, want %q", level, got, name, want)
+			}
+		}
+		if err := level.Set("loud"); err != ErrLevelInvalid {
+			t.Errorf("%T: got %v, want ErrLevelInvalid", level, err)
+		}
+	}
+	if NewSlogLevel(v).Set("warn"); v.Level() != slog.LevelWarn {
+		t.Errorf("got slog level %s", v.Level())
+	}
+}
@@ -0,0 +1,37 @@
+package logger
+
+import "github.com/sirupsen/logrus"
+
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+// NewLogrus create a Logger writes to l, such as a *logrus.Logger or
+// *logrus.Entry
+func NewLogrus(l logrus.FieldLogger) Logger {
+	return &logrusLogger{l: l}
+}
+
+func (l *logrusLogger) WithField(key string, value interface{}) Logger {
+	return &logrusLogger{l: l.l.WithField(key, value)}
+}
+
+func (l *logrusLogger) WithFields(fields Fields) Logger {
+	return &logrusLogger{l: l.l.WithFields(logrus.Fields(fields))}
+}
+
+func (l *logrusLogger) Debugf(format string, args ...interface{}) {
+	l.l.Debugf(format, args...)
+}
+
+func (l *logrusLogger) Infof(format string, args ...interface{}) {
+	l.l.Infof(format, args...)
+}
+
+func (l *logrusLogger) Warnf(format string, args ...interface{}) {
+	l.l.Warnf(format, args...)
+}
+
+func (l *logrusLogger) Errorf(format string, args ...interface{}) {
+	l.l.Errorf(format, args...)
+}
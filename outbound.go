@@ -0,0 +1,245 @@
+package es
+
+import (
+	"errors"
+	"sync"
+)
+
+// frame priority in the Outbound queue, the smaller is sent first
+const (
+	PriorityControl = iota
+	PrioritySession
+	PriorityTunnel
+)
+
+const (
+	defaultControlQueueSize = 64
+	defaultSessionQueueSize = 64
+	defaultFlowQueueSize    = 4
+	defaultTunnelWeight     = 1
+)
+
+// outbound error define
+var (
+	ErrOutboundClosed  = errors.New("outbound queue is closed")
+	ErrOutboundStopped = errors.New("outbound queue wait is stopped")
+)
+
+// flow is the frame queue of a single tunnel channel
+type flow struct {
+	key    uint64
+	tid    uint32
+	frames [][]byte
+	credit int // frames can be sent before moving to the end of ring
+}
+
+// Outbound is the prioritized frame queue between a link and its
+// underlying Conn.
+//
+// Control frames (ping) are always sent before session frames, and session
+// frames are always sent before tunnel frames, so a keepalive never waits
+// behind bulk forwarding data. Tunnel frames are queued by channel and sent
+// in weighted round-robin: a channel of a tunnel with weight N sends up to
+// N frames in a round.
+type Outbound struct {
+	lock    sync.Mutex
+	cond    *sync.Cond // wake up the blocked pushers
+	ready   chan struct{}
+	closeCh chan struct{}
+	closed  bool
+
+	control [][]byte
+	session [][]byte
+
+	flows   map[uint64]*flow
+	ring    []*flow // the flows have frames, ring[0] is the current one
+	weights map[uint32]int
+}
+
+// NewOutbound create a Outbound queue
+func NewOutbound() *Outbound {
+	o := &Outbound{
+		ready:   make(chan struct{}, 1),
+		closeCh: make(chan struct{}),
+		flows:   make(map[uint64]*flow),
+		weights: make(map[uint32]int),
+	}
+	o.cond = sync.NewCond(&o.lock)
+	return o
+}
+
+func flowKey(tid, cid uint32) uint64 {
+	return uint64(tid)<<32 | uint64(cid)
+}
+
+func (o *Outbound) notify() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// PushControl queue a link control frame, such as ping
+func (o *Outbound) PushControl(m []byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for !o.closed && len(o.control) >= defaultControlQueueSize {
+		o.cond.Wait()
+	}
+	if o.closed {
+		return ErrOutboundClosed
+	}
+	o.control = append(o.control, m)
+	o.notify()
+	return nil
+}
+
+// PushSession queue a session frame
+func (o *Outbound) PushSession(m []byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for !o.closed && len(o.session) >= defaultSessionQueueSize {
+		o.cond.Wait()
+	}
+	if o.closed {
+		return ErrOutboundClosed
+	}
+	o.session = append(o.session, m)
+	o.notify()
+	return nil
+}
+
+// PushTunnel queue a tunnel frame of the channel (tid, cid), it blocks if
+// the queue of this channel is full.
+func (o *Outbound) PushTunnel(tid, cid uint32, m []byte) error {
+	key := flowKey(tid, cid)
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for {
+		if o.closed {
+			return ErrOutboundClosed
+		}
+		f := o.flows[key]
+		if f == nil {
+			f = &flow{key: key, tid: tid, credit: o.weight(tid)}
+			o.flows[key] = f
+			o.ring = append(o.ring, f)
+		}
+		if len(f.frames) < defaultFlowQueueSize {
+			f.frames = append(f.frames, m)
+			o.notify()
+			return nil
+		}
+		o.cond.Wait()
+	}
+}
+
+// SetTunnelWeight set the round-robin weight of all channels in tunnel tid,
+// weight <= 0 reset it to default.
+func (o *Outbound) SetTunnelWeight(tid uint32, weight int) {
+	o.lock.Lock()
+	if weight <= 0 {
+		delete(o.weights, tid)
+	} else {
+		o.weights[tid] = weight
+	}
+	o.lock.Unlock()
+}
+
+func (o *Outbound) weight(tid uint32) int {
+	if w, ok := o.weights[tid]; ok {
+		return w
+	}
+	return defaultTunnelWeight
+}
+
+// next get the next frame should be sent, the caller must hold o.lock
+func (o *Outbound) next() (m []byte) {
+	switch {
+	case len(o.control) > 0:
+		m = o.control[0]
+		o.control[0] = nil
+		o.control = o.control[1:]
+	case len(o.session) > 0:
+		m = o.session[0]
+		o.session[0] = nil
+		o.session = o.session[1:]
+	case len(o.ring) > 0:
+		f := o.ring[0]
+		m = f.frames[0]
+		f.frames[0] = nil
+		f.frames = f.frames[1:]
+		f.credit--
+		if len(f.frames) == 0 {
+			// empty flow is removed, it will be added again by next push
+			o.ring[0] = nil
+			o.ring = o.ring[1:]
+			delete(o.flows, f.key)
+		} else if f.credit <= 0 {
+			f.credit = o.weight(f.tid)
+			o.ring[0] = nil
+			o.ring = append(o.ring[1:], f)
+		}
+	default:
+		return nil
+	}
+	o.cond.Broadcast()
+	return m
+}
+
+// Pop get the next frame by priority, it blocks until a frame is queued,
+// stop is closed (ErrOutboundStopped) or the queue is closed
+// (ErrOutboundClosed).
+func (o *Outbound) Pop(stop <-chan struct{}) ([]byte, error) {
+	for {
+		o.lock.Lock()
+		closed := o.closed
+		var m []byte
+		if !closed {
+			m = o.next()
+		}
+		o.lock.Unlock()
+
+		if closed {
+			return nil, ErrOutboundClosed
+		}
+		if m != nil {
+			return m, nil
+		}
+
+		select {
+		case <-o.ready:
+		case <-o.closeCh:
+		case <-stop:
+			return nil, ErrOutboundStopped
+		}
+	}
+}
+
+// TryPop get the next frame by priority without blocking, it returns nil if
+// the queue is empty or closed
+func (o *Outbound) TryPop() []byte {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		return nil
+	}
+	return o.next()
+}
+
+// Close close the queue, the blocked Push and Pop return ErrOutboundClosed
+func (o *Outbound) Close() {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.control = nil
+	o.session = nil
+	o.flows = make(map[uint64]*flow)
+	o.ring = nil
+	close(o.closeCh)
+	o.cond.Broadcast()
+}
@@ -0,0 +1,72 @@
+package es
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_OutboundPriority(t *testing.T) {
+	o := NewOutbound()
+	o.PushTunnel(1, 1, []byte("tunnel"))
+	o.PushSession([]byte("session"))
+	o.PushControl([]byte("control"))
+
+	for _, want := range []string{"control", "session", "tunnel"} {
+		m, err := o.Pop(nil)
+		if err != nil {
+			t.Fatalf("Pop failed: %s", err)
+		}
+		if string(m) != want {
+			t.Errorf("Pop got %q, want %q", m, want)
+		}
+	}
+}
+
+func Test_OutboundRoundRobin(t *testing.T) {
+	o := NewOutbound()
+	o.SetTunnelWeight(3, 2)
+	for i := 0; i < 4; i++ {
+		o.PushTunnel(1, 1, []byte("a"))
+		o.PushTunnel(1, 2, []byte("b"))
+		o.PushTunnel(3, 1, []byte("c"))
+	}
+
+	got := ""
+	for i := 0; i < 12; i++ {
+		m, _ := o.Pop(nil)
+		got += string(m)
+	}
+	if want := "abccabccabab"; got != want {
+		t.Errorf("Pop order is %s, want %s", got, want)
+	}
+}
+
+func Test_OutboundStopAndClose(t *testing.T) {
+	o := NewOutbound()
+
+	stop := make(chan struct{})
+	close(stop)
+	if _, err := o.Pop(stop); err != ErrOutboundStopped {
+		t.Errorf("Pop with stop got %v, want %v", err, ErrOutboundStopped)
+	}
+
+	// the fifth push of a channel is blocked until Close
+	for i := 0; i < defaultFlowQueueSize; i++ {
+		o.PushTunnel(1, 1, []byte("a"))
+	}
+	done := make(chan error)
+	go func() { done <- o.PushTunnel(1, 1, []byte("a")) }()
+	select {
+	case err := <-done:
+		t.Fatalf("PushTunnel is not blocked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	o.Close()
+	if err := <-done; err != ErrOutboundClosed {
+		t.Errorf("blocked PushTunnel got %v, want %v", err, ErrOutboundClosed)
+	}
+	if _, err := o.Pop(nil); err != ErrOutboundClosed {
+		t.Errorf("Pop after close got %v, want %v", err, ErrOutboundClosed)
+	}
+}
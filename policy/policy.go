@@ -0,0 +1,312 @@
+// Package policy decide whether the tunnel requested by the remote endpoint
+// can be created: the bind addresses, the dial destinations, the protocols
+// and the max tunnels per link/identity.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ooclab/es/tunnel"
+)
+
+// ErrDenied is wrapped by all the denials, the message is the reason
+var ErrDenied = errors.New("policy denied")
+
+// Policy is the rules of tunnel creation, the empty lists and the zero
+// limits mean no restriction
+type Policy struct {
+	// Protos is the allowed protocols, such as "tcp"
+	Protos []string `json:"protos"`
+
+	// Binds is the addresses we can listen on for the remote endpoint
+	Binds []Rule `json:"binds"`
+
+	// Destinations is the addresses we can dial for the remote endpoint
+	Destinations []Rule `json:"destinations"`
+
+	MaxTunnelsPerLink     int `json:"max_tunnels_per_link"`
+	MaxTunnelsPerIdentity int `json:"max_tunnels_per_identity"`
+}
+
+// Rule match a host and port
+type Rule struct {
+	// Host is "*" (any host), a CIDR such as "10.0.0.0/8", an IP, or a
+	// hostname pattern such as "*.example.com". The hostname matches a
+	// CIDR/IP rule if all its resolved addresses match, and the tunnel
+	// dials only these addresses.
+	Host string `json:"host"`
+
+	// Ports is the port range, empty means any port
+	Ports PortRange `json:"ports"`
+}
+
+// PortRange is a range of ports, such as "8000-9000" or "80" in JSON
+type PortRange struct {
+	Min int
+	Max int
+}
+
+// ParsePortRange parse "8000-9000" or "80"
+func ParsePortRange(s string) (PortRange, error) {
+	var r PortRange
+	var err error
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	if r.Min, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return r, fmt.Errorf("invalid port range %q", s)
+	}
+	if r.Max, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+		return r, fmt.Errorf("invalid port range %q", s)
+	}
+	if r.Min < 0 || r.Max > 65535 || r.Min > r.Max {
+		return r, fmt.Errorf("invalid port range %q", s)
+	}
+	return r, nil
+}
+
+func (r *PortRange) UnmarshalJSON(b []byte) error {
+	var port int
+	if err := json.Unmarshal(b, &port); err == nil {
+		*r = PortRange{port, port}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("want a port range, such as \"8000-9000\"")
+	}
+	if s == "" {
+		*r = PortRange{}
+		return nil
+	}
+	v, err := ParsePortRange(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+func (r PortRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		if r.Min == 0 {
+			return ""
+		}
+		return strconv.Itoa(r.Min)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// Contains check the port, the zero range contains all ports
+func (r PortRange) Contains(port int) bool {
+	if r.Min == 0 && r.Max == 0 {
+		return true
+	}
+	return port >= r.Min && port <= r.Max
+}
+
+// lookupFunc resolve the hostname for the CIDR/IP rules
+type lookupFunc func(host string) ([]net.IP, error)
+
+// addr get the CIDR or IP of the rule, both are nil if the host is "*" or a
+// hostname pattern
+func (rule *Rule) addr() (*net.IPNet, net.IP) {
+	if rule.Host == "*" {
+		return nil, nil
+	}
+	if _, ruleNet, err := net.ParseCIDR(rule.Host); err == nil {
+		return ruleNet, nil
+	}
+	return nil, net.ParseIP(rule.Host)
+}
+
+func (rule *Rule) match(host string, port int, lookup lookupFunc, resolved *[]net.IP) bool {
+	if !rule.Ports.Contains(port) {
+		return false
+	}
+	if rule.Host == "*" {
+		return true
+	}
+
+	ruleNet, ruleIP := rule.addr()
+	if ruleNet == nil && ruleIP == nil {
+		// hostname pattern
+		ok, _ := path.Match(strings.ToLower(rule.Host), strings.ToLower(host))
+		return ok
+	}
+
+	ips := *resolved
+	if ips == nil {
+		var err error
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else if ips, err = lookup(host); err != nil || len(ips) == 0 {
+			return false
+		}
+		*resolved = ips
+	}
+	for _, ip := range ips {
+		if ruleNet != nil && !ruleNet.Contains(ip) {
+			return false
+		}
+		if ruleIP != nil && !ruleIP.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRules check host:port by the rules, and return the resolved addresses
+// of host if they are matched by a CIDR/IP rule
+func matchRules(rules []Rule, host string, port int, lookup lookupFunc) (ok bool, pinned []net.IP) {
+	if len(rules) == 0 {
+		return true, nil
+	}
+	var resolved []net.IP
+	for i := range rules {
+		if !rules[i].match(host, port, lookup, &resolved) {
+			continue
+		}
+		if ruleNet, ruleIP := rules[i].addr(); ruleNet != nil || ruleIP != nil {
+			return true, resolved
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Check check the tunnel config by the rules, the cfg is in the view of this
+// endpoint: it listens on the local address of a forward tunnel, and dials
+// the local address of a reverse one. The addresses of a hostname checked by
+// the CIDR/IP destination rules are pinned in cfg.PinnedIPs, so the name is
+// not resolved again when dialing.
+func (p *Policy) Check(cfg *tunnel.TunnelConfig) error {
+	return p.check(cfg, lookupIP)
+}
+
+func lookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+func (p *Policy) check(cfg *tunnel.TunnelConfig, lookup lookupFunc) error {
+	if len(p.Protos) > 0 {
+		allowed := false
+		for _, proto := range p.Protos {
+			if strings.EqualFold(proto, cfg.Proto) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%w: protocol %s is not allowed", ErrDenied, cfg.Proto)
+		}
+	}
+
+	host := cfg.LocalHost
+	addr := net.JoinHostPort(host, strconv.Itoa(cfg.LocalPort))
+	cfg.PinnedIPs = nil
+	if cfg.Reverse {
+		ok, pinned := matchRules(p.Destinations, host, cfg.LocalPort, lookup)
+		if !ok {
+			return fmt.Errorf("%w: destination %s is not allowed", ErrDenied, addr)
+		}
+		cfg.PinnedIPs = pinned
+		return nil
+	}
+
+	if host == "" {
+		// listen on all interfaces
+		host = "0.0.0.0"
+	}
+	if ok, _ := matchRules(p.Binds, host, cfg.LocalPort, lookup); !ok {
+		return fmt.Errorf("%w: bind %s is not allowed", ErrDenied, addr)
+	}
+	return nil
+}
+
+// Engine enforce the policy on the links, it counts the tunnels per identity
+type Engine struct {
+	policy *Policy
+	lookup lookupFunc
+
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+// NewEngine create a Engine
+func NewEngine(p *Policy) *Engine {
+	return &Engine{
+		policy: p,
+		lookup: lookupIP,
+		counts: make(map[string]int),
+	}
+}
+
+// Guard create the Guard of a link, identity is the peer identity shared by
+// its links, such as the remote IP
+func (e *Engine) Guard(identity string) *Guard {
+	return &Guard{engine: e, identity: identity}
+}
+
+// Guard enforce the policy on one link
+type Guard struct {
+	engine   *Engine
+	identity string
+
+	lock  sync.Mutex
+	count int
+}
+
+// Allow check the tunnel config and count it in, release must be called
+// after the allowed tunnel is closed
+func (g *Guard) Allow(cfg *tunnel.TunnelConfig) (release func(), err error) {
+	e := g.engine
+	p := e.policy
+	if err := p.check(cfg, e.lookup); err != nil {
+		return nil, err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if p.MaxTunnelsPerLink > 0 && g.count >= p.MaxTunnelsPerLink {
+		return nil, fmt.Errorf("%w: max %d tunnels per link", ErrDenied, p.MaxTunnelsPerLink)
+	}
+	e.lock.Lock()
+	if p.MaxTunnelsPerIdentity > 0 && e.counts[g.identity] >= p.MaxTunnelsPerIdentity {
+		e.lock.Unlock()
+		return nil, fmt.Errorf("%w: max %d tunnels per identity", ErrDenied, p.MaxTunnelsPerIdentity)
+	}
+	e.counts[g.identity]++
+	e.lock.Unlock()
+	g.count++
+
+	var once sync.Once
+	return func() {
+		once.Do(g.release)
+	}, nil
+}
+
+func (g *Guard) release() {
+	g.lock.Lock()
+	g.count--
+	g.lock.Unlock()
+
+	e := g.engine
+	e.lock.Lock()
+	if e.counts[g.identity]--; e.counts[g.identity] <= 0 {
+		delete(e.counts, g.identity)
+	}
+	e.lock.Unlock()
+}
@@ -0,0 +1,149 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ooclab/es/tunnel"
+)
+
+func fakeLookup(host string) ([]net.IP, error) {
+	switch host {
+	case "intranet.example.com":
+		return []net.IP{net.ParseIP("10.0.0.8")}, nil
+	case "mixed.example.com":
+		return []net.IP{net.ParseIP("10.0.0.9"), net.ParseIP("8.8.8.8")}, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func Test_PortRange(t *testing.T) {
+	var rule Rule
+	if err := json.Unmarshal([]byte(`{"host": "*", "ports": "8000-9000"}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	if rule.Ports != (PortRange{8000, 9000}) || !rule.Ports.Contains(8000) || rule.Ports.Contains(9001) {
+		t.Errorf("wrong port range %+v", rule.Ports)
+	}
+	if err := json.Unmarshal([]byte(`{"ports": 22}`), &rule); err != nil || rule.Ports != (PortRange{22, 22}) {
+		t.Errorf("got %+v, %v", rule.Ports, err)
+	}
+	for _, s := range []string{"a", "9000-8000", "1-70000", "-1"} {
+		if _, err := ParsePortRange(s); err == nil {
+			t.Errorf("parse %q: no error", s)
+		}
+	}
+	if !(PortRange{}).Contains(1) {
+		t.Error("the zero range should contain all ports")
+	}
+}
+
+func Test_Policy_Check(t *testing.T) {
+	p := &Policy{
+		Protos: []string{"tcp"},
+		Binds: []Rule{
+			{Host: "127.0.0.1", Ports: PortRange{10000, 20000}},
+			{Host: "0.0.0.0", Ports: PortRange{8080, 8080}},
+		},
+		Destinations: []Rule{
+			{Host: "10.0.0.0/8"},
+			{Host: "*.public.example.com", Ports: PortRange{443, 443}},
+		},
+	}
+	cases := []struct {
+		cfg   tunnel.TunnelConfig
+		allow bool
+	}{
+		// bind
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 10080}, true},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 22}, false},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "", LocalPort: 8080}, true},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "", LocalPort: 10080}, false},
+		{tunnel.TunnelConfig{Proto: "udp", LocalHost: "127.0.0.1", LocalPort: 10080}, false},
+		// destination
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "10.1.2.3", LocalPort: 22, Reverse: true}, true},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "192.168.1.1", LocalPort: 22, Reverse: true}, false},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "intranet.example.com", LocalPort: 80, Reverse: true}, true},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "mixed.example.com", LocalPort: 80, Reverse: true}, false},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "unknown.example.com", LocalPort: 80, Reverse: true}, false},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "www.public.example.com", LocalPort: 443, Reverse: true}, true},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "WWW.Public.Example.com", LocalPort: 443, Reverse: true}, true},
+		{tunnel.TunnelConfig{Proto: "tcp", LocalHost: "www.public.example.com", LocalPort: 80, Reverse: true}, false},
+	}
+	for _, c := range cases {
+		err := p.check(&c.cfg, fakeLookup)
+		if c.allow && err != nil {
+			t.Errorf("%s: denied: %s", &c.cfg, err)
+		}
+		if !c.allow && !errors.Is(err, ErrDenied) {
+			t.Errorf("%s: got %v, want ErrDenied", &c.cfg, err)
+		}
+	}
+
+	if err := (&Policy{}).check(&cases[1].cfg, fakeLookup); err != nil {
+		t.Errorf("the empty policy denied: %s", err)
+	}
+}
+
+func Test_Policy_PinnedIPs(t *testing.T) {
+	p := &Policy{Destinations: []Rule{{Host: "10.0.0.0/8"}, {Host: "*.public.example.com"}}}
+
+	// the checked addresses are dialed, a rebinding of the name is ignored
+	cfg := &tunnel.TunnelConfig{Proto: "tcp", LocalHost: "intranet.example.com", LocalPort: 80, Reverse: true}
+	if err := p.check(cfg, fakeLookup); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.PinnedIPs) != 1 || !cfg.PinnedIPs[0].Equal(net.ParseIP("10.0.0.8")) {
+		t.Errorf("got pinned IPs %v, want 10.0.0.8", cfg.PinnedIPs)
+	}
+
+	// the name allowed by a hostname pattern is not pinned, and the pinned
+	// IPs of the request are cleared
+	cfg = &tunnel.TunnelConfig{Proto: "tcp", LocalHost: "www.public.example.com", LocalPort: 80, Reverse: true,
+		PinnedIPs: []net.IP{net.ParseIP("10.0.0.1")}}
+	if err := p.check(cfg, fakeLookup); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PinnedIPs != nil {
+		t.Errorf("got pinned IPs %v, want none", cfg.PinnedIPs)
+	}
+}
+
+func Test_Guard_Limits(t *testing.T) {
+	e := NewEngine(&Policy{MaxTunnelsPerLink: 2, MaxTunnelsPerIdentity: 3})
+	cfg := &tunnel.TunnelConfig{Proto: "tcp", LocalHost: "127.0.0.1", LocalPort: 10080}
+
+	g1, g2 := e.Guard("1.2.3.4"), e.Guard("1.2.3.4")
+	r1, err := g1.Allow(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g1.Allow(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g1.Allow(cfg); !errors.Is(err, ErrDenied) {
+		t.Fatalf("the 3rd tunnel of link: got %v, want ErrDenied", err)
+	}
+	if _, err := g2.Allow(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g2.Allow(cfg); !errors.Is(err, ErrDenied) {
+		t.Fatalf("the 4th tunnel of identity: got %v, want ErrDenied", err)
+	}
+	// other identity is not limited
+	if _, err := e.Guard("5.6.7.8").Allow(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// release twice is harmless
+	r1()
+	r1()
+	if _, err := g2.Allow(cfg); err != nil {
+		t.Fatalf("allow after release: %s", err)
+	}
+	if _, err := g2.Allow(cfg); !errors.Is(err, ErrDenied) {
+		t.Fatalf("got %v, want ErrDenied", err)
+	}
+}
@@ -0,0 +1,107 @@
+package udp
+
+import (
+	"time"
+
+	"github.com/ooclab/es/logger"
+)
+
+// Config is the configuration of a socket and its connections
+type Config struct {
+	// CongestionControl is the congestion control algorithm of the
+	// connections, CongestionCubic (default) or CongestionBBR
+	CongestionControl string
+
+	// PSK is the optional pre-shared key, it's mixed in the keys of
+	// handshake, so only the endpoints own it can connect. Without PSK the
+	// connection is encrypted but the server is not authenticated.
+	PSK []byte
+
+	// IdleTimeout is the time a connection is closed if nothing is received
+	// from remote endpoint, default is 30s. The client ping the server in
+	// every IdleTimeout/3 at most to keep alive.
+	IdleTimeout time.Duration
+
+	// MaxConns is the max connections of a server socket, the handshake of
+	// new client is ignored if it's reached. 0 means unlimited
+	MaxConns int
+
+	// FECData and FECParity enable the forward error correction, FECParity
+	// parity segments are sent after every FECData segments, so any
+	// FECParity lost segments of the group are recovered without
+	// retransmission. The client propose them in handshake, they are used
+	// only if the server enable FEC too. 0 means disabled
+	FECData   int
+	FECParity int
+
+	// Logger receive the logs of the socket and its connections (with the
+	// conn_id field), nil means logger.Default()
+	Logger logger.Logger
+}
+
+// withDefaults return a copy of config with the default values filled
+func (c *Config) withDefaults() *Config {
+	cfg := Config{}
+	if c != nil {
+		cfg = *c
+	}
+	if cfg.CongestionControl == "" {
+		cfg.CongestionControl = CongestionCubic
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultConnTimeout
+	}
+	cfg.Logger = logger.OrDefault(cfg.Logger)
+	return &cfg
+}
+
+func (c *Config) check() error {
+	switch c.CongestionControl {
+	case CongestionCubic, CongestionBBR:
+	default:
+		return ErrCongestionUnknown
+	}
+	if c.IdleTimeout < 0 || c.MaxConns < 0 {
+		return ErrConfigInvalid
+	}
+	if (c.FECData != 0 || c.FECParity != 0) && newReedSolomon(c.FECData, c.FECParity) == nil {
+		return ErrConfigInvalid
+	}
+	return nil
+}
+
+// handshakeOptions get the options proposed by client
+func (c *Config) handshakeOptions() handshakeOptions {
+	o := handshakeOptions{}
+	if c.FECData > 0 {
+		o[optionFEC] = []byte{uint8(c.FECData), uint8(c.FECParity)}
+	}
+	return o
+}
+
+// negotiate get the options used by both sides from the client proposal
+func (c *Config) negotiate(proposal handshakeOptions) handshakeOptions {
+	o := handshakeOptions{}
+	if fec, ok := proposal[optionFEC]; ok && c.FECData > 0 && len(fec) == 2 {
+		if newReedSolomon(int(fec[0]), int(fec[1])) != nil {
+			o[optionFEC] = fec
+		}
+	}
+	return o
+}
+
+// pingInterval is the interval of client ping to keep alive
+func (c *Config) pingInterval() time.Duration {
+	if d := c.IdleTimeout / 3; d < defaultPingInterval {
+		return d
+	}
+	return defaultPingInterval
+}
+
+// gcInterval is the interval of checking the idle connections
+func (c *Config) gcInterval() time.Duration {
+	if d := c.IdleTimeout / 2; d < defaultGCInterval {
+		return d
+	}
+	return defaultGCInterval
+}
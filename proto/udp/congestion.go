@@ -0,0 +1,334 @@
+package udp
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// congestion control algorithm
+const (
+	// CongestionCubic is a CUBIC like AIMD algorithm, the window grows by a
+	// cubic function of the time since the last loss and shrinks on loss
+	CongestionCubic = "cubic"
+
+	// CongestionBBR is a BBR like algorithm, the window follows the
+	// estimated bottleneck bandwidth * min RTT, and loss is not a signal
+	CongestionBBR = "bbr"
+)
+
+// congestionController decide the send window (segments can be sent in a
+// round trip) of a Conn
+type congestionController interface {
+	// Window get the current send window in segments
+	Window() int
+	// OnAck is called when segments are known to be received, rtt is the
+	// round trip time of the query
+	OnAck(acked int, rtt time.Duration)
+	// OnLoss is called when segments are known to be lost
+	OnLoss(lost int)
+	// OnRTT is called with the RTT sample of ping
+	OnRTT(rtt time.Duration)
+}
+
+func newCongestionController(name string) congestionController {
+	switch name {
+	case CongestionBBR:
+		return newBBRController()
+	default:
+		return newCubicController()
+	}
+}
+
+func clampWindow(w float64) int {
+	if w < minSendWindowSize {
+		return minSendWindowSize
+	}
+	if w > maxSendWindowSize {
+		return maxSendWindowSize
+	}
+	return int(w)
+}
+
+// rttEstimator compute the retransmission timeout as RFC 6298
+type rttEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	lock   sync.Mutex
+}
+
+func (e *rttEstimator) Update(rtt time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.srtt == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		return
+	}
+	delta := e.srtt - rtt
+	if delta < 0 {
+		delta = -delta
+	}
+	e.rttvar = (3*e.rttvar + delta) / 4
+	e.srtt = (7*e.srtt + rtt) / 8
+}
+
+// SRTT get the smoothed RTT, 0 means no sample yet
+func (e *rttEstimator) SRTT() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.srtt
+}
+
+// RTO get the retransmission timeout
+func (e *rttEstimator) RTO() time.Duration {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.srtt == 0 {
+		return maxTimeout * time.Millisecond
+	}
+	rto := e.srtt + 4*e.rttvar
+	if rto < defaultTimeout*time.Millisecond {
+		return defaultTimeout * time.Millisecond
+	}
+	if rto > maxTimeout*time.Millisecond {
+		return maxTimeout * time.Millisecond
+	}
+	return rto
+}
+
+const (
+	cubicC    = 0.4
+	cubicBeta = 0.7
+)
+
+// cubicController is the CUBIC like controller, see RFC 8312
+type cubicController struct {
+	cwnd       float64
+	ssthresh   float64
+	wMax       float64
+	k          float64
+	epochStart time.Time
+	lastReduce time.Time
+	srtt       time.Duration
+	lock       sync.Mutex
+}
+
+func newCubicController() *cubicController {
+	return &cubicController{
+		cwnd:     defaultSendWindowSize,
+		ssthresh: maxSendWindowSize,
+	}
+}
+
+func (c *cubicController) Window() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return clampWindow(c.cwnd)
+}
+
+func (c *cubicController) OnAck(acked int, rtt time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updateRTT(rtt)
+
+	if c.cwnd < c.ssthresh {
+		// slow start
+		c.cwnd += float64(acked)
+		return
+	}
+
+	now := time.Now()
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		if c.wMax < c.cwnd {
+			c.wMax = c.cwnd
+		}
+		c.k = math.Cbrt(c.wMax * (1 - cubicBeta) / cubicC)
+	}
+	t := now.Sub(c.epochStart).Seconds()
+	target := cubicC*math.Pow(t-c.k, 3) + c.wMax
+
+	// be friendly to the standard AIMD in the short RTT network
+	if c.srtt > 0 {
+		aimd := c.wMax*cubicBeta + 3*(1-cubicBeta)/(1+cubicBeta)*t/c.srtt.Seconds()
+		if aimd > target {
+			target = aimd
+		}
+	}
+	if target > c.cwnd {
+		c.cwnd += math.Min(target-c.cwnd, float64(acked))
+	}
+	if c.cwnd > maxSendWindowSize {
+		c.cwnd = maxSendWindowSize
+	}
+}
+
+func (c *cubicController) OnLoss(lost int) {
+	if lost <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// reduce the window once in a round trip
+	now := time.Now()
+	if now.Sub(c.lastReduce) < c.srtt {
+		return
+	}
+	c.lastReduce = now
+	c.wMax = c.cwnd
+	c.cwnd *= cubicBeta
+	if c.cwnd < minSendWindowSize {
+		c.cwnd = minSendWindowSize
+	}
+	c.ssthresh = c.cwnd
+	c.epochStart = time.Time{}
+}
+
+func (c *cubicController) OnRTT(rtt time.Duration) {
+	c.lock.Lock()
+	c.updateRTT(rtt)
+	c.lock.Unlock()
+}
+
+func (c *cubicController) updateRTT(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+}
+
+const (
+	bbrStartupGain   = 2.89
+	bbrCwndGain      = 2
+	bbrBwSamples     = 10
+	bbrMinRTTWindow  = 10 * time.Second
+	bbrStartupRounds = 3 // the rounds without bandwidth growth to quit startup
+)
+
+var bbrProbeGains = []float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+const (
+	bbrStateStartup = iota
+	bbrStateDrain
+	bbrStateProbeBW
+)
+
+// bbrController is the BBR like controller, the window is
+// gain * bottleneck bandwidth * min RTT
+type bbrController struct {
+	state int
+
+	samples  [bbrBwSamples]float64 // delivery rate samples (segments/s)
+	sampleID int
+	btlBw    float64
+
+	minRTT      time.Duration
+	minRTTStamp time.Time
+
+	roundStart     time.Time
+	roundDelivered int
+	fullBw         float64
+	fullBwCount    int
+	cycle          int
+
+	lock sync.Mutex
+}
+
+func newBBRController() *bbrController {
+	return &bbrController{}
+}
+
+func (c *bbrController) Window() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.btlBw == 0 || c.minRTT == 0 {
+		return defaultSendWindowSize
+	}
+	bdp := c.btlBw * c.minRTT.Seconds()
+	switch c.state {
+	case bbrStateStartup:
+		return clampWindow(bbrStartupGain * bdp)
+	case bbrStateDrain:
+		return clampWindow(bdp / bbrStartupGain * bbrCwndGain)
+	default:
+		return clampWindow(bbrProbeGains[c.cycle] * bbrCwndGain * bdp)
+	}
+}
+
+func (c *bbrController) OnAck(acked int, rtt time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.updateMinRTT(rtt)
+
+	// a delivery rate sample is taken in a round trip
+	now := time.Now()
+	if c.roundStart.IsZero() {
+		c.roundStart = now
+	}
+	c.roundDelivered += acked
+	round := c.minRTT
+	if rtt > round {
+		round = rtt
+	}
+	elapsed := now.Sub(c.roundStart)
+	if round == 0 || elapsed < round {
+		return
+	}
+	sample := float64(c.roundDelivered) / elapsed.Seconds()
+	c.roundStart = now
+	c.roundDelivered = 0
+
+	// windowed max of the delivery rate
+	c.samples[c.sampleID%bbrBwSamples] = sample
+	c.sampleID++
+	c.btlBw = 0
+	for _, v := range c.samples {
+		if v > c.btlBw {
+			c.btlBw = v
+		}
+	}
+
+	switch c.state {
+	case bbrStateStartup:
+		// quit startup if the bandwidth does not grow 25% in 3 rounds
+		if c.btlBw >= c.fullBw*1.25 {
+			c.fullBw = c.btlBw
+			c.fullBwCount = 0
+		} else if c.fullBwCount++; c.fullBwCount >= bbrStartupRounds {
+			c.state = bbrStateDrain
+		}
+	case bbrStateDrain:
+		c.state = bbrStateProbeBW
+		c.cycle = 0
+	default:
+		c.cycle = (c.cycle + 1) % len(bbrProbeGains)
+	}
+}
+
+func (c *bbrController) OnLoss(lost int) {
+	// loss is not a congestion signal of BBR
+}
+
+func (c *bbrController) OnRTT(rtt time.Duration) {
+	c.lock.Lock()
+	c.updateMinRTT(rtt)
+	c.lock.Unlock()
+}
+
+func (c *bbrController) updateMinRTT(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	now := time.Now()
+	if c.minRTT == 0 || rtt < c.minRTT || now.Sub(c.minRTTStamp) > bbrMinRTTWindow {
+		c.minRTT = rtt
+		c.minRTTStamp = now
+	}
+}
@@ -0,0 +1,103 @@
+package udp
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_cubicController(t *testing.T) {
+	c := newCubicController()
+	w := c.Window()
+	if w != defaultSendWindowSize {
+		t.Fatalf("initial window is %d, want %d", w, defaultSendWindowSize)
+	}
+
+	// slow start
+	c.OnAck(w, 10*time.Millisecond)
+	if c.Window() != 2*w {
+		t.Errorf("window after slow start round is %d, want %d", c.Window(), 2*w)
+	}
+
+	// multiplicative decrease, once in a round trip
+	w = c.Window()
+	c.OnLoss(10)
+	if c.Window() != int(float64(w)*cubicBeta) {
+		t.Errorf("window after loss is %d, want %d", c.Window(), int(float64(w)*cubicBeta))
+	}
+	reduced := c.Window()
+	c.OnLoss(10)
+	if c.Window() != reduced {
+		t.Errorf("window is reduced twice in a round trip")
+	}
+
+	// never go out of range
+	for i := 0; i < 100; i++ {
+		time.Sleep(time.Millisecond)
+		c.lastReduce = time.Time{}
+		c.OnLoss(1)
+	}
+	if c.Window() != minSendWindowSize {
+		t.Errorf("window is %d after many losses, want %d", c.Window(), minSendWindowSize)
+	}
+	for i := 0; i < 100; i++ {
+		c.OnAck(maxSendWindowSize, 10*time.Millisecond)
+	}
+	if c.Window() > maxSendWindowSize {
+		t.Errorf("window %d is larger than %d", c.Window(), maxSendWindowSize)
+	}
+}
+
+func Test_bbrController(t *testing.T) {
+	c := newBBRController()
+	if c.Window() != defaultSendWindowSize {
+		t.Fatalf("initial window is %d, want %d", c.Window(), defaultSendWindowSize)
+	}
+
+	// 100 segments in every 10ms round, the BDP is 100 segments
+	for i := 0; i < 20; i++ {
+		c.roundStart = time.Now().Add(-10 * time.Millisecond)
+		c.OnAck(100, 10*time.Millisecond)
+	}
+	if c.state != bbrStateProbeBW {
+		t.Errorf("state is %d, want probe bandwidth", c.state)
+	}
+	w := c.Window()
+	if w < 150 || w > 250 {
+		t.Errorf("window is %d, want about 2 * BDP", w)
+	}
+
+	// loss does not change the window
+	c.OnLoss(50)
+	if c.Window() != w {
+		t.Errorf("window is changed by loss")
+	}
+}
+
+func Test_rttEstimator(t *testing.T) {
+	var e rttEstimator
+	if e.RTO() != maxTimeout*time.Millisecond {
+		t.Errorf("RTO without samples is %s", e.RTO())
+	}
+	for i := 0; i < 10; i++ {
+		e.Update(time.Millisecond)
+	}
+	if e.RTO() != defaultTimeout*time.Millisecond {
+		t.Errorf("RTO is %s, want the min %dms", e.RTO(), defaultTimeout)
+	}
+	for i := 0; i < 10; i++ {
+		e.Update(200 * time.Millisecond)
+	}
+	if rto := e.RTO(); rto < 200*time.Millisecond || rto > maxTimeout*time.Millisecond {
+		t.Errorf("RTO is %s for 200ms RTT", rto)
+	}
+}
+
+func Test_Config(t *testing.T) {
+	cfg := (*Config)(nil).withDefaults()
+	if cfg.CongestionControl != CongestionCubic {
+		t.Errorf("default congestion control is %s", cfg.CongestionControl)
+	}
+	if err := (&Config{CongestionControl: "reno"}).withDefaults().check(); err != ErrCongestionUnknown {
+		t.Errorf("check unknown congestion control got %v", err)
+	}
+}
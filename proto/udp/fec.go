@@ -0,0 +1,337 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// forward error correction
+//
+// the data segments of a message are split into groups of FECData
+// segments, FECParity parity segments are sent after every group. Any
+// FECParity lost segments of a group can be recovered by the receiver
+// without retransmission. The parity is a Reed-Solomon erasure code over
+// GF(2^8), the coefficients are a Cauchy matrix, so any square sub matrix is
+// invertible.
+//
+// parity segment body:
+// | GroupStart(2) | DataCount(1) | ParityIndex(1) | LastLength(2) | Parity |
+const (
+	fecHeaderSize = 6
+	fecMaxShards  = 64 // data + parity in a group
+
+	// the data segment is smaller in FEC mode, so the parity with header
+	// is in a segment
+	fecSegmentBodyMaxSize = segmentBodyMaxSize - fecHeaderSize
+)
+
+var errParityInvalid = errors.New("invalid parity segment")
+
+var (
+	gfExp [510]byte
+	gfLog [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfInv get the inverse of a, a must not be 0
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd dst += c * src
+func gfMulAdd(dst []byte, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	lc := int(gfLog[c])
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= gfExp[lc+int(gfLog[s])]
+		}
+	}
+}
+
+// gfInvert invert the square matrix in place by Gauss-Jordan elimination
+func gfInvert(m [][]byte) bool {
+	n := len(m)
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if m[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		c := gfInv(m[col][col])
+		for j := 0; j < n; j++ {
+			m[col][j] = gfMul(m[col][j], c)
+			inv[col][j] = gfMul(inv[col][j], c)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			f := m[row][col]
+			gfMulAdd(m[row], m[col], f)
+			gfMulAdd(inv[row], inv[col], f)
+		}
+	}
+	copy(m, inv)
+	return true
+}
+
+// reedSolomon is the erasure code of data shards and parity shards
+type reedSolomon struct {
+	data   int
+	parity int
+}
+
+func newReedSolomon(data int, parity int) *reedSolomon {
+	if data <= 0 || parity <= 0 || data+parity > fecMaxShards {
+		return nil
+	}
+	return &reedSolomon{data: data, parity: parity}
+}
+
+// coef is the coefficient of data shard j in parity shard i
+func (r *reedSolomon) coef(i int, j int) byte {
+	return gfInv(byte(r.data+i) ^ byte(j))
+}
+
+// encode create the parity shards of size, the shorter data shard is padded
+// with zero. less than r.data shards is allowed for the last group
+func (r *reedSolomon) encode(shards [][]byte, size int) [][]byte {
+	parity := make([][]byte, r.parity)
+	for i := range parity {
+		parity[i] = make([]byte, size)
+		for j, shard := range shards {
+			gfMulAdd(parity[i], shard, r.coef(i, j))
+		}
+	}
+	return parity
+}
+
+// reconstruct fill the nil data shards by the parity shards, false is
+// returned if the parity shards are not enough. the recovered shards are
+// padded to the parity size
+func (r *reedSolomon) reconstruct(shards [][]byte, parity [][]byte) bool {
+	var missing, rows []int
+	for j, shard := range shards {
+		if shard == nil {
+			missing = append(missing, j)
+		}
+	}
+	if len(missing) == 0 {
+		return true
+	}
+	size := 0
+	for i, p := range parity {
+		if p != nil && len(rows) < len(missing) {
+			rows = append(rows, i)
+			size = len(p)
+		}
+	}
+	if len(rows) < len(missing) {
+		return false
+	}
+
+	// the parity minus the known data is the sum of the missing data
+	n := len(missing)
+	m := make([][]byte, n)
+	residual := make([][]byte, n)
+	for k, i := range rows {
+		m[k] = make([]byte, n)
+		for x, j := range missing {
+			m[k][x] = r.coef(i, j)
+		}
+		residual[k] = append([]byte{}, parity[i]...)
+		for j, shard := range shards {
+			if shard != nil {
+				gfMulAdd(residual[k], shard, r.coef(i, j))
+			}
+		}
+	}
+	if !gfInvert(m) {
+		return false
+	}
+	for x, j := range missing {
+		shard := make([]byte, size)
+		for k := range rows {
+			gfMulAdd(shard, residual[k], m[x][k])
+		}
+		shards[j] = shard
+	}
+	return true
+}
+
+// fecGroup is the segments received of a group
+type fecGroup struct {
+	count   int // the data segments, 0 if no parity is received
+	lastLen int // the length of the last data segment
+	data    [][]byte
+	parity  [][]byte
+	done    bool // all data segments are saved
+}
+
+func newParitySegment(hdr header, groupStart uint16, count int, index int, lastLen int, parity []byte) *segment {
+	b := make([]byte, fecHeaderSize, fecHeaderSize+len(parity))
+	binary.BigEndian.PutUint16(b[0:2], groupStart)
+	b[2] = uint8(count)
+	b[3] = uint8(index)
+	binary.BigEndian.PutUint16(b[4:6], uint16(lastLen))
+	b = append(b, parity...)
+	seg, _ := newSegment(segTypeMsgParity, hdr.Flags(), hdr.StreamID(), hdr.TransID(), 0, b)
+	return seg
+}
+
+func loadParity(b []byte) (groupStart uint16, count int, index int, lastLen int, parity []byte, err error) {
+	if len(b) <= fecHeaderSize {
+		err = errParityInvalid
+		return
+	}
+	groupStart = binary.BigEndian.Uint16(b[0:2])
+	count = int(b[2])
+	index = int(b[3])
+	lastLen = int(binary.BigEndian.Uint16(b[4:6]))
+	parity = b[fecHeaderSize:]
+	if count == 0 || lastLen == 0 || lastLen > len(parity) {
+		err = errParityInvalid
+	}
+	return
+}
+
+// ParitySegments create the parity segments of the group
+func (m *msgSending) ParitySegments(group int) []*segment {
+	total := int(m.segmentCount())
+	start := group * m.fec.data
+	end := start + m.fec.data
+	if end > total {
+		end = total
+	}
+	shards := make([][]byte, 0, end-start)
+	for i := start; i < end; i++ {
+		shards = append(shards, m.GetSegmentByOrderID(uint16(i)).b)
+	}
+	size := len(shards[0])
+	lastLen := len(shards[len(shards)-1])
+	hdr := m.GetSegmentByOrderID(uint16(start)).h
+
+	var segs []*segment
+	for i, p := range m.fec.encode(shards, size) {
+		segs = append(segs, newParitySegment(hdr, uint16(start), len(shards), i, lastLen, p))
+	}
+	return segs
+}
+
+// group get the group of the data segment
+func (m *msgRecving) group(orderID uint16) (uint16, *fecGroup) {
+	start := orderID - orderID%uint16(m.fec.data)
+	g := m.groups[start]
+	if g == nil {
+		g = &fecGroup{
+			data:   make([][]byte, m.fec.data),
+			parity: make([][]byte, m.fec.parity),
+		}
+		m.groups[start] = g
+	}
+	return start, g
+}
+
+// saveShard keep the data segment for recovering
+func (m *msgRecving) saveShard(seg *segment) {
+	_, g := m.group(seg.h.OrderID())
+	if g.done {
+		return
+	}
+	g.data[seg.h.OrderID()%uint16(m.fec.data)] = seg.b
+	count := g.count
+	if count == 0 {
+		count = m.fec.data
+	}
+	for _, b := range g.data[:count] {
+		if b == nil {
+			return
+		}
+	}
+	*g = fecGroup{done: true}
+}
+
+// SaveParity save the parity segment, the lost data segments of the group
+// are recovered if it's possible
+func (m *msgRecving) SaveParity(seg *segment) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.completed || m.fec == nil {
+		return nil, nil
+	}
+	groupStart, count, index, lastLen, parity, err := loadParity(seg.b)
+	if err != nil {
+		return nil, err
+	}
+	if int(groupStart)%m.fec.data != 0 || count > m.fec.data || index >= m.fec.parity {
+		return nil, errParityInvalid
+	}
+	start, g := m.group(groupStart)
+	if g.done || g.parity[index] != nil {
+		return nil, nil
+	}
+	g.count, g.lastLen = count, lastLen
+	g.parity[index] = parity
+	m.lastActive = time.Now()
+
+	shards := g.data[:count]
+	if !m.fec.reconstruct(shards, g.parity) {
+		return nil, nil
+	}
+	for j, shard := range shards {
+		orderID := start + uint16(j)
+		if _, ok := m.saved[orderID]; ok || orderID < m.nextID {
+			continue // it's received
+		}
+		if j == count-1 {
+			shard = shard[:lastLen]
+		} else {
+			shard = shard[:len(parity)]
+		}
+		hdr := header(make([]byte, headerSize))
+		hdr.encode(segTypeMsgTrans, seg.h.Flags(), seg.h.StreamID(), seg.h.TransID(), orderID, uint16(len(shard)))
+		if msg := m.save(&segment{h: hdr, b: shard}); msg != nil {
+			return msg, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,141 @@
+package udp
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func Test_gfInvert(t *testing.T) {
+	rs := newReedSolomon(4, 3)
+	m := make([][]byte, 3)
+	orig := make([][]byte, 3)
+	for i := range m {
+		m[i] = []byte{rs.coef(i, 0), rs.coef(i, 2), rs.coef(i, 3)}
+		orig[i] = append([]byte{}, m[i]...)
+	}
+	if !gfInvert(m) {
+		t.Fatal("Cauchy matrix is not invertible")
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			var v byte
+			for k := 0; k < 3; k++ {
+				v ^= gfMul(orig[i][k], m[k][j])
+			}
+			if (i == j && v != 1) || (i != j && v != 0) {
+				t.Fatalf("M * inv(M) is not identity at (%d, %d): %d", i, j, v)
+			}
+		}
+	}
+}
+
+func Test_reedSolomon(t *testing.T) {
+	rs := newReedSolomon(6, 3)
+	for _, count := range []int{1, 4, 6} { // the last group may be short
+		shards := make([][]byte, count)
+		for i := range shards {
+			shards[i] = make([]byte, 100)
+			rand.Read(shards[i])
+		}
+		shards[count-1] = shards[count-1][:37]
+		parity := rs.encode(shards, 100)
+
+		for lost := 1; lost <= 3 && lost <= count; lost++ {
+			received := make([][]byte, count)
+			copy(received, shards)
+			for _, i := range rand.Perm(count)[:lost] {
+				received[i] = nil
+			}
+			// use the parity from the last, the first ones are lost too
+			p := make([][]byte, 3)
+			copy(p[3-lost:], parity[3-lost:])
+			if !rs.reconstruct(received, p) {
+				t.Fatalf("reconstruct %d lost of %d failed", lost, count)
+			}
+			for i := range shards {
+				if !bytes.Equal(received[i][:len(shards[i])], shards[i]) {
+					t.Errorf("shard %d of %d is wrong after %d lost", i, count, lost)
+				}
+			}
+		}
+
+		received := make([][]byte, count)
+		if count > 1 && rs.reconstruct(received, [][]byte{parity[0], nil, nil}) {
+			t.Errorf("reconstruct without enough parity")
+		}
+	}
+	if newReedSolomon(0, 1) != nil || newReedSolomon(60, 10) != nil {
+		t.Errorf("invalid ratio is accepted")
+	}
+}
+
+func Test_msgRecving_FEC(t *testing.T) {
+	rs := newReedSolomon(4, 2)
+	for _, length := range []int{10, 4 * fecSegmentBodyMaxSize, 21*fecSegmentBodyMaxSize + 7} {
+		b := make([]byte, length)
+		rand.Read(b)
+		sending := newMsgSending(segTypeMsgTrans, 0, 0, 1, b)
+		sending.bodySize = fecSegmentBodyMaxSize
+		sending.fec = rs
+
+		recving := newMsgRecving()
+		recving.fec = rs
+		total := int(sending.segmentCount())
+		var msg []byte
+		for group := 0; group*rs.data < total; group++ {
+			// lose the first two segments of every group
+			for i := group*rs.data + 2; i < (group+1)*rs.data && i < total; i++ {
+				m, err := recving.Save(sending.GetSegmentByOrderID(uint16(i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				msg = append(msg, m...)
+			}
+			for _, seg := range sending.ParitySegments(group) {
+				seg, err := loadSegment(encodeSegment(protoVersion, seg.bytes()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				m, err := recving.SaveParity(seg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				msg = append(msg, m...)
+			}
+		}
+		if !recving.IsCompleted() || !bytes.Equal(msg, b) {
+			t.Errorf("message of %d bytes is not recovered", length)
+		}
+	}
+}
+
+func Test_Config_negotiate(t *testing.T) {
+	client := &Config{FECData: 8, FECParity: 2}
+	if o := (&Config{}).negotiate(client.handshakeOptions()); len(o) != 0 {
+		t.Errorf("server without FEC accept %v", o)
+	}
+	o := (&Config{FECData: 4, FECParity: 4}).negotiate(client.handshakeOptions())
+	if !bytes.Equal(o[optionFEC], []byte{8, 2}) {
+		t.Errorf("negotiated FEC is %v", o[optionFEC])
+	}
+	if err := (&Config{FECData: 8}).withDefaults().check(); err != ErrConfigInvalid {
+		t.Errorf("check FEC without parity got %v", err)
+	}
+}
+
+func Test_Conn_FEC(t *testing.T) {
+	client, server, closeFunc := newConnPair(t, &Config{FECData: 8, FECParity: 2})
+	defer closeFunc()
+	if client.fec == nil || server.fec == nil {
+		t.Fatal("FEC is not negotiated")
+	}
+	b := make([]byte, 100*1024)
+	rand.Read(b)
+	if err := client.Send(b); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := server.Recv(); err != nil || !bytes.Equal(m, b) {
+		t.Errorf("recv got %d bytes, %v", len(m), err)
+	}
+}
@@ -0,0 +1,341 @@
+package udp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// packet kind
+const (
+	packetInitial uint8 = 1 // client hello, may carry the cookie
+	packetRetry   uint8 = 2 // server ask client to send the initial with cookie
+	packetHello   uint8 = 3 // server hello, the connection is created
+	packetData    uint8 = 4 // a sealed segment
+)
+
+// packet
+// | Kind(1) | ConnID(8) | PacketNumber(8) | Body |
+//
+// initial body: | Version(1) | ClientPub(32) | CookieLen(1) | Cookie | Options |
+// retry body:   | Cookie |
+// hello body:   | ServerPub(32) | Sealed(Version(1) | Options) |
+// data body:    | Sealed(segment) |
+const (
+	packetHeaderSize = 17
+	packetKeySize    = 32
+	packetTagSize    = 16
+	packetOverhead   = packetHeaderSize + packetTagSize
+
+	cookieSize     = 8 + 16
+	cookieLifetime = 10 * time.Second
+
+	defaultHandshakeTimeout = 3 * time.Second
+	handshakeMaxRetry       = 3
+
+	replayWindowSize = 1024
+
+	keyDerivationLabel = "es udp handshake"
+)
+
+var (
+	errPacketInvalid   = errors.New("invalid packet")
+	errPacketReplayed  = errors.New("packet is replayed or too old")
+	errCookieInvalid   = errors.New("invalid cookie")
+	errHandshakeFailed = errors.New("handshake authentication failed")
+	errVersionMismatch = errors.New("protocol version is not supported")
+)
+
+// handshake options, the unknown option is ignored
+// | Type(1) | Length(1) | Value |
+type handshakeOptions map[uint8][]byte
+
+const (
+	optionFEC uint8 = 1 // | FECData(1) | FECParity(1) |
+)
+
+func (o handshakeOptions) encode() []byte {
+	var b []byte
+	for t, v := range o {
+		b = append(b, t, uint8(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
+
+func loadHandshakeOptions(b []byte) (handshakeOptions, error) {
+	o := handshakeOptions{}
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, errPacketInvalid
+		}
+		o[b[0]] = b[2 : 2+int(b[1])]
+		b = b[2+int(b[1]):]
+	}
+	return o, nil
+}
+
+// apply enable the features in the options negotiated
+func (o handshakeOptions) apply(c *Conn) {
+	if fec, ok := o[optionFEC]; ok && len(fec) == 2 {
+		c.fec = newReedSolomon(int(fec[0]), int(fec[1]))
+	}
+}
+
+// replayWindow reject the packet number seen or too old
+type replayWindow struct {
+	max  uint64
+	bits [replayWindowSize / 64]uint64
+}
+
+func newReplayWindow() *replayWindow {
+	w := &replayWindow{}
+	w.bits[0] = 1 // packet number 0 is the hello
+	return w
+}
+
+func (w *replayWindow) check(pn uint64) bool {
+	if pn > w.max {
+		return true
+	}
+	if w.max-pn >= replayWindowSize {
+		return false
+	}
+	i := pn % replayWindowSize
+	return w.bits[i/64]&(1<<(i%64)) == 0
+}
+
+func (w *replayWindow) update(pn uint64) {
+	if pn > w.max {
+		if pn-w.max >= replayWindowSize {
+			w.bits = [replayWindowSize / 64]uint64{}
+		} else {
+			for i := w.max + 1; i < pn; i++ {
+				j := i % replayWindowSize
+				w.bits[j/64] &^= 1 << (j % 64)
+			}
+		}
+		w.max = pn
+	}
+	i := pn % replayWindowSize
+	w.bits[i/64] |= 1 << (i % 64)
+}
+
+// packetCipher seal and open the packets of a connection
+type packetCipher struct {
+	send cipher.AEAD
+	recv cipher.AEAD
+	pn   uint64 // the last packet number sent
+
+	replay     *replayWindow
+	replayLock sync.Mutex
+}
+
+// newPacketCipher derive the keys of both directions from the shared secret,
+// psk is mixed in if it's set
+func newPacketCipher(shared []byte, psk []byte, clientPub []byte, serverPub []byte, isServer bool) (*packetCipher, error) {
+	info := append([]byte(keyDerivationLabel), clientPub...)
+	info = append(info, serverPub...)
+	keys, err := hkdf.Key(sha256.New, shared, psk, string(info), packetKeySize*2)
+	if err != nil {
+		return nil, err
+	}
+	c2s, err := newAEAD(keys[:packetKeySize])
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newAEAD(keys[packetKeySize:])
+	if err != nil {
+		return nil, err
+	}
+	pc := &packetCipher{send: c2s, recv: s2c, replay: newReplayWindow()}
+	if isServer {
+		pc.send, pc.recv = s2c, c2s
+	}
+	return pc, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func packetNonce(pn uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], pn)
+	return nonce
+}
+
+func putPacketHeader(b []byte, kind uint8, connID uint64, pn uint64) {
+	b[0] = kind
+	binary.BigEndian.PutUint64(b[1:9], connID)
+	binary.BigEndian.PutUint64(b[9:17], pn)
+}
+
+// sealWith seal the body in a packet with the packet number
+func (pc *packetCipher) sealWith(kind uint8, connID uint64, pn uint64, prefix []byte, body []byte) []byte {
+	b := make([]byte, packetHeaderSize, packetHeaderSize+len(prefix)+len(body)+packetTagSize)
+	putPacketHeader(b, kind, connID, pn)
+	b = append(b, prefix...)
+	return pc.send.Seal(b, packetNonce(pn), body, b[:packetHeaderSize])
+}
+
+// seal seal a segment in a data packet
+func (pc *packetCipher) seal(connID uint64, segment []byte) []byte {
+	return pc.sealWith(packetData, connID, atomic.AddUint64(&pc.pn, 1), nil, segment)
+}
+
+// open open a data packet, fresh is true if the packet is the newest
+// received, only then the remote address can be changed
+func (pc *packetCipher) open(b []byte) (segment []byte, fresh bool, err error) {
+	if len(b) < packetOverhead {
+		return nil, false, errPacketInvalid
+	}
+	pn := binary.BigEndian.Uint64(b[9:17])
+	pc.replayLock.Lock()
+	ok := pc.replay.check(pn)
+	pc.replayLock.Unlock()
+	if !ok {
+		return nil, false, errPacketReplayed
+	}
+
+	segment, err = pc.recv.Open(nil, packetNonce(pn), b[packetHeaderSize:], b[:packetHeaderSize])
+	if err != nil {
+		return nil, false, err
+	}
+
+	pc.replayLock.Lock()
+	defer pc.replayLock.Unlock()
+	if !pc.replay.check(pn) {
+		return nil, false, errPacketReplayed
+	}
+	fresh = pn > pc.replay.max
+	pc.replay.update(pn)
+	return segment, fresh, nil
+}
+
+// cookieKey create the cookie of server, a cookie prove client own the address
+type cookieKey []byte
+
+func newCookieKey() cookieKey {
+	k := make([]byte, 32)
+	rand.Read(k)
+	return k
+}
+
+func (k cookieKey) sum(addr net.Addr, clientPub []byte, timestamp []byte) []byte {
+	mac := hmac.New(sha256.New, k)
+	mac.Write([]byte(addr.String()))
+	mac.Write(clientPub)
+	mac.Write(timestamp)
+	return mac.Sum(nil)[:cookieSize-8]
+}
+
+func (k cookieKey) new(addr net.Addr, clientPub []byte) []byte {
+	cookie := make([]byte, 8, cookieSize)
+	binary.BigEndian.PutUint64(cookie, uint64(time.Now().Unix()))
+	return append(cookie, k.sum(addr, clientPub, cookie[:8])...)
+}
+
+func (k cookieKey) verify(addr net.Addr, clientPub []byte, cookie []byte) error {
+	if len(cookie) != cookieSize {
+		return errCookieInvalid
+	}
+	created := time.Unix(int64(binary.BigEndian.Uint64(cookie[:8])), 0)
+	if age := time.Since(created); age < -time.Second || age > cookieLifetime {
+		return errCookieInvalid
+	}
+	if subtle.ConstantTimeCompare(k.sum(addr, clientPub, cookie[:8]), cookie[8:]) != 1 {
+		return errCookieInvalid
+	}
+	return nil
+}
+
+type initialPacket struct {
+	version   uint8
+	clientPub []byte
+	cookie    []byte
+	options   handshakeOptions
+}
+
+func newInitialPacket(version uint8, clientPub []byte, cookie []byte, options handshakeOptions) []byte {
+	b := make([]byte, packetHeaderSize)
+	putPacketHeader(b, packetInitial, 0, 0)
+	b = append(b, version)
+	b = append(b, clientPub...)
+	b = append(b, uint8(len(cookie)))
+	b = append(b, cookie...)
+	return append(b, options.encode()...)
+}
+
+func loadInitialPacket(b []byte) (*initialPacket, error) {
+	b = b[packetHeaderSize:]
+	if len(b) < 1+packetKeySize+1 {
+		return nil, errPacketInvalid
+	}
+	p := &initialPacket{version: b[0], clientPub: b[1 : 1+packetKeySize]}
+	b = b[1+packetKeySize:]
+	if len(b) < 1+int(b[0]) {
+		return nil, errPacketInvalid
+	}
+	p.cookie = b[1 : 1+int(b[0])]
+	var err error
+	p.options, err = loadHandshakeOptions(b[1+int(b[0]):])
+	return p, err
+}
+
+func newRetryPacket(cookie []byte) []byte {
+	b := make([]byte, packetHeaderSize, packetHeaderSize+len(cookie))
+	putPacketHeader(b, packetRetry, 0, 0)
+	return append(b, cookie...)
+}
+
+// newHelloPacket create the server hello, packet number 0 is used to seal
+// the version and options
+func newHelloPacket(pc *packetCipher, connID uint64, serverPub []byte, version uint8, options handshakeOptions) []byte {
+	body := append([]byte{version}, options.encode()...)
+	return pc.sealWith(packetHello, connID, 0, serverPub, body)
+}
+
+// openHelloPacket open the server hello with the client key, the cipher
+// is returned if the server is authenticated
+func openHelloPacket(b []byte, priv *ecdh.PrivateKey, psk []byte) (pc *packetCipher, version uint8, options handshakeOptions, err error) {
+	if len(b) < packetHeaderSize+packetKeySize+packetTagSize+1 {
+		err = errPacketInvalid
+		return
+	}
+	serverPub := b[packetHeaderSize : packetHeaderSize+packetKeySize]
+	pub, err := ecdh.X25519().NewPublicKey(serverPub)
+	if err != nil {
+		return
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return
+	}
+	if pc, err = newPacketCipher(shared, psk, priv.PublicKey().Bytes(), serverPub, false); err != nil {
+		return
+	}
+	body, err := pc.recv.Open(nil, packetNonce(0), b[packetHeaderSize+packetKeySize:], b[:packetHeaderSize])
+	if err != nil {
+		err = errHandshakeFailed
+		return
+	}
+	version = body[0]
+	options, err = loadHandshakeOptions(body[1:])
+	return
+}
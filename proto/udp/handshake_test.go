@@ -0,0 +1,125 @@
+package udp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_replayWindow(t *testing.T) {
+	w := newReplayWindow()
+	if w.check(0) {
+		t.Errorf("packet number 0 is accepted")
+	}
+	for _, pn := range []uint64{1, 3, 2, 100, 50} {
+		if !w.check(pn) {
+			t.Errorf("packet %d is rejected", pn)
+		}
+		w.update(pn)
+		if w.check(pn) {
+			t.Errorf("packet %d is accepted twice", pn)
+		}
+	}
+	w.update(100 + replayWindowSize)
+	if w.check(99) {
+		t.Errorf("too old packet is accepted")
+	}
+	if !w.check(101) {
+		t.Errorf("packet 101 in window is rejected")
+	}
+}
+
+func Test_cookieKey(t *testing.T) {
+	k := newCookieKey()
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	pub := bytes.Repeat([]byte{1}, packetKeySize)
+	cookie := k.new(addr, pub)
+	if err := k.verify(addr, pub, cookie); err != nil {
+		t.Errorf("verify cookie failed: %s", err)
+	}
+	if err := k.verify(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1235}, pub, cookie); err != errCookieInvalid {
+		t.Errorf("cookie of other address got %v", err)
+	}
+	if err := newCookieKey().verify(addr, pub, cookie); err != errCookieInvalid {
+		t.Errorf("cookie of other key got %v", err)
+	}
+
+	old := make([]byte, 8)
+	binary.BigEndian.PutUint64(old, uint64(time.Now().Add(-cookieLifetime*2).Unix()))
+	old = append(old, k.sum(addr, pub, old)...)
+	if err := k.verify(addr, pub, old); err != errCookieInvalid {
+		t.Errorf("expired cookie got %v", err)
+	}
+}
+
+func Test_Handshake_PSK(t *testing.T) {
+	client, server, closeFunc := newConnPair(t, &Config{PSK: []byte("secret")})
+	defer closeFunc()
+	go func() {
+		m, _ := server.RecvMsg()
+		server.SendMsg(m)
+	}()
+	if err := client.SendMsg([]byte("psk")); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := client.RecvMsg(); err != nil || string(m) != "psk" {
+		t.Fatalf("RecvMsg got %q, %v", m, err)
+	}
+
+	// the server with other key
+	sc, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	defer sc.Close()
+	NewServerSocketWithConfig(sc, &Config{PSK: []byte("other")})
+	cc, _ := net.ListenUDP("udp", nil)
+	defer cc.Close()
+	if _, _, err := NewClientSocketWithConfig(cc, sc.LocalAddr().(*net.UDPAddr), &Config{PSK: []byte("secret")}); err != errHandshakeFailed {
+		t.Errorf("handshake with wrong PSK got %v", err)
+	}
+}
+
+func Test_Conn_Roaming(t *testing.T) {
+	client, server, closeFunc := newConnPair(t, nil)
+	defer closeFunc()
+
+	// wait the ping of client, so server has seen the client address
+	client.Ping()
+	origAddr := server.RemoteAddr().String()
+
+	send := func(b []byte) *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.WriteTo(b, client.remoteAddr())
+		time.Sleep(50 * time.Millisecond)
+		return conn
+	}
+
+	// forged packet is dropped
+	forged := make([]byte, 100)
+	rand.Read(forged)
+	putPacketHeader(forged, packetData, server.id, 1000)
+	c := send(forged)
+	defer c.Close()
+	if server.RemoteAddr().String() != origAddr {
+		t.Errorf("remote address is changed by forged packet")
+	}
+
+	// the client move to a new address
+	packet := client.cipher.seal(client.id, newPingReqSegment(0, 1000).bytes())
+	roamed := send(packet)
+	defer roamed.Close()
+	if server.RemoteAddr().String() != roamed.LocalAddr().String() {
+		t.Errorf("remote address is %s after roaming, want %s", server.RemoteAddr(), roamed.LocalAddr())
+	}
+
+	// replayed packet is dropped
+	c = send(packet)
+	defer c.Close()
+	if server.RemoteAddr().String() != roamed.LocalAddr().String() {
+		t.Errorf("remote address is changed by replayed packet")
+	}
+}
@@ -0,0 +1,301 @@
+package udp
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConfig is the impairments of a simulated network path
+type lossyConfig struct {
+	Loss      float64       // probability of a packet is dropped
+	Duplicate float64       // probability of a packet is sent twice
+	Reorder   float64       // probability of a packet is held back by ReorderDelay
+	Delay     time.Duration // one way delay
+	Jitter    time.Duration // random delay added to Delay
+	Bandwidth int           // bytes per second, 0 means unlimited
+	MTU       int           // the larger packet is dropped, 0 means unlimited
+
+	ReorderDelay time.Duration
+	QueueDelay   time.Duration // the packet is dropped if it wait longer in the bandwidth queue
+}
+
+// lossyConn is a net.PacketConn wrapper, the impairments are applied to the
+// packets written
+type lossyConn struct {
+	net.PacketConn
+
+	lock   sync.Mutex
+	config lossyConfig
+	rand   *rand.Rand
+	free   time.Time // when the bandwidth queue is empty
+
+	sent    int
+	dropped int
+}
+
+func newLossyConn(c net.PacketConn, seed int64) *lossyConn {
+	return &lossyConn{PacketConn: c, rand: rand.New(rand.NewSource(seed))}
+}
+
+// setConfig change the impairments, it's safe to be called at any time
+func (c *lossyConn) setConfig(config lossyConfig) {
+	if config.ReorderDelay == 0 {
+		config.ReorderDelay = config.Delay + 5*time.Millisecond
+	}
+	if config.QueueDelay == 0 {
+		config.QueueDelay = 100 * time.Millisecond
+	}
+	c.lock.Lock()
+	c.config = config
+	c.lock.Unlock()
+}
+
+// delay get the delay of the packet, false means dropped
+func (c *lossyConn) delay(size int) (time.Duration, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	config := c.config
+	c.sent++
+	if config.MTU > 0 && size > config.MTU {
+		c.dropped++
+		return 0, false
+	}
+	if c.rand.Float64() < config.Loss {
+		c.dropped++
+		return 0, false
+	}
+
+	d := config.Delay
+	if config.Jitter > 0 {
+		d += time.Duration(c.rand.Int63n(int64(config.Jitter)))
+	}
+	if c.rand.Float64() < config.Reorder {
+		d += config.ReorderDelay
+	}
+	if config.Bandwidth > 0 {
+		now := time.Now()
+		if c.free.Before(now) {
+			c.free = now
+		}
+		if c.free.Sub(now) > config.QueueDelay {
+			c.dropped++ // tail drop
+			return 0, false
+		}
+		c.free = c.free.Add(time.Duration(size) * time.Second / time.Duration(config.Bandwidth))
+		d += c.free.Sub(now)
+	}
+	return d, true
+}
+
+func (c *lossyConn) send(b []byte, addr net.Addr) {
+	d, ok := c.delay(len(b))
+	if !ok {
+		return
+	}
+	if d == 0 {
+		c.PacketConn.WriteTo(b, addr)
+		return
+	}
+	time.AfterFunc(d, func() { c.PacketConn.WriteTo(b, addr) })
+}
+
+// WriteTo implements net.PacketConn, the packet may be dropped, delayed or
+// duplicated
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	p := append([]byte{}, b...)
+	c.send(p, addr)
+
+	c.lock.Lock()
+	dup := c.rand.Float64() < c.config.Duplicate
+	c.lock.Unlock()
+	if dup {
+		c.send(p, addr)
+	}
+	return len(b), nil
+}
+
+// SetDontFragment enable the path MTU discovery, the packet larger than MTU
+// is dropped
+func (c *lossyConn) SetDontFragment() error {
+	return nil
+}
+
+func (c *lossyConn) stats() (sent int, dropped int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sent, c.dropped
+}
+
+// newLossyConnPair create the connections over a clean path, the impairments
+// are applied in both directions after the handshake, except the MTU
+func newLossyConnPair(t *testing.T, config *Config, lossy lossyConfig) (client *Conn, server *Conn, conns []*lossyConn, closeFunc func()) {
+	client, server, closeFunc = newConnPairWith(t, config, func(c net.PacketConn) net.PacketConn {
+		lc := newLossyConn(c, int64(len(conns)+1))
+		lc.setConfig(lossyConfig{MTU: lossy.MTU})
+		conns = append(conns, lc)
+		return lc
+	})
+	for _, lc := range conns {
+		lc.setConfig(lossy)
+	}
+	return
+}
+
+// lossyMessage create the i-th message of the test, the size is from 1 byte
+// to several segments
+func lossyMessage(i int) []byte {
+	r := rand.New(rand.NewSource(int64(i)))
+	b := make([]byte, 1+r.Intn(8*segmentBodyMaxSize))
+	r.Read(b)
+	return b
+}
+
+func Test_LossyNetwork(t *testing.T) {
+	cases := []struct {
+		name   string
+		lossy  lossyConfig
+		config *Config
+		count  int // the messages sent, 0 means the default
+	}{
+		{"clean", lossyConfig{}, nil, 0},
+		{"loss 5%", lossyConfig{Loss: 0.05}, nil, 0},
+		{"loss 20%", lossyConfig{Loss: 0.2}, nil, 30},
+		{"reorder 20%", lossyConfig{Reorder: 0.2, Delay: time.Millisecond}, nil, 0},
+		{"duplicate 20%", lossyConfig{Duplicate: 0.2}, nil, 0},
+		{"delay 20ms", lossyConfig{Delay: 20 * time.Millisecond, Jitter: 5 * time.Millisecond}, nil, 0},
+		{"bandwidth 2MB/s", lossyConfig{Bandwidth: 2 * 1024 * 1024, Delay: 5 * time.Millisecond}, nil, 0},
+		{"mixed", lossyConfig{Loss: 0.05, Duplicate: 0.05, Reorder: 0.1, Delay: 5 * time.Millisecond, Jitter: 2 * time.Millisecond, Bandwidth: 4 * 1024 * 1024}, nil, 0},
+		{"loss 20% fec", lossyConfig{Loss: 0.2}, &Config{FECData: 4, FECParity: 2}, 30},
+		{"mixed fec", lossyConfig{Loss: 0.05, Duplicate: 0.05, Reorder: 0.1, Delay: 5 * time.Millisecond, Jitter: 2 * time.Millisecond, Bandwidth: 4 * 1024 * 1024}, &Config{FECData: 8, FECParity: 2}, 0},
+		{"mixed bbr", lossyConfig{Loss: 0.05, Duplicate: 0.05, Reorder: 0.1, Delay: 5 * time.Millisecond, Jitter: 2 * time.Millisecond, Bandwidth: 4 * 1024 * 1024}, &Config{CongestionControl: CongestionBBR}, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			count := 100
+			if c.count > 0 {
+				count = c.count
+			}
+			if testing.Short() {
+				count /= 5
+			}
+			client, server, conns, closeFunc := newLossyConnPair(t, c.config, c.lossy)
+			defer closeFunc()
+
+			done := make(chan error, 1)
+			go func() {
+				s, err := server.AcceptStream()
+				if err != nil {
+					done <- err
+					return
+				}
+				for i := 0; i < count; i++ {
+					m, err := s.RecvMsg()
+					if err != nil {
+						done <- err
+						return
+					}
+					if !bytes.Equal(m, lossyMessage(i)) {
+						done <- fmt.Errorf("message %d mismatch", i)
+						return
+					}
+				}
+				done <- nil
+			}()
+
+			s, err := client.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			total := 0
+			for i := 0; i < count; i++ {
+				m := lossyMessage(i)
+				if err := s.SendMsg(m); err != nil {
+					t.Fatalf("send message %d failed: %s", i, err)
+				}
+				total += len(m)
+			}
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatal("recv timeout")
+			}
+
+			elapsed := time.Since(start)
+			sent, dropped := conns[1].stats()
+			t.Logf("%d messages, %d bytes in %s, %.1f KB/s, client sent %d packets, %d dropped",
+				count, total, elapsed, float64(total)/1024/elapsed.Seconds(), sent, dropped)
+		})
+	}
+}
+
+func Test_LossyNetwork_ConcurrentStreams(t *testing.T) {
+	client, server, _, closeFunc := newLossyConnPair(t, nil, lossyConfig{
+		Loss: 0.05, Reorder: 0.1, Duplicate: 0.05, Delay: 2 * time.Millisecond,
+	})
+	defer closeFunc()
+
+	streams, count := 4, 20
+	errCh := make(chan error, 2*streams)
+	go func() {
+		for i := 0; i < streams; i++ {
+			s, err := server.AcceptStream()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			go func(s *Stream) {
+				for i := 0; i < count; i++ {
+					m, err := s.RecvMsg()
+					if err != nil {
+						errCh <- err
+						return
+					}
+					if !bytes.Equal(m, lossyMessage(int(s.ID())*count+i)) {
+						errCh <- fmt.Errorf("stream %d message %d mismatch", s.ID(), i)
+						return
+					}
+				}
+				errCh <- nil
+			}(s)
+		}
+	}()
+
+	for i := 0; i < streams; i++ {
+		s, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(s *Stream) {
+			for i := 0; i < count; i++ {
+				if err := s.SendMsg(lossyMessage(int(s.ID())*count + i)); err != nil {
+					errCh <- err
+					return
+				}
+			}
+			errCh <- nil
+		}(s)
+	}
+
+	timeout := time.After(30 * time.Second)
+	for i := 0; i < 2*streams; i++ {
+		select {
+		case err := <-errCh:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("timeout")
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ooclab/es"
+)
+
+// flagMsgBatch is set in the segments of a message joined by several
+// messages, see SendBatch
+const flagMsgBatch uint16 = 1 << 8
+
+var errBatchInvalid = errors.New("invalid batch message")
+
+var (
+	_ es.Conn        = (*Conn)(nil)
+	_ es.BatchSender = (*Conn)(nil)
+	_ net.Conn       = (*Conn)(nil)
+)
+
+// deadline is a cancel chan closed when the deadline is exceeded, a pending
+// I/O see the new deadline set
+type deadline struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait the timer func
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// Recv recv a message of the default stream, it implements es.Conn
+func (c *Conn) Recv() ([]byte, error) {
+	return c.stream0.recvMsg(c.rd.wait())
+}
+
+// Send send a message in the default stream, it implements es.Conn
+func (c *Conn) Send(message []byte) error {
+	return c.sendMsg(c.stream0, message, c.wd.wait())
+}
+
+// SendBatch send the messages in one message, the remote endpoint receive
+// them one by one. It implements es.BatchSender
+func (c *Conn) SendBatch(messages [][]byte) error {
+	if len(messages) == 1 {
+		return c.Send(messages[0])
+	}
+	length := 0
+	for _, m := range messages {
+		length += 4 + len(m)
+	}
+	b := make([]byte, 0, length)
+	for _, m := range messages {
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(m)))
+		b = append(b, m...)
+	}
+	return c.sendMsgWithFlags(c.stream0, b, flagMsgBatch, c.wd.wait())
+}
+
+// splitBatch get the messages joined by SendBatch
+func splitBatch(b []byte) ([][]byte, error) {
+	var messages [][]byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errBatchInvalid
+		}
+		n := int(binary.BigEndian.Uint32(b[0:4]))
+		if len(b)-4 < n {
+			return nil, errBatchInvalid
+		}
+		messages = append(messages, b[4:4+n:4+n])
+		b = b[4+n:]
+	}
+	return messages, nil
+}
+
+// Read read the data of default stream, the rest of a message is kept for
+// the next Read. It implements net.Conn
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if len(c.readBuf) == 0 {
+		msg, err := c.stream0.recvMsg(c.rd.wait())
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf = msg
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Write write the data in default stream, it's split to messages of
+// maxMsgSize. It implements net.Conn
+func (c *Conn) Write(p []byte) (n int, err error) {
+	for n < len(p) {
+		end := n + maxMsgSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err = c.sendMsg(c.stream0, p[n:end], c.wd.wait()); err != nil {
+			return
+		}
+		n = end
+	}
+	return
+}
+
+// SetDeadline implements net.Conn
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return nil
+}
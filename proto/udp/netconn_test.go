@@ -0,0 +1,55 @@
+package udp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_Conn_SendBatch(t *testing.T) {
+	client, server, closeFunc := newConnPair(t, nil)
+	defer closeFunc()
+
+	batch := [][]byte{[]byte("a"), bytes.Repeat([]byte("b"), segmentBodyMaxSize*3), []byte("c")}
+	if err := client.SendBatch(batch); err != nil {
+		t.Fatalf("SendBatch failed: %s", err)
+	}
+	for i, want := range batch {
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %s", err)
+		}
+		if !bytes.Equal(m, want) {
+			t.Errorf("message %d of batch mismatch", i)
+		}
+	}
+
+	if _, err := splitBatch([]byte{0, 0, 0, 9, 1}); err != errBatchInvalid {
+		t.Errorf("splitBatch of short message got %v", err)
+	}
+}
+
+func Test_deadline(t *testing.T) {
+	d := newDeadline()
+	if isClosedChan(d.wait()) {
+		t.Fatal("zero deadline is exceeded")
+	}
+
+	// a pending wait see the extended deadline
+	d.set(time.Now().Add(20 * time.Millisecond))
+	wait := d.wait()
+	d.set(time.Now().Add(time.Hour))
+	time.Sleep(40 * time.Millisecond)
+	if isClosedChan(wait) {
+		t.Errorf("deadline is exceeded after extended")
+	}
+
+	d.set(time.Now().Add(-time.Second))
+	if !isClosedChan(d.wait()) {
+		t.Errorf("past deadline is not exceeded")
+	}
+	d.set(time.Time{})
+	if isClosedChan(d.wait()) {
+		t.Errorf("deadline is exceeded after reset")
+	}
+}
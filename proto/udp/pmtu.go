@@ -0,0 +1,236 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// path MTU discovery, see RFC 8899
+//
+// the connection start with segmentMaxSize, which is safe for the most
+// paths, then probe the larger sizes by binary search with the padding probe
+// segments. The DF bit is set, so a probe larger than the path MTU is lost
+// instead of fragmented. The search is done again in every
+// pmtuRaiseInterval. If the messages are timeout again and again, the path
+// MTU may be reduced (black hole), the segment size fall back to
+// segmentMaxSize, then segmentMinSize for the paths below it, such as the
+// tunnels, and the search is done again from there.
+//
+// probe segment body: | ProbeID(4) | Padding |
+// ack segment body:   | ProbeID(4) | Size(2) |
+const (
+	pmtuSearchStep         = 16 // stop search if the range is smaller
+	pmtuProbeMaxTimes      = 3  // a size is failed if the probes are lost
+	pmtuBlackHoleThreshold = 3  // the consecutive timeouts to fall back
+	pmtuRaiseInterval      = 10 * time.Minute
+)
+
+var (
+	errDFUnsupported     = errors.New("DF bit is not supported")
+	errPathMTUReduced    = errors.New("path MTU is reduced")
+	errPMTUProbeInvalid  = errors.New("invalid PMTU probe segment")
+	errPMTUProbeTooSmall = errors.New("PMTU probe size is too small")
+)
+
+// dontFragmenter is the packet conn can set DF bit itself
+type dontFragmenter interface {
+	SetDontFragment() error
+}
+
+// enableDontFragment set DF bit of the packet conn, the path MTU discovery
+// work only if it's set
+func enableDontFragment(c interface{}) error {
+	if df, ok := c.(dontFragmenter); ok {
+		return df.SetDontFragment()
+	}
+	return setDontFragment(c)
+}
+
+// pmtuState is the path MTU of a connection
+type pmtuState struct {
+	lock     sync.Mutex
+	size     int // the segment size in use
+	high     int // the smallest size failed
+	timeouts int // the consecutive timeouts without progress
+
+	search chan struct{} // search again at once
+
+	probes    map[uint32]chan struct{}
+	probeID   uint32
+	probeLock sync.Mutex
+}
+
+func newPMTUState() *pmtuState {
+	return &pmtuState{
+		size:   segmentMaxSize,
+		high:   segmentSizeLimit + 1,
+		search: make(chan struct{}, 1),
+		probes: make(map[uint32]chan struct{}),
+	}
+}
+
+// segmentSize get the segment size in use
+func (s *pmtuState) segmentSize() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// next get the next size to probe, false means the search is done
+func (s *pmtuState) next() (int, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.high-s.size <= pmtuSearchStep {
+		return 0, false
+	}
+	return (s.size + s.high) / 2, true
+}
+
+func (s *pmtuState) update(size int, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ok && size > s.size {
+		s.size = size
+	} else if !ok && size < s.high {
+		s.high = size
+	}
+}
+
+// raise search the larger size again, the path may be changed
+func (s *pmtuState) raise() {
+	s.lock.Lock()
+	s.high = segmentSizeLimit + 1
+	s.lock.Unlock()
+}
+
+// onProgress reset the black hole detection
+func (s *pmtuState) onProgress() {
+	s.lock.Lock()
+	s.timeouts = 0
+	s.lock.Unlock()
+}
+
+// onTimeout count the timeout without progress, true is returned if the
+// segment size fall back
+func (s *pmtuState) onTimeout() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.timeouts++
+	if s.timeouts < pmtuBlackHoleThreshold || s.size <= segmentMinSize {
+		return false
+	}
+	s.timeouts = 0
+	s.high = s.size
+	if s.size > segmentMaxSize {
+		s.size = segmentMaxSize
+	} else {
+		s.size = segmentMinSize
+	}
+	select {
+	case s.search <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// segmentBodySize get the max segment body of the path
+func (c *Conn) segmentBodySize() int {
+	size := c.pmtu.segmentSize() - headerSize - checksumSize
+	if c.fec != nil {
+		size -= fecHeaderSize
+	}
+	return size
+}
+
+// pmtuLoop search the path MTU until the connection is closed
+func (c *Conn) pmtuLoop() {
+	for {
+		size, ok := c.pmtu.next()
+		if !ok {
+			select {
+			case <-time.After(pmtuRaiseInterval):
+				c.pmtu.raise()
+			case <-c.pmtu.search:
+			case <-c.shutdownCh:
+				return
+			}
+			continue
+		}
+
+		acked := false
+		for i := 0; i < pmtuProbeMaxTimes && !acked; i++ {
+			var err error
+			if acked, err = c.probePMTU(size); err != nil {
+				return
+			}
+		}
+		c.pmtu.update(size, acked)
+	}
+}
+
+// probePMTU send a probe segment of size, and wait the ack
+func (c *Conn) probePMTU(size int) (bool, error) {
+	if size < headerSize+checksumSize+4 {
+		return false, errPMTUProbeTooSmall
+	}
+	ch := make(chan struct{})
+	c.pmtu.probeLock.Lock()
+	c.pmtu.probeID++
+	id := c.pmtu.probeID
+	c.pmtu.probes[id] = ch
+	c.pmtu.probeLock.Unlock()
+	defer func() {
+		c.pmtu.probeLock.Lock()
+		delete(c.pmtu.probes, id)
+		c.pmtu.probeLock.Unlock()
+	}()
+
+	b := make([]byte, size-headerSize-checksumSize)
+	binary.BigEndian.PutUint32(b[0:4], id)
+	seg, err := newSegment(segTypePMTUProbe, 0, 0, 0, 0, b)
+	if err != nil {
+		return false, err
+	}
+	if err := c.write(seg.bytes()); err != nil {
+		return false, nil // EMSGSIZE, larger than the local MTU
+	}
+
+	start := time.Now()
+	select {
+	case <-ch:
+		c.rtt.Update(time.Since(start))
+		return true, nil
+	case <-time.After(c.rtt.RTO()):
+		return false, nil
+	case <-c.shutdownCh:
+		return false, ErrConnectionShutdown
+	}
+}
+
+func (c *Conn) handlePMTUProbe(seg *segment) error {
+	if len(seg.b) < 4 {
+		return errPMTUProbeInvalid
+	}
+	b := make([]byte, 6)
+	copy(b[0:4], seg.b[0:4])
+	binary.BigEndian.PutUint16(b[4:6], uint16(headerSize+checksumSize+len(seg.b)))
+	ack, _ := newSegment(segTypePMTUAck, 0, 0, 0, 0, b)
+	return c.write(ack.bytes())
+}
+
+func (c *Conn) handlePMTUAck(seg *segment) error {
+	if len(seg.b) < 6 {
+		return errPMTUProbeInvalid
+	}
+	id := binary.BigEndian.Uint32(seg.b[0:4])
+	c.pmtu.probeLock.Lock()
+	ch := c.pmtu.probes[id]
+	delete(c.pmtu.probes, id)
+	c.pmtu.probeLock.Unlock()
+	if ch != nil {
+		close(ch)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package udp
+
+import "syscall"
+
+// setDontFragment set DF bit of IPv4 and IPv6 both, the kernel does not
+// fragment the packets and ignore the cached path MTU
+func setDontFragment(c interface{}) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return errDFUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE)
+		err6 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE)
+		if err4 != nil && err6 != nil {
+			serr = err4
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package udp
+
+// setDontFragment is only supported on Linux, the segment size is always
+// segmentMaxSize on the other platforms
+func setDontFragment(c interface{}) error {
+	return errDFUnsupported
+}
@@ -0,0 +1,165 @@
+package udp
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func Test_pmtuState(t *testing.T) {
+	s := newPMTUState()
+	mtu := 4000 // the largest segment passed
+	probes := 0
+	for {
+		size, ok := s.next()
+		if !ok {
+			break
+		}
+		probes++
+		s.update(size, size <= mtu)
+	}
+	if size := s.segmentSize(); size > mtu || size < mtu-pmtuSearchStep {
+		t.Errorf("segment size is %d after %d probes, want about %d", size, probes, mtu)
+	}
+
+	// black hole
+	for i := 0; i < pmtuBlackHoleThreshold-1; i++ {
+		if s.onTimeout() {
+			t.Fatalf("fall back after %d timeouts", i+1)
+		}
+	}
+	s.onProgress()
+	for i := 0; i < pmtuBlackHoleThreshold-1; i++ {
+		s.onTimeout()
+	}
+	if !s.onTimeout() || s.segmentSize() != segmentMaxSize {
+		t.Errorf("segment size is %d after black hole", s.segmentSize())
+	}
+	select {
+	case <-s.search:
+	default:
+		t.Errorf("search is not started after fall back")
+	}
+
+	// the path is smaller than segmentMaxSize
+	for i := 0; i < pmtuBlackHoleThreshold-1; i++ {
+		s.onTimeout()
+	}
+	if !s.onTimeout() || s.segmentSize() != segmentMinSize {
+		t.Errorf("segment size is %d after black hole of segmentMaxSize", s.segmentSize())
+	}
+	for i := 0; i < pmtuBlackHoleThreshold; i++ {
+		if s.onTimeout() {
+			t.Errorf("fall back below segmentMinSize")
+		}
+	}
+}
+
+// waitSegmentSize wait the path MTU discovery done
+func waitSegmentSize(c *Conn, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, ok := c.pmtu.next(); !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c.pmtu.segmentSize()
+}
+
+func Test_Conn_PMTU(t *testing.T) {
+	mtu := 4000
+	client, server, conns, closeFunc := newLossyConnPair(t, nil, lossyConfig{MTU: mtu})
+	defer closeFunc()
+
+	for _, c := range []*Conn{client, server} {
+		max := mtu - packetOverhead
+		if size := waitSegmentSize(c, 5*time.Second); size > max || size < max-pmtuSearchStep {
+			t.Errorf("segment size is %d, want about %d", size, max)
+		}
+	}
+
+	b := make([]byte, 64*1024)
+	rand.Read(b)
+	sent, _ := conns[1].stats()
+	if err := client.Send(b); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := server.Recv(); err != nil || !bytes.Equal(m, b) {
+		t.Fatalf("recv got %d bytes, %v", len(m), err)
+	}
+	if n, _ := conns[1].stats(); n-sent > len(b)/(mtu/2) {
+		t.Errorf("%d packets are sent for %d bytes", n-sent, len(b))
+	}
+}
+
+func Test_Conn_PMTUBlackHole(t *testing.T) {
+	client, server, conns, closeFunc := newLossyConnPair(t, nil, lossyConfig{MTU: 4000})
+	defer closeFunc()
+	if waitSegmentSize(client, 5*time.Second) <= segmentMaxSize {
+		t.Fatal("path MTU is not discovered")
+	}
+
+	// the path is changed, the large packets are dropped silently
+	for _, c := range conns {
+		c.setConfig(lossyConfig{MTU: 1500})
+	}
+	for i := 0; i < 3; i++ {
+		b := make([]byte, 32*1024)
+		rand.Read(b)
+		if err := client.Send(b); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := server.Recv(); err != nil || !bytes.Equal(m, b) {
+			t.Fatalf("recv got %d bytes, %v", len(m), err)
+		}
+	}
+	if size := client.pmtu.segmentSize(); size > 1500-packetOverhead {
+		t.Errorf("segment size is %d after black hole", size)
+	}
+}
+
+func Test_Conn_PMTUSmallPath(t *testing.T) {
+	// the UDP payload of the minimum IPv6 MTU, such as a tunnel
+	mtu := 1280 - 40 - 8
+	client, server, _, closeFunc := newLossyConnPair(t, nil, lossyConfig{MTU: mtu})
+	defer closeFunc()
+
+	for i := 0; i < 3; i++ {
+		b := make([]byte, 32*1024)
+		rand.Read(b)
+		if err := client.Send(b); err != nil {
+			t.Fatal(err)
+		}
+		if m, err := server.Recv(); err != nil || !bytes.Equal(m, b) {
+			t.Fatalf("recv got %d bytes, %v", len(m), err)
+		}
+	}
+	if size := client.pmtu.segmentSize(); size > mtu-packetOverhead {
+		t.Errorf("segment size is %d on the path of MTU %d", size, mtu)
+	}
+}
+
+func Test_Conn_PMTULoopback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("DF bit is only supported on Linux")
+	}
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := enableDontFragment(c); err != nil {
+		t.Fatalf("set DF bit failed: %s", err)
+	}
+
+	client, _, closeFunc := newConnPair(t, nil)
+	defer closeFunc()
+	// the MTU of loopback is larger than the limit
+	if size := waitSegmentSize(client, 5*time.Second); size < segmentSizeLimit-pmtuSearchStep {
+		t.Errorf("segment size is %d on loopback", size)
+	}
+}
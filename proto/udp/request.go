@@ -4,6 +4,7 @@ import "errors"
 
 const (
 	requestTypeQueryReceive uint8 = iota
+	requestTypeCancelReceive
 )
 
 var (
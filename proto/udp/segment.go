@@ -3,27 +3,52 @@ package udp
 import (
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 )
 
 const (
-	// protoVersion is the only version we support
-	protoVersion uint8 = 0
-	headerSize         = 14
+	// protoVersion is the newest version we support, the version of a
+	// connection is negotiated in handshake.
+	// version 0: no checksum
+	// version 1: CRC32-C checksum after the header
+	// version 2: 4 bytes TransID, it's not reused while the remote endpoint
+	// keeps the received message
+	protoVersion    uint8 = 2
+	minProtoVersion uint8 = 0
+	headerSize            = 16
+	headerSizeV1          = 14 // the header of version 0 and 1, 2 bytes TransID
+	checksumSize          = 4
 
-	segTypeMsgSYN      uint8 = 1
-	segTypeMsgACK      uint8 = 2
+	// 1, 2 was the SYN/ACK of plaintext handshake, see handshake.go
 	segTypeMsgPingReq  uint8 = 3
 	segTypeMsgPingRep  uint8 = 4
 	segTypeMsgReq      uint8 = 5
 	segTypeMsgRep      uint8 = 6
 	segTypeMsgReceived uint8 = 7
-	segTypeMsgReTrans  uint8 = 8
+	segTypeMsgSACK     uint8 = 8 // selective ack
 	segTypeMsgTrans    uint8 = 9
+	segTypeMsgStream   uint8 = 10 // stream control, SYN/ACK/FIN/RST in flags
+	segTypeConnClose   uint8 = 11 // the connection is closed
+	segTypeMsgParity   uint8 = 12 // the FEC parity of a group of segTypeMsgTrans
+	segTypePMTUProbe   uint8 = 13 // the padding probe of path MTU
+	segTypePMTUAck     uint8 = 14
 
+	// the base segment size before path MTU discovery, it's safe for the
+	// most paths
 	segmentMaxSize     = 1400
-	segmentBodyMaxSize = segmentMaxSize - headerSize // <= MTU
+	segmentBodyMaxSize = segmentMaxSize - headerSize - checksumSize // <= MTU
 
-	handshakeKey = "ES HANDSHAKE" // TODO: use this
+	// the smallest segment the black hole detection falls back to, it fits
+	// the minimum IPv6 MTU 1280 - IPv6 - UDP header
+	segmentMinSize     = 1280 - 40 - 8 - packetOverhead
+	segmentBodyMinSize = segmentMinSize - headerSize - checksumSize
+
+	// the largest segment in a jumbo frame, 9000 MTU - IPv6 - UDP header
+	segmentSizeLimit = 9000 - 40 - 8 - packetOverhead
+	segmentBodyLimit = segmentSizeLimit - headerSize - checksumSize
+
+	// the control segments fit the smallest segment
+	maxSACKGaps = (segmentBodyMinSize - 4) / 2
 )
 
 const (
@@ -44,7 +69,7 @@ const (
 )
 
 // segment header
-// | Version(1) | Type(1) | Flags(2) | StreamID(4) | TransID(2) | OrderID(2) | Length(2) |
+// | Version(1) | Type(1) | Flags(2) | StreamID(4) | TransID(4) | OrderID(2) | Length(2) |
 type header []byte
 
 func (h header) Version() uint8 {
@@ -59,27 +84,27 @@ func (h header) Flags() uint16 {
 func (h header) StreamID() uint32 {
 	return binary.BigEndian.Uint32(h[4:8])
 }
-func (h header) TransID() uint16 {
-	return binary.BigEndian.Uint16(h[8:10])
+func (h header) TransID() uint32 {
+	return binary.BigEndian.Uint32(h[8:12])
 }
 func (h header) OrderID() uint16 {
-	return binary.BigEndian.Uint16(h[10:12])
+	return binary.BigEndian.Uint16(h[12:14])
 }
 func (h header) Length() uint16 {
-	return binary.BigEndian.Uint16(h[12:14])
+	return binary.BigEndian.Uint16(h[14:16])
 }
 func (h header) String() string {
 	return fmt.Sprintf("Version:%d Type:%d Flags:%d StreamID:%d TransID:%d OrderID:%d Length:%d",
 		h.Version(), h.Type(), h.Flags(), h.StreamID(), h.TransID(), h.OrderID(), h.Length())
 }
-func (h header) encode(segType uint8, flags uint16, streamID uint32, transID uint16, orderID uint16, length uint16) {
+func (h header) encode(segType uint8, flags uint16, streamID uint32, transID uint32, orderID uint16, length uint16) {
 	h[0] = protoVersion
 	h[1] = segType
 	binary.BigEndian.PutUint16(h[2:4], flags)
 	binary.BigEndian.PutUint32(h[4:8], streamID)
-	binary.BigEndian.PutUint16(h[8:10], transID)
-	binary.BigEndian.PutUint16(h[10:12], orderID)
-	binary.BigEndian.PutUint16(h[12:14], length)
+	binary.BigEndian.PutUint32(h[8:12], transID)
+	binary.BigEndian.PutUint16(h[12:14], orderID)
+	binary.BigEndian.PutUint16(h[14:16], length)
 }
 
 type segment struct {
@@ -95,10 +120,9 @@ func (seg *segment) length() int {
 	return headerSize + len(seg.b)
 }
 
-// | Version(1) | Type(1) | Flags(2) | StreamID(4) | TransID(2) | OrderID(2) | Checksum(16) | Length(2) |
-func newSegment(segType uint8, flags uint16, streamID uint32, transID uint16, orderID uint16, message []byte) (*segment, error) {
+func newSegment(segType uint8, flags uint16, streamID uint32, transID uint32, orderID uint16, message []byte) (*segment, error) {
 	length := len(message)
-	if length > segmentBodyMaxSize {
+	if length > segmentBodyLimit {
 		return nil, errSegmentBodyTooLarge
 	}
 	hdr := header(make([]byte, headerSize))
@@ -109,16 +133,6 @@ func newSegment(segType uint8, flags uint16, streamID uint32, transID uint16, or
 	return &segment{h: hdr, b: message}, nil
 }
 
-func newSYNSegment() *segment {
-	seg, _ := newSegment(segTypeMsgSYN, 0, 0, 0, 0, []byte(handshakeKey))
-	return seg
-}
-
-func newACKSegment(key []byte) *segment {
-	seg, _ := newSegment(segTypeMsgACK, 0, 0, 0, 0, key)
-	return seg
-}
-
 func newPingReqSegment(streamID uint32, id uint32) *segment {
 	b := make([]byte, 4)
 	binary.BigEndian.PutUint32(b, id)
@@ -141,6 +155,37 @@ func newRepSegment(streamID uint32, b []byte) *segment {
 	return seg
 }
 
+// newSACKSegment create a selective ack segment of the message transID, all
+// segments before nextID are received, missing are the gaps before
+// largestOrderID
+// | NextID(2) | LargestOrderID(2) | MissingOrderID(2) ... |
+func newSACKSegment(streamID uint32, transID uint32, nextID uint16, largestOrderID uint16, missing []uint16) *segment {
+	if len(missing) > maxSACKGaps {
+		missing = missing[:maxSACKGaps]
+	}
+	b := make([]byte, 4+len(missing)*2)
+	binary.BigEndian.PutUint16(b[0:2], nextID)
+	binary.BigEndian.PutUint16(b[2:4], largestOrderID)
+	for i, orderID := range missing {
+		binary.BigEndian.PutUint16(b[4+i*2:6+i*2], orderID)
+	}
+	seg, _ := newSegment(segTypeMsgSACK, 0, streamID, transID, 0, b)
+	return seg
+}
+
+func loadSACK(b []byte) (nextID uint16, largestOrderID uint16, missing []uint16, err error) {
+	if len(b) < 4 || len(b)%2 != 0 {
+		err = errSACKInvalid
+		return
+	}
+	nextID = binary.BigEndian.Uint16(b[0:2])
+	largestOrderID = binary.BigEndian.Uint16(b[2:4])
+	for i := 4; i < len(b); i += 2 {
+		missing = append(missing, binary.BigEndian.Uint16(b[i:i+2]))
+	}
+	return
+}
+
 func newSingleSegment(segType uint8, flags uint16, streamID uint32, message []byte) *segment {
 	hdr := header(make([]byte, headerSize))
 	hdr.encode(segType, flags, streamID, 0, 0, uint16(len(message)))
@@ -150,15 +195,75 @@ func newSingleSegment(segType uint8, flags uint16, streamID uint32, message []by
 	}
 }
 
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeSegment encode the segment bytes in the version, the checksum is
+// inserted after the header since version 1, the TransID is 2 bytes before
+// version 2
+// | Version(1) | Type(1) | Flags(2) | StreamID(4) | TransID(2) | OrderID(2) | Length(2) | Checksum(4) |
+func encodeSegment(version uint8, b []byte) []byte {
+	b[0] = version
+	size := headerSize
+	if version < 2 {
+		// drop the high 2 bytes of TransID
+		copy(b[2:], b[:8])
+		b = b[2:]
+		size = headerSizeV1
+	}
+	if version == 0 {
+		return b
+	}
+	out := make([]byte, len(b)+checksumSize)
+	copy(out, b[:size])
+	copy(out[size+checksumSize:], b[size:])
+	binary.BigEndian.PutUint32(out[size:], crc32.Checksum(out, castagnoli))
+	return out
+}
+
+// loadSegment load and validate the segment, the checksum field is removed
 func loadSegment(data []byte) (*segment, error) {
+	if len(data) == 0 {
+		return nil, errSegmentMalformed
+	}
+	size := headerSize
+	if data[0] < 2 {
+		size = headerSizeV1
+	}
+	if len(data) < size {
+		return nil, errSegmentMalformed
+	}
 	hdr := header(make([]byte, headerSize))
-	copy(hdr, data[0:headerSize])
-	// !IMPORTANT! must copy data!
-	b := make([]byte, len(data)-headerSize)
-	copy(b, data[headerSize:])
-	seg := &segment{h: hdr, b: b}
-	if hdr.Length() == 0 {
-		return seg, nil // FIXME!
+	if size == headerSizeV1 {
+		copy(hdr, data[0:8])
+		copy(hdr[10:], data[8:size])
+	} else {
+		copy(hdr, data[0:size])
+	}
+	body := data[size:]
+
+	switch hdr.Version() {
+	case 0:
+	case 1, 2:
+		if len(body) < checksumSize {
+			return nil, errSegmentMalformed
+		}
+		sum := binary.BigEndian.Uint32(body[:checksumSize])
+		crc := crc32.Update(0, castagnoli, data[:size])
+		crc = crc32.Update(crc, castagnoli, make([]byte, checksumSize))
+		crc = crc32.Update(crc, castagnoli, body[checksumSize:])
+		if crc != sum {
+			return nil, errSegmentChecksum
+		}
+		body = body[checksumSize:]
+	default:
+		return nil, errSegmentVersion
+	}
+
+	if int(hdr.Length()) != len(body) || len(body) > segmentBodyLimit {
+		return nil, errSegmentMalformed
 	}
-	return seg, nil
+	// !IMPORTANT! must copy data!
+	b := make([]byte, len(body))
+	copy(b, body)
+	return &segment{h: hdr, b: b}, nil
 }
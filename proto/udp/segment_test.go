@@ -0,0 +1,102 @@
+package udp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_encodeSegment(t *testing.T) {
+	message := []byte("hello, segment")
+	for _, version := range []uint8{0, 1, 2} {
+		seg, _ := newSegment(segTypeMsgTrans, 0, 3, 0x10001, 2, message)
+		b := encodeSegment(version, seg.bytes())
+		loaded, err := loadSegment(b)
+		if err != nil {
+			t.Fatalf("load segment of version %d failed: %s", version, err)
+		}
+		if loaded.h.Version() != version || loaded.h.StreamID() != 3 || loaded.h.OrderID() != 2 || !bytes.Equal(loaded.b, message) {
+			t.Errorf("segment of version %d is changed", version)
+		}
+		// the TransID is 2 bytes before version 2
+		want := uint32(0x10001)
+		if version < 2 {
+			want = 1
+		}
+		if loaded.h.TransID() != want {
+			t.Errorf("TransID of version %d is %d, want %d", version, loaded.h.TransID(), want)
+		}
+	}
+}
+
+func Test_loadSegment_Invalid(t *testing.T) {
+	seg, _ := newSegment(segTypeMsgTrans, 0, 0, 1, 0, []byte("hello, segment"))
+	b := encodeSegment(protoVersion, seg.bytes())
+
+	// every corrupted byte is detected
+	for i := range b {
+		c := append([]byte{}, b...)
+		c[i] ^= 0x10
+		if _, err := loadSegment(c); err == nil {
+			t.Errorf("corrupted byte %d is not detected", i)
+		}
+	}
+	c := append([]byte{}, b...)
+	c[len(c)-1] ^= 0xff
+	if _, err := loadSegment(c); err != errSegmentChecksum {
+		t.Errorf("load corrupted segment got %v", err)
+	}
+
+	if _, err := loadSegment(b[:headerSize-1]); err != errSegmentMalformed {
+		t.Errorf("load short segment got %v", err)
+	}
+	if _, err := loadSegment(encodeSegment(0, seg.bytes())[:headerSize+2]); err != errSegmentMalformed {
+		t.Errorf("load truncated segment got %v", err)
+	}
+	c = append([]byte{}, seg.bytes()...)
+	c[0] = protoVersion + 1
+	if _, err := loadSegment(c); err != errSegmentVersion {
+		t.Errorf("load segment of unknown version got %v", err)
+	}
+}
+
+func Test_Conn_DropStats(t *testing.T) {
+	client, server, closeFunc := newConnPair(t, nil)
+	defer closeFunc()
+
+	if client.version != protoVersion || server.version != protoVersion {
+		t.Fatalf("negotiated version is %d/%d, want %d", client.version, server.version, protoVersion)
+	}
+
+	seg := newSingleSegment(segTypeMsgStream, flagACK, 0, nil)
+	b := encodeSegment(client.version, seg.bytes())
+	b[len(b)-1] ^= 0xff // the checksum
+	if _, err := client.c.WriteTo(client.cipher.seal(client.id, b), client.remoteAddr()); err != nil {
+		t.Fatal(err)
+	}
+	// not sealed by the connection key
+	forged := append([]byte{}, client.cipher.seal(client.id, encodeSegment(client.version, seg.bytes()))...)
+	forged[len(forged)-1] ^= 0xff
+	if _, err := client.c.WriteTo(forged, client.remoteAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if s := server.DropStats(); s.Checksum == 1 && s.Auth == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := server.DropStats(); s.Checksum != 1 || s.Auth != 1 {
+		t.Errorf("drop stats is %+v", s)
+	}
+
+	// the connection still works
+	if err := client.Send([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := server.Recv(); err != nil || string(m) != "ping" {
+		t.Errorf("recv got %q, %v", m, err)
+	}
+}
@@ -157,3 +157,49 @@ func Test_msgRecving_GetMissing(t *testing.T) {
 		}()
 	}
 }
+
+func Test_msgRecving_SACK(t *testing.T) {
+	b := make([]byte, segmentBodyMaxSize*40)
+	rand.Read(b)
+	sending := newMsgSending(0, 0, 0, 0, b)
+	recving := newMsgRecving()
+
+	// in order segments are acked every ackInterval
+	sacks := 0
+	for orderID := uint16(0); orderID < ackInterval*2; orderID++ {
+		recving.Save(sending.GetSegmentByOrderID(orderID))
+		if _, _, _, ok := recving.SACK(); ok {
+			sacks++
+		}
+	}
+	if sacks != 2 {
+		t.Errorf("got %d SACK for %d in order segments", sacks, ackInterval*2)
+	}
+
+	// every out of order segment trigger a SACK at first
+	lost := uint16(ackInterval * 2)
+	for i := uint16(1); i <= fastRetransmitThreshold; i++ {
+		recving.Save(sending.GetSegmentByOrderID(lost + i))
+		nextID, largestOrderID, missing, ok := recving.SACK()
+		if !ok {
+			t.Fatalf("no SACK for out of order segment %d", lost+i)
+		}
+		if nextID != lost || largestOrderID != lost+i || len(missing) != 1 || missing[0] != lost {
+			t.Errorf("SACK is nextID = %d, largestOrderID = %d, missing = %v", nextID, largestOrderID, missing)
+		}
+
+		seg := newSACKSegment(0, 0, nextID, largestOrderID, missing)
+		n, l, m, err := loadSACK(seg.b)
+		if err != nil || n != nextID || l != largestOrderID || len(m) != len(missing) || m[0] != missing[0] {
+			t.Errorf("loadSACK mismatch: %d %d %v %v", n, l, m, err)
+		}
+	}
+	recving.Save(sending.GetSegmentByOrderID(lost + fastRetransmitThreshold + 1))
+	if _, _, _, ok := recving.SACK(); ok {
+		t.Errorf("SACK is not throttled")
+	}
+
+	if _, _, _, err := loadSACK([]byte{1, 2, 3}); err != errSACKInvalid {
+		t.Errorf("loadSACK invalid segment got %v", err)
+	}
+}
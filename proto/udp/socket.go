@@ -0,0 +1,487 @@
+package udp
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxPacketSize = segmentSizeLimit + packetOverhead
+
+// connPool manage all connections
+type connPool struct {
+	idConnMap  map[uint64]*Conn
+	pubConnMap map[string]*Conn // the client public key of handshake
+	m          *sync.Mutex
+	config     *Config
+}
+
+func newConnPool(config *Config) *connPool {
+	return &connPool{
+		idConnMap:  map[uint64]*Conn{},
+		pubConnMap: map[string]*Conn{},
+		m:          &sync.Mutex{},
+		config:     config,
+	}
+}
+
+// Get get the connection specified by connection ID
+func (p *connPool) Get(id uint64) (*Conn, bool) {
+	p.m.Lock()
+	c, ok := p.idConnMap[id]
+	p.m.Unlock()
+	return c, ok
+}
+
+// GetByClientPub get the connection created by the handshake of client key
+func (p *connPool) GetByClientPub(pub []byte) (*Conn, bool) {
+	p.m.Lock()
+	c, ok := p.pubConnMap[string(pub)]
+	p.m.Unlock()
+	return c, ok
+}
+
+// New create a connection with a random ID
+func (p *connPool) New(conn net.PacketConn, raddr net.Addr, pc *packetCipher, clientPub []byte) *Conn {
+	p.m.Lock()
+	defer p.m.Unlock()
+	var id uint64
+	for {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = binary.BigEndian.Uint64(b)
+		if _, ok := p.idConnMap[id]; !ok && id != 0 {
+			break
+		}
+	}
+	c := newConn(conn, raddr, id, p.config, pc)
+	c.clientPub = string(clientPub)
+	c.onClose = p.Delete
+	p.idConnMap[id] = c
+	p.pubConnMap[c.clientPub] = c
+	return c
+}
+
+// Add save the connection created by client handshake
+func (p *connPool) Add(c *Conn) {
+	c.onClose = p.Delete
+	p.m.Lock()
+	p.idConnMap[c.id] = c
+	p.m.Unlock()
+}
+
+// Len get the number of connections
+func (p *connPool) Len() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return len(p.idConnMap)
+}
+
+// Delete remove a conn from client pool
+func (p *connPool) Delete(conn *Conn) {
+	p.m.Lock()
+	delete(p.idConnMap, conn.id)
+	delete(p.pubConnMap, conn.clientPub)
+	p.m.Unlock()
+}
+
+// GarbageCollection close the idle connections
+func (p *connPool) GarbageCollection() {
+	conns := []*Conn{}
+	p.m.Lock()
+	for _, conn := range p.idConnMap {
+		if time.Since(conn.getLastActive()) > p.config.IdleTimeout {
+			conns = append(conns, conn)
+		} else {
+			conn.gc()
+		}
+	}
+	p.m.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+		conn.log.Debugf("%s is timeout, close it", conn)
+	}
+}
+
+// CloseAll close all connections
+func (p *connPool) CloseAll() {
+	conns := []*Conn{}
+	p.m.Lock()
+	for _, conn := range p.idConnMap {
+		conns = append(conns, conn)
+	}
+	p.m.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+type udpserver struct {
+	c net.PacketConn
+
+	connPool *connPool
+	config   *Config
+
+	// server side
+	isServer  bool
+	cookieKey cookieKey
+
+	clientCh chan *Conn
+	drops    dropCounters // the packets not belong to a connection
+	pmtu     bool         // DF bit is set, the path MTU can be probed
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup // the goroutines of socket
+}
+
+func newUDPServer(conn net.PacketConn, config *Config, isServer bool) *udpserver {
+	err := enableDontFragment(conn)
+	if err != nil {
+		config.Logger.Debugf("path MTU discovery is disabled: %s", err)
+	}
+	return &udpserver{
+		pmtu:      err == nil,
+		c:         conn,
+		connPool:  newConnPool(config),
+		config:    config,
+		isServer:  isServer,
+		cookieKey: newCookieKey(),
+		clientCh:  make(chan *Conn, defaultAcceptBacklog),
+		closeCh:   make(chan struct{}),
+	}
+}
+
+// start run the goroutines of socket, they are stopped by Close
+func (p *udpserver) start() {
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		p.recv()
+	}()
+	go func() {
+		defer p.wg.Done()
+		p.garbageCollection()
+	}()
+}
+
+// startConn run the goroutines of the connection
+func (p *udpserver) startConn(c *Conn) {
+	if !p.pmtu {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		c.pmtuLoop()
+	}()
+}
+
+func (p *udpserver) garbageCollection() {
+	ticker := time.NewTicker(p.config.gcInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.connPool.GarbageCollection()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+func (p *udpserver) recv() error {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, raddr, err := p.c.ReadFrom(buf)
+		if err != nil {
+			if p.isClosed() || errors.Is(err, net.ErrClosed) {
+				p.config.Logger.Debugf("socket is closed, quit recv()")
+				p.stop()
+				return nil
+			}
+			p.config.Logger.Errorf("ReadFrom error: %s", err)
+			return err
+		}
+		if err := p.handlePacket(buf[:n], raddr); err != nil {
+			p.config.Logger.Debugf("handle packet (from %s) failed: %s", raddr, err)
+		}
+	}
+}
+
+func (p *udpserver) handlePacket(b []byte, raddr net.Addr) error {
+	if len(b) < packetHeaderSize {
+		atomic.AddUint64(&p.drops.malformed, 1)
+		return errPacketInvalid
+	}
+	switch b[0] {
+	case packetData:
+		conn, ok := p.connPool.Get(binary.BigEndian.Uint64(b[1:9]))
+		if !ok {
+			atomic.AddUint64(&p.drops.unknownConn, 1)
+			return errConnUnknown
+		}
+		return conn.handlePacket(b, raddr)
+	case packetInitial:
+		if p.isServer {
+			err := p.handleInitial(b, raddr)
+			switch err {
+			case errPacketInvalid:
+				atomic.AddUint64(&p.drops.malformed, 1)
+			case errVersionMismatch:
+				atomic.AddUint64(&p.drops.version, 1)
+			}
+			return err
+		}
+	}
+	atomic.AddUint64(&p.drops.malformed, 1)
+	return errPacketInvalid
+}
+
+// DropStats get the counters of the packets dropped by the socket and its
+// connections
+func (p *udpserver) DropStats() DropStats {
+	stats := p.drops.stats()
+	p.connPool.m.Lock()
+	for _, c := range p.connPool.idConnMap {
+		stats.add(c.DropStats())
+	}
+	p.connPool.m.Unlock()
+	return stats
+}
+
+// handleInitial handle the client hello, the connection is created if the
+// cookie is valid
+func (p *udpserver) handleInitial(b []byte, raddr net.Addr) error {
+	initial, err := loadInitialPacket(b)
+	if err != nil {
+		return err
+	}
+	if initial.version < minProtoVersion {
+		return errVersionMismatch
+	}
+	version := initial.version // the newest version both support
+	if version > protoVersion {
+		version = protoVersion
+	}
+	if len(initial.cookie) == 0 || p.cookieKey.verify(raddr, initial.clientPub, initial.cookie) != nil {
+		// stateless, prove the client own the address before any work
+		_, err = p.c.WriteTo(newRetryPacket(p.cookieKey.new(raddr, initial.clientPub)), raddr)
+		return err
+	}
+
+	// the hello is lost
+	if conn, ok := p.connPool.GetByClientPub(initial.clientPub); ok {
+		_, err = p.c.WriteTo(conn.hello, raddr)
+		return err
+	}
+
+	// the client retry and timeout in handshake
+	if p.config.MaxConns > 0 && p.connPool.Len() >= p.config.MaxConns {
+		return errConnLimit
+	}
+	if len(p.clientCh) == cap(p.clientCh) {
+		return errAcceptBacklogFull
+	}
+
+	clientPub, err := ecdh.X25519().NewPublicKey(initial.clientPub)
+	if err != nil {
+		return err
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	shared, err := priv.ECDH(clientPub)
+	if err != nil {
+		return err
+	}
+	serverPub := priv.PublicKey().Bytes()
+	pc, err := newPacketCipher(shared, p.config.PSK, initial.clientPub, serverPub, true)
+	if err != nil {
+		return err
+	}
+
+	conn := p.connPool.New(p.c, raddr, pc, initial.clientPub)
+	options := p.config.negotiate(initial.options)
+	options.apply(conn)
+	conn.version = version
+	conn.hello = newHelloPacket(pc, conn.id, serverPub, version, options)
+	if _, err = p.c.WriteTo(conn.hello, raddr); err != nil {
+		return err
+	}
+	conn.helloAt = time.Now()
+	p.startConn(conn)
+	p.clientCh <- conn
+	return nil
+}
+
+// Accept wait the new client connection incoming, ErrSocketClosed is
+// returned after the socket is closed
+func (p *udpserver) Accept() (*Conn, error) {
+	select {
+	case c := <-p.clientCh:
+		return c, nil
+	case <-p.closeCh:
+		return nil, ErrSocketClosed
+	}
+}
+
+func (p *udpserver) isClosed() bool {
+	return isClosedChan(p.closeCh)
+}
+
+// stop close the connections and the packet conn
+func (p *udpserver) stop() {
+	p.closeOnce.Do(func() {
+		close(p.closeCh)
+		p.connPool.CloseAll()
+		p.c.Close()
+	})
+}
+
+// Close close all connections and the packet conn, it's returned after all
+// goroutines of socket quit
+func (p *udpserver) Close() error {
+	p.stop()
+	p.wg.Wait()
+	return nil
+}
+
+// ClientSocket is a UDP implement of Socket
+type ClientSocket struct {
+	*udpserver
+	raddr net.Addr
+}
+
+// NewClientSocket create a client socket
+func NewClientSocket(conn net.PacketConn, raddr net.Addr) (*ClientSocket, *Conn, error) {
+	return NewClientSocketWithConfig(conn, raddr, nil)
+}
+
+// NewClientSocketWithConfig create a client socket with the config, nil config
+// means the default
+func NewClientSocketWithConfig(conn net.PacketConn, raddr net.Addr, config *Config) (*ClientSocket, *Conn, error) {
+	config = config.withDefaults()
+	if err := config.check(); err != nil {
+		return nil, nil, err
+	}
+	sock := &ClientSocket{
+		udpserver: newUDPServer(conn, config, false),
+		raddr:     raddr,
+	}
+	c, err := sock.handshake()
+	if err != nil {
+		return nil, nil, err
+	}
+	sock.start()
+	sock.startConn(c)
+	sock.wg.Add(1)
+	go func() {
+		defer sock.wg.Done()
+		sock.pingLoop(c)
+	}()
+	return sock, c, nil
+}
+
+func (p *ClientSocket) handshake() (*Conn, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer p.c.SetReadDeadline(time.Time{})
+
+	var cookie []byte
+	buf := make([]byte, maxPacketSize)
+	for i := 0; i < handshakeMaxRetry; i++ {
+		initial := newInitialPacket(protoVersion, priv.PublicKey().Bytes(), cookie, p.config.handshakeOptions())
+		if _, err = p.c.WriteTo(initial, p.raddr); err != nil {
+			p.config.Logger.Warnf("handshake: write packet failed: %s", err)
+			return nil, err
+		}
+		sentAt := time.Now()
+
+		p.c.SetReadDeadline(time.Now().Add(defaultHandshakeTimeout))
+		n, raddr, err := p.c.ReadFrom(buf)
+		if err != nil {
+			p.config.Logger.Warnf("handshake: read packet failed: %s", err)
+			continue
+		}
+		if raddr.String() != p.raddr.String() {
+			p.config.Logger.Warnf("unknown from addr: %s", raddr.String())
+			continue
+		}
+		if n < packetHeaderSize {
+			continue
+		}
+
+		switch buf[0] {
+		case packetRetry:
+			cookie = append([]byte{}, buf[packetHeaderSize:n]...)
+		case packetHello:
+			pc, version, options, err := openHelloPacket(buf[:n], priv, p.config.PSK)
+			if err != nil {
+				p.config.Logger.Warnf("handshake: open hello failed: %s", err)
+				return nil, err
+			}
+			if version < minProtoVersion || version > protoVersion {
+				return nil, errVersionMismatch
+			}
+			c := newConn(p.c, p.raddr, binary.BigEndian.Uint64(buf[1:9]), p.config, pc)
+			c.version = version
+			options.apply(c)
+			c.nextStreamID = 1 // client open the odd streams
+			c.rtt.Update(time.Since(sentAt))
+			p.connPool.Add(c)
+			return c, nil
+		}
+	}
+	return nil, ErrTimeout
+}
+
+// pingLoop keep the connection alive until it's closed
+func (p *ClientSocket) pingLoop(c *Conn) {
+	ticker := time.NewTicker(p.config.pingInterval())
+	defer ticker.Stop()
+	for {
+		c.Ping() // ping timeout
+		select {
+		case <-ticker.C:
+		case <-c.shutdownCh:
+			return
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+// ServerSocket is a UDP implement of socket
+type ServerSocket struct {
+	*udpserver
+}
+
+// NewServerSocket create a UDPConn
+func NewServerSocket(conn net.PacketConn) (*ServerSocket, error) {
+	return NewServerSocketWithConfig(conn, nil)
+}
+
+// NewServerSocketWithConfig create a server socket with the config, nil config
+// means the default
+func NewServerSocketWithConfig(conn net.PacketConn, config *Config) (*ServerSocket, error) {
+	config = config.withDefaults()
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+	sock := &ServerSocket{
+		udpserver: newUDPServer(conn, config, true),
+	}
+	sock.start()
+	return sock, nil
+}
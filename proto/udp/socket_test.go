@@ -0,0 +1,142 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestSockets(t *testing.T, config *Config) (*ServerSocket, *ClientSocket, *Conn, *Conn) {
+	sc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssock, err := NewServerSocketWithConfig(sc, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csock, client, err := NewClientSocketWithConfig(cc, sc.LocalAddr(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ssock.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssock, csock, client, server
+}
+
+func waitClosed(t *testing.T, c *Conn, timeout time.Duration) {
+	select {
+	case <-c.shutdownCh:
+	case <-time.After(timeout):
+		t.Fatalf("%s is not closed in %s", c, timeout)
+	}
+}
+
+func Test_ServerSocket_Close(t *testing.T) {
+	ssock, csock, client, server := newTestSockets(t, nil)
+	defer csock.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Recv()
+		done <- err
+	}()
+	go func() {
+		ssock.Accept() // wait in Accept when closing
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ssock.Close()
+
+	if _, err := ssock.Accept(); err != ErrSocketClosed {
+		t.Errorf("Accept after closed got %v", err)
+	}
+	if err := <-done; err != ErrConnectionShutdown {
+		t.Errorf("Recv after closed got %v", err)
+	}
+	if ssock.connPool.Len() != 0 {
+		t.Errorf("%d connections left after closed", ssock.connPool.Len())
+	}
+	// the client is notified
+	waitClosed(t, client, time.Second)
+	if csock.connPool.Len() != 0 {
+		t.Errorf("closed client connection is not removed")
+	}
+	if err := ssock.Close(); err != nil {
+		t.Errorf("close again got %v", err)
+	}
+}
+
+func Test_Conn_Close(t *testing.T) {
+	ssock, csock, client, server := newTestSockets(t, nil)
+	defer ssock.Close()
+	defer csock.Close()
+
+	client.Close()
+	waitClosed(t, server, time.Second)
+	if ssock.connPool.Len() != 0 {
+		t.Errorf("closed server connection is not removed")
+	}
+	if err := client.Send([]byte("closed")); err != ErrConnectionShutdown {
+		t.Errorf("Send after closed got %v", err)
+	}
+}
+
+func Test_ServerSocket_IdleTimeout(t *testing.T) {
+	config := &Config{IdleTimeout: 300 * time.Millisecond}
+	ssock, csock, client, server := newTestSockets(t, config)
+	defer ssock.Close()
+
+	// the client ping keep it alive
+	time.Sleep(3 * config.IdleTimeout)
+	if server.isClosed() {
+		t.Fatal("server connection is closed when the client is alive")
+	}
+
+	// the client is gone without the close segment
+	client.onClose = nil
+	client.shutdown()
+	csock.c.Close()
+	waitClosed(t, server, 4*config.IdleTimeout)
+	if ssock.connPool.Len() != 0 {
+		t.Errorf("idle connection is not removed")
+	}
+	csock.Close()
+}
+
+func Test_ServerSocket_MaxConns(t *testing.T) {
+	ssock, csock, _, _ := newTestSockets(t, &Config{MaxConns: 1})
+	defer ssock.Close()
+	defer csock.Close()
+
+	cc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := NewClientSocket(cc, ssock.c.LocalAddr())
+		done <- err
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if n := ssock.connPool.Len(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+	cc.Close()
+	if err := <-done; err == nil {
+		t.Errorf("handshake over the limit succeeded")
+	}
+}
+
+func Test_Config_Invalid(t *testing.T) {
+	for _, config := range []*Config{{IdleTimeout: -1}, {MaxConns: -1}} {
+		if err := config.withDefaults().check(); err != ErrConfigInvalid {
+			t.Errorf("check %+v got %v", config, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package udp
+
+import "sync/atomic"
+
+// DropStats is the counters of the packets dropped
+type DropStats struct {
+	Malformed   uint64 // too short, bad length or unknown kind
+	Checksum    uint64 // checksum mismatch
+	Version     uint64 // unsupported or not negotiated version
+	Auth        uint64 // authentication failed or replayed
+	UnknownConn uint64 // no such connection
+}
+
+func (s *DropStats) add(o DropStats) {
+	s.Malformed += o.Malformed
+	s.Checksum += o.Checksum
+	s.Version += o.Version
+	s.Auth += o.Auth
+	s.UnknownConn += o.UnknownConn
+}
+
+type dropCounters struct {
+	malformed   uint64
+	checksum    uint64
+	version     uint64
+	auth        uint64
+	unknownConn uint64
+}
+
+// countSegmentError count the error of loadSegment
+func (d *dropCounters) countSegmentError(err error) {
+	switch err {
+	case errSegmentChecksum:
+		atomic.AddUint64(&d.checksum, 1)
+	case errSegmentVersion:
+		atomic.AddUint64(&d.version, 1)
+	default:
+		atomic.AddUint64(&d.malformed, 1)
+	}
+}
+
+func (d *dropCounters) stats() DropStats {
+	return DropStats{
+		Malformed:   atomic.LoadUint64(&d.malformed),
+		Checksum:    atomic.LoadUint64(&d.checksum),
+		Version:     atomic.LoadUint64(&d.version),
+		Auth:        atomic.LoadUint64(&d.auth),
+		UnknownConn: atomic.LoadUint64(&d.unknownConn),
+	}
+}
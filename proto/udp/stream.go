@@ -0,0 +1,339 @@
+package udp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultAcceptBacklog = 64
+
+var (
+	// ErrStreamClosed is the error about sending in a closed stream
+	ErrStreamClosed = errors.New("stream is closed")
+	// ErrStreamReset is the error about the stream is reset by remote endpoint
+	ErrStreamReset = errors.New("stream is reset")
+)
+
+// msgQueue is the received messages of a stream in order
+type msgQueue struct {
+	msgs  [][]byte
+	lock  sync.Mutex
+	ready chan struct{}
+}
+
+func newMsgQueue() *msgQueue {
+	return &msgQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *msgQueue) push(m []byte) {
+	q.lock.Lock()
+	q.msgs = append(q.msgs, m)
+	q.lock.Unlock()
+	q.notify()
+}
+
+// notify wake up a waiting reader
+func (q *msgQueue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *msgQueue) pop() ([]byte, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.msgs) == 0 {
+		return nil, false
+	}
+	m := q.msgs[0]
+	q.msgs[0] = nil
+	q.msgs = q.msgs[1:]
+	if len(q.msgs) > 0 {
+		q.notify()
+	}
+	return m, true
+}
+
+// Stream is a independent message stream in a Conn, the messages sent one by
+// one are received in order
+type Stream struct {
+	id      uint32
+	conn    *Conn
+	inbound *msgQueue
+
+	lock         sync.Mutex
+	localClosed  bool // FIN is sent
+	remoteClosed bool // FIN is received
+	reset        bool
+
+	established chan struct{} // SYN is acked
+	finAcked    chan struct{}
+	resetCh     chan struct{}
+}
+
+func newStream(conn *Conn, id uint32) *Stream {
+	return &Stream{
+		id:          id,
+		conn:        conn,
+		inbound:     newMsgQueue(),
+		established: make(chan struct{}),
+		finAcked:    make(chan struct{}),
+		resetCh:     make(chan struct{}),
+	}
+}
+
+// ID get the stream ID
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// SendMsg send a single message, it's returned after the message is received
+// by remote endpoint
+func (s *Stream) SendMsg(message []byte) error {
+	s.lock.Lock()
+	reset, closed := s.reset, s.localClosed
+	s.lock.Unlock()
+	if reset {
+		return ErrStreamReset
+	}
+	if closed {
+		return ErrStreamClosed
+	}
+	return s.conn.sendMsg(s, message, nil)
+}
+
+// RecvMsg recv a single message, io.EOF is returned if remote endpoint closed
+// the stream and all messages are read
+func (s *Stream) RecvMsg() ([]byte, error) {
+	return s.recvMsg(nil)
+}
+
+// recvMsg recv a single message before deadline is closed
+func (s *Stream) recvMsg(deadline <-chan struct{}) ([]byte, error) {
+	for {
+		if m, ok := s.inbound.pop(); ok {
+			return m, nil
+		}
+		s.lock.Lock()
+		reset, closed := s.reset, s.remoteClosed
+		s.lock.Unlock()
+		if reset {
+			return nil, ErrStreamReset
+		}
+		if closed {
+			return nil, io.EOF
+		}
+		select {
+		case <-s.inbound.ready:
+		case <-deadline:
+			return nil, os.ErrDeadlineExceeded
+		case <-s.conn.shutdownCh:
+			return nil, ErrConnectionShutdown
+		}
+	}
+}
+
+// Close half close the stream, the messages of remote endpoint can still be
+// received
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.localClosed || s.reset {
+		s.lock.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	s.lock.Unlock()
+
+	err := s.conn.control(flagFIN, s.id, s.finAcked)
+	s.conn.tryDeleteStream(s)
+	return err
+}
+
+// Reset hard close the stream in both sides
+func (s *Stream) Reset() error {
+	if !s.setReset() {
+		return nil
+	}
+	s.conn.deleteStream(s.id)
+	return s.conn.writeStreamSegment(flagRST, s.id)
+}
+
+func (s *Stream) setReset() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.reset {
+		return false
+	}
+	s.reset = true
+	close(s.resetCh)
+	s.inbound.notify()
+	return true
+}
+
+func (s *Stream) setRemoteClosed() {
+	s.lock.Lock()
+	s.remoteClosed = true
+	s.lock.Unlock()
+	s.inbound.notify()
+}
+
+func (s *Stream) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.localClosed || !s.remoteClosed {
+		return false
+	}
+	select {
+	case <-s.finAcked:
+		return true
+	default:
+		return false
+	}
+}
+
+// OpenStream open a new stream
+func (c *Conn) OpenStream() (*Stream, error) {
+	c.streamLock.Lock()
+	id := c.nextStreamID
+	c.nextStreamID += 2
+	s := newStream(c, id)
+	c.streams[id] = s
+	c.streamLock.Unlock()
+
+	if err := c.control(flagSYN, id, s.established); err != nil {
+		c.deleteStream(id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream wait the stream opened by remote endpoint
+func (c *Conn) AcceptStream() (*Stream, error) {
+	select {
+	case s := <-c.acceptCh:
+		return s, nil
+	case <-c.shutdownCh:
+		return nil, ErrConnectionShutdown
+	}
+}
+
+func (c *Conn) getStream(id uint32) *Stream {
+	c.streamLock.Lock()
+	s := c.streams[id]
+	c.streamLock.Unlock()
+	return s
+}
+
+func (c *Conn) deleteStream(id uint32) {
+	if id == 0 {
+		return // the default stream is always here
+	}
+	c.streamLock.Lock()
+	delete(c.streams, id)
+	c.streamLock.Unlock()
+}
+
+// tryDeleteStream delete the stream if it's closed in both sides
+func (c *Conn) tryDeleteStream(s *Stream) {
+	if s.isClosed() {
+		c.deleteStream(s.id)
+	}
+}
+
+func (c *Conn) writeStreamSegment(flags uint16, id uint32) error {
+	seg, _ := newSegment(segTypeMsgStream, flags, id, 0, 0, nil)
+	return c.write(seg.bytes())
+}
+
+// control send the stream control segment until done
+func (c *Conn) control(flags uint16, id uint32, done chan struct{}) error {
+	deadline := time.After(defaultRequestTimeout)
+	for {
+		if err := c.writeStreamSegment(flags, id); err != nil {
+			return err
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(c.rtt.RTO()):
+		case <-deadline:
+			return ErrTimeout
+		case <-c.shutdownCh:
+			return ErrConnectionShutdown
+		}
+	}
+}
+
+func (c *Conn) handleStream(seg *segment) error {
+	flags := seg.h.Flags()
+	id := seg.h.StreamID()
+	s := c.getStream(id)
+
+	switch {
+	case flags&flagRST != 0:
+		if s != nil && id != 0 {
+			s.setReset()
+			c.deleteStream(id)
+		}
+		return nil
+
+	case flags&flagSYN != 0:
+		if s == nil {
+			c.streamLock.Lock()
+			if id == 0 || id%2 == c.nextStreamID%2 {
+				// the remote endpoint can not open this stream
+				c.streamLock.Unlock()
+				return c.writeStreamSegment(flagRST, id)
+			}
+			s = newStream(c, id)
+			c.streams[id] = s
+			c.streamLock.Unlock()
+			select {
+			case c.acceptCh <- s:
+			default:
+				c.deleteStream(id)
+				return c.writeStreamSegment(flagRST, id)
+			}
+		}
+		// ack the duplicate SYN too
+		return c.writeStreamSegment(flagACK, id)
+
+	case flags&flagFIN != 0 && flags&flagACK != 0:
+		if s != nil {
+			s.lock.Lock()
+			select {
+			case <-s.finAcked:
+			default:
+				close(s.finAcked)
+			}
+			s.lock.Unlock()
+			c.tryDeleteStream(s)
+		}
+		return nil
+
+	case flags&flagFIN != 0:
+		if s != nil {
+			s.setRemoteClosed()
+			defer c.tryDeleteStream(s)
+		}
+		// ack the FIN of deleted stream too, the ack may be lost
+		return c.writeStreamSegment(flagFIN|flagACK, id)
+
+	case flags&flagACK != 0:
+		if s != nil {
+			s.lock.Lock()
+			select {
+			case <-s.established:
+			default:
+				close(s.established)
+			}
+			s.lock.Unlock()
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package udp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// newConnPair create a connected client and server Conn on loopback
+func newConnPair(t *testing.T, config *Config) (client *Conn, server *Conn, closeFunc func()) {
+	return newConnPairWith(t, config, nil)
+}
+
+// newConnPairWith create the connections over the packet conns wrapped by
+// wrap, nil wrap means the loopback UDP
+func newConnPairWith(t *testing.T, config *Config, wrap func(net.PacketConn) net.PacketConn) (client *Conn, server *Conn, closeFunc func()) {
+	if wrap == nil {
+		wrap = func(c net.PacketConn) net.PacketConn { return c }
+	}
+	sc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ssock, err := NewServerSocketWithConfig(wrap(sc), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csock, client, err := NewClientSocketWithConfig(wrap(cc), sc.LocalAddr(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server, err = ssock.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	return client, server, func() {
+		csock.Close()
+		ssock.Close()
+		cc.Close()
+		sc.Close()
+	}
+}
+
+func Test_Stream(t *testing.T) {
+	client, server, closeFunc := newConnPair(t, nil)
+	defer closeFunc()
+
+	// echo every accepted stream
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					m, err := s.RecvMsg()
+					if err != nil {
+						s.Close()
+						return
+					}
+					s.SendMsg(m)
+				}
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := client.OpenStream()
+			if err != nil {
+				t.Errorf("OpenStream failed: %s", err)
+				return
+			}
+			if s.ID()%2 != 1 {
+				t.Errorf("client stream ID %d is not odd", s.ID())
+			}
+			for j := 0; j < 20; j++ {
+				m := []byte(fmt.Sprintf("stream %d message %d", s.ID(), j))
+				m = bytes.Repeat(m, i*j*10+1)
+				if err := s.SendMsg(m); err != nil {
+					t.Errorf("SendMsg failed: %s", err)
+					return
+				}
+				rm, err := s.RecvMsg()
+				if err != nil {
+					t.Errorf("RecvMsg failed: %s", err)
+					return
+				}
+				if !bytes.Equal(m, rm) {
+					t.Errorf("stream %d message %d mismatch", s.ID(), j)
+				}
+			}
+			s.Close()
+			if _, err := s.RecvMsg(); err != io.EOF {
+				t.Errorf("RecvMsg after closed got %v, want EOF", err)
+			}
+			if err := s.SendMsg([]byte("closed")); err != ErrStreamClosed {
+				t.Errorf("SendMsg after closed got %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	client.streamLock.Lock()
+	n := len(client.streams)
+	client.streamLock.Unlock()
+	if n != 1 {
+		t.Errorf("%d streams left in client, want the default only", n)
+	}
+}
+
+func Test_Stream_Reset(t *testing.T) {
+	client, server, closeFunc := newConnPair(t, nil)
+	defer closeFunc()
+
+	s, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.ID() != s.ID() {
+		t.Fatalf("accepted stream %d, want %d", ss.ID(), s.ID())
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := ss.RecvMsg()
+		done <- err
+	}()
+	s.Reset()
+	if err := <-done; err != ErrStreamReset {
+		t.Errorf("RecvMsg of reset stream got %v", err)
+	}
+	if err := s.SendMsg([]byte("reset")); err != ErrStreamReset {
+		t.Errorf("SendMsg of reset stream got %v", err)
+	}
+}
+
+func Test_Conn_ConcurrentSendMsg(t *testing.T) {
+	client, server, closeFunc := newConnPair(t, nil)
+	defer closeFunc()
+
+	// more messages than the sending slots
+	total := maxSendPoolSize * 3
+	var wg sync.WaitGroup
+	for i := 0; i < total; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := client.SendMsg([]byte(fmt.Sprintf("message %d", i))); err != nil {
+				t.Errorf("SendMsg failed: %s", err)
+			}
+		}(i)
+	}
+	got := map[string]bool{}
+	for i := 0; i < total; i++ {
+		m, err := server.RecvMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[string(m)] = true
+	}
+	wg.Wait()
+	if len(got) != total {
+		t.Errorf("got %d different messages, want %d", len(got), total)
+	}
+}
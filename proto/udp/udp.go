@@ -6,12 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sort"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/ooclab/es/logger"
 )
 
 const (
@@ -19,29 +20,38 @@ const (
 	defaultTimeout = 100
 	maxTimeout     = 1600
 
-	// TODO: sendWindowSize should changed dynamically
 	defaultSendWindowSize = 64
 	minSendWindowSize     = 8
 	maxSendWindowSize     = 1024
 
-	defaultConnTranSize   = 10
 	defaultConnTimeout    = 30 * time.Second
 	defaultPingInterval   = 6 * time.Second
 	defaultPingTimeout    = 3 * time.Second
+	defaultGCInterval     = 10 * time.Second
 	defaultRequestTimeout = 12 * time.Second
-	defaultSendingTimeout = 60 * time.Second // FIXME!
 
-	maxRecvPoolSize = 10
-	maxSendPoolSize = 10
+	maxSendPoolSize = 64                  // the max sending messages of a conn
+	maxRecvPoolSize = maxSendPoolSize * 2 // the max not completed recving messages of a conn
 
-	sendMsgMaxTimes = 999              // FIXME!
-	maxMsgSize      = 1024 * 1024 * 16 // 16M
+	sendMsgMaxTimes = 999 // FIXME!
+
+	// the receiver send a SACK for each of the first fastRetransmitThreshold
+	// out of order segments, then every sackInterval out of order segments,
+	// and a cumulative one every ackInterval segments.
+	// the sender retransmit a segment reported missing fastRetransmitThreshold
+	// times at once.
+	fastRetransmitThreshold = 3
+	sackInterval            = 8
+	ackInterval             = minSendWindowSize / 2
+	maxPendingSACK          = 64
+	maxMsgSize              = 1024 * 1024 * 16 // 16M
 
 	// response status
 	responseStatusUnknownType = 0
 	queryReceiveNotExist      = 1
 	queryReceiveCompleted     = 2
 	queryReceiveNotCompleted  = 3
+	cancelReceiveDone         = 4
 )
 
 var (
@@ -51,15 +61,25 @@ var (
 	ErrConnectionShutdown = errors.New("connection is shutdown")
 	// ErrSegTypeUnknown is the error abount unknown message type
 	ErrSegTypeUnknown = errors.New("unknown message type")
+	// ErrCongestionUnknown is the error about unknown congestion control algorithm
+	ErrCongestionUnknown = errors.New("unknown congestion control algorithm")
+	// ErrConfigInvalid is the error about the negative timeout or limit in config
+	ErrConfigInvalid = errors.New("invalid config")
+	// ErrSocketClosed is the error about accepting in a closed socket
+	ErrSocketClosed = errors.New("socket is closed")
 
 	errSendingListFull = errors.New("sending list is full")
 	errRecvingListFull = errors.New("recving list is full")
 
 	errSegmentChecksum     = errors.New("segment checksum error")
-	errClientExist         = errors.New("client is exist in ClientPool")
+	errSegmentMalformed    = errors.New("malformed segment")
+	errSegmentVersion      = errors.New("segment version is not supported")
+	errConnUnknown         = errors.New("unknown connection")
+	errConnLimit           = errors.New("too many connections")
+	errAcceptBacklogFull   = errors.New("accept backlog is full")
 	errSegmentBodyTooLarge = errors.New("segment body is too large")
-
-	errTransIDTooLarge = errors.New("transID is larger than defaultConnTranSize")
+	errSACKInvalid         = errors.New("invalid SACK segment")
+	errMsgTooLarge         = errors.New("message is too large")
 )
 
 type msgRecving struct {
@@ -72,13 +92,29 @@ type msgRecving struct {
 
 	// !IMPORTANT! completed is a fag
 	// It means this msgRecving should be take if re trans message incoming and this flag is true
-	completed bool
-	lock      sync.Mutex
+	completed  bool
+	lock       sync.Mutex
+	streamID   uint32
+	lastActive time.Time // the time of last segment saved, or completed
+	flags      uint16
+
+	arrived    int  // segments saved since the last SACK
+	outOfOrder int  // out of order segments since nextID moved
+	sackNow    bool // a SACK should be sent for the out of order segment
+
+	fec    *reedSolomon // nil if FEC is disabled
+	groups map[uint16]*fecGroup
+
+	cancelled bool // the sender give up, it's completed without message
+
+	log logger.Logger
 }
 
 func newMsgRecving() *msgRecving {
 	return &msgRecving{
-		saved: map[uint16]*segment{},
+		saved:  map[uint16]*segment{},
+		groups: map[uint16]*fecGroup{},
+		log:    logger.Discard,
 	}
 }
 
@@ -103,19 +139,32 @@ func (m *msgRecving) GetMissing() (uint16, []uint16) {
 func (m *msgRecving) Save(seg *segment) ([]byte, error) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	return m.save(seg), nil
+}
 
+// save save the segment, the message is returned if it's completed
+func (m *msgRecving) save(seg *segment) []byte {
+	if m.completed {
+		return nil
+	}
 	oid := seg.h.OrderID()
 	if oid < m.nextID || (oid >= m.nextID && m.saved[oid] != nil) {
-		logrus.Warnf("dumplicate segment: %s", seg.h.String())
-		return nil, nil
+		m.log.Debugf("dumplicate segment: %s", seg.h.String())
+		return nil
+	}
+	if m.fec != nil {
+		m.saveShard(seg)
 	}
 
 	m.readLength += uint32(len(seg.b))
+	m.lastActive = time.Now()
 	if m.largestOrderID < oid {
 		m.largestOrderID = oid
 	}
+	m.arrived++
 
 	if oid == m.nextID {
+		m.outOfOrder = 0
 		if oid == 0 {
 			// FIXME!
 			m.needLength = binary.BigEndian.Uint32(seg.b[0:4])
@@ -138,11 +187,16 @@ func (m *msgRecving) Save(seg *segment) ([]byte, error) {
 		}
 	} else {
 		m.saved[oid] = seg
+		m.outOfOrder++
+		if m.outOfOrder <= fastRetransmitThreshold || m.outOfOrder%sackInterval == 0 {
+			m.sackNow = true
+		}
 	}
 
 	// FIXME: readLength is enough?
 	if m.needLength > 0 && m.needLength <= m.readLength {
 		m.completed = true
+		m.groups = nil
 		if len(m.saved) > 0 {
 			// read message completed
 			sl := []uint16{}
@@ -155,10 +209,57 @@ func (m *msgRecving) Save(seg *segment) ([]byte, error) {
 			}
 		}
 		// TODO: cleanup ?
-		return m.readBuf.Bytes(), nil
+		return m.readBuf.Bytes()
 	}
 
-	return nil, nil
+	return nil
+}
+
+// SACK get the selective ack should be sent after Save, ok is false if no
+// SACK is needed now
+func (m *msgRecving) SACK() (nextID uint16, largestOrderID uint16, missing []uint16, ok bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.completed || (!m.sackNow && m.arrived < ackInterval) {
+		return
+	}
+	m.sackNow = false
+	m.arrived = 0
+	for i := m.nextID; i < m.largestOrderID && len(missing) < maxSACKGaps; i++ {
+		if _, saved := m.saved[i]; !saved {
+			missing = append(missing, i)
+		}
+	}
+	return m.nextID, m.largestOrderID, missing, true
+}
+
+// expired report whether the msgRecving can be forgot. the completed one is
+// kept for the query of sender.
+func (m *msgRecving) expired(now time.Time) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.completed {
+		return now.Sub(m.lastActive) > defaultRequestTimeout
+	}
+	return now.Sub(m.lastActive) > defaultConnTimeout
+}
+
+// Cancel forget the message not completed, false is returned if it's
+// completed already
+func (m *msgRecving) Cancel() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.completed {
+		return m.cancelled
+	}
+	m.completed = true
+	m.cancelled = true
+	m.saved = nil
+	m.groups = nil
+	m.readBuf.Reset()
+	m.lastActive = time.Now()
+	return true
 }
 
 func (m *msgRecving) IsCompleted() bool {
@@ -172,11 +273,15 @@ type msgSending struct {
 	types    uint8
 	flags    uint16
 	streamID uint32
-	transID  uint16
+	transID  uint32
 	message  []byte
+	bodySize int          // the max body of a segment
+	fec      *reedSolomon // nil if FEC is disabled
+
+	sacks chan []byte // the SACK from remote endpoint
 }
 
-func newMsgSending(types uint8, flags uint16, streamID uint32, transID uint16, message []byte) *msgSending {
+func newMsgSending(types uint8, flags uint16, streamID uint32, transID uint32, message []byte) *msgSending {
 	length := len(message)
 	multiHdr := make([]byte, 4)
 	binary.BigEndian.PutUint32(multiHdr, uint32(length+4))
@@ -188,13 +293,15 @@ func newMsgSending(types uint8, flags uint16, streamID uint32, transID uint16, m
 		streamID: streamID,
 		transID:  transID,
 		message:  message,
+		bodySize: segmentBodyMaxSize,
+		sacks:    make(chan []byte, maxPendingSACK),
 	}
 }
 
 func (m *msgSending) segmentCount() uint16 {
 	length := len(m.message)
-	c := length / segmentBodyMaxSize
-	if length%segmentBodyMaxSize != 0 {
+	c := length / m.bodySize
+	if length%m.bodySize != 0 {
 		c++
 	}
 	return uint16(c)
@@ -206,11 +313,11 @@ func (m *msgSending) IterBufferd() <-chan *segment {
 	ch := make(chan *segment, sum)
 	go func() {
 		for i := 0; i < sum; i++ {
-			end := (i + 1) * segmentBodyMaxSize
+			end := (i + 1) * m.bodySize
 			if end > length {
 				end = length
 			}
-			b := m.message[i*segmentBodyMaxSize : end]
+			b := m.message[i*m.bodySize : end]
 			seg, _ := newSegment(m.types, m.flags, m.streamID, m.transID, uint16(i), b)
 			ch <- seg
 		}
@@ -220,8 +327,8 @@ func (m *msgSending) IterBufferd() <-chan *segment {
 }
 
 func (m *msgSending) GetSegmentByOrderID(orderID uint16) *segment {
-	start := int(orderID) * segmentBodyMaxSize
-	end := start + segmentBodyMaxSize
+	start := int(orderID) * m.bodySize
+	end := start + m.bodySize
 	if end > len(m.message) {
 		end = len(m.message)
 	}
@@ -232,28 +339,43 @@ func (m *msgSending) GetSegmentByOrderID(orderID uint16) *segment {
 
 // Conn is a UDP implement of es.Conn
 type Conn struct {
-	c     *net.UDPConn
-	raddr *net.UDPAddr
-	id    uint32
-
-	rl      []*msgRecving // recving list
-	rlMutex sync.Mutex
-
-	sl      []*msgSending // sending list
-	slMutex sync.Mutex
-
-	slWait      map[uint16]chan struct{} // wait transID
+	c        net.PacketConn
+	raddr    net.Addr
+	addrLock sync.Mutex
+	id       uint64 // the random connection ID
+
+	cipher    *packetCipher
+	hello     []byte    // the server hello
+	clientPub string    // the client key of handshake
+	helloAt   time.Time // the server hello is sent, for the first RTT sample
+	version   uint8     // the negotiated protocol version
+	fec       *reedSolomon
+	pmtu      *pmtuState
+	drops     dropCounters
+
+	rl        map[uint32]*msgRecving // recving list
+	rlPending map[uint32]*msgRecving // the recving may be not completed
+	rlMutex   sync.Mutex
+
+	sl          map[uint32]*msgSending // sending list
+	slMutex     sync.Mutex
+	slots       chan struct{} // limit the sending messages
+	nextTransID uint32
+
+	slWait      map[uint32]chan struct{} // wait transID
 	slWaitMutex sync.Mutex
 
-	// wait sending complete single
-	ss      map[uint16]chan struct{}
-	ssMutex sync.Mutex
-	sws     int // the max segment in a sending loop
+	cc  congestionController // decide the max segment in a sending loop
+	rtt rttEstimator
 
 	lastActiveMutex sync.Mutex
 	lastActive      time.Time
 
-	inbound chan []byte
+	streams      map[uint32]*Stream
+	nextStreamID uint32 // client open the odd streams, server open the even
+	streamLock   sync.Mutex
+	acceptCh     chan *Stream
+	stream0      *Stream // the default stream of SendMsg and RecvMsg
 
 	// requests is used to send a inner request
 	requests     map[uint32]chan []byte
@@ -265,31 +387,61 @@ type Conn struct {
 	pingID   uint32
 	pingLock sync.Mutex
 
+	// net.Conn
+	rd       *deadline
+	wd       *deadline
+	readBuf  []byte
+	readLock sync.Mutex
+
 	shutdownCh chan struct{}
+	closeOnce  sync.Once
+	onClose    func(*Conn) // remove the conn from socket
+
+	log logger.Logger
 }
 
-func newConn(conn *net.UDPConn, raddr *net.UDPAddr, id uint32) *Conn {
-	return &Conn{
+func newConn(conn net.PacketConn, raddr net.Addr, id uint64, config *Config, pc *packetCipher) *Conn {
+	c := &Conn{
 		c:          conn,
 		raddr:      raddr,
 		id:         id,
-		rl:         make([]*msgRecving, defaultConnTranSize),
-		sl:         make([]*msgSending, defaultConnTranSize),
-		ss:         make(map[uint16]chan struct{}),
-		sws:        defaultSendWindowSize,
+		cipher:     pc,
+		rl:         make(map[uint32]*msgRecving),
+		rlPending:  make(map[uint32]*msgRecving),
+		sl:         make(map[uint32]*msgSending),
+		slots:      make(chan struct{}, maxSendPoolSize),
+		cc:         newCongestionController(config.CongestionControl),
 		lastActive: time.Now(),
-		inbound:    make(chan []byte, 1),
+		pmtu:       newPMTUState(),
+
+		streams:      make(map[uint32]*Stream),
+		nextStreamID: 2,
+		acceptCh:     make(chan *Stream, defaultAcceptBacklog),
 
 		pings:    make(map[uint32]chan struct{}),
 		requests: make(map[uint32]chan []byte),
-		slWait:   make(map[uint16]chan struct{}),
+		slWait:   make(map[uint32]chan struct{}),
+
+		rd: newDeadline(),
+		wd: newDeadline(),
 
 		shutdownCh: make(chan struct{}),
+
+		log: config.Logger.WithField("conn_id", fmt.Sprintf("%016x", id)),
 	}
+	c.stream0 = newStream(c, 0)
+	c.streams[0] = c.stream0
+	return c
 }
 
 // RemoteAddr get the address of remote endpoint
 func (c *Conn) RemoteAddr() net.Addr {
+	return c.remoteAddr()
+}
+
+func (c *Conn) remoteAddr() net.Addr {
+	c.addrLock.Lock()
+	defer c.addrLock.Unlock()
 	return c.raddr
 }
 
@@ -298,28 +450,61 @@ func (c *Conn) LocalAddr() net.Addr {
 	return c.c.LocalAddr()
 }
 
+// DropStats get the counters of the packets dropped by this connection
+func (c *Conn) DropStats() DropStats {
+	return c.drops.stats()
+}
+
 func (c *Conn) String() string {
-	return fmt.Sprintf("conn %d: %s(L) -- %s(R)", c.id, c.LocalAddr(), c.RemoteAddr())
+	return fmt.Sprintf("conn %016x: %s(L) -- %s(R)", c.id, c.LocalAddr(), c.RemoteAddr())
 }
 
-func (c *Conn) getRecving(transID uint16) (*msgRecving, error) {
-	if transID >= defaultConnTranSize {
-		return nil, errTransIDTooLarge
-	}
+func (c *Conn) getRecving(transID uint32) *msgRecving {
 	c.rlMutex.Lock()
 	recving := c.rl[transID]
 	c.rlMutex.Unlock()
-	return recving, nil
+	return recving
 }
 
-func (c *Conn) setRecving(transID uint16, recving *msgRecving) error {
-	if transID >= defaultConnTranSize {
-		return errTransIDTooLarge
-	}
+// newRecving create the msgRecving of a new incoming message
+func (c *Conn) newRecving(transID uint32, streamID uint32, flags uint16) (*msgRecving, error) {
 	c.rlMutex.Lock()
+	defer c.rlMutex.Unlock()
+	if recving := c.rl[transID]; recving != nil {
+		return recving, nil
+	}
+	// c.rl keeps the completed messages for a while, count the pending
+	// ones only
+	for id, v := range c.rlPending {
+		if v.IsCompleted() {
+			delete(c.rlPending, id)
+		}
+	}
+	if len(c.rlPending) >= maxRecvPoolSize {
+		return nil, errRecvingListFull
+	}
+	recving := newMsgRecving()
+	recving.log = c.log
+	recving.fec = c.fec
+	recving.streamID = streamID
+	recving.flags = flags
+	recving.lastActive = time.Now()
 	c.rl[transID] = recving
+	c.rlPending[transID] = recving
+	return recving, nil
+}
+
+// gc forget the expired msgRecving
+func (c *Conn) gc() {
+	now := time.Now()
+	c.rlMutex.Lock()
+	for transID, recving := range c.rl {
+		if recving.expired(now) {
+			delete(c.rl, transID)
+			delete(c.rlPending, transID)
+		}
+	}
 	c.rlMutex.Unlock()
-	return nil
 }
 
 func (c *Conn) getLastActive() time.Time {
@@ -329,6 +514,32 @@ func (c *Conn) getLastActive() time.Time {
 	return lt
 }
 
+// handlePacket open the data packet and handle the segment, the remote
+// address is changed if the newest packet come from a new address
+func (c *Conn) handlePacket(b []byte, raddr net.Addr) error {
+	msg, fresh, err := c.cipher.open(b)
+	if err != nil {
+		atomic.AddUint64(&c.drops.auth, 1)
+		return err
+	}
+	if !c.helloAt.IsZero() {
+		// the client reply the hello at once
+		if c.rtt.SRTT() == 0 {
+			c.rtt.Update(time.Since(c.helloAt))
+		}
+		c.helloAt = time.Time{}
+	}
+	if fresh {
+		c.addrLock.Lock()
+		if c.raddr.String() != raddr.String() {
+			c.log.Debugf("remote address is changed from %s to %s", c.raddr, raddr)
+			c.raddr = raddr
+		}
+		c.addrLock.Unlock()
+	}
+	return c.handle(msg)
+}
+
 func (c *Conn) handle(msg []byte) error {
 	c.lastActiveMutex.Lock()
 	c.lastActive = time.Now()
@@ -336,15 +547,17 @@ func (c *Conn) handle(msg []byte) error {
 
 	seg, err := loadSegment(msg)
 	if err != nil {
-		logrus.Errorf("load segment failed: %s", err)
+		c.drops.countSegmentError(err)
 		return err
 	}
+	if seg.h.Version() != c.version {
+		atomic.AddUint64(&c.drops.version, 1)
+		return errSegmentVersion
+	}
 
 	types := seg.h.Type()
 
 	switch types {
-	case segTypeMsgSYN:
-		err = c.handlePingSYN(seg)
 	case segTypeMsgPingReq:
 		err = c.handlePingReq(seg)
 	case segTypeMsgPingRep:
@@ -355,10 +568,18 @@ func (c *Conn) handle(msg []byte) error {
 		err = c.handleRep(seg)
 	case segTypeMsgReceived:
 		err = c.handleReceived(seg)
-	case segTypeMsgReTrans:
-		err = c.handleReTrans(seg)
-	case segTypeMsgTrans:
+	case segTypeMsgSACK:
+		err = c.handleSACK(seg)
+	case segTypeMsgTrans, segTypeMsgParity:
 		err = c.handleTrans(seg)
+	case segTypeMsgStream:
+		err = c.handleStream(seg)
+	case segTypeConnClose:
+		err = c.handleClose(seg)
+	case segTypePMTUProbe:
+		err = c.handlePMTUProbe(seg)
+	case segTypePMTUAck:
+		err = c.handlePMTUAck(seg)
 	default:
 		err = c.handleUnknown(seg)
 	}
@@ -366,13 +587,8 @@ func (c *Conn) handle(msg []byte) error {
 	return err
 }
 
-func (c *Conn) handlePingSYN(seg *segment) error {
-	seg = newACKSegment(seg.b) // FIXME!
-	return c.write(seg.bytes())
-}
-
 func (c *Conn) handlePingReq(seg *segment) error {
-	seg = newPingRepSegment(c.id, seg.b)
+	seg = newPingRepSegment(0, seg.b)
 	return c.write(seg.bytes())
 }
 
@@ -397,8 +613,10 @@ func (c *Conn) handleReq(seg *segment) error {
 	switch types {
 	case requestTypeQueryReceive:
 		return c.handleReqQueryReceive(seg)
+	case requestTypeCancelReceive:
+		return c.handleReqCancelReceive(seg)
 	default:
-		logrus.Errorf("unknown request types: %d", types)
+		c.log.Errorf("unknown request types: %d", types)
 		seg, _ = newSegment(segTypeMsgRep, 0, seg.h.StreamID(), 0, 0, []byte{responseStatusUnknownType})
 		c.write(seg.bytes())
 		return errRequestUnknwonType
@@ -408,10 +626,7 @@ func (c *Conn) handleReq(seg *segment) error {
 // handleReqQueryReceive query recving status of the specified msg
 func (c *Conn) handleReqQueryReceive(seg *segment) error {
 	transID := seg.h.TransID()
-	recving, err := c.getRecving(transID)
-	if err != nil {
-		return err
-	}
+	recving := c.getRecving(transID)
 	if recving == nil {
 		return c.responseQueryReceive(seg, queryReceiveNotExist)
 	}
@@ -424,11 +639,8 @@ func (c *Conn) handleReqQueryReceive(seg *segment) error {
 
 	// !IMPORTANT! segment size limit!
 	max := len(missingOrderIDList)
-	if max > (segmentBodyMaxSize-7)/2 {
-		max = (segmentBodyMaxSize - 7) / 2
-	}
-	if max > c.sws {
-		max = c.sws // FIXME! test
+	if max > (segmentBodyMinSize-7)/2 {
+		max = (segmentBodyMinSize - 7) / 2
 	}
 
 	b := make([]byte, 7+max*2)
@@ -438,15 +650,28 @@ func (c *Conn) handleReqQueryReceive(seg *segment) error {
 	for i := 0; i < max; i++ {
 		binary.BigEndian.PutUint16(b[7+i*2:7+i*2+2], missingOrderIDList[i])
 	}
-	seg, _ = newSegment(segTypeMsgRep, 0, c.id, transID, 0, b)
+	seg, _ = newSegment(segTypeMsgRep, 0, seg.h.StreamID(), transID, 0, b)
 	return c.write(seg.bytes())
 }
 
+// handleReqCancelReceive forget the msg not completed, the late segments are
+// ignored
+func (c *Conn) handleReqCancelReceive(seg *segment) error {
+	recving, err := c.newRecving(seg.h.TransID(), seg.h.StreamID(), seg.h.Flags())
+	if err != nil {
+		return err
+	}
+	if !recving.Cancel() {
+		return c.responseQueryReceive(seg, queryReceiveCompleted)
+	}
+	return c.responseQueryReceive(seg, cancelReceiveDone)
+}
+
 func (c *Conn) responseQueryReceive(seg *segment, status uint8) error {
 	b := make([]byte, 5)
 	copy(b[0:4], seg.b[0:4])
 	b[4] = status
-	seg, _ = newSegment(segTypeMsgRep, 0, c.id, seg.h.TransID(), 0, b)
+	seg, _ = newSegment(segTypeMsgRep, 0, seg.h.StreamID(), seg.h.TransID(), 0, b)
 	return c.write(seg.bytes())
 }
 
@@ -456,10 +681,9 @@ func (c *Conn) handleRep(seg *segment) error {
 	c.requestMutex.Lock()
 	ch := c.requests[requestID]
 	if ch != nil {
-		// add timeout!
+		// ch is buffered, the requester may be timeout
 		ch <- seg.b[4:]
 		delete(c.requests, requestID)
-		close(ch)
 	}
 	c.requestMutex.Unlock()
 	return nil
@@ -478,192 +702,359 @@ func (c *Conn) handleReceived(seg *segment) error {
 	return nil
 }
 
-func (c *Conn) handleReTrans(seg *segment) error {
-	logrus.Errorf("re trans message have not completed!")
+func (c *Conn) handleSACK(seg *segment) error {
+	transID := seg.h.TransID()
+	c.slMutex.Lock()
+	sending := c.sl[transID]
+	c.slMutex.Unlock()
+	if sending == nil {
+		return nil // the message is completed
+	}
+	select {
+	case sending.sacks <- seg.b:
+	default:
+		// the sender is busy, the later SACK take the same info
+	}
 	return nil
 }
 
 func (c *Conn) handleTrans(seg *segment) error {
 	transID := seg.h.TransID()
-	recving, err := c.getRecving(transID)
+	streamID := seg.h.StreamID()
+	recving := c.getRecving(transID)
+	if recving != nil && recving.IsCompleted() {
+		// the duplicate segment of a completed message, the received
+		// signal may be lost
+		return c.writeReceived(streamID, transID)
+	}
+	if recving == nil {
+		s := c.getStream(streamID)
+		if s == nil {
+			return c.writeStreamSegment(flagRST, streamID)
+		}
+		var err error
+		if recving, err = c.newRecving(transID, streamID, seg.h.Flags()); err != nil {
+			return err
+		}
+	}
+	var msg []byte
+	var err error
+	if seg.h.Type() == segTypeMsgParity {
+		msg, err = recving.SaveParity(seg)
+	} else {
+		msg, err = recving.Save(seg)
+	}
 	if err != nil {
 		return err
 	}
-	// !IMPORTANT! recving.completed
-	if recving == nil || recving.IsCompleted() {
-		recving = newMsgRecving()
-		c.setRecving(transID, recving)
+	if msg != nil {
+		if err := c.deliver(recving, msg); err != nil {
+			return err
+		}
+		return c.writeReceived(streamID, transID)
+	}
+	if nextID, largestOrderID, missing, ok := recving.SACK(); ok {
+		return c.write(newSACKSegment(streamID, transID, nextID, largestOrderID, missing).bytes())
+	}
+	return nil
+}
+
+// deliver push the message received to the stream
+func (c *Conn) deliver(recving *msgRecving, msg []byte) error {
+	s := c.getStream(recving.streamID)
+	if s == nil {
+		return nil // the stream is closed
 	}
-	// fmt.Printf("%p recving: nextID = %d, transID = %d, orderID = %d, %s\n", recving, recving.nextID, transID, seg.h.OrderID(), hex.EncodeToString(seg.h.Checksum()[:]))
-	msg, err := recving.Save(seg)
+	if recving.flags&flagMsgBatch == 0 {
+		s.inbound.push(msg)
+		return nil
+	}
+	messages, err := splitBatch(msg)
 	if err != nil {
 		return err
 	}
-	if msg != nil {
-		go func() { c.inbound <- msg }() // FIXME!! do not lock at here!
-		// send msg received
-		seg, _ := newSegment(segTypeMsgReceived, 0, c.id, transID, 0, nil)
-		return c.write(seg.bytes())
+	for _, m := range messages {
+		s.inbound.push(m)
 	}
-	// TODO: recving.Save() should return a grade for change remote sws(Sending Window Size)!
 	return nil
 }
 
+func (c *Conn) writeReceived(streamID uint32, transID uint32) error {
+	seg, _ := newSegment(segTypeMsgReceived, 0, streamID, transID, 0, nil)
+	return c.write(seg.bytes())
+}
+
 func (c *Conn) handleUnknown(seg *segment) error {
-	logrus.Errorf("unknown type segment: %s", seg.h.String())
+	c.log.Errorf("unknown type segment: %s", seg.h.String())
 	return ErrSegTypeUnknown
 }
 
-// RecvMsg recv a single message
+// RecvMsg recv a single message of the default stream
 func (c *Conn) RecvMsg() ([]byte, error) {
-	// TODO: timeout
-	// Wait for a response
+	return c.stream0.RecvMsg()
+}
+
+// SendMsg send a single message in the default stream
+func (c *Conn) SendMsg(message []byte) error {
+	return c.sendMsg(c.stream0, message, nil)
+}
+
+// newSending get a free transID and save the msgSending, it's blocked if
+// there are maxSendPoolSize messages sending
+func (c *Conn) newSending(streamID uint32, flags uint16, message []byte, deadline <-chan struct{}) (*msgSending, error) {
 	select {
-	case msg := <-c.inbound:
-		return msg, nil
+	case c.slots <- struct{}{}:
+	case <-deadline:
+		return nil, os.ErrDeadlineExceeded
 	case <-c.shutdownCh:
 		return nil, ErrConnectionShutdown
 	}
+
+	c.slMutex.Lock()
+	defer c.slMutex.Unlock()
+	// transID is not reused soon, so the late segments of old message is
+	// not confused with the new one. It's 2 bytes before version 2, and
+	// wraps in a few seconds at a high message rate.
+	for {
+		transID := c.nextTransID
+		c.nextTransID++
+		if c.version < 2 {
+			c.nextTransID &= 0xffff
+		}
+		if _, ok := c.sl[transID]; !ok {
+			sending := newMsgSending(segTypeMsgTrans, flags, streamID, transID, message)
+			sending.bodySize = c.segmentBodySize()
+			sending.fec = c.fec
+			c.sl[transID] = sending
+			return sending, nil
+		}
+	}
 }
 
-// SendMsg send a single message
-func (c *Conn) SendMsg(message []byte) error {
+func (c *Conn) deleteSending(sending *msgSending) {
+	c.slMutex.Lock()
+	delete(c.sl, sending.transID)
+	c.slMutex.Unlock()
+	<-c.slots
+}
+
+// sendMsg send a single message in the stream, it's returned after the
+// message is received by remote endpoint, or deadline is closed
+func (c *Conn) sendMsg(s *Stream, message []byte, deadline <-chan struct{}) error {
+	return c.sendMsgWithFlags(s, message, 0, deadline)
+}
+
+func (c *Conn) sendMsgWithFlags(s *Stream, message []byte, flags uint16, deadline <-chan struct{}) error {
 	length := len(message)
 	if length <= 0 {
 		return errors.New("empty message")
 	}
-
-	// TODO: timeout
-	// get sending stor
-	var sending *msgSending
+	if length > maxMsgSize {
+		return errMsgTooLarge
+	}
 	for {
-		c.slMutex.Lock()
-		for i, v := range c.sl {
-			if v == nil {
-				sending = newMsgSending(segTypeMsgTrans, 0, c.id, uint16(i), message)
-				c.sl[i] = sending
-				defer func() { c.sl[i] = nil }() // FIXME!
-				break
-			}
-		}
-		c.slMutex.Unlock()
-		if sending != nil {
-			break
+		// the message is sent again in the smaller segments if the path
+		// MTU is reduced
+		if err := c.sendMsgOnce(s, message, flags, deadline); err != errPathMTUReduced {
+			return err
 		}
-		fmt.Println("wait transID")
-		time.Sleep(100 * time.Millisecond)
 	}
+}
+
+func (c *Conn) sendMsgOnce(s *Stream, message []byte, flags uint16, deadline <-chan struct{}) error {
+	sending, err := c.newSending(s.id, flags, message, deadline)
+	if err != nil {
+		return err
+	}
+	defer c.deleteSending(sending)
 
 	ch := make(chan struct{})
 	c.slWaitMutex.Lock()
 	c.slWait[sending.transID] = ch
 	c.slWaitMutex.Unlock()
-	var remain int
+	defer func() {
+		c.slWaitMutex.Lock()
+		delete(c.slWait, sending.transID)
+		c.slWaitMutex.Unlock()
+	}()
 
-	for i := 0; i < sendMsgMaxTimes; {
-	QUERY:
-		i++
-		remain = c.sws
-		if i > 1 {
-			// must query remote endpoint before send message again
-			status, largestOrderID, missing, err := c.queryMsgReceive(sending)
-			if err != nil {
-				return err // FIXME!
+	// every loop sends the lost segments and the new segments in the
+	// congestion window, then wait the SACK of remote endpoint. the receiving
+	// status is queried only if nothing is heard in RTO.
+	total := int(sending.segmentCount())
+	next := 0                // the first segment have not been sent
+	received := 0            // the segments known to be received
+	var retrans []uint16     // the lost segments should be sent again
+	dup := map[uint16]int{}  // the times of a segment reported missing
+	mark := map[uint16]int{} // a missing report count only if it's caused by the segments from mark
+	probe := -1              // the segment to sample RTT
+	var probeAt time.Time
+
+	timer := time.NewTimer(c.rtt.RTO())
+	defer timer.Stop()
+	resetTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
-			if status == queryReceiveCompleted {
-				return nil
+		}
+		timer.Reset(c.rtt.RTO())
+	}
+
+	for i := 0; i < sendMsgMaxTimes; {
+		window := c.cc.Window()
+		for n := 0; len(retrans) > 0 && n < window; n++ {
+			if int(retrans[0]) >= total {
+				c.log.Errorf("SHOULD NOT: seg is null: %d %d", retrans[0], len(sending.message))
+				return errors.New("orderID is too large")
 			}
-			if status == queryReceiveNotCompleted {
-				maxOrderID := sending.segmentCount() - 1
-				// handle missing
-				for _, orderID := range missing {
-					if remain <= 0 {
-						goto QUERY
-					}
-					if orderID > maxOrderID {
-						logrus.Error("SHOULD NOT: seg is null: ", orderID, len(sending.message))
-						return errors.New("orderID is too large")
-					}
-					seg := sending.GetSegmentByOrderID(orderID)
-					c.write(seg.bytes())
-					remain--
-				}
-				// handle largestOrderID
-				for orderID := largestOrderID + 1; orderID <= maxOrderID; orderID++ {
-					if remain <= 0 {
-						goto QUERY
-					}
-					seg := sending.GetSegmentByOrderID(orderID)
-					c.write(seg.bytes())
-					remain--
-				}
-				goto WAIT
+			if err := c.write(sending.GetSegmentByOrderID(retrans[0]).bytes()); err != nil {
+				return err
 			}
+			retrans = retrans[1:]
 		}
-
-		// sending full message
-		for seg := range sending.IterBufferd() {
-			if remain <= 0 {
-				goto QUERY
+		for ; next < total && next-received < window; next++ {
+			if probe < 0 {
+				probe, probeAt = next, time.Now()
 			}
-			if err := c.write(seg.bytes()); err != nil {
+			if err := c.write(sending.GetSegmentByOrderID(uint16(next)).bytes()); err != nil {
 				return err
 			}
-			remain--
+			// the parity follow the last segment of group
+			if sending.fec != nil && ((next+1)%sending.fec.data == 0 || next+1 == total) {
+				for _, seg := range sending.ParitySegments(next / sending.fec.data) {
+					if err := c.write(seg.bytes()); err != nil {
+						return err
+					}
+				}
+			}
 		}
 
-	WAIT:
-		// waiting message received success
 		select {
 		case <-ch:
+			c.cc.OnAck(total-received, 0)
+			c.pmtu.onProgress()
 			return nil
-		case <-time.After(defaultSendingTimeout):
+
+		case b := <-sending.sacks:
+			_, largestOrderID, ml, err := loadSACK(b)
+			if err != nil || int(largestOrderID) >= next {
+				continue // not for this message
+			}
+			var rtt time.Duration
+			if probe >= 0 && int(largestOrderID) >= probe {
+				rtt = time.Since(probeAt)
+				c.rtt.Update(rtt)
+				c.cc.OnRTT(rtt)
+				probe = -1
+			}
+			if r := int(largestOrderID) + 1 - len(ml); r > received {
+				c.cc.OnAck(r-received, rtt)
+				c.pmtu.onProgress()
+				received = r
+				resetTimer()
+			}
+			// fast retransmit
+			lost := 0
+			for _, orderID := range ml {
+				if int(largestOrderID) < mark[orderID] {
+					continue // reported before the last retransmission
+				}
+				if dup[orderID]++; dup[orderID] >= fastRetransmitThreshold {
+					dup[orderID] = 0
+					mark[orderID] = next
+					retrans = append(retrans, orderID)
+					lost++
+				}
+			}
+			c.cc.OnLoss(lost)
+
+		case <-timer.C:
+			i++
+			// no RTT sample here, the query may be sent several times
+			status, largestOrderID, ml, err := c.queryMsgReceive(sending)
+			if err != nil {
+				return err // FIXME!
+			}
+
+			switch status {
+			case queryReceiveCompleted:
+				c.cc.OnAck(total-received, 0)
+				return nil
+			case queryReceiveNotExist:
+				// all segments sent are lost
+				if c.pmtu.onTimeout(); sending.bodySize > c.segmentBodySize() {
+					return c.cancelMsgReceive(sending)
+				}
+				c.cc.OnLoss(next)
+				next = 0
+				received = 0
+				retrans = nil
+			case queryReceiveNotCompleted:
+				// the segments after largestOrderID are lost, send them again.
+				if r := int(largestOrderID) + 1 - len(ml); r > received {
+					c.cc.OnAck(r-received, 0)
+					c.pmtu.onProgress()
+					received = r
+				} else if c.pmtu.onTimeout(); sending.bodySize > c.segmentBodySize() {
+					// the query is answered but the segments are lost
+					// again and again, the path MTU may be reduced
+					return c.cancelMsgReceive(sending)
+				}
+				c.cc.OnLoss(len(ml) + next - int(largestOrderID) - 1)
+				retrans = ml
+				next = int(largestOrderID) + 1
+			}
+			dup = map[uint16]int{}
+			mark = map[uint16]int{}
+			probe = -1
+			timer.Reset(c.rtt.RTO())
+
+		case <-s.resetCh:
+			return ErrStreamReset
+
+		case <-deadline:
+			return os.ErrDeadlineExceeded
+
 		case <-c.shutdownCh:
 			return ErrConnectionShutdown
 		}
 	}
 
-	// clean
-	c.slWaitMutex.Lock()
-	delete(c.slWait, sending.transID)
-	c.slWaitMutex.Unlock()
-
 	return ErrTimeout
 }
 
-func (c *Conn) Read(p []byte) (n int, err error) {
-	msg, err := c.RecvMsg()
-	if err == nil {
-		copy(p, msg)
-	}
-	return len(msg), err
-}
-
-func (c *Conn) Write(p []byte) (n int, err error) {
-	if len(p) <= maxMsgSize {
-		err = c.SendMsg(p)
-		if err != nil {
-			return
-		}
-		return len(p), nil
-	}
-
-	total := len(p)
-	var start, end, read int
-	for start < total {
-		end += maxMsgSize
-		if end >= total {
-			end = total
+// cancelMsgReceive cancel the message sending, errPathMTUReduced is returned
+// if it's cancelled, so it can be sent again. nil is returned if the remote
+// endpoint completed it already
+func (c *Conn) cancelMsgReceive(s *msgSending) error {
+	b := make([]byte, 1)
+	b[0] = requestTypeCancelReceive
+	for i := 0; i < pmtuProbeMaxTimes; i++ {
+		id, ch := c.genRequestIDChan()
+		msg := make([]byte, 4, 5)
+		binary.BigEndian.PutUint32(msg, id)
+		seg, _ := newSegment(segTypeMsgReq, s.flags, s.streamID, s.transID, 0, append(msg, b...))
+		if err := c.write(seg.bytes()); err != nil {
+			return err
 		}
-		err = c.SendMsg(p[start:end])
-		if err != nil {
-			return read, err
+		select {
+		case res := <-ch:
+			if res[0] == queryReceiveCompleted {
+				return nil
+			}
+			c.log.Debugf("%s: path MTU is reduced, send message %d again", c, s.transID)
+			return errPathMTUReduced
+		case <-time.After(c.rtt.RTO()):
+			c.requestMutex.Lock()
+			delete(c.requests, id)
+			c.requestMutex.Unlock()
+		case <-c.shutdownCh:
+			return ErrConnectionShutdown
 		}
-
-		n += (end - start)
-		start = end
 	}
-	return read, nil
+	return ErrTimeout
 }
 
 func (c *Conn) queryMsgReceive(s *msgSending) (status uint8, largestOrderID uint16, missing []uint16, err error) {
@@ -671,11 +1062,12 @@ func (c *Conn) queryMsgReceive(s *msgSending) (status uint8, largestOrderID uint
 	b := make([]byte, 5)
 	binary.BigEndian.PutUint32(b[0:4], id)
 	b[4] = requestTypeQueryReceive
-	seg, _ := newSegment(segTypeMsgReq, s.flags, c.id, s.transID, 0, b)
+	seg, _ := newSegment(segTypeMsgReq, s.flags, s.streamID, s.transID, 0, b)
 
+	deadline := time.After(defaultRequestTimeout)
 	for i := 0; i < 999; i++ {
 		if err = c.write(seg.bytes()); err != nil {
-			logrus.Errorf("queryMsgReceive: write segment failed: %s", err)
+			c.log.Errorf("queryMsgReceive: write segment failed: %s", err)
 			return
 		}
 
@@ -698,14 +1090,12 @@ func (c *Conn) queryMsgReceive(s *msgSending) (status uint8, largestOrderID uint
 				missing = append(missing, orderID)
 			}
 			return // success
-		case <-time.After(1000 * time.Millisecond):
+		case <-time.After(c.rtt.RTO()):
 			continue // retry
-			// FIXME! just one time.After
-		case <-time.After(defaultRequestTimeout):
+		case <-deadline:
 			c.requestMutex.Lock()
 			delete(c.requests, id)
 			c.requestMutex.Unlock()
-			close(ch)
 			err = ErrTimeout
 			return
 		case <-c.shutdownCh:
@@ -719,7 +1109,8 @@ func (c *Conn) queryMsgReceive(s *msgSending) (status uint8, largestOrderID uint
 }
 
 func (c *Conn) write(b []byte) error {
-	_, err := c.c.WriteToUDP(b, c.raddr)
+	b = encodeSegment(c.version, b)
+	_, err := c.c.WriteTo(c.cipher.seal(c.id, b), c.remoteAddr())
 	return err
 }
 
@@ -735,8 +1126,8 @@ func (c *Conn) Ping() (time.Duration, error) {
 	c.pingLock.Unlock()
 
 	// Send the ping request
-	seg := newPingReqSegment(c.id, id)
-	c.c.WriteToUDP(seg.bytes(), c.raddr)
+	seg := newPingReqSegment(0, id)
+	c.write(seg.bytes())
 
 	// Wait for a response
 	start := time.Now()
@@ -751,12 +1142,14 @@ func (c *Conn) Ping() (time.Duration, error) {
 		return 0, ErrConnectionShutdown
 	}
 
-	// TODO: compute time duration
-	return time.Now().Sub(start), nil
+	rtt := time.Now().Sub(start)
+	c.rtt.Update(rtt)
+	c.cc.OnRTT(rtt)
+	return rtt, nil
 }
 
 func (c *Conn) genRequestIDChan() (id uint32, ch chan []byte) {
-	ch = make(chan []byte)
+	ch = make(chan []byte, 1)
 
 	// Get a new request id, mark as pending
 	c.requestMutex.Lock()
@@ -781,8 +1174,8 @@ func (c *Conn) request(msg []byte) ([]byte, error) {
 	binary.BigEndian.PutUint32(hdr, id)
 	msg = append(hdr, msg...)
 
-	seg := newReqSegment(c.id, msg)
-	c.c.WriteToUDP(seg.bytes(), c.raddr)
+	seg := newReqSegment(0, msg)
+	c.write(seg.bytes())
 
 	// Wait for a response
 	select {
@@ -798,284 +1191,36 @@ func (c *Conn) request(msg []byte) ([]byte, error) {
 	}
 }
 
-// Close close this connection
+// Close close this connection, the remote endpoint is notified
 func (c *Conn) Close() error {
-	// FIXME: close is not completed
-	close(c.shutdownCh)
-	// close(c.inbound)
-	return nil
-}
-
-type clientPool struct {
-	nextClientID uint32
-	idAddrMap    map[uint32]string
-	m            *sync.Mutex
-}
-
-func newClientPool() *clientPool {
-	return &clientPool{
-		nextClientID: 1,
-		idAddrMap:    map[uint32]string{},
-		m:            &sync.Mutex{},
-	}
-}
-
-func (p *clientPool) newClientID() (id uint32) {
-	p.m.Lock()
-	for {
-		id = p.nextClientID
-		p.nextClientID++
-		if _, ok := p.idAddrMap[id]; !ok {
-			break
-		}
-	}
-	p.m.Unlock()
-	return
-}
-
-// connPool manage all connections
-type connPool struct {
-	addrConnMap map[string]*Conn
-	m           *sync.Mutex
-}
-
-func newConnPool() *connPool {
-	return &connPool{
-		addrConnMap: map[string]*Conn{},
-		m:           &sync.Mutex{},
-	}
-}
-
-// Get get the connection specified by address string
-func (p *connPool) Get(addr net.Addr) (*Conn, bool) {
-	p.m.Lock()
-	c, ok := p.addrConnMap[addr.String()]
-	p.m.Unlock()
-	return c, ok
-}
-
-// New create a special single connection
-func (p *connPool) New(conn *net.UDPConn, raddr *net.UDPAddr, id uint32) (*Conn, error) {
-	addr := raddr.String()
-	p.m.Lock()
-	_, ok := p.addrConnMap[addr]
-	p.m.Unlock()
-	if ok {
-		return nil, errClientExist
-	}
-	c := newConn(conn, raddr, id)
-	p.m.Lock()
-	p.addrConnMap[addr] = c
-	p.m.Unlock()
-	return c, nil
-}
-
-// Delete remove a conn from client pool
-func (p *connPool) Delete(conn *Conn) error {
-	p.m.Lock()
-	defer p.m.Unlock()
-	addr := conn.raddr.String()
-	if _, ok := p.addrConnMap[addr]; !ok {
-		return errors.New("delete: no such addr in addrConnMap")
+	if c.shutdown() {
+		// best effort, the idle timeout of remote endpoint is the fallback
+		seg := newSingleSegment(segTypeConnClose, 0, 0, nil)
+		c.write(seg.bytes())
 	}
-	delete(p.addrConnMap, addr)
 	return nil
 }
 
-// GarbageCollection delete the disconnected clients
-func (p *connPool) GarbageCollection() {
-	addrs := []string{}
-	p.m.Lock()
-	for addr, conn := range p.addrConnMap {
-		if time.Since(conn.getLastActive()) > defaultConnTimeout {
-			addrs = append(addrs, addr)
+// shutdown stop the connection, false is returned if it's stopped before
+func (c *Conn) shutdown() bool {
+	stopped := false
+	c.closeOnce.Do(func() {
+		close(c.shutdownCh)
+		if c.onClose != nil {
+			c.onClose(c)
 		}
-	}
-	p.m.Unlock()
-
-	p.m.Lock()
-	for _, addr := range addrs {
-		p.addrConnMap[addr].Close() // FIXME!
-		delete(p.addrConnMap, addr)
-		logrus.Debugf("client %s is timeout, delete it", addr)
-	}
-	p.m.Unlock()
+		stopped = true
+	})
+	return stopped
 }
 
-type udpserver struct {
-	c *net.UDPConn
-
-	clients  *clientPool
-	connPool *connPool
-
-	clientCh chan *Conn
-
-	closed bool
+func (c *Conn) isClosed() bool {
+	return isClosedChan(c.shutdownCh)
 }
 
-func (p *udpserver) garbageCollection() {
-	for {
-		start := time.Now()
-		p.connPool.GarbageCollection()
-		time.Sleep(10*time.Second - time.Now().Sub(start))
+func (c *Conn) handleClose(seg *segment) error {
+	if c.shutdown() {
+		c.log.Debugf("%s is closed by remote endpoint", c)
 	}
-}
-
-func (p *udpserver) recv() error {
-	// FIXME!
-	go p.garbageCollection()
-
-	buf := make([]byte, segmentMaxSize)
-	for {
-		n, raddr, err := p.c.ReadFromUDP(buf)
-		if err != nil {
-			if p.closed {
-				return nil
-			}
-			// FIXME!
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				logrus.Debugf("conn is closed, quit recv()")
-				p.closed = true
-				return nil
-			}
-			logrus.Errorf("ReadFromUDP error: %s", err)
-			return err
-		}
-
-		conn, ok := p.connPool.Get(raddr)
-		if !ok {
-			// save new client
-			id := p.clients.newClientID()
-			conn, err = p.connPool.New(p.c, raddr, id)
-			if err != nil {
-				logrus.Errorf("save new client failed: %s", err)
-				// TODO: notice schema
-				seg := newACKSegment([]byte("error: create client conn"))
-				p.c.WriteToUDP(seg.bytes(), raddr)
-				continue
-			}
-			p.clientCh <- conn
-		}
-
-		// handle in
-		if err := conn.handle(buf[0:n]); err != nil {
-			logrus.Errorf("handle msg(from %s) failed: %s", raddr.String(), err)
-		}
-	}
-}
-
-// Accept wait the new client connection incoming
-func (p *udpserver) Accept() (*Conn, error) {
-	return <-p.clientCh, nil
-}
-
-// TODO: add lock
-func (p *udpserver) Close() error {
-	if p.closed {
-		return nil
-	}
-
-	p.closed = true
 	return nil
 }
-
-// ClientSocket is a UDP implement of Socket
-type ClientSocket struct {
-	udpserver
-	raddr *net.UDPAddr
-}
-
-// NewClientSocket create a client socket
-func NewClientSocket(conn *net.UDPConn, raddr *net.UDPAddr) (*ClientSocket, *Conn, error) {
-	sock := &ClientSocket{
-		udpserver: udpserver{
-			c:        conn,
-			clients:  newClientPool(),
-			connPool: newConnPool(),
-			clientCh: make(chan *Conn, 1),
-		},
-		raddr: raddr,
-	}
-	c, err := sock.handshake() // FIXME! quit?
-	if err != nil {
-		return nil, nil, err
-	}
-	go sock.pingLoop(c)
-	go sock.recv()
-	return sock, c, nil
-}
-
-func (p *ClientSocket) handshake() (*Conn, error) {
-	for {
-		if conn, err := p._handshake(); err == nil {
-			return conn, err
-		}
-		time.Sleep(6 * time.Second)
-	}
-}
-
-func (p *ClientSocket) _handshake() (*Conn, error) {
-	// send heartbeat and wait
-	seg := newSYNSegment()
-	_, err := p.c.WriteToUDP(seg.bytes(), p.raddr)
-	if err != nil {
-		logrus.Warnf("handshake: write segment failed: %s", err)
-		return nil, err
-	}
-
-	buf := make([]byte, segmentBodyMaxSize)
-
-	// read
-	n, raddr, err := p.c.ReadFromUDP(buf)
-	if raddr.String() != p.raddr.String() {
-		logrus.Debugf("p.raddr.String() = %s, raddr.String() = %s", p.raddr.String(), raddr.String())
-		logrus.Warnf("unknown from addr: %s", raddr.String())
-	}
-	if err != nil {
-		logrus.Warnf("handshake: read segment failed: %s", err)
-		return nil, err
-	}
-
-	seg, err = loadSegment(buf[0:n])
-	if err != nil {
-		logrus.Warnf("handshake: loadSegment failed: %s", err)
-		return nil, err
-	}
-	if seg.h.Type() != segTypeMsgACK {
-		logrus.Warnf("handshake: segment type is %d, not segTypeMsgSYN(%d)", seg.h.Type(), segTypeMsgSYN)
-		return nil, errors.New("segment type is not segTypeMsgACK")
-	}
-	if string(seg.b) != handshakeKey {
-		logrus.Warnf("handshake: response segment body is mismatch")
-		return nil, errors.New("response segment body is mismatch")
-	}
-
-	// TODO: check streamID
-	return p.connPool.New(p.c, p.raddr, seg.h.StreamID())
-}
-
-func (p *ClientSocket) pingLoop(c *Conn) {
-	for {
-		c.Ping() // ping timeout
-		time.Sleep(defaultPingInterval)
-	}
-}
-
-// ServerSocket is a UDP implement of socket
-type ServerSocket struct {
-	udpserver
-}
-
-// NewServerSocket create a UDPConn
-func NewServerSocket(conn *net.UDPConn) (*ServerSocket, error) {
-	sock := &ServerSocket{
-		udpserver: udpserver{
-			c:        conn,
-			clients:  newClientPool(),
-			connPool: newConnPool(),
-			clientCh: make(chan *Conn, 1),
-		},
-	}
-	go sock.recv()
-	return sock, nil
-}
@@ -3,9 +3,11 @@ package udp
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -217,3 +219,83 @@ func Test_Socket_WriterReaderCloser(t *testing.T) {
 		}()
 	}
 }
+
+func Test_Socket_CongestionBBR(t *testing.T) {
+	quit := make(chan struct{})
+	defer close(quit)
+
+	raddr, err := runServer(quit)
+	if err != nil {
+		t.Fatalf("runServer failed: %s", err)
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sock, clientConn, err := NewClientSocketWithConfig(conn, raddr.(*net.UDPAddr), &Config{CongestionControl: CongestionBBR})
+	if err != nil {
+		t.Fatalf("create client socket failed: %s", err)
+	}
+	defer sock.Close()
+
+	for i := 0; i < 8; i++ {
+		b := make([]byte, 1024*1024)
+		rand.Read(b)
+		if err := clientConn.SendMsg(b); err != nil {
+			t.Fatalf("SendMsg failed: %s", err)
+		}
+		msg, err := clientConn.RecvMsg()
+		if err != nil {
+			t.Fatalf("RecvMsg failed: %s", err)
+		}
+		if md5.Sum(msg) != md5.Sum(b) {
+			t.Fatalf("msg is mismatch")
+		}
+	}
+	if w := clientConn.cc.Window(); w == defaultSendWindowSize {
+		t.Errorf("window is not changed by BBR")
+	}
+}
+
+func Test_Conn_TransIDWrap(t *testing.T) {
+	client, server, closeFunc := newConnPair(t, nil)
+	defer closeFunc()
+
+	// more messages than 2 bytes TransID in the time the received message
+	// is kept, a reused TransID must not be taken as a duplicated message
+	const total = 1<<16 + 4096
+	const senders = 16
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := make([]byte, 4)
+			for n := i; n < total; n += senders {
+				binary.BigEndian.PutUint32(b, uint32(n))
+				if err := client.Send(b); err != nil {
+					t.Errorf("send message %d failed: %s", n, err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	received := make([]bool, total)
+	server.SetReadDeadline(time.Now().Add(30 * time.Second))
+	for i := 0; i < total; i++ {
+		m, err := server.Recv()
+		if err != nil {
+			t.Fatalf("received %d/%d messages: %s", i, total, err)
+		}
+		n := binary.BigEndian.Uint32(m)
+		if n >= total || received[n] {
+			t.Fatalf("got unexpected message %d", n)
+		}
+		received[n] = true
+	}
+}
@@ -0,0 +1,95 @@
+package session
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// CodeInternal is the code of the errors not registered
+const CodeInternal = "internal"
+
+// Error is the error of a failed request, it's sent to the requester in
+// Response.Error. Its Code is registered by RegisterError in both endpoints,
+// so it matches the sentinel error of the Code by errors.Is.
+type Error struct {
+	Code    string
+	Message string `json:",omitempty"`
+}
+
+type registeredError struct {
+	code string
+	err  error
+}
+
+var (
+	registeredErrors []registeredError
+	registeredLock   sync.RWMutex
+)
+
+func init() {
+	RegisterError("no-handler", ErrNoHandler)
+}
+
+// RegisterError bind code to the sentinel error err, the first registered
+// code is used if err wraps several sentinels
+func RegisterError(code string, err error) {
+	registeredLock.Lock()
+	registeredErrors = append(registeredErrors, registeredError{code: code, err: err})
+	registeredLock.Unlock()
+}
+
+// NewError create the wire error of err, the sentinel text is trimmed from
+// the message as the code carries it
+func NewError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return &Error{Code: e.Code, Message: e.Message}
+	}
+
+	registeredLock.RLock()
+	defer registeredLock.RUnlock()
+	for _, r := range registeredErrors {
+		if errors.Is(err, r.err) {
+			return &Error{Code: r.code, Message: strings.TrimPrefix(err.Error(), r.err.Error()+": ")}
+		}
+	}
+	return &Error{Code: CodeInternal, Message: err.Error()}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Message
+}
+
+// Unwrap get the sentinel error registered for the code
+func (e *Error) Unwrap() error {
+	registeredLock.RLock()
+	defer registeredLock.RUnlock()
+	for _, r := range registeredErrors {
+		if r.code == e.Code {
+			return r.err
+		}
+	}
+	return nil
+}
+
+// ErrorResponse create the failed response of err, the status is kept for
+// the remote endpoints which don't know Response.Error
+func ErrorResponse(status string, err error) *Response {
+	return &Response{Status: status, Error: NewError(err)}
+}
+
+// Err get the error of the failed response, nil if it's succeeded. The
+// status is used as the code if the remote endpoint doesn't send Error.
+func (r *Response) Err() error {
+	if r.Status == "success" {
+		return nil
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+	return &Error{Code: r.Status}
+}
@@ -0,0 +1,57 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var errTest = errors.New("test failed")
+
+func init() {
+	RegisterError("test-failed", errTest)
+}
+
+func Test_ErrorResponse(t *testing.T) {
+	resp := ErrorResponse("failed", fmt.Errorf("%w: port 22", errTest))
+	b, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &Response{}
+	if err := json.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	err = got.Err()
+	if !errors.Is(err, errTest) {
+		t.Errorf("got %v, want errTest", err)
+	}
+	if err.Error() != "test-failed: port 22" {
+		t.Errorf("got %q", err.Error())
+	}
+	if errors.Is(err, ErrNoHandler) {
+		t.Error("matches the sentinel of another code")
+	}
+
+	// relayed by another endpoint
+	if e := NewError(fmt.Errorf("relay: %w", err)); e.Code != "test-failed" || e.Message != "port 22" {
+		t.Errorf("got %+v", e)
+	}
+
+	// unknown errors
+	if e := NewError(errors.New("boom")); e.Code != CodeInternal || e.Unwrap() != nil {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func Test_ResponseErr(t *testing.T) {
+	if err := (&Response{Status: "success"}).Err(); err != nil {
+		t.Errorf("got %v", err)
+	}
+	// the remote endpoint without Response.Error
+	err := (&Response{Status: "no-handler"}).Err()
+	if !errors.Is(err, ErrNoHandler) {
+		t.Errorf("got %v, want ErrNoHandler", err)
+	}
+}
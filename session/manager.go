@@ -4,19 +4,28 @@ import (
 	"errors"
 
 	"github.com/ooclab/es"
-	"github.com/sirupsen/logrus"
+	"github.com/ooclab/es/logger"
+)
+
+// session manager error define
+var (
+	ErrSessionNotFound = errors.New("no such session")
+	ErrMsgTypeUnknown  = errors.New("unknown session msg type")
 )
 
 type Manager struct {
 	pool           *Pool
-	outbound       chan []byte
+	outbound       *es.Outbound
 	requestHandler RequestHandler
+	log            logger.Logger
 }
 
-func NewManager(isServerSide bool, outbound chan []byte) *Manager {
+// NewManager create a session manager, nil log means logger.Default()
+func NewManager(isServerSide bool, outbound *es.Outbound, log logger.Logger) *Manager {
 	m := &Manager{
 		pool:     newPool(isServerSide),
 		outbound: outbound,
+		log:      logger.OrDefault(log),
 	}
 	return m
 }
@@ -35,25 +44,33 @@ func (manager *Manager) HandleIn(payload []byte) error {
 
 	case MsgTypeRequest:
 		rMsg := manager.requestHandler.Handle(m)
-		manager.outbound <- append([]byte{es.LinkMsgTypeSession}, rMsg.Bytes()...)
+		if rMsg == nil {
+			return nil
+		}
+		return manager.outbound.PushSession(rMsg.Frame())
 
 	case MsgTypeResponse:
 		s := manager.pool.Get(m.ID)
 		if s == nil {
-			logrus.Errorf("can not find session with ID %d", m.ID)
-			return errors.New("no such session")
+			manager.log.WithField("session_id", m.ID).Errorf("can not find session")
+			return ErrSessionNotFound
 		}
 		s.HandleResponse(m.Payload)
 
 	default:
-		logrus.Errorf("unknown session msg type: %d", m.Type)
-		return errors.New("unknown session msg type")
+		manager.log.Errorf("unknown session msg type: %d", m.Type)
+		return ErrMsgTypeUnknown
 
 	}
 
 	return nil
 }
 
+// Len get the count of sessions
+func (manager *Manager) Len() int {
+	return manager.pool.Len()
+}
+
 func (manager *Manager) New() (*Session, error) {
 	return manager.pool.New(manager.outbound)
 }
@@ -61,9 +78,7 @@ func (manager *Manager) New() (*Session, error) {
 func (manager *Manager) Close() {
 	for item := range manager.pool.IterBuffered() {
 		item.Val.Close()
-		logrus.WithFields(logrus.Fields{
-			"session_id": item.Key,
-		}).Debug("close session")
+		manager.log.WithField("session_id", item.Key).Debugf("close session")
 		manager.pool.Delete(item.Val)
 	}
 }
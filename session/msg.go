@@ -1,10 +1,11 @@
 package session
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+
+	"github.com/ooclab/es"
 )
 
 const (
@@ -26,15 +27,24 @@ func (m *EMSG) String() string {
 }
 
 func (m *EMSG) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, m.Type)
-	binary.Write(buf, binary.BigEndian, m.ID)
+	b := make([]byte, eMSGLengthMin+len(m.Payload))
+	m.encode(b)
+	return b
+}
 
-	if len(m.Payload) > 0 {
-		binary.Write(buf, binary.BigEndian, m.Payload)
-	}
+// Frame get the link frame of this message (link message type + EMSG) in
+// a single buffer from the buffer pool
+func (m *EMSG) Frame() []byte {
+	b := es.GetBuffer(1 + eMSGLengthMin + len(m.Payload))
+	b[0] = es.LinkMsgTypeSession
+	m.encode(b[1:])
+	return b
+}
 
-	return buf.Bytes()
+func (m *EMSG) encode(b []byte) {
+	b[0] = m.Type
+	binary.BigEndian.PutUint32(b[1:5], m.ID)
+	copy(b[eMSGLengthMin:], m.Payload)
 }
 
 func LoadEMSG(data []byte) (*EMSG, error) {
@@ -3,6 +3,8 @@ package session
 import (
 	"errors"
 	"sync"
+
+	"github.com/ooclab/es"
 )
 
 type Pool struct {
@@ -48,7 +50,13 @@ func (p *Pool) Exist(id uint32) bool {
 	return exist
 }
 
-func (p *Pool) New(outbound chan []byte) (*Session, error) {
+func (p *Pool) Len() int {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+	return len(p.pool)
+}
+
+func (p *Pool) New(outbound *es.Outbound) (*Session, error) {
 	id := p.newID()
 
 	p.poolMutex.Lock()
@@ -10,7 +10,8 @@ var (
 	ErrNoHandler = errors.New("no such handler")
 )
 
-// RequestHandler define request-response handler func
+// RequestHandler define request-response handler func, Handle return nil if
+// the response is pushed to the outbound later by the handler itself
 type RequestHandler interface {
 	Handle(*EMSG) *EMSG
 }
@@ -2,55 +2,96 @@ package session
 
 import (
 	"encoding/json"
+	"errors"
+	"sync"
+	"time"
 
 	"github.com/ooclab/es"
 )
 
+// ErrSessionClosed is returned by the waiting request after the session is
+// closed, such as the link is closed
+var ErrSessionClosed = errors.New("session is closed")
+
+// ErrSessionTimeout is returned by SendAndWaitTimeout if the response is not
+// received in time
+var ErrSessionTimeout = errors.New("session timeout")
+
 type Session struct {
 	ID       uint32
 	inbound  chan []byte
-	outbound chan []byte
+	outbound *es.Outbound
+
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-func newSession(id uint32, outbound chan []byte) *Session {
+func newSession(id uint32, outbound *es.Outbound) *Session {
 	return &Session{
 		ID:       id,
 		inbound:  make(chan []byte, 1),
 		outbound: outbound,
+		done:     make(chan struct{}),
 	}
 }
 
+// Close wake up the waiting request, the response received later is dropped
 func (session *Session) Close() {
-	close(session.inbound)
+	session.closeOnce.Do(func() { close(session.done) })
 }
 
 func (session *Session) HandleResponse(payload []byte) error {
 	// logrus.Debugf("inner session : got response : %s", string(payload))
-	session.inbound <- payload
-	return nil
+	select {
+	case session.inbound <- payload:
+		return nil
+	case <-session.done:
+		return ErrSessionClosed
+	}
 }
 
-func (session *Session) sendAndWait(payload []byte) (respPayload []byte, err error) {
-	// TODO:
-
+// sendAndWait send the request and wait the response, it waits forever if
+// timeout is nil
+func (session *Session) sendAndWait(payload []byte, timeout <-chan time.Time) (respPayload []byte, err error) {
 	m := &EMSG{
 		Type:    MsgTypeRequest,
 		ID:      session.ID,
 		Payload: payload,
 	}
-	session.outbound <- append([]byte{es.LinkMsgTypeSession}, m.Bytes()...)
+	if err = session.outbound.PushSession(m.Frame()); err != nil {
+		return
+	}
 
-	// TODO: timeout
-	respPayload = <-session.inbound
-	return respPayload, nil
+	select {
+	case respPayload = <-session.inbound:
+		return respPayload, nil
+	case <-session.done:
+		return nil, ErrSessionClosed
+	case <-timeout:
+		// the response received later is dropped
+		session.Close()
+		return nil, ErrSessionTimeout
+	}
 }
 
 func (session *Session) SendAndWait(r *Request) (resp *Response, err error) {
+	return session.sendRequest(r, nil)
+}
+
+// SendAndWaitTimeout is SendAndWait which closes the session and returns
+// ErrSessionTimeout if the response is not received in timeout
+func (session *Session) SendAndWaitTimeout(r *Request, timeout time.Duration) (*Response, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	return session.sendRequest(r, t.C)
+}
+
+func (session *Session) sendRequest(r *Request, timeout <-chan time.Time) (resp *Response, err error) {
 	reqData, err := json.Marshal(r)
 	if err != nil {
 		return
 	}
-	respData, err := session.sendAndWait(reqData)
+	respData, err := session.sendAndWait(reqData, timeout)
 	if err != nil {
 		return
 	}
@@ -64,7 +105,7 @@ func (session *Session) SendJSONAndWait(request interface{}, response interface{
 	if err != nil {
 		return err
 	}
-	respData, err := session.sendAndWait(reqData)
+	respData, err := session.sendAndWait(reqData, nil)
 	if err != nil {
 		return err
 	}
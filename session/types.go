@@ -14,4 +14,7 @@ type Request struct {
 type Response struct {
 	Status string
 	Body   []byte
+
+	// Error is the detail of the failed request, see Err
+	Error *Error `json:",omitempty"`
 }
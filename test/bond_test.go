@@ -0,0 +1,174 @@
+package test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+)
+
+// getBondServerAndClient create a client link bonded by n tcp connections
+func getBondServerAndClient(n int) (serverBond *link.Bond, clientBond *link.Bond, clientLink *link.Link, paths []net.Conn, err error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+
+	serverBondCh := make(chan *link.Bond, 1)
+	acceptor := link.NewBondAcceptor()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b, isNew, err := acceptor.Accept(es.NewBaseConn(conn))
+			if err != nil || !isNew {
+				continue
+			}
+			serverBondCh <- b
+			go func() {
+				sl := link.NewLink(&link.LinkConfig{IsServerSide: true})
+				sl.Bind(b)
+				sl.Wait()
+				sl.Close()
+			}()
+		}
+	}()
+
+	clientBond = link.NewBond()
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		ec := es.NewBaseConn(conn)
+		if err = link.JoinBond(ec, clientBond.ID); err != nil {
+			return nil, nil, nil, nil, err
+		}
+		clientBond.Add(ec)
+		paths = append(paths, conn)
+	}
+	serverBond = <-serverBondCh
+
+	clientLink = link.NewLink(nil)
+	go func() {
+		clientLink.Bind(clientBond)
+		clientLink.Wait()
+		clientLink.Close()
+	}()
+	return
+}
+
+// waitBondPaths wait the alive paths of bonds become n
+func waitBondPaths(n int, bonds ...*link.Bond) bool {
+	for i := 0; i < 100; i++ {
+		ok := true
+		for _, b := range bonds {
+			if b.Paths() != n {
+				ok = false
+			}
+		}
+		if ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func runEchoServer() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func testTunnelEcho(port int) error {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	b := bytes.Repeat([]byte("bond"), 1024*16)
+	go conn.Write(b)
+	rb := make([]byte, len(b))
+	if _, err = io.ReadFull(conn, rb); err != nil {
+		return err
+	}
+	if !bytes.Equal(b, rb) {
+		return fmt.Errorf("echo mismatch")
+	}
+	return nil
+}
+
+func Test_LinkBond(t *testing.T) {
+	serverBond, clientBond, clientLink, paths, err := getBondServerAndClient(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitBondPaths(3, clientBond, serverBond) {
+		t.Fatalf("paths of bond is %d/%d, want 3", clientBond.Paths(), serverBond.Paths())
+	}
+
+	echoPort, err := runEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	localPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	if err := openTunnel(clientLink, "127.0.0.1", localPort, "127.0.0.1", echoPort, false); err != nil {
+		t.Fatalf("OpenTunnel failed: %s", err)
+	}
+
+	// spread the channels over the paths
+	for i := 0; i < 6; i++ {
+		if err := testTunnelEcho(localPort); err != nil {
+			t.Fatalf("tunnel echo failed: %s", err)
+		}
+	}
+
+	// failover
+	paths[0].Close()
+	if !waitBondPaths(2, clientBond, serverBond) {
+		t.Fatalf("paths of bond is %d/%d after a path closed, want 2", clientBond.Paths(), serverBond.Paths())
+	}
+
+	s, _ := clientLink.NewSession()
+	for i := 0; i < 10; i++ {
+		if !testLinkInnerSession(s, 1024) {
+			t.Fatal("session echo failed after failover")
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if err := testTunnelEcho(localPort); err != nil {
+			t.Fatalf("tunnel echo failed after failover: %s", err)
+		}
+	}
+
+	// the bond is closed with the last path
+	paths[1].Close()
+	paths[2].Close()
+	for i := 0; i < 100 && !clientLink.IsClosed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !clientLink.IsClosed() {
+		t.Errorf("link is not closed after all paths closed")
+	}
+}
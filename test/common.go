@@ -1,6 +1,7 @@
 package test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -22,6 +23,11 @@ import (
 // }
 
 func getServerAndClient() (serverLink *link.Link, clientLink *link.Link, err error) {
+	return getServerAndClientWith(nil)
+}
+
+// getServerAndClientWith create the server link by config
+func getServerAndClientWith(config *link.LinkConfig) (serverLink *link.Link, clientLink *link.Link, err error) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		logrus.Error("listen error:", err)
@@ -43,7 +49,7 @@ func getServerAndClient() (serverLink *link.Link, clientLink *link.Link, err err
 			}
 
 			go func() {
-				l := link.NewLink(nil)
+				l := link.NewLink(config)
 				serverLinkCh <- l
 				ec := es.NewBaseConn(conn)
 				if err := l.Bind(ec); err != nil {
@@ -51,7 +57,7 @@ func getServerAndClient() (serverLink *link.Link, clientLink *link.Link, err err
 				}
 				l.Wait()
 				if err := l.Close(); err != nil {
-					logrus.Errorf("link quit: ", err)
+					logrus.Errorf("link quit: %s", err)
 				}
 			}()
 		}
@@ -82,16 +88,21 @@ func tcpConnect(addrS string) (conn net.Conn, err error) {
 }
 
 func connectServer(addr string) *link.Link {
+	return connectServerWith(addr, nil)
+}
+
+// connectServerWith create the client link by config
+func connectServerWith(addr string, config *link.LinkConfig) *link.Link {
 	conn, err := tcpConnect(addr)
 	if err != nil {
 		panic(err)
 	}
-	l := link.NewLink(nil)
+	l := link.NewLink(config)
 	ec := es.NewBaseConn(conn)
 	// FIXME: quit it not a good choice for testcase!
 	go func() {
 		if err := l.Bind(ec); err != nil {
-			logrus.Errorf("link quit: ", err)
+			logrus.Errorf("link quit: %s", err)
 		}
 		l.Wait()
 		l.Close()
@@ -99,6 +110,17 @@ func connectServer(addr string) *link.Link {
 	return l
 }
 
+// openTunnel open a tcp tunnel by the addresses in the view of l, as the
+// tunnel spec
+func openTunnel(l *link.Link, localHost string, localPort int, remoteHost string, remotePort int, reverse bool) error {
+	opts := link.TunnelOptions{BindHost: localHost, BindPort: localPort, DialHost: remoteHost, DialPort: remotePort}
+	if reverse {
+		opts = link.TunnelOptions{BindHost: remoteHost, BindPort: remotePort, DialHost: localHost, DialPort: localPort, Reverse: true}
+	}
+	_, err := l.OpenTunnel(context.Background(), opts)
+	return err
+}
+
 func runPingServer(addr string) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
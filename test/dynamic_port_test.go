@@ -0,0 +1,115 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/ooclab/es/link"
+)
+
+func bindPort(t *testing.T, h *link.TunnelHandle) int {
+	_, port, err := net.SplitHostPort(h.BindAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(port)
+	if n == 0 {
+		t.Fatalf("the bound port of %s is not reported", h.BindAddr())
+	}
+	return n
+}
+
+func Test_DynamicPort(t *testing.T) {
+	_, clientLink, _ := getServerAndClient()
+	defer clientLink.Close()
+
+	// forward: this endpoint binds the ephemeral port
+	fwd, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", DialHost: "127.0.0.1", DialPort: 12345,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := bindPort(t, fwd)
+	if port != fwd.Config().LocalPort {
+		t.Errorf("got bind port %d, want %d", port, fwd.Config().LocalPort)
+	}
+	if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", port)); err != nil {
+		t.Fatal(err)
+	}
+
+	// reverse: the remote endpoint binds the ephemeral port and reports it
+	rev, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", DialHost: "127.0.0.1", DialPort: 12345, Reverse: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port = bindPort(t, rev)
+	if port != rev.Config().RemotePort {
+		t.Errorf("got bind port %d, want %d", port, rev.Config().RemotePort)
+	}
+	if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", port)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitClosed(port) {
+		t.Error("the listener in the remote endpoint is still open")
+	}
+}
+
+func Test_DynamicPort_Clients(t *testing.T) {
+	registry := link.NewRegistry()
+	addr := runRegistryServer(t, registry, nil)
+
+	// the clients get the public ports without coordination
+	ports := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		l := connectServer(addr)
+		defer l.Close()
+		h, err := l.OpenTunnel(context.Background(), link.TunnelOptions{
+			BindHost: "127.0.0.1", DialHost: "127.0.0.1", DialPort: 12345, Reverse: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := bindPort(t, h)
+		if ports[port] {
+			t.Fatalf("port %d is bound twice", port)
+		}
+		ports[port] = true
+		if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", port)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_DynamicPort_Hub(t *testing.T) {
+	registry := link.NewRegistry()
+	addr := runRegistryServer(t, registry, link.NewHub(registry))
+	clientA := connectServer(addr)
+	clientB := connectServerWith(addr, &link.LinkConfig{Name: "b"})
+	defer clientA.Close()
+	defer clientB.Close()
+
+	if !waitRegistered(registry, "b") {
+		t.Fatal("b is not registered")
+	}
+
+	// B binds the ephemeral port, A dials the ping server
+	rev, err := clientA.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", DialHost: "127.0.0.1", DialPort: 12345, Reverse: true, Peer: "b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", bindPort(t, rev))); err != nil {
+		t.Fatalf("ping through the reverse relay failed: %s", err)
+	}
+}
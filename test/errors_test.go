@@ -0,0 +1,73 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/policy"
+	"github.com/ooclab/es/tunnel"
+)
+
+func Test_OpenTunnel_Errors(t *testing.T) {
+	_, clientLink, _ := getServerAndClient()
+	defer clientLink.Close()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := taken.Addr().(*net.TCPAddr).Port
+
+	// the remote endpoint can not listen
+	err = openTunnel(clientLink, "127.0.0.1", 12345, "127.0.0.1", takenPort, true)
+	if !errors.Is(err, tunnel.ErrPortInUse) || errors.Is(err, policy.ErrDenied) {
+		t.Errorf("got %v, want ErrPortInUse", err)
+	}
+
+	// the local side can not listen
+	err = openTunnel(clientLink, "127.0.0.1", takenPort, "127.0.0.1", 12345, false)
+	if !errors.Is(err, tunnel.ErrPortInUse) {
+		t.Errorf("got %v, want ErrPortInUse", err)
+	}
+
+	// the remote endpoint can not dial, the channel is closed
+	tun, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t), DialHost: "127.0.0.1", DialPort: freePort(t),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", tun.Config().LocalPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want the channel closed", err)
+	}
+}
+
+func Test_OpenTunnel_PolicyError(t *testing.T) {
+	engine := policy.NewEngine(&policy.Policy{
+		Binds: []policy.Rule{{Host: "127.0.0.1", Ports: policy.PortRange{Min: 1, Max: 1}}},
+	})
+	_, clientLink, _ := getServerAndClientWith(&link.LinkConfig{
+		IsServerSide: true,
+		Policy:       engine.Guard("127.0.0.1"),
+	})
+	defer clientLink.Close()
+
+	err := openTunnel(clientLink, "127.0.0.1", 12345, "127.0.0.1", freePort(t), true)
+	if !errors.Is(err, policy.ErrDenied) || errors.Is(err, tunnel.ErrPortInUse) {
+		t.Errorf("got %v, want ErrDenied", err)
+	}
+}
@@ -0,0 +1,270 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/policy"
+	"github.com/ooclab/es/session"
+)
+
+// runRegistryServer serve the links of registry and hub, and return the
+// listen address
+func runRegistryServer(t *testing.T, registry *link.Registry, hub *link.Hub) string {
+	return runRegistryServerWith(t, func() *link.LinkConfig {
+		return &link.LinkConfig{IsServerSide: true, Registry: registry, Hub: hub}
+	})
+}
+
+// runRegistryServerWith serve the links by the config of newConfig, it's
+// called in order of the connections
+func runRegistryServerWith(t *testing.T, newConfig func() *link.LinkConfig) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			cfg := newConfig()
+			go func() {
+				l := link.NewLink(cfg)
+				if err := l.Bind(es.NewBaseConn(conn)); err != nil {
+					logrus.Errorf("link bind failed: %s", err)
+				}
+				l.Wait()
+				l.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func waitRegistered(registry *link.Registry, name string) bool {
+	for i := 0; i < 100; i++ {
+		if registry.Lookup(name) != nil {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func waitClosed(port int) bool {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func Test_Hub(t *testing.T) {
+	registry := link.NewRegistry()
+	addr := runRegistryServer(t, registry, link.NewHub(registry))
+	clientA := connectServer(addr)
+	clientB := connectServerWith(addr, &link.LinkConfig{Name: "b"})
+	defer clientA.Close()
+
+	if !waitRegistered(registry, "b") {
+		t.Fatal("b is not registered")
+	}
+
+	// A listens, B dials the ping server
+	fwdPort := freePort(t)
+	_, err := clientA.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: fwdPort, DialHost: "127.0.0.1", DialPort: 12345, Peer: "b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", fwdPort)); err != nil {
+		t.Fatalf("ping through the forward relay failed: %s", err)
+	}
+
+	// B listens, A dials the ping server
+	rev, err := clientA.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t), DialHost: "127.0.0.1", DialPort: 12345,
+		Reverse: true, Peer: "b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", rev.Config().RemotePort)); err != nil {
+		t.Fatalf("ping through the reverse relay failed: %s", err)
+	}
+
+	// closing the tunnel in A close the listener in B
+	if err := rev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !waitClosed(rev.Config().RemotePort) {
+		t.Error("the listener in the peer is still open")
+	}
+
+	// unknown peer
+	_, err = clientA.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t), DialHost: "127.0.0.1", DialPort: 12345, Peer: "c",
+	})
+	if !errors.Is(err, link.ErrPeerNotFound) || !strings.Contains(err.Error(), "peer-not-found") {
+		t.Errorf("got %v, want peer-not-found", err)
+	}
+
+	// the peer is gone, its relayed tunnels are closed in A
+	clientB.Close()
+	if !waitClosed(fwdPort) {
+		t.Error("the relayed tunnel is still open after the peer is closed")
+	}
+	for i := 0; i < 100 && registry.Lookup("b") != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if registry.Lookup("b") != nil {
+		t.Error("the closed peer is still registered")
+	}
+}
+
+// stuckHandler never answers the requests until stop is closed
+type stuckHandler struct {
+	stop chan struct{}
+}
+
+func (h stuckHandler) Handle(*session.EMSG) *session.EMSG {
+	<-h.stop
+	return nil
+}
+
+func Test_Hub_SlowPeer(t *testing.T) {
+	registry := link.NewRegistry()
+	addr := runRegistryServer(t, registry, link.NewHub(registry))
+	clientA := connectServerWith(addr, &link.LinkConfig{Name: "a", ConnectionWriteTimeout: time.Second})
+	defer clientA.Close()
+
+	// B never answers the tunnel request of the hub
+	conn, err := tcpConnect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stuck := stuckHandler{stop: make(chan struct{})}
+	clientB := link.NewLinkCustom(&link.LinkConfig{Name: "b"}, stuck)
+	defer clientB.Close()
+	defer close(stuck.stop)
+	go clientB.Bind(es.NewBaseConn(conn))
+	if !waitRegistered(registry, "a") || !waitRegistered(registry, "b") {
+		t.Fatal("a or b is not registered")
+	}
+
+	// the relay to itself is rejected
+	_, err = clientA.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t), DialHost: "127.0.0.1", DialPort: 12345, Peer: "a",
+	})
+	if !errors.Is(err, link.ErrSelfRelay) {
+		t.Errorf("got %v, want ErrSelfRelay", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = clientA.OpenTunnel(ctx, link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t), DialHost: "127.0.0.1", DialPort: 12345, Peer: "b",
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+
+	// the link of A still works while the hub waits B
+	if _, err := clientA.Ping(); err != nil {
+		t.Errorf("ping while the relay is pending: %s", err)
+	}
+	if err := openTunnel(clientA, "127.0.0.1", freePort(t), "127.0.0.1", 12345, false); err != nil {
+		t.Errorf("open tunnel while the relay is pending: %s", err)
+	}
+}
+
+func Test_Hub_Policy(t *testing.T) {
+	registry := link.NewRegistry()
+	hub := link.NewHub(registry)
+	engine := policy.NewEngine(&policy.Policy{
+		Destinations:      []policy.Rule{{Host: "127.0.0.1", Ports: policy.PortRange{Min: 12345, Max: 12345}}},
+		MaxTunnelsPerLink: 1,
+	})
+	n := 0
+	addr := runRegistryServerWith(t, func() *link.LinkConfig {
+		n++
+		return &link.LinkConfig{IsServerSide: true, Registry: registry, Hub: hub, Policy: engine.Guard(fmt.Sprint(n))}
+	})
+	clientA := connectServerWith(addr, &link.LinkConfig{Name: "a"})
+	clientB := connectServerWith(addr, &link.LinkConfig{Name: "b"})
+	defer clientA.Close()
+	defer clientB.Close()
+	if !waitRegistered(registry, "a") || !waitRegistered(registry, "b") {
+		t.Fatal("a or b is not registered")
+	}
+	relay := func(from *link.Link, peer string, dialPort int) (*link.TunnelHandle, error) {
+		return from.OpenTunnel(context.Background(), link.TunnelOptions{
+			BindHost: "127.0.0.1", BindPort: freePort(t), DialHost: "127.0.0.1", DialPort: dialPort, Peer: peer,
+		})
+	}
+
+	// the peer dials a destination out of the rules
+	if _, err := relay(clientA, "b", 22); !errors.Is(err, policy.ErrDenied) {
+		t.Fatalf("got %v, want policy-denied", err)
+	}
+
+	h, err := relay(clientA, "b", 12345)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runPingClient(fmt.Sprintf("http://%s/ping", h.BindAddr())); err != nil {
+		t.Fatal(err)
+	}
+	// the relayed tunnel is counted in both links
+	if _, err := relay(clientA, "b", 12345); err == nil || !strings.Contains(err.Error(), "max 1 tunnels per link") {
+		t.Errorf("got %v, want the limit of A", err)
+	}
+	if _, err := relay(clientB, "a", 12345); err == nil || !strings.Contains(err.Error(), "max 1 tunnels per link") {
+		t.Errorf("got %v, want the limit of B", err)
+	}
+
+	// and released after it is closed
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var lastErr error
+	for i := 0; i < 50; i++ {
+		if _, lastErr = relay(clientB, "a", 12345); lastErr == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lastErr != nil {
+		t.Errorf("relay after release failed: %s", lastErr)
+	}
+}
+
+func Test_Hub_Disabled(t *testing.T) {
+	_, clientLink, _ := getServerAndClient()
+	err := openTunnel(clientLink, "127.0.0.1", freePort(t), "127.0.0.1", 12345, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = clientLink.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t), DialHost: "127.0.0.1", DialPort: 12345, Peer: "b",
+	})
+	if !errors.Is(err, link.ErrHubDisabled) || !strings.Contains(err.Error(), "hub-disabled") {
+		t.Errorf("got %v, want hub-disabled", err)
+	}
+}
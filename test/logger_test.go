@@ -0,0 +1,107 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/logger"
+)
+
+type logEntry struct {
+	fields logger.Fields
+	msg    string
+}
+
+// recordLogger keep all logs in memory
+type recordLogger struct {
+	fields  logger.Fields
+	lock    *sync.Mutex
+	entries *[]logEntry
+}
+
+func newRecordLogger() *recordLogger {
+	return &recordLogger{fields: logger.Fields{}, lock: &sync.Mutex{}, entries: &[]logEntry{}}
+}
+
+func (l *recordLogger) WithField(key string, value interface{}) logger.Logger {
+	return l.WithFields(logger.Fields{key: value})
+}
+
+func (l *recordLogger) WithFields(fields logger.Fields) logger.Logger {
+	n := *l
+	n.fields = logger.Fields{}
+	for k, v := range l.fields {
+		n.fields[k] = v
+	}
+	for k, v := range fields {
+		n.fields[k] = v
+	}
+	return &n
+}
+
+func (l *recordLogger) logf(format string, args ...interface{}) {
+	l.lock.Lock()
+	*l.entries = append(*l.entries, logEntry{fields: l.fields, msg: fmt.Sprintf(format, args...)})
+	l.lock.Unlock()
+}
+
+func (l *recordLogger) Debugf(format string, args ...interface{}) { l.logf(format, args...) }
+func (l *recordLogger) Infof(format string, args ...interface{})  { l.logf(format, args...) }
+func (l *recordLogger) Warnf(format string, args ...interface{})  { l.logf(format, args...) }
+func (l *recordLogger) Errorf(format string, args ...interface{}) { l.logf(format, args...) }
+
+// has check whether a log has all the keys
+func (l *recordLogger) has(keys ...string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, e := range *l.entries {
+		found := true
+		for _, k := range keys {
+			if _, ok := e.fields[k]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func Test_Logger(t *testing.T) {
+	rec := newRecordLogger()
+	_, clientLink, err := getServerAndClientWith(&link.LinkConfig{IsServerSide: true, Logger: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientLink.Close()
+
+	tun, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t), DialHost: "127.0.0.1", DialPort: 12345,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", tun.Config().LocalPort)); err != nil {
+		t.Fatal(err)
+	}
+	// closing the tunnel close its channels
+	if err := tun.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !rec.has("link_id") || !rec.has("link_id", "tunnel_id") {
+		t.Error("no logs of the link and tunnel")
+	}
+	for i := 0; i < 100 && !rec.has("link_id", "tunnel_id", "channel_id"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !rec.has("link_id", "tunnel_id", "channel_id") {
+		t.Error("no logs of the channel")
+	}
+}
@@ -0,0 +1,162 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/link"
+)
+
+func Test_OpenTunnel(t *testing.T) {
+	serverLink, clientLink, _ := getServerAndClient()
+	defer clientLink.Close()
+
+	h, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t),
+		DialHost: "127.0.0.1", DialPort: 12345,
+		Labels: map[string]string{"owner": "test"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", h.Config().LocalPort)); err != nil {
+		t.Fatal(err)
+	}
+	if s := h.Stats(); s.Recv == 0 || s.Send == 0 {
+		t.Errorf("got stats %+v", s)
+	}
+
+	// the labels are sent to the remote endpoint
+	found := false
+	for _, st := range serverLink.Tunnels() {
+		if st.ID == h.ID() {
+			found = st.Config.Labels["owner"] == "test"
+		}
+	}
+	if !found {
+		t.Error("the labels are not found in the remote endpoint")
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-h.Done():
+	default:
+		t.Error("Done is not closed after Close")
+	}
+	if err := h.Close(); err != nil {
+		t.Errorf("close again: %s", err)
+	}
+
+	// closed by the remote endpoint
+	rev, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t),
+		DialHost: "127.0.0.1", DialPort: 12345, Reverse: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := serverLink.CloseTunnel(rev.ID()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-rev.Done():
+	case <-time.After(time.Second):
+		t.Error("Done is not closed after the remote endpoint closed the tunnel")
+	}
+}
+
+func Test_OpenTunnel_Options(t *testing.T) {
+	_, clientLink, _ := getServerAndClient()
+	defer clientLink.Close()
+
+	_, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{Proto: "sctp", BindPort: 1, DialPort: 1})
+	if !errors.Is(err, link.ErrTunnelOptionsInvalid) {
+		t.Errorf("got %v, want ErrTunnelOptionsInvalid", err)
+	}
+	_, err = clientLink.OpenTunnel(context.Background(), link.TunnelOptions{BindHost: "127.0.0.1", BindPort: freePort(t)})
+	if !errors.Is(err, link.ErrTunnelOptionsInvalid) {
+		t.Errorf("got %v, want ErrTunnelOptionsInvalid", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = clientLink.OpenTunnel(ctx, link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t),
+		DialHost: "127.0.0.1", DialPort: 12345,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+func Test_OpenTunnel_RateLimit(t *testing.T) {
+	_, clientLink, _ := getServerAndClient()
+	defer clientLink.Close()
+	echoPort, err := runEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 64K is echoed at 32K/s after the burst of 32K
+	h, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t),
+		DialHost: "127.0.0.1", DialPort: echoPort,
+		RateLimit: 1024 * 32,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := testTunnelEcho(h.Config().LocalPort); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 800*time.Millisecond {
+		t.Errorf("echo in %s, the rate is not limited", d)
+	}
+}
+
+func Test_OpenTunnel_IdleTimeout(t *testing.T) {
+	_, clientLink, _ := getServerAndClient()
+	defer clientLink.Close()
+	echoPort, err := runEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{
+		BindHost: "127.0.0.1", BindPort: freePort(t),
+		DialHost: "127.0.0.1", DialPort: echoPort,
+		IdleTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", h.Config().LocalPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the active channel is kept
+	buf := make([]byte, 4)
+	for i := 0; i < 5; i++ {
+		conn.Write([]byte("ping"))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("the active channel is closed: %s", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the idle channel is closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Errorf("got %v, want the idle channel closed", err)
+	}
+}
@@ -0,0 +1,74 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/policy"
+)
+
+func Test_LinkPolicy(t *testing.T) {
+	allowedPort := freePort(t)
+	engine := policy.NewEngine(&policy.Policy{
+		Binds:             []policy.Rule{{Host: "127.0.0.1", Ports: policy.PortRange{Min: allowedPort, Max: allowedPort}}},
+		Destinations:      []policy.Rule{{Host: "127.0.0.1", Ports: policy.PortRange{Min: 12345, Max: 12345}}},
+		MaxTunnelsPerLink: 2,
+	})
+	_, clientLink, _ := getServerAndClientWith(&link.LinkConfig{
+		IsServerSide: true,
+		Policy:       engine.Guard("127.0.0.1"),
+	})
+
+	// the server binds a port out of the rules
+	err := openTunnel(clientLink, "127.0.0.1", 12345, "127.0.0.1", freePort(t), true)
+	if err == nil || !strings.Contains(err.Error(), "policy-denied: bind") {
+		t.Fatalf("got %v, want policy-denied", err)
+	}
+	// the server dials a destination out of the rules
+	err = openTunnel(clientLink, "127.0.0.1", freePort(t), "127.0.0.1", 22, false)
+	if err == nil || !strings.Contains(err.Error(), "policy-denied: destination 127.0.0.1:22") {
+		t.Fatalf("got %v, want policy-denied", err)
+	}
+
+	// allowed
+	if err := openTunnel(clientLink, "127.0.0.1", 12345, "127.0.0.1", allowedPort, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", allowedPort)); err != nil {
+		t.Fatal(err)
+	}
+	fwd, err := clientLink.OpenTunnel(context.Background(), link.TunnelOptions{BindHost: "127.0.0.1", BindPort: freePort(t), DialHost: "127.0.0.1", DialPort: 12345})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// max tunnels per link, and the closed tunnel is released
+	err = openTunnel(clientLink, "127.0.0.1", freePort(t), "127.0.0.1", 12345, false)
+	if err == nil || !strings.Contains(err.Error(), "policy-denied: max 2 tunnels per link") {
+		t.Fatalf("got %v, want policy-denied", err)
+	}
+	if err := fwd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	localPort := freePort(t)
+	var lastErr error
+	for i := 0; i < 50; i++ {
+		if lastErr = openTunnel(clientLink, "127.0.0.1", localPort, "127.0.0.1", 12345, false); lastErr == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if lastErr != nil {
+		t.Fatalf("open tunnel after release failed: %s", lastErr)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
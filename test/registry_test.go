@@ -0,0 +1,76 @@
+package test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/link"
+)
+
+func Test_Registry(t *testing.T) {
+	registry := link.NewRegistry()
+	var lock sync.Mutex
+	var events []link.Event
+	registry.Subscribe(func(e link.Event) {
+		lock.Lock()
+		events = append(events, e)
+		lock.Unlock()
+	})
+	addr := runRegistryServer(t, registry, nil)
+
+	office := connectServerWith(addr, &link.LinkConfig{Name: "office", Labels: map[string]string{"site": "sh", "role": "db"}})
+	home := connectServerWith(addr, &link.LinkConfig{Name: "home", Labels: map[string]string{"site": "sh"}})
+	anonymous := connectServer(addr)
+	defer home.Close()
+	defer anonymous.Close()
+	if !waitRegistered(registry, "office") || !waitRegistered(registry, "home") {
+		t.Fatal("the clients are not registered")
+	}
+	for i := 0; i < 100 && registry.Len() < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// unique IDs
+	all := registry.All()
+	if len(all) != 3 {
+		t.Fatalf("got %d links, want 3", len(all))
+	}
+	for i, l := range all {
+		if l.ID == 0 || (i > 0 && l.ID <= all[i-1].ID) {
+			t.Errorf("wrong link IDs: %d", l.ID)
+		}
+		if registry.Get(l.ID) != l {
+			t.Errorf("get link %d failed", l.ID)
+		}
+	}
+
+	l := registry.Lookup("office")
+	if l.Name() != "office" || l.Labels()["role"] != "db" {
+		t.Errorf("wrong link %d: %s %v", l.ID, l.Name(), l.Labels())
+	}
+	if links := registry.Select(map[string]string{"site": "sh"}); len(links) != 2 {
+		t.Errorf("select site=sh: got %d links, want 2", len(links))
+	}
+	if links := registry.Select(map[string]string{"site": "sh", "role": "db"}); len(links) != 1 || links[0] != l {
+		t.Errorf("select site=sh,role=db: got %v", links)
+	}
+
+	office.Close()
+	for i := 0; i < 100 && registry.Lookup("office") != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if registry.Lookup("office") != nil || registry.Get(l.ID) != nil {
+		t.Error("the closed link is still in registry")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	count := map[link.EventType]int{}
+	for _, e := range events {
+		count[e.Type]++
+	}
+	if count[link.EventConnect] != 3 || count[link.EventRegister] != 2 || count[link.EventDisconnect] != 1 {
+		t.Errorf("got events %v", count)
+	}
+}
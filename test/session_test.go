@@ -52,6 +52,19 @@ func Benchmark_LinkInnerSessionMulti(b *testing.B) {
 	}
 }
 
+// Benchmark_LinkInnerSessionParallel runs many sessions at the same time, so
+// the link send loop can coalesce the queued frames
+func Benchmark_LinkInnerSessionParallel(b *testing.B) {
+	_, clientLink, _ := getServerAndClient()
+
+	b.RunParallel(func(pb *testing.PB) {
+		s, _ := clientLink.NewSession()
+		for pb.Next() {
+			s.SendAndWait(&session.Request{Action: "/echo", Body: []byte("Ping")})
+		}
+	})
+}
+
 func Test_LinkInnerSessionMinimalFrame(t *testing.T) {
 	_, clientLink, err := getServerAndClient()
 	if err != nil {
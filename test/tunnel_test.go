@@ -1,9 +1,17 @@
 package test
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"testing"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/tunnel"
 )
 
 func init() {
@@ -18,7 +26,7 @@ func setupChannelPing() error {
 	remoteHost := "127.0.0.1"
 	remotePort := 54321
 	reverse := true
-	if err := clientLink.OpenTunnel("tcp", localHost, localPort, remoteHost, remotePort, reverse); err != nil {
+	if err := openTunnel(clientLink, localHost, localPort, remoteHost, remotePort, reverse); err != nil {
 		logrus.Errorf("OpenTunnel failed: %s", err)
 		return err
 	}
@@ -56,3 +64,125 @@ func Benchmark_LinkChannelPing(b *testing.B) {
 		}
 	}
 }
+
+// Benchmark_LinkChannelForward measure the bulk forwarding throughput of a
+// forward tunnel: client -> L(tunnel) -> R(tunnel) -> sink
+func Benchmark_LinkChannelForward(b *testing.B) {
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := sink.Accept()
+		if err != nil {
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+	}()
+
+	// pick a free local port for the tunnel
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	localPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	_, clientLink, _ := getServerAndClient()
+	sinkPort := sink.Addr().(*net.TCPAddr).Port
+	if err := openTunnel(clientLink, "127.0.0.1", localPort, "127.0.0.1", sinkPort, false); err != nil {
+		b.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 1024*32)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn.Close()
+	if n := <-received; n != int64(b.N*len(buf)) {
+		b.Errorf("sink received %d bytes, want %d", n, b.N*len(buf))
+	}
+}
+
+// freePort pick a free local tcp port
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func Test_LinkCloseTunnel(t *testing.T) {
+	_, clientLink, _ := getServerAndClient()
+	remotePort := freePort(t)
+	opts := link.TunnelOptions{
+		BindHost: "127.0.0.1",
+		BindPort: remotePort,
+		DialHost: "127.0.0.1",
+		DialPort: 12345,
+		Reverse:  true,
+	}
+	tun, err := clientLink.OpenTunnel(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("http://127.0.0.1:%d/ping", remotePort)
+	if err := runPingClient(url); err != nil {
+		t.Fatalf("ping through the tunnel failed: %s", err)
+	}
+
+	if err := clientLink.CloseTunnel(tun.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", remotePort)); err == nil {
+		conn.Close()
+		t.Fatal("the remote listener is still open")
+	}
+	if err := clientLink.CloseTunnel(tun.ID()); err != tunnel.ErrTunnelNotFound {
+		t.Errorf("close the closed tunnel: got %v, want ErrTunnelNotFound", err)
+	}
+
+	// the port can be used again
+	if _, err := clientLink.OpenTunnel(context.Background(), opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPingClient(url); err != nil {
+		t.Fatalf("ping through the reopened tunnel failed: %s", err)
+	}
+}
+
+func Test_LinkClose_KeepOtherListeners(t *testing.T) {
+	_, link1, _ := getServerAndClient()
+	_, link2, _ := getServerAndClient()
+	port1, port2 := freePort(t), freePort(t)
+	if err := openTunnel(link1, "127.0.0.1", port1, "127.0.0.1", 12345, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := openTunnel(link2, "127.0.0.1", port2, "127.0.0.1", 12345, false); err != nil {
+		t.Fatal(err)
+	}
+
+	link1.Close()
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port1)); err == nil {
+		conn.Close()
+		t.Error("the listener of the closed link is still open")
+	}
+	if err := runPingClient(fmt.Sprintf("http://127.0.0.1:%d/ping", port2)); err != nil {
+		t.Errorf("the listener of the other link is broken: %s", err)
+	}
+}
@@ -0,0 +1,134 @@
+package test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooclab/es/link"
+	"github.com/ooclab/es/proto/udp"
+)
+
+// getUDPServerAndClient create the links over the UDP transport
+func getUDPServerAndClient() (serverLink *link.Link, clientLink *link.Link, closeFunc func(), err error) {
+	sc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		return
+	}
+	ssock, err := udp.NewServerSocket(sc)
+	if err != nil {
+		return
+	}
+	cc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return
+	}
+	csock, clientConn, err := udp.NewClientSocket(cc, sc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return
+	}
+	serverConn, err := ssock.Accept()
+	if err != nil {
+		return
+	}
+
+	serverLink = link.NewLink(&link.LinkConfig{IsServerSide: true})
+	go func() {
+		serverLink.Bind(serverConn)
+		serverLink.Wait()
+		serverLink.Close()
+	}()
+	clientLink = link.NewLink(nil)
+	go func() {
+		clientLink.Bind(clientConn)
+		clientLink.Wait()
+		clientLink.Close()
+	}()
+	closeFunc = func() {
+		clientLink.Close()
+		serverLink.Close()
+		csock.Close()
+		ssock.Close()
+		cc.Close()
+		sc.Close()
+	}
+	return
+}
+
+func Test_LinkOverUDP(t *testing.T) {
+	_, clientLink, closeFunc, err := getUDPServerAndClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeFunc()
+
+	s, err := clientLink.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, length := range []int{1, 1024, 1024 * 32} {
+		if !testLinkInnerSession(s, length) {
+			t.Fatalf("session echo of %d bytes failed", length)
+		}
+	}
+
+	echoPort, err := runEchoServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	localPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	if err := openTunnel(clientLink, "127.0.0.1", localPort, "127.0.0.1", echoPort, false); err != nil {
+		t.Fatalf("OpenTunnel failed: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := testTunnelEcho(localPort); err != nil {
+			t.Fatalf("tunnel echo over UDP failed: %s", err)
+		}
+	}
+}
+
+func Test_UDPConnDeadline(t *testing.T) {
+	sc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	ssock, _ := udp.NewServerSocket(sc)
+	defer ssock.Close()
+	cc, _ := net.ListenUDP("udp", nil)
+	defer cc.Close()
+	_, conn, err := udp.NewClientSocket(cc, sc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c net.Conn = conn
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err = c.Read(make([]byte, 10))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("Read got %v, want timeout", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Read is timeout after %s", time.Since(start))
+	}
+
+	// the message larger than buffer is read in several Read
+	serverConn, _ := ssock.Accept()
+	c.SetReadDeadline(time.Time{})
+	go serverConn.Write([]byte("hello, world"))
+	b := make([]byte, 5)
+	var got []byte
+	for len(got) < 12 {
+		n, err := c.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, b[:n]...)
+	}
+	if string(got) != "hello, world" {
+		t.Errorf("Read got %q", got)
+	}
+}
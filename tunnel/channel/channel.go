@@ -1,9 +1,30 @@
 package channel
 
 import (
+	"errors"
+	"net"
+	"time"
+
 	tcommon "github.com/ooclab/es/tunnel/common"
 )
 
+// the read buffer size of a channel, it's a size class of es.GetBuffer
+const readBufferSize = 1024 * 16
+
+// ErrIdleTimeout is returned by Serve if the channel is idle for
+// Options.IdleTimeout
+var ErrIdleTimeout = errors.New("channel idle timeout")
+
+// Options is the options of the channels in a pool
+type Options struct {
+	// Limiter limit the bytes read from the conns, nil means no limit
+	Limiter *Limiter
+
+	// IdleTimeout close the channel if nothing is read from or written to
+	// its conn, 0 means never
+	IdleTimeout time.Duration
+}
+
 type Channel interface {
 	ID() uint32
 	String() string
@@ -12,4 +33,22 @@ type Channel interface {
 	SetClosedByRemote()
 	HandleIn(m *tcommon.TMSG) error
 	Serve() error
+
+	// Stats get the byte counters of the channel
+	Stats() Stats
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// Stats is the byte counters of channel: Recv is read from the conn (and
+// sent to the link), Send is written to the conn
+type Stats struct {
+	Recv uint64 `json:"recv"`
+	Send uint64 `json:"send"`
+}
+
+// Add add the counters of o
+func (s *Stats) Add(o Stats) {
+	s.Recv += o.Recv
+	s.Send += o.Send
 }
@@ -0,0 +1,55 @@
+package channel
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter limit the bytes per second shared by the channels of a tunnel,
+// the burst is the bytes of one second
+type Limiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// NewLimiter create a Limiter of rate bytes per second, it returns nil (no
+// limit) if rate <= 0
+func NewLimiter(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// reserve take n bytes from the bucket, and return the time to wait
+func (l *Limiter) reserve(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait block until n bytes are allowed, a nil Limiter never blocks
+func (l *Limiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	if d := l.reserve(n); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -5,19 +5,28 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/logger"
 )
 
 type Pool struct {
 	nextID    uint32
 	pool      map[uint32]Channel
 	poolMutex sync.RWMutex
+	log       logger.Logger
+	opts      Options
 }
 
-func NewPool() *Pool {
+// NewPool create a channel pool, the channels log with the channel_id field
+// added to log
+func NewPool(log logger.Logger, opts Options) *Pool {
 	return &Pool{
 		nextID:    1,
 		pool:      map[uint32]Channel{},
 		poolMutex: sync.RWMutex{},
+		log:       logger.OrDefault(log),
+		opts:      opts,
 	}
 }
 
@@ -61,25 +70,39 @@ func (p *Pool) Delete(c Channel) error {
 	return nil
 }
 
-func (p *Pool) New(tid uint32, outbound chan []byte, conn net.Conn) Channel {
+func (p *Pool) New(tid uint32, outbound *es.Outbound, conn net.Conn) Channel {
 	cid := p.newID()
 	return p.NewByID(cid, tid, outbound, conn)
 }
 
-func (p *Pool) NewByID(cid uint32, tid uint32, outbound chan []byte, conn net.Conn) Channel {
+func (p *Pool) NewByID(cid uint32, tid uint32, outbound *es.Outbound, conn net.Conn) Channel {
 	p.poolMutex.Lock()
 	c := &tcpChannel{
 		tid:      tid,
 		cid:      cid,
 		outbound: outbound,
 		conn:     conn,
+		log:      p.log.WithField("channel_id", cid),
+		opts:     p.opts,
 		lock:     &sync.Mutex{},
 	}
+	c.touch()
 	p.pool[cid] = c
 	p.poolMutex.Unlock()
 	return c
 }
 
+// All get a snapshot of the channels in pool
+func (p *Pool) All() []Channel {
+	p.poolMutex.RLock()
+	defer p.poolMutex.RUnlock()
+	channels := make([]Channel, 0, len(p.pool))
+	for _, c := range p.pool {
+		channels = append(channels, c)
+	}
+	return channels
+}
+
 // Used by the Iter & IterBuffered functions to wrap two variables together over a channel,
 type poolTuple struct {
 	Key uint32
@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ooclab/es"
+	"github.com/ooclab/es/logger"
 	"github.com/ooclab/es/util"
-	"github.com/sirupsen/logrus"
 
 	tcommon "github.com/ooclab/es/tunnel/common"
 )
@@ -21,10 +23,15 @@ type tcpChannel struct {
 	recv uint64
 	send uint64
 
+	// lastActive is the time (unix nano) of the last read or write
+	lastActive int64
+
 	tid      uint32
 	cid      uint32
-	outbound chan []byte
+	outbound *es.Outbound
 	conn     net.Conn
+	log      logger.Logger
+	opts     Options
 
 	closed         bool
 	closedByRemote bool // FIXME!
@@ -40,6 +47,30 @@ func (c *tcpChannel) String() string {
 	return fmt.Sprintf(`[TCP Channel] %d-%d: L(%s), R(%s)`, c.tid, c.cid, c.conn.LocalAddr(), c.conn.RemoteAddr())
 }
 
+func (c *tcpChannel) Stats() Stats {
+	return Stats{
+		Recv: atomic.LoadUint64(&c.recv),
+		Send: atomic.LoadUint64(&c.send),
+	}
+}
+
+func (c *tcpChannel) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *tcpChannel) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *tcpChannel) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+// idle get the time since the last read or write
+func (c *tcpChannel) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
 func (c *tcpChannel) Close() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -49,9 +80,9 @@ func (c *tcpChannel) Close() {
 	}
 
 	c.closed = true
-	closeConn(c.conn)
+	closeConn(c.log, c.conn)
 
-	logrus.Debugf("CLOSE tcp channel %s: recv = %d, send = %d", c, atomic.LoadUint64(&c.recv), atomic.LoadUint64(&c.send))
+	c.log.Debugf("CLOSE tcp channel %s: recv = %d, send = %d", c, atomic.LoadUint64(&c.recv), atomic.LoadUint64(&c.send))
 }
 
 func (c *tcpChannel) IsClosedByRemote() bool {
@@ -72,24 +103,25 @@ func (c *tcpChannel) HandleIn(m *tcommon.TMSG) error {
 	wLen, err := c.conn.Write(m.Payload)
 	// FIXME: make sure write all data, BUT it seems that golang do it already!
 	if wLen != len(m.Payload) {
-		logrus.Errorf("tcp channel c.conn.Write error: wLen = %d != len(m.Payload) = %d", wLen, len(m.Payload))
+		c.log.Errorf("tcp channel c.conn.Write error: wLen = %d != len(m.Payload) = %d", wLen, len(m.Payload))
 	}
 	if err != nil {
-		logrus.Errorf("channel write failed: %s", err)
+		c.log.Errorf("channel write failed: %s", err)
 		return errors.New("write payload error")
 	}
 
 	atomic.AddUint64(&c.send, uint64(wLen))
+	c.touch()
 	return nil
 }
 
 func (c *tcpChannel) Serve() error {
-	// logrus.Debugf("start serve channel %s", c)
+	// c.log.Debugf("start serve channel %s", c)
 
 	// FIXME!
 	defer func() {
 		if r := recover(); r != nil {
-			logrus.Warn("channel serve recovered: ", r)
+			c.log.Warnf("channel serve recovered: %v", r)
 		}
 		if !c.closed {
 			c.Close()
@@ -99,28 +131,41 @@ func (c *tcpChannel) Serve() error {
 	// link.outbound <- channel.conn.Read
 	for {
 		// IMPORTANT: buf read size is very important for speed!
-		buf := make([]byte, 1024*16) // TODO: custom
-		reqLen, err := c.conn.Read(buf)
+		// read the payload behind the frame header, so the frame is built in place
+		buf := es.GetBuffer(readBufferSize)
+		if c.opts.IdleTimeout > 0 {
+			c.conn.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&c.lastActive)).Add(c.opts.IdleTimeout))
+		}
+		reqLen, err := c.conn.Read(buf[tcommon.FrameHeaderSize:])
 		if err != nil {
+			es.PutBuffer(buf)
+			if c.opts.IdleTimeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+				if c.idle() < c.opts.IdleTimeout {
+					// the remote side is writing
+					continue
+				}
+				c.log.Debugf("channel %s is idle for %s, close it", c, c.opts.IdleTimeout)
+				return ErrIdleTimeout
+			}
 			if c.closed || util.TCPisClosedConnError(err) {
-				logrus.Debugf("channel %s is closed normally, quit read", c)
+				c.log.Debugf("channel %s is closed normally, quit read", c)
 				return nil
 			}
 			if err != io.EOF {
-				logrus.Warnf("channel %s recv failed: %s", c, err)
+				c.log.Warnf("channel %s recv failed: %s", c, err)
 			}
 
 			return err
 		}
 
-		m := &tcommon.TMSG{
-			Type:      tcommon.MsgTypeChannelForward,
-			TunnelID:  c.tid,
-			ChannelID: c.cid,
-			Payload:   buf[:reqLen],
+		buf[0] = es.LinkMsgTypeTunnel
+		tcommon.PutFrameHeader(buf[1:], tcommon.MsgTypeChannelForward, c.tid, c.cid)
+		if err := c.outbound.PushTunnel(c.tid, c.cid, buf[:tcommon.FrameHeaderSize+reqLen]); err != nil {
+			c.log.Debugf("channel %s push to link failed: %s", c, err)
+			return err
 		}
-		// FIXME! panic: send on closed channel
-		c.outbound <- append([]byte{es.LinkMsgTypeTunnel}, m.Bytes()...)
 		atomic.AddUint64(&c.recv, uint64(reqLen))
+		c.touch()
+		c.opts.Limiter.Wait(reqLen)
 	}
 }
@@ -10,7 +10,7 @@ import (
 	"time"
 
 	"github.com/ooclab/es"
-	"github.com/sirupsen/logrus"
+	"github.com/ooclab/es/logger"
 
 	tcommon "github.com/ooclab/es/tunnel/common"
 )
@@ -23,8 +23,9 @@ type udpChannel struct {
 
 	tid      uint32
 	cid      uint32
-	outbound chan []byte
+	outbound *es.Outbound
 	conn     net.Conn
+	log      logger.Logger
 
 	closed bool
 
@@ -39,6 +40,21 @@ func (c *udpChannel) String() string {
 	return fmt.Sprintf(`[UDP Channel] %d-%d: L(%s), R(%s)`, c.tid, c.cid, c.conn.LocalAddr(), c.conn.RemoteAddr())
 }
 
+func (c *udpChannel) Stats() Stats {
+	return Stats{
+		Recv: atomic.LoadUint64(&c.recv),
+		Send: atomic.LoadUint64(&c.send),
+	}
+}
+
+func (c *udpChannel) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *udpChannel) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
 func (c *udpChannel) Close() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -48,9 +64,9 @@ func (c *udpChannel) Close() {
 	}
 
 	c.closed = true
-	closeConn(c.conn)
+	closeConn(c.log, c.conn)
 
-	logrus.Debugf("CLOSE udp channel %s: recv = %d, send = %d", c, atomic.LoadUint64(&c.recv), atomic.LoadUint64(&c.send))
+	c.log.Debugf("CLOSE udp channel %s: recv = %d, send = %d", c, atomic.LoadUint64(&c.recv), atomic.LoadUint64(&c.send))
 }
 
 func (c *udpChannel) IsClosed() bool {
@@ -63,10 +79,10 @@ func (c *udpChannel) HandleIn(m *tcommon.TMSG) error {
 	wLen, err := c.conn.Write(m.Payload)
 	// FIXME: make sure write all data, BUT it seems that golang do it already!
 	if wLen != len(m.Payload) {
-		logrus.Errorf("udp channel: c.conn.Write error: wLen = %d != len(m.Payload) = %d", wLen, len(m.Payload))
+		c.log.Errorf("udp channel: c.conn.Write error: wLen = %d != len(m.Payload) = %d", wLen, len(m.Payload))
 	}
 	if err != nil {
-		logrus.Errorf("channel write failed: %s", err)
+		c.log.Errorf("channel write failed: %s", err)
 		return errors.New("write payload error")
 	}
 
@@ -75,12 +91,12 @@ func (c *udpChannel) HandleIn(m *tcommon.TMSG) error {
 }
 
 func (c *udpChannel) Serve() error {
-	// logrus.Debugf("start serve channel %s", c)
+	// c.log.Debugf("start serve channel %s", c)
 
 	// FIXME!
 	defer func() {
 		if r := recover(); r != nil {
-			logrus.Warn("channel serve recovered: ", r)
+			c.log.Warnf("channel serve recovered: %v", r)
 		}
 		if !c.closed {
 			c.Close()
@@ -92,26 +108,25 @@ func (c *udpChannel) Serve() error {
 	lastReceived := time.Now()
 	for time.Since(lastReceived) < 6*time.Second {
 		// IMPORTANT: buf read size is very important for speed!
-		buf := make([]byte, 1024*16)                            // TODO: custom
+		// read the payload behind the frame header, so the frame is built in place
+		buf := es.GetBuffer(readBufferSize)
 		c.conn.SetReadDeadline(time.Now().Add(6 * time.Second)) // TODO: custom
-		reqLen, err := c.conn.Read(buf)
-		fmt.Println("--- reqLen, err = ", reqLen, err)
+		reqLen, err := c.conn.Read(buf[tcommon.FrameHeaderSize:])
 		if err != nil {
+			es.PutBuffer(buf)
 			if err != io.EOF {
-				logrus.Warnf("channel %s recv failed: %s", c, err)
+				c.log.Warnf("channel %s recv failed: %s", c, err)
 			}
 
 			return err
 		}
 
-		m := &tcommon.TMSG{
-			Type:      tcommon.MsgTypeChannelForward,
-			TunnelID:  c.tid,
-			ChannelID: c.cid,
-			Payload:   buf[:reqLen],
+		buf[0] = es.LinkMsgTypeTunnel
+		tcommon.PutFrameHeader(buf[1:], tcommon.MsgTypeChannelForward, c.tid, c.cid)
+		if err := c.outbound.PushTunnel(c.tid, c.cid, buf[:tcommon.FrameHeaderSize+reqLen]); err != nil {
+			c.log.Debugf("channel %s push to link failed: %s", c, err)
+			return err
 		}
-		// FIXME! panic: send on closed channel
-		c.outbound <- append([]byte{es.LinkMsgTypeTunnel}, m.Bytes()...)
 		atomic.AddUint64(&c.recv, uint64(reqLen))
 
 		// update the lastReceived
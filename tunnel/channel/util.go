@@ -3,13 +3,13 @@ package channel
 import (
 	"net"
 
-	"github.com/sirupsen/logrus"
+	"github.com/ooclab/es/logger"
 )
 
-func closeConn(conn net.Conn) {
+func closeConn(log logger.Logger, conn net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
-			logrus.Warn("closeConn recovered: ", r)
+			log.Warnf("closeConn recovered: %v", r)
 		}
 	}()
 	conn.Close()
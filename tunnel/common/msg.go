@@ -1,14 +1,18 @@
 package common
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+
+	"github.com/ooclab/es"
 )
 
 const (
 	msgLengthMin int = 9
+
+	// FrameHeaderSize is the size of link message type and TMSG header
+	FrameHeaderSize = 1 + msgLengthMin
 )
 
 var (
@@ -35,16 +39,33 @@ func (m *TMSG) PayloadLen() int {
 }
 
 func (m *TMSG) Bytes() []byte {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, m.Type)
-	binary.Write(buf, binary.LittleEndian, m.TunnelID)
-	binary.Write(buf, binary.LittleEndian, m.ChannelID)
+	b := make([]byte, m.Len())
+	m.encodeHeader(b)
+	copy(b[msgLengthMin:], m.Payload)
+	return b
+}
 
-	if len(m.Payload) > 0 {
-		binary.Write(buf, binary.LittleEndian, m.Payload)
-	}
+// Frame get the link frame of this message (link message type + TMSG) in
+// a single buffer from the buffer pool
+func (m *TMSG) Frame() []byte {
+	b := es.GetBuffer(1 + m.Len())
+	b[0] = es.LinkMsgTypeTunnel
+	m.encodeHeader(b[1:])
+	copy(b[FrameHeaderSize:], m.Payload)
+	return b
+}
+
+func (m *TMSG) encodeHeader(b []byte) {
+	PutFrameHeader(b[:msgLengthMin], m.Type, m.TunnelID, m.ChannelID)
+}
 
-	return buf.Bytes()
+// PutFrameHeader encode a TMSG header into b, b should be at least 9 bytes.
+// It's used for building the frame in place, when the payload is read into
+// b[9:] already.
+func PutFrameHeader(b []byte, msgType uint8, tunnelID uint32, channelID uint32) {
+	b[0] = msgType
+	binary.LittleEndian.PutUint32(b[1:5], tunnelID)
+	binary.LittleEndian.PutUint32(b[5:9], channelID)
 }
 
 func LoadTMSG(data []byte) (*TMSG, error) {
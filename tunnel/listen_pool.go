@@ -5,8 +5,6 @@ import (
 	"fmt"
 	"net"
 	"sync"
-
-	"github.com/sirupsen/logrus"
 )
 
 type listenTarget struct {
@@ -52,10 +50,10 @@ func (l *listenTarget) Close() error {
 
 	switch l.proto {
 	case "tcp":
-		logrus.Debugf("closing tcp listen: %s", l.addr)
+		l.tunnel.log.Debugf("closing tcp listen: %s", l.addr)
 		return l.t.(net.Listener).Close()
 	case "udp":
-		logrus.Debugf("closing udp listen: %s", l.addr)
+		l.tunnel.log.Debugf("closing udp listen: %s", l.addr)
 		return l.t.(*net.UDPConn).Close()
 	}
 	return nil // FIXME!
@@ -78,7 +76,7 @@ func (p *listenPool) TCPKey(host string, port int) string {
 }
 
 func (p *listenPool) UDPKey(host string, port int) string {
-	return fmt.Sprintf("tcp:%s:%d", host, port)
+	return fmt.Sprintf("udp:%s:%d", host, port)
 }
 
 func (p *listenPool) Exist(key string) bool {
@@ -115,7 +113,7 @@ func (p *listenPool) Delete(key string) error {
 	}
 	v.Close() // FIXME!
 	delete(p.pool, key)
-	logrus.Debugf("delete listen %s from pool success", key)
+	v.tunnel.log.Debugf("delete listen %s from pool success", key)
 	return nil
 }
 
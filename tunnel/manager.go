@@ -3,27 +3,53 @@ package tunnel
 import (
 	"errors"
 
-	"github.com/sirupsen/logrus"
-
+	"github.com/ooclab/es"
+	"github.com/ooclab/es/logger"
 	"github.com/ooclab/es/session"
 	tcommon "github.com/ooclab/es/tunnel/common"
 )
 
 var globalListenPool = newListenPool()
 
+// tunnel error define
+var (
+	ErrTunnelNotFound  = errors.New("no such tunnel")
+	ErrTunnelExisted   = errors.New("tunnel ID existed")
+	ErrChannelNotFound = errors.New("no such channel")
+	ErrMsgTypeUnknown  = errors.New("unknown tunnel msg type")
+
+	// ErrPortInUse is returned if the listen address of tunnel is taken
+	ErrPortInUse = errors.New("listen address is in use")
+
+	// ErrDialFailed is returned if a reverse tunnel can not connect its
+	// local address for a new channel, the remote channel is closed then
+	ErrDialFailed = errors.New("dial failed")
+)
+
+func init() {
+	session.RegisterError("tunnel-not-found", ErrTunnelNotFound)
+	session.RegisterError("tunnel-existed", ErrTunnelExisted)
+	session.RegisterError("port-in-use", ErrPortInUse)
+	session.RegisterError("dial-failed", ErrDialFailed)
+}
+
 type Manager struct {
 	pool           *Pool
 	lpool          *listenPool
-	outbound       chan []byte
+	outbound       *es.Outbound
 	sessionManager *session.Manager
+	log            logger.Logger
 }
 
-func NewManager(isServerSide bool, outbound chan []byte, sm *session.Manager) *Manager {
+// NewManager create a tunnel manager, the tunnels log with the tunnel_id
+// field added to log, nil log means logger.Default()
+func NewManager(isServerSide bool, outbound *es.Outbound, sm *session.Manager, log logger.Logger) *Manager {
 	return &Manager{
 		pool:           NewPool(isServerSide),
 		lpool:          globalListenPool,
 		outbound:       outbound,
 		sessionManager: sm,
+		log:            logger.OrDefault(log),
 	}
 }
 
@@ -38,23 +64,23 @@ func (manager *Manager) HandleIn(payload []byte) error {
 	case tcommon.MsgTypeChannelForward:
 		t := manager.pool.Get(m.TunnelID)
 		if t == nil {
-			logrus.Warnf("can not find tunnel %d", m.TunnelID)
-			return errors.New("can not find tunnel")
+			manager.log.WithField("tunnel_id", m.TunnelID).Warnf("can not find tunnel")
+			return ErrTunnelNotFound
 		}
 		return t.HandleIn(m)
 
 	case tcommon.MsgTypeChannelClose:
 		t := manager.pool.Get(m.TunnelID)
 		if t == nil {
-			logrus.Warnf("can not find tunnel %d", m.TunnelID)
-			return errors.New("no such tunnel")
+			manager.log.WithField("tunnel_id", m.TunnelID).Warnf("can not find tunnel")
+			return ErrTunnelNotFound
 		}
 		t.HandleChannelClose(m)
 		// return nil
 
 	default:
-		logrus.Errorf("unknown tunnel msg type: %d", m.Type)
-		return errors.New("unknown tunnel msg type")
+		manager.log.Errorf("unknown tunnel msg type: %d", m.Type)
+		return ErrMsgTypeUnknown
 
 	}
 
@@ -62,26 +88,57 @@ func (manager *Manager) HandleIn(payload []byte) error {
 }
 
 func (manager *Manager) TunnelCreate(cfg *TunnelConfig) (*Tunnel, error) {
-	logrus.Debugf("prepare to create a tunnel with config %+v", cfg)
+	manager.log.Debugf("prepare to create a tunnel with config %+v", cfg)
 	t, err := manager.pool.New(manager, cfg)
 	if err != nil {
-		logrus.Errorf("create new tunnel failed: %s", err)
+		manager.log.Errorf("create new tunnel failed: %s", err)
 		return nil, err
 	}
 
+	if cfg.Weight > 0 {
+		manager.outbound.SetTunnelWeight(t.ID, cfg.Weight)
+	}
+
 	if err := t.Listen(); err != nil {
-		logrus.Errorf("run forward tunnel %s failed: %s", t.String(), err)
+		t.log.Errorf("run forward tunnel %s failed: %s", t.String(), err)
+		manager.outbound.SetTunnelWeight(t.ID, 0)
 		manager.pool.Delete(t)
 		return nil, err
 	}
 
-	logrus.Debugf("create forward tunnel: %+v", t)
+	t.log.Debugf("create forward tunnel: %s", t)
 	return t, nil
 }
 
+// Tunnels get the tunnels of the manager
+func (manager *Manager) Tunnels() []*Tunnel {
+	return manager.pool.All()
+}
+
+// NoCompress check whether the tunnel opt-out the link compression
+func (manager *Manager) NoCompress(id uint32) bool {
+	t := manager.pool.Get(id)
+	return t != nil && t.Config.NoCompress
+}
+
+// TunnelClose close the tunnel: its listener and channels in this endpoint
+func (manager *Manager) TunnelClose(id uint32) error {
+	t := manager.pool.Get(id)
+	if t == nil {
+		return ErrTunnelNotFound
+	}
+	manager.pool.Delete(t)
+	manager.outbound.SetTunnelWeight(t.ID, 0)
+	t.Close()
+	t.log.Debugf("close tunnel %s", t)
+	return nil
+}
+
+// Close close all tunnels of the manager, the listeners of the other links
+// in the global listen pool are kept
 func (manager *Manager) Close() error {
-	for item := range manager.lpool.IterBuffered() {
-		manager.lpool.Delete(item.Key)
+	for _, t := range manager.pool.All() {
+		manager.TunnelClose(t.ID)
 	}
 	return nil
 }
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"errors"
+
+	tcommon "github.com/ooclab/es/tunnel/common"
+)
+
+// ErrRelayClosed is returned when the peer of a relay tunnel is closed
+var ErrRelayClosed = errors.New("relay peer is closed")
+
+// Splice create the relay tunnels in two managers: the channel messages of
+// one are sent to the other over its link with the channel ID unchanged.
+// The ID of acfg is allocated by a, and bcfg.ID is created by the remote
+// endpoint of b already. A relay tunnel doesn't listen or dial, closing it
+// doesn't close its peer.
+func Splice(a *Manager, acfg *TunnelConfig, b *Manager, bcfg *TunnelConfig) (*Tunnel, *Tunnel, error) {
+	tb, err := b.pool.New(b, bcfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	ta, err := a.pool.New(a, acfg)
+	if err != nil {
+		b.pool.Delete(tb)
+		return nil, nil, err
+	}
+	ta.relay, tb.relay = tb, ta
+	ta.log.Debugf("splice tunnel %s and %s", ta, tb)
+	return ta, tb, nil
+}
+
+// IsRelay check whether the tunnel is created by Splice
+func (t *Tunnel) IsRelay() bool {
+	return t.relay != nil
+}
+
+// relayIn send the channel message to the peer of relay tunnel
+func (t *Tunnel) relayIn(m *tcommon.TMSG) error {
+	peer := t.relay
+	select {
+	case <-peer.done:
+		t.log.WithField("channel_id", m.ChannelID).Debugf("drop message, the relay peer is closed")
+		return nil
+	default:
+	}
+
+	t.statsLock.Lock()
+	t.stats.Recv += uint64(len(m.Payload))
+	t.statsLock.Unlock()
+
+	frame := (&tcommon.TMSG{
+		Type:      m.Type,
+		TunnelID:  peer.ID,
+		ChannelID: m.ChannelID,
+		Payload:   m.Payload,
+	}).Frame()
+	if err := peer.outbound.PushTunnel(peer.ID, m.ChannelID, frame); err != nil {
+		t.log.WithField("channel_id", m.ChannelID).Warnf("relay message failed: %s", err)
+		return nil
+	}
+
+	peer.statsLock.Lock()
+	peer.stats.Send += uint64(len(m.Payload))
+	peer.statsLock.Unlock()
+	return nil
+}
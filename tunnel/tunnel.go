@@ -4,42 +4,81 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ooclab/es"
+	"github.com/ooclab/es/logger"
 	"github.com/ooclab/es/tunnel/channel"
 	tcommon "github.com/ooclab/es/tunnel/common"
 	"github.com/ooclab/es/util"
-	"github.com/sirupsen/logrus"
 )
 
 type TunnelConfig struct {
 	ID         uint32
 	Proto      string // TCP or UDP
 	LocalHost  string
-	LocalPort  int
+	LocalPort  int // 0 binds an ephemeral port, it's set after listen
 	RemoteHost string
 	RemotePort int
 	Reverse    bool
+
+	// Weight is the round-robin weight of this tunnel's channels in the
+	// link outbound queue, 0 means the default weight
+	Weight int
+
+	// NoCompress disable the link compression of this tunnel, such as the
+	// traffic is compressed already
+	NoCompress bool
+
+	// Peer is the name of client at the far end, the server relay the
+	// tunnel to it if the server is a hub. Empty means the remote endpoint.
+	Peer string
+
+	// RateLimit is the bytes per second read from the conns of channels,
+	// in each endpoint, 0 means no limit
+	RateLimit int64
+
+	// IdleTimeout close the channel if no data is transferred, 0 means never
+	IdleTimeout time.Duration
+
+	// Labels is the metadata of the tunnel, such as the owner
+	Labels map[string]string
+
+	// PinnedIPs is the addresses of LocalHost checked by the policy, the
+	// reverse tunnel dials them instead of resolving LocalHost again
+	PinnedIPs []net.IP `json:"-"`
 }
 
 func (c *TunnelConfig) RemoteConfig() *TunnelConfig {
 	return &TunnelConfig{
-		Proto:      c.Proto,
-		LocalHost:  c.RemoteHost,
-		LocalPort:  c.RemotePort,
-		RemoteHost: c.LocalHost,
-		RemotePort: c.LocalPort,
-		Reverse:    !c.Reverse,
+		Proto:       c.Proto,
+		LocalHost:   c.RemoteHost,
+		LocalPort:   c.RemotePort,
+		RemoteHost:  c.LocalHost,
+		RemotePort:  c.LocalPort,
+		Reverse:     !c.Reverse,
+		Weight:      c.Weight,
+		NoCompress:  c.NoCompress,
+		Peer:        c.Peer,
+		RateLimit:   c.RateLimit,
+		IdleTimeout: c.IdleTimeout,
+		Labels:      c.Labels,
 	}
 }
 
 func (c *TunnelConfig) String() string {
+	var s string
 	if c.Reverse {
-		return fmt.Sprintf("%s: L(%s:%d) <- R(%s:%d)", c.Proto, c.LocalHost, c.LocalPort, c.RemoteHost, c.RemotePort)
+		s = fmt.Sprintf("%s: L(%s:%d) <- R(%s:%d)", c.Proto, c.LocalHost, c.LocalPort, c.RemoteHost, c.RemotePort)
 	} else {
-		return fmt.Sprintf("%s: L(%s:%d) -> R(%s:%d)", c.Proto, c.LocalHost, c.LocalPort, c.RemoteHost, c.RemotePort)
+		s = fmt.Sprintf("%s: L(%s:%d) -> R(%s:%d)", c.Proto, c.LocalHost, c.LocalPort, c.RemoteHost, c.RemotePort)
 	}
+	if c.Peer != "" {
+		s += " @" + c.Peer
+	}
+	return s
 }
 
 // Tunnel define a tunnel struct
@@ -47,19 +86,39 @@ type Tunnel struct {
 	ID          uint32
 	Config      *TunnelConfig
 	cpool       *channel.Pool
-	outbound    chan []byte
+	outbound    *es.Outbound
 	manager     *Manager
 	openChannel func(*tcommon.TMSG) (channel.Channel, error)
 	listenFunc  func() error
+	log         logger.Logger
+
+	// listenKey is the key in listen pool of a listening (forward) tunnel
+	listenKey string
+
+	// relay is the peer tunnel in another link, see Splice
+	relay *Tunnel
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// stats of the closed channels
+	stats     channel.Stats
+	statsLock sync.Mutex
 }
 
 func newTunnel(manager *Manager, cfg *TunnelConfig) *Tunnel {
+	log := manager.log.WithField("tunnel_id", cfg.ID)
 	t := &Tunnel{
-		ID:       cfg.ID,
-		Config:   cfg,
-		cpool:    channel.NewPool(),
+		ID:     cfg.ID,
+		Config: cfg,
+		cpool: channel.NewPool(log, channel.Options{
+			Limiter:     channel.NewLimiter(cfg.RateLimit),
+			IdleTimeout: cfg.IdleTimeout,
+		}),
 		outbound: manager.outbound,
 		manager:  manager,
+		log:      log,
+		done:     make(chan struct{}),
 	}
 	switch cfg.Proto {
 	case "tcp":
@@ -69,7 +128,7 @@ func newTunnel(manager *Manager, cfg *TunnelConfig) *Tunnel {
 		t.openChannel = t.openUDPChannel
 		t.listenFunc = t.listenUDP
 	default:
-		logrus.Errorf("can not be here!")
+		log.Errorf("can not be here!")
 		return nil
 	}
 	return t
@@ -84,41 +143,65 @@ func (t *Tunnel) String() string {
 }
 
 func (t *Tunnel) HandleIn(m *tcommon.TMSG) (err error) {
+	if t.relay != nil {
+		return t.relayIn(m)
+	}
 	c := t.cpool.Get(m.ChannelID)
 	if t.Config.Reverse {
 		if c == nil {
 			c, err = t.openChannel(m)
 			if err != nil {
+				// the remote endpoint should not wait for it
+				t.closeRemoteChannel(m.ChannelID)
 				return err
 			}
-			logrus.Debugf("HandleIn: OPEN tcp channel %s success", c)
+			t.log.Debugf("HandleIn: OPEN tcp channel %s success", c)
 		}
 	} else {
 		// forward tunnel
 		if c == nil {
-			logrus.Errorf("can not find channel %d:%d", m.TunnelID, m.ChannelID)
-			return errors.New("no such channel")
+			t.log.WithField("channel_id", m.ChannelID).Errorf("can not find channel")
+			return ErrChannelNotFound
 		}
 	}
 
 	return c.HandleIn(m)
 }
 
-func (t *Tunnel) openTCPChannel(m *tcommon.TMSG) (channel.Channel, error) {
-	// (reverse tunnel) need to setup a connect to localhost:localport
+// dial connect to localhost:localport of the reverse tunnel, or the pinned
+// IPs in order
+func (t *Tunnel) dial() (*net.TCPConn, error) {
 	cfg := t.Config
 	addrS := fmt.Sprintf("%s:%d", cfg.LocalHost, cfg.LocalPort)
-	addr, err := net.ResolveTCPAddr("tcp", addrS)
-	if err != nil {
-		logrus.Warnf("resolve %s failed: %s", addrS, err)
-		// TODO: notice remote endpoint ?
-		return nil, err
+	var addrs []*net.TCPAddr
+	for _, ip := range cfg.PinnedIPs {
+		addrs = append(addrs, &net.TCPAddr{IP: ip, Port: cfg.LocalPort})
+	}
+	if len(addrs) == 0 {
+		addr, err := net.ResolveTCPAddr("tcp", addrS)
+		if err != nil {
+			t.log.Warnf("resolve %s failed: %s", addrS, err)
+			// TODO: notice remote endpoint ?
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+
+	var err error
+	for _, addr := range addrs {
+		var conn *net.TCPConn
+		if conn, err = net.DialTCP("tcp", nil, addr); err == nil {
+			return conn, nil
+		}
+		t.log.Errorf("dial %s (%s) failed: %s", addrS, addr, err.Error())
 	}
+	return nil, fmt.Errorf("%w: %s", ErrDialFailed, err)
+}
 
-	conn, err := net.DialTCP("tcp", nil, addr)
+func (t *Tunnel) openTCPChannel(m *tcommon.TMSG) (channel.Channel, error) {
+	// (reverse tunnel) need to setup a connect to localhost:localport
+	conn, err := t.dial()
 	if err != nil {
-		logrus.Errorf("dial %s failed: %s", addrS, err.Error())
-		// TODO: try again ?
 		return nil, err
 	}
 
@@ -130,19 +213,8 @@ func (t *Tunnel) openTCPChannel(m *tcommon.TMSG) (channel.Channel, error) {
 
 func (t *Tunnel) openUDPChannel(m *tcommon.TMSG) (channel.Channel, error) {
 	// (reverse tunnel) need to setup a connect to localhost:localport
-	cfg := t.Config
-	addrS := fmt.Sprintf("%s:%d", cfg.LocalHost, cfg.LocalPort)
-	addr, err := net.ResolveTCPAddr("tcp", addrS)
-	if err != nil {
-		logrus.Warnf("resolve %s failed: %s", addrS, err)
-		// TODO: notice remote endpoint ?
-		return nil, err
-	}
-
-	conn, err := net.DialTCP("tcp", nil, addr)
+	conn, err := t.dial()
 	if err != nil {
-		logrus.Errorf("dial %s failed: %s", addrS, err.Error())
-		// TODO: try again ?
 		return nil, err
 	}
 
@@ -154,7 +226,7 @@ func (t *Tunnel) openUDPChannel(m *tcommon.TMSG) (channel.Channel, error) {
 
 func (t *Tunnel) NewChannelByConn(conn net.Conn) channel.Channel {
 	if t.Config.Reverse {
-		logrus.Errorf("reverse tunnel can not create channel use random ID!")
+		t.log.Errorf("reverse tunnel can not create channel use random ID!")
 		return nil
 	}
 	return t.cpool.New(t.ID, t.outbound, conn)
@@ -166,34 +238,37 @@ func (t *Tunnel) ServeChannel(c channel.Channel) {
 			t.closeRemoteChannel(c.ID())
 		}
 	}
+	t.statsLock.Lock()
+	t.stats.Add(c.Stats())
+	t.statsLock.Unlock()
 	if t.cpool.Exist(c.ID()) {
 		t.cpool.Delete(c)
 	}
 }
 
 func (t *Tunnel) closeRemoteChannel(cid uint32) {
-	// FIXME! temp fix "panic: send on closed channel"
-	defer func() {
-		if r := recover(); r != nil {
-			logrus.Error("t.closeRemoteChannel recovered: ", r)
-		}
-	}()
-	logrus.Debugf("prepare notice remote endpoint to close channel %d", cid)
+	t.log.Debugf("prepare notice remote endpoint to close channel %d", cid)
 	m := &tcommon.TMSG{
 		Type:      tcommon.MsgTypeChannelClose,
 		TunnelID:  t.ID,
 		ChannelID: cid,
 	}
-	// FIXME! panic: send on closed channel
-	t.outbound <- append([]byte{es.LinkMsgTypeTunnel}, m.Bytes()...)
-	logrus.Debugf("notice remote endpoint to close channel %d done", cid)
+	// use the channel's own queue, so the close is sent after its data
+	if err := t.outbound.PushTunnel(t.ID, cid, m.Frame()); err != nil {
+		t.log.Warnf("notice remote endpoint to close channel %d failed: %s", cid, err)
+		return
+	}
+	t.log.Debugf("notice remote endpoint to close channel %d done", cid)
 }
 
 func (t *Tunnel) HandleChannelClose(m *tcommon.TMSG) error {
+	if t.relay != nil {
+		return t.relayIn(m)
+	}
 	c := t.cpool.Get(m.ChannelID)
 	if c == nil {
-		logrus.Warnf("can not find channel %d:%d", m.TunnelID, m.ChannelID)
-		return errors.New("no such channel")
+		t.log.WithField("channel_id", m.ChannelID).Warnf("can not find channel")
+		return ErrChannelNotFound
 	}
 
 	// TODO: more clean!
@@ -203,6 +278,38 @@ func (t *Tunnel) HandleChannelClose(m *tcommon.TMSG) error {
 	return nil
 }
 
+// Channels get the opened channels of the tunnel
+func (t *Tunnel) Channels() []channel.Channel {
+	return t.cpool.All()
+}
+
+// Stats get the byte counters of all channels of the tunnel
+func (t *Tunnel) Stats() channel.Stats {
+	t.statsLock.Lock()
+	stats := t.stats
+	t.statsLock.Unlock()
+	for _, c := range t.cpool.All() {
+		stats.Add(c.Stats())
+	}
+	return stats
+}
+
+// Done is closed after the tunnel is closed
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Close close the listener and all channels of the tunnel
+func (t *Tunnel) Close() {
+	t.closeOnce.Do(func() { close(t.done) })
+	if t.listenKey != "" {
+		t.manager.lpool.Delete(t.listenKey)
+	}
+	for _, c := range t.cpool.All() {
+		t.cpool.Delete(c)
+	}
+}
+
 func (t *Tunnel) Listen() error {
 	if t.Config.Reverse {
 		// reverse tunnel can not listen
@@ -215,27 +322,35 @@ func (t *Tunnel) listenTCP() error {
 	host, port := t.Config.LocalHost, t.Config.LocalPort
 	key := t.manager.lpool.TCPKey(host, port)
 
-	if t.manager.lpool.Exist(key) {
+	// port 0 binds an ephemeral port, it's never in lpool
+	if port != 0 && t.manager.lpool.Exist(key) {
 		// the listen address is exist in lpool already
-		logrus.Errorf("start listen for %s:%d failed, it's existed already.", host, port)
-		return errors.New("listen address is existed")
+		t.log.Errorf("start listen for %s:%d failed, it's existed already.", host, port)
+		return fmt.Errorf("%w: %s:%d", ErrPortInUse, host, port)
 	}
 
 	// start listen
 	addr := fmt.Sprintf("%s:%d", host, port)
 	laddr, err := net.ResolveTCPAddr("tcp", addr)
 	if nil != err {
-		logrus.Fatalln(err)
+		t.log.Errorf("resolve %s failed: %s", addr, err)
+		return err
 	}
 	l, err := net.ListenTCP("tcp", laddr)
 	if err != nil {
 		// the listen address is taken by another program
-		logrus.Errorf("start listen on %s failed: %s", addr, err)
-		return err
+		t.log.Errorf("start listen on %s failed: %s", addr, err)
+		return listenError(err)
+	}
+	if port == 0 {
+		port = l.Addr().(*net.TCPAddr).Port
+		key = t.manager.lpool.TCPKey(host, port)
+		t.Config.LocalPort = port
 	}
 
 	// save listen
 	t.manager.lpool.Add(key, newTCPListenTarget(t, host, port, l))
+	t.listenKey = key
 
 	go func() {
 		// defer l.Close()
@@ -243,49 +358,65 @@ func (t *Tunnel) listenTCP() error {
 			conn, err := l.Accept()
 			if err != nil {
 				if util.TCPisClosedConnError(err) {
-					logrus.Debugf("the listener of %s is closed", t)
+					t.log.Debugf("the listener of %s is closed", t)
 				} else {
-					logrus.Errorf("accept new client failed: %s", err)
+					t.log.Errorf("accept new client failed: %s", err)
 				}
 				break
 			}
-			logrus.Debugf("tunnel %s accept new client %s", t.String(), conn.RemoteAddr())
+			t.log.Debugf("tunnel %s accept new client %s", t.String(), conn.RemoteAddr())
 
 			c := t.NewChannelByConn(conn)
 			go t.ServeChannel(c)
-			logrus.Debugf("listenTCP: OPEN channel %s success", c)
+			t.log.Debugf("listenTCP: OPEN channel %s success", c)
 		}
 	}()
 
-	logrus.Debugf("start listen tunnel %s success", t)
+	t.log.Debugf("start listen tunnel %s success", t)
 	return nil
 }
 
+// listenError wrap the error of listen by ErrPortInUse if the address is
+// taken by another program
+func listenError(err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("%w: %s", ErrPortInUse, err)
+	}
+	return err
+}
+
 func (t *Tunnel) listenUDP() error {
 	host, port := t.Config.LocalHost, t.Config.LocalPort
 	key := t.manager.lpool.UDPKey(host, port)
 
-	if t.manager.lpool.Exist(key) {
+	if port != 0 && t.manager.lpool.Exist(key) {
 		// the listen address is exist in lpool already
-		logrus.Errorf("start udp listen for %s:%d failed, it's existed already.", host, port)
-		return errors.New("listen udp address is existed")
+		t.log.Errorf("start udp listen for %s:%d failed, it's existed already.", host, port)
+		return fmt.Errorf("%w: %s:%d", ErrPortInUse, host, port)
 	}
 
 	// start listen
 	addr := fmt.Sprintf("%s:%d", host, port)
 	laddr, err := net.ResolveUDPAddr("udp", addr)
 	if nil != err {
-		logrus.Fatalln(err)
+		t.log.Errorf("resolve %s failed: %s", addr, err)
+		return err
 	}
 	conn, err := net.ListenUDP("tcp", laddr)
 	if err != nil {
 		// the listen address is taken by another program
-		logrus.Errorf("start listen on %s failed: %s", addr, err)
-		return err
+		t.log.Errorf("start listen on %s failed: %s", addr, err)
+		return listenError(err)
+	}
+	if port == 0 {
+		port = conn.LocalAddr().(*net.UDPAddr).Port
+		key = t.manager.lpool.UDPKey(host, port)
+		t.Config.LocalPort = port
 	}
 
 	// save listen
 	t.manager.lpool.Add(key, newUDPListenTarget(t, host, port, conn))
+	t.listenKey = key
 
 	go func() {
 		buf := make([]byte, 1400) // FIXME!
@@ -293,17 +424,17 @@ func (t *Tunnel) listenUDP() error {
 			n, raddr, err := conn.ReadFromUDP(buf)
 			if err != nil {
 				// FIXME!
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					logrus.Debugf("conn is closed, quit recv()")
+				if errors.Is(err, net.ErrClosed) {
+					t.log.Debugf("conn is closed, quit recv()")
 					return
 				}
-				logrus.Errorf("ReadFromUDP error: %s", err)
+				t.log.Errorf("ReadFromUDP error: %s", err)
 				return
 			}
-			fmt.Println("--- n, raddr, err = ", n, raddr, err)
+			t.log.Debugf("udp listener of %s: drop %d bytes from %s", t, n, raddr)
 		}
 	}()
 
-	logrus.Debugf("start listen tunnel %s success", t)
+	t.log.Debugf("start listen tunnel %s success", t)
 	return nil
 }
@@ -3,8 +3,6 @@ package tunnel
 import (
 	"errors"
 	"sync"
-
-	"github.com/sirupsen/logrus"
 )
 
 type Pool struct {
@@ -78,8 +76,8 @@ func (p *Pool) New(manager *Manager, cfg *TunnelConfig) (*Tunnel, error) {
 		cfg.ID = p.newID()
 	} else {
 		if p.Exist(cfg.ID) {
-			logrus.Errorf("create tunnel by id failed: id %d is existed", cfg.ID)
-			return nil, errors.New("tunnel ID existed")
+			manager.log.WithField("tunnel_id", cfg.ID).Errorf("create tunnel by id failed: id is existed")
+			return nil, ErrTunnelExisted
 		}
 	}
 
@@ -90,3 +88,14 @@ func (p *Pool) New(manager *Manager, cfg *TunnelConfig) (*Tunnel, error) {
 
 	return t, nil
 }
+
+// All get a snapshot of the tunnels in pool
+func (p *Pool) All() []*Tunnel {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+	tunnels := make([]*Tunnel, 0, len(p.pool))
+	for _, t := range p.pool {
+		tunnels = append(tunnels, t)
+	}
+	return tunnels
+}
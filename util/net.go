@@ -1,11 +1,11 @@
 package util
 
 import (
+	"errors"
 	"net"
 	"os"
 	"reflect"
 	"runtime"
-	"strings"
 )
 
 // errno returns v's underlying uintptr, else 0.
@@ -26,14 +26,15 @@ func TCPisClosedConnError(err error) bool {
 		return false
 	}
 
-	str := err.Error()
-	if strings.Contains(str, "use of closed network connection") {
+	if errors.Is(err, net.ErrClosed) {
 		return true
 	}
 
 	if runtime.GOOS == "windows" {
-		if oe, ok := err.(*net.OpError); ok && oe.Op == "read" {
-			if se, ok := oe.Err.(*os.SyscallError); ok && se.Syscall == "wsarecv" {
+		var oe *net.OpError
+		if errors.As(err, &oe) && oe.Op == "read" {
+			var se *os.SyscallError
+			if errors.As(oe.Err, &se) && se.Syscall == "wsarecv" {
 				const WSAECONNABORTED = 10053
 				const WSAECONNRESET = 10054
 				if n := http2errno(se.Err); n == WSAECONNRESET || n == WSAECONNABORTED {